@@ -0,0 +1,111 @@
+package accesslog
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	dbConn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, dbConn.AutoMigrate(&db.User{}, &db.Bucket{}))
+	return dbConn
+}
+
+func TestRecordFormat(t *testing.T) {
+	r := Record{
+		BucketOwner: "owner-1",
+		Bucket:      "photos",
+		Time:        time.Date(2026, 2, 6, 0, 0, 38, 0, time.UTC),
+		RemoteIP:    "192.0.2.3",
+		Requester:   "owner-1",
+		RequestID:   "3E57427F3EXAMPLE",
+		Operation:   "REST.GET.OBJECT",
+		Key:         "a b.txt",
+		RequestURI:  "GET /api/buckets/photos/files/a%20b.txt HTTP/1.1",
+		Status:      404,
+		TotalTime:   7 * time.Millisecond,
+		UserAgent:   `curl "8"`,
+		AuthType:    "AuthHeader",
+		HostHeader:  "localhost",
+	}
+	require.Equal(t, `owner-1 photos [06/Feb/2026:00:00:38 +0000] 192.0.2.3 owner-1 3E57427F3EXAMPLE REST.GET.OBJECT a%20b.txt `+
+		`"GET /api/buckets/photos/files/a%20b.txt HTTP/1.1" 404 NoSuchKey - - 7 - "-" "curl \"8\"" - - - - AuthHeader localhost - - -`,
+		r.Format())
+}
+
+func TestOperation(t *testing.T) {
+	require.Equal(t, "REST.GET.OBJECT", Operation("GET", "/api/buckets/:bucketName/files/:fileName", false))
+	require.Equal(t, "REST.POST.OBJECT", Operation("POST", "/api/buckets/:bucketName/files", false))
+	require.Equal(t, "REST.DELETE.BUCKET", Operation("DELETE", "/api/buckets/:bucketName", false))
+	require.Equal(t, "REST.PUT.OBJECT_LOCK", Operation("PUT", "/api/buckets/:bucketName/object-lock", false))
+	require.Equal(t, "REST.GET.OBJECT", Operation("GET", "/api/presigned/download", true))
+}
+
+func TestLoggerMiddleware(t *testing.T) {
+	DB := setupTestDB(t)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-1", BucketName: "photos", UserID: "user-1",
+		LoggingTargetBucket: "logs", LoggingTargetPrefix: "photos/"}).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-2", BucketName: "quiet", UserID: "user-1"}).Error)
+	logger := NewLogger(DB, nil)
+	user := &db.User{ID: "user-1"}
+
+	app := fiber.New()
+	app.Use(logger.Middleware())
+	app.Use(func(c *fiber.Ctx) error {
+		if c.Get("X-User") != "" {
+			c.Locals("user", user)
+		}
+		return c.Next()
+	})
+	app.Get("/api/buckets/:bucketName/files/:fileName", func(c *fiber.Ctx) error {
+		if c.Get("X-User") == "" {
+			return c.Status(403).JSON(fiber.Map{"error": "forbidden"})
+		}
+		return c.SendString("0123456789")
+	})
+	app.Get("/api/presigned/download", func(c *fiber.Ctx) error {
+		c.Locals("user", *user)
+		return c.SendString("hi")
+	})
+
+	send := func(target string, signed bool) {
+		req := httptest.NewRequest("GET", target, nil)
+		if signed {
+			req.Header.Set("X-User", user.ID)
+		}
+		_, err := app.Test(req)
+		require.NoError(t, err)
+	}
+	send("/api/buckets/photos/files/a.txt", true)
+	send("/api/buckets/photos/files/a.txt", false)
+	send("/api/buckets/quiet/files/a.txt", true) // logging off
+	send("/api/presigned/download?bucket=photos&key=b.txt&expires=1&sig=secret", false)
+
+	deliveries := logger.drain(time.Now())
+	require.Len(t, deliveries, 1)
+	p := deliveries[0].payload
+	require.Equal(t, "bucket-1", p.BucketID)
+	require.Equal(t, "logs", p.TargetBucket)
+	require.True(t, strings.HasPrefix(p.Key, "photos/"))
+	require.Len(t, p.Lines, 3)
+
+	require.Contains(t, p.Lines[0], " user-1 ")
+	require.Contains(t, p.Lines[0], " REST.GET.OBJECT a.txt ")
+	require.Contains(t, p.Lines[0], `" 200 - 10 10 `)
+	require.Contains(t, p.Lines[1], `" 403 AccessDenied `)
+	require.Contains(t, p.Lines[2], " b.txt ")
+	require.Contains(t, p.Lines[2], " QueryString ")
+	require.Contains(t, p.Lines[2], "sig=REDACTED")
+	require.NotContains(t, p.Lines[2], "secret")
+
+	require.Empty(t, logger.drain(time.Now()))
+}
@@ -0,0 +1,329 @@
+// Package accesslog records requests to buckets with server access logging
+// enabled and hands them, batched, to the worker, which writes them as log
+// objects into the configured target bucket.
+package accesslog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// DefaultFlushInterval is how often Run hands buffered records to the worker,
+// and so roughly how late log objects arrive.
+const DefaultFlushInterval = 5 * time.Minute
+
+// maxLinesPerObject bounds one log object, and the task payload carrying it.
+const maxLinesPerObject = 1000
+
+// configTTL is how long a bucket's logging configuration is cached, so a
+// change takes up to this long to apply.
+const configTTL = time.Minute
+
+type target struct {
+	bucketID string
+	owner    string
+	bucket   string // empty when logging is off
+	prefix   string
+	fetched  time.Time
+}
+
+type batchKey struct {
+	bucketID string
+	bucket   string
+	prefix   string
+}
+
+// Logger buffers formatted records in memory per source bucket, so logging
+// costs no write per request. Records buffered when the process dies are
+// lost: as with S3, delivery is best effort.
+type Logger struct {
+	DB     *gorm.DB
+	Client *asynq.Client
+
+	mu      sync.Mutex
+	targets map[string]target // by source bucket name
+	pending map[batchKey][]string
+}
+
+func NewLogger(DB *gorm.DB, client *asynq.Client) *Logger {
+	return &Logger{
+		DB:      DB,
+		Client:  client,
+		targets: map[string]target{},
+		pending: map[batchKey][]string{},
+	}
+}
+
+// lookup returns the logging configuration of bucketName, cached for
+// configTTL. Unknown buckets are not cached, so requests for made-up names
+// cannot grow the cache.
+func (l *Logger) lookup(bucketName string) (target, bool) {
+	l.mu.Lock()
+	t, ok := l.targets[bucketName]
+	l.mu.Unlock()
+	if ok && time.Since(t.fetched) < configTTL {
+		return t, t.bucket != ""
+	}
+
+	var bucket db.Bucket
+	err := l.DB.Select("id", "user_id", "logging_target_bucket", "logging_target_prefix").
+		Where("bucket_name = ?", bucketName).First(&bucket).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.WithError(err).WithField("bucket", bucketName).Warn("Failed to load bucket logging configuration")
+		}
+		return target{}, false
+	}
+	t = target{
+		bucketID: bucket.ID,
+		owner:    bucket.UserID,
+		bucket:   bucket.LoggingTargetBucket,
+		prefix:   bucket.LoggingTargetPrefix,
+		fetched:  time.Now(),
+	}
+	l.mu.Lock()
+	l.targets[strings.Clone(bucketName)] = t
+	l.mu.Unlock()
+	return t, t.bucket != ""
+}
+
+// add buffers r for delivery to t.
+func (l *Logger) add(t target, r Record) {
+	key := batchKey{bucketID: t.bucketID, bucket: t.bucket, prefix: t.prefix}
+	line := r.Format()
+	l.mu.Lock()
+	l.pending[key] = append(l.pending[key], line)
+	l.mu.Unlock()
+}
+
+type delivery struct {
+	key     batchKey
+	payload tasks.AccessLogPayload
+}
+
+// drain empties the buffer into one delivery per log object.
+func (l *Logger) drain(now time.Time) []delivery {
+	l.mu.Lock()
+	batch := l.pending
+	l.pending = map[batchKey][]string{}
+	l.mu.Unlock()
+
+	var deliveries []delivery
+	for key, lines := range batch {
+		for len(lines) > 0 {
+			n := min(len(lines), maxLinesPerObject)
+			deliveries = append(deliveries, delivery{key: key, payload: tasks.AccessLogPayload{
+				BucketID:     key.bucketID,
+				TargetBucket: key.bucket,
+				Key:          ObjectKey(key.prefix, now),
+				Lines:        lines[:n],
+			}})
+			lines = lines[n:]
+		}
+	}
+	return deliveries
+}
+
+// ObjectKey names a log object the way S3 does: the target prefix, the
+// delivery time and a random suffix.
+func ObjectKey(prefix string, now time.Time) string {
+	return prefix + now.UTC().Format("2006-01-02-15-04-05-") + strings.ToUpper(randomHex(8))
+}
+
+// Flush enqueues every buffered record for delivery. Records that fail to
+// enqueue are put back and retried on the next flush.
+func (l *Logger) Flush() error {
+	var firstErr error
+	for _, d := range l.drain(time.Now()) {
+		task, err := tasks.NewDeliverAccessLogsTask(d.payload)
+		if err == nil {
+			_, err = l.Client.Enqueue(task)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			l.mu.Lock()
+			l.pending[d.key] = append(d.payload.Lines, l.pending[d.key]...)
+			l.mu.Unlock()
+		}
+	}
+	return firstErr
+}
+
+// Run flushes every interval until ctx is done, then flushes one last time.
+func (l *Logger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := l.Flush(); err != nil {
+				log.WithError(err).Error("Failed to flush access logs")
+			}
+			return
+		case <-ticker.C:
+			if err := l.Flush(); err != nil {
+				log.WithError(err).Warn("Failed to flush access logs, will retry")
+			}
+		}
+	}
+}
+
+// Middleware records every request addressed to a bucket with logging on,
+// whether signed, presigned or anonymous, and whether it succeeded or not.
+// It must be registered before the auth middlewares so it sees the user
+// they set.
+func (l *Logger) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		bucketName, key := c.Params("bucketName"), c.Params("fileName")
+		presigned := strings.HasPrefix(c.Path(), "/api/presigned/") && c.Query("sig") != ""
+		if presigned {
+			bucketName, key = c.Query("bucket"), c.Query("key")
+		}
+		if bucketName == "" {
+			return err
+		}
+		t, ok := l.lookup(bucketName)
+		if !ok {
+			return err
+		}
+		l.add(t, l.record(c, err, start, bucketName, key, presigned, t.owner))
+		return err
+	}
+}
+
+func (l *Logger) record(c *fiber.Ctx, err error, start time.Time, bucketName, key string, presigned bool, owner string) Record {
+	var requester string
+	switch u := c.Locals("user").(type) {
+	case *db.User:
+		if u != nil {
+			requester = u.ID
+		}
+	case db.User:
+		requester = u.ID
+	}
+	var authType string
+	switch {
+	case requester == "":
+	case presigned:
+		authType = "QueryString"
+	default:
+		authType = "AuthHeader"
+	}
+
+	// a returned error is turned into a response after this middleware runs
+	status := c.Response().StatusCode()
+	if err != nil {
+		status = fiber.StatusInternalServerError
+		var fe *fiber.Error
+		if errors.As(err, &fe) {
+			status = fe.Code
+		}
+	}
+
+	var bytesSent int64
+	if !c.Response().SkipBody {
+		if n := c.Response().Header.ContentLength(); n > 0 {
+			bytesSent = int64(n)
+		} else {
+			bytesSent = int64(len(c.Response().Body()))
+		}
+	}
+	var objectSize int64
+	switch {
+	case key == "":
+	case c.Method() == fiber.MethodPost, c.Method() == fiber.MethodPut:
+		objectSize = int64(c.Request().Header.ContentLength())
+	case c.Method() == fiber.MethodHead:
+		objectSize = int64(c.Response().Header.ContentLength())
+	case status == fiber.StatusOK:
+		objectSize = bytesSent
+	}
+
+	versionID := c.GetRespHeader("x-amz-version-id")
+	if versionID == "" {
+		versionID, _ = c.Locals("versionID").(string)
+	}
+	requestID := c.GetRespHeader(fiber.HeaderXRequestID)
+	if requestID == "" {
+		requestID = strings.ToUpper(randomHex(8))
+	}
+
+	return Record{
+		BucketOwner: owner,
+		Bucket:      bucketName,
+		Time:        start,
+		RemoteIP:    c.IP(),
+		Requester:   requester,
+		RequestID:   requestID,
+		Operation:   Operation(c.Method(), c.Route().Path, presigned),
+		Key:         key,
+		RequestURI:  c.Method() + " " + redactURI(string(c.Request().RequestURI())) + " " + string(c.Request().Header.Protocol()),
+		Status:      status,
+		BytesSent:   bytesSent,
+		ObjectSize:  objectSize,
+		TotalTime:   time.Since(start),
+		Referer:     c.Get(fiber.HeaderReferer),
+		UserAgent:   c.Get(fiber.HeaderUserAgent),
+		VersionID:   versionID,
+		AuthType:    authType,
+		HostHeader:  c.Hostname(),
+	}
+}
+
+// Operation names a request as S3 access logs do, REST.<method>.<resource>.
+// The resource is OBJECT or BUCKET, or the bucket subresource the route
+// addresses, such as NOTIFICATION or OBJECT_LOCK.
+func Operation(method, routePath string, presigned bool) string {
+	resource := "OBJECT"
+	if !presigned {
+		segments := strings.Split(routePath, "/")
+		switch last := segments[len(segments)-1]; last {
+		case ":fileName", "files":
+		case ":bucketName":
+			resource = "BUCKET"
+		default:
+			resource = strings.ToUpper(strings.ReplaceAll(last, "-", "_"))
+		}
+	}
+	return "REST." + method + "." + resource
+}
+
+// redactURI hides the signature of presigned URLs, which would otherwise
+// let anyone reading the logs reuse them.
+func redactURI(uri string) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return uri
+	}
+	q := u.Query()
+	if q.Get("sig") == "" {
+		return uri
+	}
+	q.Set("sig", "REDACTED")
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
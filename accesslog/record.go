@@ -0,0 +1,114 @@
+package accesslog
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record is one request in a server access log.
+type Record struct {
+	BucketOwner string
+	Bucket      string
+	Time        time.Time
+	RemoteIP    string
+	Requester   string // user ID, empty for anonymous requests
+	RequestID   string
+	Operation   string // e.g. REST.GET.OBJECT
+	Key         string
+	RequestURI  string // "<method> <uri> <protocol>"
+	Status      int
+	BytesSent   int64
+	ObjectSize  int64
+	TotalTime   time.Duration
+	Referer     string
+	UserAgent   string
+	VersionID   string
+	AuthType    string // AuthHeader, QueryString or empty
+	HostHeader  string
+}
+
+const timeLayout = "[02/Jan/2006:15:04:05 -0700]"
+
+// Format renders r as one line in the S3 server access log format. Fields
+// with no value here, such as the signature version and TLS details, are
+// written as "-" so standard parsers still line the columns up.
+func (r Record) Format() string {
+	fields := []string{
+		dash(r.BucketOwner),
+		dash(r.Bucket),
+		r.Time.UTC().Format(timeLayout),
+		dash(r.RemoteIP),
+		dash(r.Requester),
+		dash(r.RequestID),
+		dash(r.Operation),
+		dash(url.PathEscape(r.Key)),
+		quote(r.RequestURI),
+		strconv.Itoa(r.Status),
+		dash(ErrorCode(r.Status, r.Key != "")),
+		count(r.BytesSent),
+		count(r.ObjectSize),
+		strconv.FormatInt(r.TotalTime.Milliseconds(), 10),
+		"-", // turn-around time
+		quote(r.Referer),
+		quote(r.UserAgent),
+		dash(r.VersionID),
+		"-", // host ID
+		"-", // signature version
+		"-", // cipher suite
+		dash(r.AuthType),
+		dash(r.HostHeader),
+		"-", // TLS version
+		"-", // access point ARN
+		"-", // ACL required
+	}
+	return strings.Join(fields, " ")
+}
+
+// ErrorCode is the S3 error code logged for an HTTP status, or "" when the
+// request succeeded or the status has no S3 equivalent.
+func ErrorCode(status int, hasKey bool) string {
+	switch {
+	case status == 400:
+		return "InvalidRequest"
+	case status == 401, status == 403:
+		return "AccessDenied"
+	case status == 404 && hasKey:
+		return "NoSuchKey"
+	case status == 404:
+		return "NoSuchBucket"
+	case status == 405:
+		return "MethodNotAllowed"
+	case status == 413:
+		return "EntityTooLarge"
+	case status == 429:
+		return "SlowDown"
+	case status == 503:
+		return "ServiceUnavailable"
+	case status >= 500:
+		return "InternalError"
+	}
+	return ""
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+func count(n int64) string {
+	if n <= 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,175 @@
+// Package apierror defines the error responses of the API: an HTTP status,
+// a machine-readable code and a message, returned as
+//
+//	{"error": "bucket not found", "code": "NoSuchBucket", "requestId": "..."}
+//
+// Each code always comes with the same status.
+package apierror
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Codes follow the S3 names where S3 has one.
+const (
+	InvalidArgument       = "InvalidArgument"
+	MalformedRequest      = "MalformedRequest"
+	InvalidToken          = "InvalidToken"
+	MissingSecurityHeader = "MissingSecurityHeader"
+	Unauthenticated       = "Unauthenticated"
+	MFARequired           = "MFARequired"
+	InvalidAccessKeyID    = "InvalidAccessKeyId"
+	SignatureMismatch     = "SignatureDoesNotMatch"
+	AccessDenied          = "AccessDenied"
+	AccountDisabled       = "AccountDisabled"
+	EmailNotVerified      = "EmailNotVerified"
+	ObjectLocked          = "ObjectLocked"
+	QuotaExceeded         = "QuotaExceeded"
+	NoSuchBucket          = "NoSuchBucket"
+	NoSuchKey             = "NoSuchKey"
+	NoSuchTask            = "NoSuchTask"
+	NoSuchUser            = "NoSuchUser"
+	NotFound              = "NotFound"
+	MethodNotAllowed      = "MethodNotAllowed"
+	BucketAlreadyExists   = "BucketAlreadyExists"
+	BucketNotEmpty        = "BucketNotEmpty"
+	ObjectAlreadyExists   = "ObjectAlreadyExists"
+	EmailAlreadyExists    = "EmailAlreadyExists"
+	InvalidTaskState      = "InvalidTaskState"
+	AccountLocked         = "AccountLocked"
+	EntityTooLarge        = "EntityTooLarge"
+	UpgradeRequired       = "UpgradeRequired"
+	SlowDown              = "SlowDown"
+	InternalError         = "InternalError"
+)
+
+var statuses = map[string]int{
+	InvalidArgument:       http.StatusBadRequest,
+	MalformedRequest:      http.StatusBadRequest,
+	InvalidToken:          http.StatusBadRequest,
+	MissingSecurityHeader: http.StatusUnauthorized,
+	Unauthenticated:       http.StatusUnauthorized,
+	MFARequired:           http.StatusUnauthorized,
+	InvalidAccessKeyID:    http.StatusForbidden,
+	SignatureMismatch:     http.StatusForbidden,
+	AccessDenied:          http.StatusForbidden,
+	AccountDisabled:       http.StatusForbidden,
+	EmailNotVerified:      http.StatusForbidden,
+	ObjectLocked:          http.StatusForbidden,
+	QuotaExceeded:         http.StatusForbidden,
+	NoSuchBucket:          http.StatusNotFound,
+	NoSuchKey:             http.StatusNotFound,
+	NoSuchTask:            http.StatusNotFound,
+	NoSuchUser:            http.StatusNotFound,
+	NotFound:              http.StatusNotFound,
+	MethodNotAllowed:      http.StatusMethodNotAllowed,
+	BucketAlreadyExists:   http.StatusConflict,
+	BucketNotEmpty:        http.StatusConflict,
+	ObjectAlreadyExists:   http.StatusConflict,
+	EmailAlreadyExists:    http.StatusConflict,
+	InvalidTaskState:      http.StatusConflict,
+	AccountLocked:         http.StatusLocked,
+	EntityTooLarge:        http.StatusRequestEntityTooLarge,
+	UpgradeRequired:       http.StatusUpgradeRequired,
+	SlowDown:              http.StatusTooManyRequests,
+	InternalError:         http.StatusInternalServerError,
+}
+
+// Error is an API error. Handlers usually answer with Send directly;
+// Error is for helpers that decide the code on the handler's behalf.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Status is the HTTP status of e's code.
+func (e *Error) Status() int {
+	return Status(e.Code)
+}
+
+// New returns an error with code and message.
+func New(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Status returns the HTTP status that goes with code; unknown codes are
+// internal errors.
+func Status(code string) int {
+	if status, ok := statuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Send writes an error response with code and message and returns nil, so
+// handlers can return it.
+func Send(c *fiber.Ctx, code, message string) error {
+	return SendWith(c, code, message, nil)
+}
+
+// SendWith is Send with extra fields in the body.
+func SendWith(c *fiber.Ctx, code, message string, fields fiber.Map) error {
+	return write(c, Status(code), code, message, fields)
+}
+
+func write(c *fiber.Ctx, status int, code, message string, fields fiber.Map) error {
+	body := fiber.Map{}
+	for k, v := range fields {
+		body[k] = v
+	}
+	body["error"] = message
+	body["code"] = code
+	body["requestId"] = requestid.Get(c)
+	return c.Status(status).JSON(body)
+}
+
+// Write sends err as the response.
+func Write(c *fiber.Ctx, err *Error) error {
+	return Send(c, err.Code, err.Message)
+}
+
+// Handler is the Fiber ErrorHandler: errors returned rather than answered,
+// like an unknown route or an oversized body, get the same body shape.
+func Handler(c *fiber.Ctx, err error) error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return Write(c, apiErr)
+	}
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		// keep statuses without a code of their own, e.g. 408
+		return write(c, fe.Code, codeForStatus(fe.Code), fe.Message, nil)
+	}
+	requestid.Log(c).WithError(err).Error("Unhandled error")
+	return Send(c, InternalError, "internal server error")
+}
+
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return InvalidArgument
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return AccessDenied
+	case http.StatusNotFound:
+		return NotFound
+	case http.StatusMethodNotAllowed:
+		return MethodNotAllowed
+	case http.StatusRequestEntityTooLarge:
+		return EntityTooLarge
+	case http.StatusTooManyRequests:
+		return SlowDown
+	case http.StatusUpgradeRequired:
+		return UpgradeRequired
+	}
+	return InternalError
+}
@@ -0,0 +1,64 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorResponses(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: Handler})
+	app.Use(requestid.New())
+	app.Get("/bucket", func(c *fiber.Ctx) error {
+		return Send(c, NoSuchBucket, "bucket not found")
+	})
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		return SendWith(c, SlowDown, "rate limit exceeded", fiber.Map{"retry_after": 30})
+	})
+	app.Get("/returned", func(c *fiber.Ctx) error {
+		return New(ObjectLocked, "object is locked")
+	})
+
+	get := func(path string) (int, string, map[string]interface{}) {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		require.NoError(t, err)
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, resp.Header.Get(requestid.Header), body
+	}
+
+	status, id, body := get("/bucket")
+	require.Equal(t, 404, status)
+	require.NotEmpty(t, id)
+	require.Equal(t, "NoSuchBucket", body["code"])
+	require.Equal(t, "bucket not found", body["error"])
+	require.Equal(t, id, body["requestId"])
+
+	status, id2, body := get("/slow")
+	require.Equal(t, 429, status)
+	require.NotEqual(t, id, id2)
+	require.Equal(t, "SlowDown", body["code"])
+	require.EqualValues(t, 30, body["retry_after"])
+
+	status, _, body = get("/returned")
+	require.Equal(t, 403, status)
+	require.Equal(t, "ObjectLocked", body["code"])
+
+	// framework errors get the same shape
+	status, id, body = get("/missing")
+	require.Equal(t, 404, status)
+	require.Equal(t, "NotFound", body["code"])
+	require.Equal(t, id, body["requestId"])
+}
+
+func TestEveryCodeHasStatus(t *testing.T) {
+	for code, status := range statuses {
+		require.Equal(t, status, Status(code), code)
+		require.GreaterOrEqual(t, status, 400, code)
+	}
+	require.Equal(t, 500, Status("SomethingElse"))
+}
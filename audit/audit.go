@@ -0,0 +1,172 @@
+// Package audit keeps the append-only, hash-chained log of management
+// actions: bucket and configuration changes, key rotations, presigned URL
+// generation, task submissions and admin actions.
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Event is one management action. Before and After are the state of the
+// target around it, as anything that marshals to a JSON object; nil for
+// creations and deletions respectively. Only the fields that differ are
+// kept, and secrets must never be passed in.
+type Event struct {
+	Action     string // e.g. bucket.create
+	TargetType string // bucket, user, task or object
+	Target     string
+	Before     interface{}
+	After      interface{}
+}
+
+// appendMu serializes appends within a process; across processes the lock
+// on the last row does (MySQL only).
+var appendMu sync.Mutex
+
+// Record appends ev, performed by actor from the request c. With a nil
+// actor the authenticated user of c is used. A failure is logged and not
+// returned: the action it describes has already happened.
+func Record(DB *gorm.DB, c *fiber.Ctx, actor *db.User, ev Event) {
+	if actor == nil {
+		actor, _ = c.Locals("user").(*db.User)
+	}
+	entry := db.AuditEvent{
+		IP:         c.IP(),
+		Action:     ev.Action,
+		TargetType: ev.TargetType,
+		Target:     ev.Target,
+	}
+	if actor != nil {
+		entry.ActorID, entry.AccessKey = actor.ID, actor.AccessKey
+	}
+	var err error
+	if entry.Before, entry.After, err = diff(ev.Before, ev.After); err == nil {
+		err = Append(DB, &entry)
+	}
+	if err != nil {
+		requestid.Log(c).WithError(err).WithFields(log.Fields{
+			"action": ev.Action,
+			"target": ev.Target,
+			"actor":  entry.ActorID,
+		}).Error("Failed to record audit event")
+	}
+}
+
+// Append chains entry to the last event and stores it.
+func Append(DB *gorm.DB, entry *db.AuditEvent) error {
+	appendMu.Lock()
+	defer appendMu.Unlock()
+	return DB.Transaction(func(tx *gorm.DB) error {
+		query := tx.Select("hash").Order("id DESC").Limit(1)
+		if tx.Dialector.Name() == "mysql" {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		var last db.AuditEvent
+		if err := query.Find(&last).Error; err != nil {
+			return err
+		}
+		entry.PrevHash = last.Hash
+		// whole seconds, so the hash survives the round trip through a
+		// TIMESTAMP column
+		entry.CreatedAt = time.Now().UTC().Truncate(time.Second)
+		entry.Hash = Hash(entry)
+		return tx.Create(entry).Error
+	})
+}
+
+// hashed is what an event's hash covers, in a fixed field order.
+type hashed struct {
+	PrevHash   string  `json:"prev"`
+	ActorID    string  `json:"actor"`
+	AccessKey  string  `json:"accessKey"`
+	IP         string  `json:"ip"`
+	Action     string  `json:"action"`
+	TargetType string  `json:"targetType"`
+	Target     string  `json:"target"`
+	Before     *string `json:"before"`
+	After      *string `json:"after"`
+	CreatedAt  int64   `json:"createdAt"`
+}
+
+// Hash is the hex sha256 of e's content and the hash of the event before it.
+func Hash(e *db.AuditEvent) string {
+	data, _ := json.Marshal(hashed{
+		PrevHash:   e.PrevHash,
+		ActorID:    e.ActorID,
+		AccessKey:  e.AccessKey,
+		IP:         e.IP,
+		Action:     e.Action,
+		TargetType: e.TargetType,
+		Target:     e.Target,
+		Before:     e.Before,
+		After:      e.After,
+		CreatedAt:  e.CreatedAt.Unix(),
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// diff reduces before and after to the fields that differ and encodes them.
+func diff(before, after interface{}) (*string, *string, error) {
+	b, err := toMap(before)
+	if err != nil {
+		return nil, nil, err
+	}
+	a, err := toMap(after)
+	if err != nil {
+		return nil, nil, err
+	}
+	if b != nil && a != nil {
+		for k, v := range b {
+			if w, ok := a[k]; ok && bytes.Equal(v, w) {
+				delete(b, k)
+				delete(a, k)
+			}
+		}
+	}
+	bs, err := encode(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	as, err := encode(a)
+	return bs, as, err
+}
+
+func toMap(v interface{}) (map[string]json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func encode(m map[string]json.RawMessage) (*string, error) {
+	if m == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
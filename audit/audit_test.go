@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	dbConn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, dbConn.AutoMigrate(&db.AuditEvent{}))
+	return dbConn
+}
+
+func record(t *testing.T, DB *gorm.DB, actor *db.User, ev Event) {
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		Record(DB, c, actor, ev)
+		return nil
+	})
+	_, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+}
+
+func TestRecordAndVerify(t *testing.T) {
+	DB := setupTestDB(t)
+	actor := &db.User{ID: "user-1", AccessKey: "AK1"}
+
+	record(t, DB, actor, Event{Action: "bucket.create", TargetType: "bucket", Target: "photos",
+		After: map[string]interface{}{"acl": "private", "versioning": false}})
+	record(t, DB, actor, Event{Action: "bucket.put_logging", TargetType: "bucket", Target: "photos",
+		Before: map[string]interface{}{"acl": "private", "loggingTarget": ""},
+		After:  map[string]interface{}{"acl": "private", "loggingTarget": "logs"}})
+	record(t, DB, actor, Event{Action: "bucket.delete", TargetType: "bucket", Target: "photos",
+		Before: map[string]interface{}{"acl": "private"}})
+
+	var events []db.AuditEvent
+	require.NoError(t, DB.Order("id").Find(&events).Error)
+	require.Len(t, events, 3)
+	require.Equal(t, "", events[0].PrevHash)
+	require.Equal(t, events[0].Hash, events[1].PrevHash)
+	require.Equal(t, "user-1", events[1].ActorID)
+	require.Equal(t, "AK1", events[1].AccessKey)
+	require.Nil(t, events[0].Before)
+	// only the changed field is kept
+	require.Equal(t, `{"loggingTarget":""}`, *events[1].Before)
+	require.Equal(t, `{"loggingTarget":"logs"}`, *events[1].After)
+	require.Nil(t, events[2].After)
+
+	checked, err := Verify(DB)
+	require.NoError(t, err)
+	require.Equal(t, 3, checked)
+
+	// the model refuses changes; raw SQL gets through but breaks the chain
+	require.ErrorIs(t, DB.Model(&events[1]).Update("target", "other").Error, db.ErrAuditImmutable)
+	require.ErrorIs(t, DB.Delete(&events[1]).Error, db.ErrAuditImmutable)
+
+	require.NoError(t, DB.Exec("UPDATE audit_events SET target = ? WHERE id = ?", "other", events[1].ID).Error)
+	_, err = Verify(DB)
+	var chainErr *ChainError
+	require.True(t, errors.As(err, &chainErr))
+	require.Equal(t, events[1].ID, chainErr.ID)
+
+	require.NoError(t, DB.Exec("UPDATE audit_events SET target = ? WHERE id = ?", "photos", events[1].ID).Error)
+	require.NoError(t, DB.Exec("DELETE FROM audit_events WHERE id = ?", events[0].ID).Error)
+	_, err = Verify(DB)
+	require.True(t, errors.As(err, &chainErr))
+	require.Equal(t, events[1].ID, chainErr.ID)
+}
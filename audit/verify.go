@@ -0,0 +1,50 @@
+package audit
+
+import (
+	"fmt"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"gorm.io/gorm"
+)
+
+const verifyBatchSize = 1000
+
+// ChainError reports the first event at which the chain does not hold.
+type ChainError struct {
+	ID     uint64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("audit chain broken at event %d: %s", e.ID, e.Reason)
+}
+
+// Verify walks the whole log in order and recomputes every hash. It returns
+// the number of events checked and a *ChainError if an event was altered,
+// removed or inserted. Removing events from the end cannot be detected from
+// the chain alone.
+func Verify(DB *gorm.DB) (int, error) {
+	var prevHash string
+	var lastID uint64
+	checked := 0
+	for {
+		var batch []db.AuditEvent
+		if err := DB.Where("id > ?", lastID).Order("id").Limit(verifyBatchSize).Find(&batch).Error; err != nil {
+			return checked, err
+		}
+		for i := range batch {
+			e := &batch[i]
+			if e.PrevHash != prevHash {
+				return checked, &ChainError{ID: e.ID, Reason: "previous hash does not match, an event before it was changed or removed"}
+			}
+			if Hash(e) != e.Hash {
+				return checked, &ChainError{ID: e.ID, Reason: "hash does not match its content"}
+			}
+			prevHash, lastID = e.Hash, e.ID
+			checked++
+		}
+		if len(batch) < verifyBatchSize {
+			return checked, nil
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// maxPasswordBytes is where bcrypt stops reading.
+const maxPasswordBytes = 72
+
+// PasswordPolicy decides which new passwords are accepted. A nil policy only
+// asks for 8 characters.
+type PasswordPolicy struct {
+	MinLength int
+	// SHA-1 hashes, upper-case hex, of known breached passwords
+	breached map[string]struct{}
+}
+
+// LoadPasswordPolicy builds a policy with the breached passwords listed in
+// path, if set. Lines hold either a password or, as in the Have I Been
+// Pwned downloads, an SHA-1 hash optionally followed by ":count".
+func LoadPasswordPolicy(minLength int, path string) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{MinLength: minLength, breached: map[string]struct{}{}}
+	if path == "" {
+		return policy, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open breached password list: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); isSHA1(hash) {
+			policy.breached[strings.ToUpper(hash)] = struct{}{}
+			continue
+		}
+		policy.breached[sha1Hex(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read breached password list: %w", err)
+	}
+	return policy, nil
+}
+
+// Breached is how many passwords the breached list holds.
+func (p *PasswordPolicy) Breached() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.breached)
+}
+
+// Check returns why password may not be used, as a message for the user, or
+// nil.
+func (p *PasswordPolicy) Check(password string) error {
+	minLength := 8
+	if p != nil && p.MinLength > 0 {
+		minLength = p.MinLength
+	}
+	if len([]rune(password)) < minLength {
+		return fmt.Errorf("password must be at least %d characters", minLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+	}
+	if p != nil {
+		if _, ok := p.breached[sha1Hex(password)]; ok {
+			return errors.New("password appears in a list of breached passwords; choose another")
+		}
+	}
+	return nil
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func isSHA1(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "breached.txt")
+	content := strings.Join([]string{
+		"# common passwords",
+		"",
+		"letmein123",
+		// SHA-1 of "password123", as in the Have I Been Pwned downloads
+		"cbfdac6008f9cab4083784cbd1874f76618d2a97:251682",
+	}, "\n")
+	require.NoError(t, os.WriteFile(list, []byte(content), 0o600))
+
+	policy, err := LoadPasswordPolicy(10, list)
+	require.NoError(t, err)
+	require.Equal(t, 2, policy.Breached())
+
+	require.NoError(t, policy.Check("correct horse battery"))
+	require.ErrorContains(t, policy.Check("short1234"), "at least 10 characters")
+	require.ErrorContains(t, policy.Check(strings.Repeat("x", 73)), "at most 72 bytes")
+	require.ErrorContains(t, policy.Check("letmein123"), "breached")
+	require.ErrorContains(t, policy.Check("password123"), "breached")
+
+	// characters, not bytes, count towards the minimum
+	require.Error(t, policy.Check(strings.Repeat("ü", 9)))
+	require.NoError(t, policy.Check(strings.Repeat("ü", 10)))
+
+	_, err = LoadPasswordPolicy(8, filepath.Join(t.TempDir(), "missing.txt"))
+	require.Error(t, err)
+
+	var none *PasswordPolicy
+	require.Zero(t, none.Breached())
+	require.Error(t, none.Check("1234567"))
+	require.NoError(t, none.Check("letmein123"))
+}
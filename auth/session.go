@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidToken    = errors.New("invalid or expired token")
+	ErrAccountDisabled = errors.New("account disabled")
+)
+
+// Sessions issues the tokens of console logins, which cannot sign every
+// request the way API clients do. The access token is short-lived and
+// signed with Secret; the refresh token lives in its db.Session, is
+// replaced on every use and keeps the session alive for RefreshTTL after
+// the last one.
+type Sessions struct {
+	Secret     []byte
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// Tokens are what a login or refresh returns to the client.
+type Tokens struct {
+	SessionID             string    `json:"sessionId"`
+	AccessToken           string    `json:"accessToken"`
+	AccessTokenExpiresAt  time.Time `json:"accessTokenExpiresAt"`
+	RefreshToken          string    `json:"refreshToken"`
+	RefreshTokenExpiresAt time.Time `json:"refreshTokenExpiresAt"`
+}
+
+// accessClaims are the signed content of an access token.
+type accessClaims struct {
+	SessionID string `json:"sid"`
+	UserID    string `json:"sub"`
+	Expires   int64  `json:"exp"`
+}
+
+// Start opens a session for user and returns its first tokens.
+func (s *Sessions) Start(DB *gorm.DB, user *db.User, userAgent, ip string) (*Tokens, error) {
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	session := db.Session{
+		ID:               uuid.NewString(),
+		UserID:           user.ID,
+		RefreshTokenHash: HashToken(refresh),
+		UserAgent:        truncate(userAgent, 255),
+		IP:               ip,
+		ExpiresAt:        now.Add(s.RefreshTTL),
+		LastUsedAt:       now,
+	}
+	if err := DB.Create(&session).Error; err != nil {
+		return nil, err
+	}
+	return s.tokens(&session, refresh)
+}
+
+// Refresh exchanges a refresh token for new tokens of the same session.
+// The old refresh token stops working, also when two refreshes race.
+func (s *Sessions) Refresh(DB *gorm.DB, refreshToken string) (*Tokens, error) {
+	var session db.Session
+	if err := DB.Where("refresh_token_hash = ?", HashToken(refreshToken)).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if now.After(session.ExpiresAt) {
+		DB.Delete(&session)
+		return nil, ErrInvalidToken
+	}
+	var user db.User
+	if err := DB.First(&user, "id = ?", session.UserID).Error; err != nil {
+		return nil, ErrInvalidToken
+	}
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+
+	next, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	res := DB.Model(&db.Session{}).
+		Where("id = ? AND refresh_token_hash = ?", session.ID, session.RefreshTokenHash).
+		Updates(map[string]interface{}{
+			"refresh_token_hash": HashToken(next),
+			"expires_at":         now.Add(s.RefreshTTL),
+			"last_used_at":       now,
+		})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrInvalidToken
+	}
+	session.ExpiresAt = now.Add(s.RefreshTTL)
+	return s.tokens(&session, next)
+}
+
+// Authenticate checks an access token and returns its session and user. A
+// token of a deleted session fails even before it expires.
+func (s *Sessions) Authenticate(DB *gorm.DB, token string) (*db.Session, *db.User, error) {
+	claims, err := s.parse(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	var session db.Session
+	if err := DB.First(&session, "id = ?", claims.SessionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrInvalidToken
+		}
+		return nil, nil, err
+	}
+	if session.UserID != claims.UserID {
+		return nil, nil, ErrInvalidToken
+	}
+	var user db.User
+	if err := DB.First(&user, "id = ?", session.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrInvalidToken
+		}
+		return nil, nil, err
+	}
+	return &session, &user, nil
+}
+
+// RevokeAll logs out every session of userID but keep, which may be empty.
+func RevokeAll(DB *gorm.DB, userID, keep string) error {
+	return DB.Where("user_id = ? AND id <> ?", userID, keep).Delete(&db.Session{}).Error
+}
+
+// HashToken is how refresh tokens are stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Sessions) tokens(session *db.Session, refresh string) (*Tokens, error) {
+	expires := time.Now().Add(s.AccessTTL)
+	access, err := s.sign(accessClaims{SessionID: session.ID, UserID: session.UserID, Expires: expires.Unix()})
+	if err != nil {
+		return nil, err
+	}
+	return &Tokens{
+		SessionID:             session.ID,
+		AccessToken:           access,
+		AccessTokenExpiresAt:  time.Unix(expires.Unix(), 0).UTC(),
+		RefreshToken:          refresh,
+		RefreshTokenExpiresAt: session.ExpiresAt.UTC(),
+	}, nil
+}
+
+// sign encodes claims as <payload>.<HMAC-SHA256 of payload>, both base64url.
+func (s *Sessions) sign(claims accessClaims) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload)), nil
+}
+
+func (s *Sessions) parse(token string) (*accessClaims, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, s.mac(payload)) {
+		return nil, ErrInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims accessClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return nil, ErrInvalidToken
+	}
+	return &claims, nil
+}
+
+func (s *Sessions) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.Secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
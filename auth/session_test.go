@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupSessionDB(t *testing.T) *gorm.DB {
+	DB, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, DB.AutoMigrate(&db.User{}, &db.Session{}))
+	return DB
+}
+
+func TestSessionTokens(t *testing.T) {
+	DB := setupSessionDB(t)
+	user := db.User{ID: "user-1", Email: "a@example.com", AccessKey: "ak-1"}
+	require.NoError(t, DB.Create(&user).Error)
+	sessions := &Sessions{Secret: []byte("0123456789abcdef0123456789abcdef"), AccessTTL: time.Minute, RefreshTTL: time.Hour}
+
+	tokens, err := sessions.Start(DB, &user, "test-agent", "127.0.0.1")
+	require.NoError(t, err)
+	session, authed, err := sessions.Authenticate(DB, tokens.AccessToken)
+	require.NoError(t, err)
+	require.Equal(t, tokens.SessionID, session.ID)
+	require.Equal(t, user.ID, authed.ID)
+
+	var stored db.Session
+	require.NoError(t, DB.First(&stored, "id = ?", tokens.SessionID).Error)
+	require.Equal(t, HashToken(tokens.RefreshToken), stored.RefreshTokenHash, "only a hash of the refresh token is stored")
+
+	// tampering with the claims breaks the signature
+	payload, sig, _ := strings.Cut(tokens.AccessToken, ".")
+	_, _, err = sessions.Authenticate(DB, payload+"x."+sig)
+	require.ErrorIs(t, err, ErrInvalidToken)
+	other := &Sessions{Secret: []byte("another secret of thirty-two bytes"), AccessTTL: time.Minute}
+	_, _, err = other.Authenticate(DB, tokens.AccessToken)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// refresh tokens rotate
+	next, err := sessions.Refresh(DB, tokens.RefreshToken)
+	require.NoError(t, err)
+	require.Equal(t, tokens.SessionID, next.SessionID)
+	require.NotEqual(t, tokens.RefreshToken, next.RefreshToken)
+	_, err = sessions.Refresh(DB, tokens.RefreshToken)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// access tokens expire
+	expired := &Sessions{Secret: sessions.Secret, AccessTTL: -time.Second, RefreshTTL: time.Hour}
+	short, err := expired.Start(DB, &user, "", "")
+	require.NoError(t, err)
+	_, _, err = sessions.Authenticate(DB, short.AccessToken)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// revoking a session invalidates its access token at once
+	require.NoError(t, RevokeAll(DB, user.ID, short.SessionID))
+	_, _, err = sessions.Authenticate(DB, next.AccessToken)
+	require.ErrorIs(t, err, ErrInvalidToken)
+	_, err = sessions.Refresh(DB, next.RefreshToken)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	require.NoError(t, DB.Model(&user).Update("disabled", true).Error)
+	_, err = sessions.Refresh(DB, short.RefreshToken)
+	require.ErrorIs(t, err, ErrAccountDisabled)
+}
@@ -0,0 +1,39 @@
+// Command audit-verify checks the hash chain of the audit log and exits
+// non-zero when it is broken.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
+	"github.com/SysTechSalihY/mini-s3-clone/config"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	godotenv.Load(".env")
+	cfg, err := config.Load("audit-verify", os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := db.ConnectDb(cfg.Database.URL); err != nil {
+		fmt.Fprintln(os.Stderr, "DB connection failed:", err)
+		os.Exit(2)
+	}
+
+	checked, err := audit.Verify(db.DB)
+	var chainErr *audit.ChainError
+	switch {
+	case errors.As(err, &chainErr):
+		fmt.Printf("FAILED after %d events: %v\n", checked, err)
+		os.Exit(1)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "verification failed:", err)
+		os.Exit(2)
+	}
+	fmt.Printf("OK: %d events verified\n", checked)
+}
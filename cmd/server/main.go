@@ -3,13 +3,25 @@ package main
 import (
 	"context"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/SysTechSalihY/mini-s3-clone/accesslog"
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/config"
 	"github.com/SysTechSalihY/mini-s3-clone/db"
 	"github.com/SysTechSalihY/mini-s3-clone/handlers"
+	"github.com/SysTechSalihY/mini-s3-clone/health"
+	"github.com/SysTechSalihY/mini-s3-clone/lockout"
+	"github.com/SysTechSalihY/mini-s3-clone/mail"
+	"github.com/SysTechSalihY/mini-s3-clone/metrics"
 	"github.com/SysTechSalihY/mini-s3-clone/middleware"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/SysTechSalihY/mini-s3-clone/tracing"
+	"github.com/SysTechSalihY/mini-s3-clone/usage"
 	"github.com/gofiber/fiber/v2"
 	"github.com/hibiken/asynq"
 	"github.com/joho/godotenv"
@@ -25,36 +37,55 @@ func main() {
 		log.Info(".env file loaded")
 	}
 
+	// Configuration: file, then environment, then flags
+	cfg, err := config.Load("server", os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.PrintOnly {
+		cfg.Print(os.Stdout)
+		return
+	}
+
 	// Logger setup
 	log.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339})
-	log.SetLevel(log.DebugLevel)
+	cfg.Apply()
 	log.Info("Logger initialized")
 
+	// Tracing
+	shutdownTracing, err := tracing.Setup(context.Background(), "mini-s3-server", cfg.Tracing.Exporter)
+	if err != nil {
+		log.Fatal("Failed to set up tracing:", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// Fiber app
-	app := fiber.New()
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
 	log.Info("Fiber app initialized")
 
 	// DB connection
 	log.Info("Connecting to database...")
-	if err := db.ConnectDb(); err != nil {
+	if err := db.ConnectDb(cfg.Database.URL); err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	} else {
 		log.Info("Database connected successfully")
 	}
-
-	// AWS SES client
-	log.Info("Loading AWS config...")
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(os.Getenv("AWS_REGION")))
-	if err != nil {
-		log.Fatal("Failed to load AWS config:", err)
+	if err := metrics.InstrumentGORM(db.DB); err != nil {
+		log.Fatal("Failed to instrument database:", err)
+	}
+	if err := tracing.InstrumentGORM(db.DB); err != nil {
+		log.Fatal("Failed to instrument database:", err)
+	}
+	if sqlDB, err := db.DB.DB(); err == nil {
+		defer sqlDB.Close()
 	}
-	sesClient := sesv2.NewFromConfig(cfg)
-	log.Info("AWS SES client initialized")
 
 	// Redis + Asynq
-	redisAddr := os.Getenv("REDIS_ADDR")
+	redisAddr := cfg.Redis.Addr
 	log.WithField("redis_addr", redisAddr).Info("Connecting to Redis...")
 	redisClient := redis.NewClient(&redis.Options{Addr: redisAddr})
+	metrics.InstrumentRedis(redisClient)
+	tracing.InstrumentRedis(redisClient)
 	if _, err := redisClient.Ping(context.Background()).Result(); err != nil {
 		log.Fatal("Failed to connect to Redis:", err)
 	} else {
@@ -62,55 +93,206 @@ func main() {
 	}
 
 	asynqClient := asynq.NewClient(asynq.RedisClientOpt{Addr: redisAddr})
+	asynqInspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: redisAddr})
 	defer redisClient.Close()
 	defer asynqClient.Close()
+	defer asynqInspector.Close()
 	log.Info("Asynq client initialized")
 
+	// Emails are rendered here and sent by the worker
+	mailTemplates, err := mail.LoadTemplates(cfg.Mail.TemplatesDir, cfg.Mail.DefaultLocale)
+	if err != nil {
+		log.Fatal("Failed to load mail templates:", err)
+	}
+	mailQueue := &mail.Queue{Client: asynqClient, Templates: mailTemplates}
+	sessions := cfg.Sessions()
+	passwords, err := cfg.PasswordPolicy()
+	if err != nil {
+		log.Fatal("Failed to load password policy:", err)
+	}
+	loginGuard := lockout.New(redisClient, cfg.LockoutPolicy())
+
+	notifier := &notify.Notifier{DB: db.DB, Client: asynqClient, Redis: redisClient, Stream: cfg.StreamOptions()}
+	if err := notify.EnsureConsumerGroups(context.Background(), redisClient, cfg.Events.ConsumerGroups); err != nil {
+		log.WithError(err).Warn("Failed to create event stream consumer groups")
+	}
+
+	// Request IDs, first so every error response and log line can carry one
+	app.Use(requestid.New())
+
+	// Probes, ahead of the rate limiter so they are never rejected
+	checker := health.NewChecker(
+		health.Database(db.DB),
+		health.Redis(redisClient),
+		health.Storage(cfg.Storage.Root, cfg.Storage.MinFreeBytes),
+	)
+	app.Get("/healthz", health.Live())
+	app.Get("/readyz", checker.Readiness())
+	log.Info("Health routes registered")
+
+	// Request spans, so every later middleware runs inside one
+	app.Use(tracing.Middleware())
+	log.Info("Tracing middleware added")
+
+	// Prometheus metrics, ahead of the rate limiter so rejected requests are
+	// counted too; the scrape endpoint is not rate limited
+	app.Use(metrics.Middleware())
+	app.Get("/metrics", metrics.Handler())
+	log.Info("Metrics middleware added")
+
 	// Rate limiter middleware
-	app.Use(middleware.RateLimit(redisClient, 20, time.Minute))
+	app.Use(middleware.RateLimit(redisClient, cfg.RateLimit.Requests, cfg.RateLimit.Window))
 	log.Info("RateLimit middleware added")
 
+	// Progress streams run until shutdown starts rather than until clients
+	// leave, which could be never
+	streams, stopStreams := context.WithCancel(context.Background())
+
+	// Buffered counters and log records, flushed one last time on shutdown
+	background, stopBackground := context.WithCancel(context.Background())
+	var flushers sync.WaitGroup
+
+	// Usage metering, ahead of the auth middlewares so it sees their user
+	meter := usage.NewMeter(db.DB)
+	flushers.Add(1)
+	go func() {
+		defer flushers.Done()
+		meter.Run(background, usage.DefaultFlushInterval)
+	}()
+	app.Use(meter.Middleware())
+	log.Info("Usage metering middleware added")
+
+	// Server access logs, delivered to their target buckets by the worker
+	accessLogger := accesslog.NewLogger(db.DB, asynqClient)
+	flushers.Add(1)
+	go func() {
+		defer flushers.Done()
+		accessLogger.Run(background, accesslog.DefaultFlushInterval)
+	}()
+	app.Use(accessLogger.Middleware())
+	log.Info("Access logging middleware added")
+
 	// Public routes
 	log.Info("Registering public routes...")
-	app.Post("/api/auth/signup", handlers.SignUp(db.DB))
+	app.Post("/api/auth/signup", handlers.SignUp(db.DB, passwords))
 	app.Get("/api/auth/verify-email", handlers.VerifyEmail(db.DB))
-	app.Post("/api/auth/secret-key", handlers.CreateSecretKey(db.DB))
-	app.Post("/api/presigned/upload", middleware.ValidatePresignedURL(db.DB), handlers.UploadFilePresignedURL(db.DB))
+	app.Post("/api/auth/secret-key", handlers.CreateSecretKey(db.DB, loginGuard, mailQueue))
+	app.Post("/api/auth/password-reset", handlers.RequestPasswordReset(db.DB, mailQueue, cfg.Server.AppURL))
+	app.Post("/api/auth/password-reset/confirm", handlers.ResetPassword(db.DB, passwords))
+	app.Post("/api/auth/login", handlers.Login(db.DB, sessions, loginGuard, mailQueue))
+	app.Post("/api/auth/refresh", handlers.RefreshSession(db.DB, sessions))
+	app.Post("/api/presigned/upload", middleware.ValidatePresignedURL(db.DB), handlers.UploadFilePresignedURL(db.DB, notifier))
 	app.Get("/api/presigned/download", middleware.ValidatePresignedURL(db.DB), handlers.DownloadFilePresignedURL(db.DB))
 	log.Info("Public routes registered")
 
 	// Auth middleware
 	log.Info("Registering auth middleware...")
-	app.Use(middleware.AuthMiddleware(db.DB))
+	app.Use(middleware.AuthMiddleware(db.DB, sessions))
+	app.Use(middleware.UserRateLimit(redisClient, cfg.RateLimit.Requests, cfg.RateLimit.Window))
+	if cfg.Verification.Mode == config.VerificationBlock {
+		// unverified accounts can still verify, change their address or leave
+		app.Use(middleware.RequireVerified("/api/auth/", "/api/account"))
+	}
 	log.Info("Auth middleware registered")
 
 	// Authenticated routes
 	log.Info("Registering authenticated routes...")
 	app.Get("/api/auth/verification-link",
-		handlers.CreateVerificationLink(db.DB, sesClient, os.Getenv("AWS_EMAIL"), os.Getenv("APP_URL")))
+		handlers.CreateVerificationLink(db.DB, mailQueue, cfg.Server.AppURL, cfg.Verification.ResendInterval))
 
 	app.Post("/api/buckets", handlers.CreateBucket(db.DB))
 	app.Get("/api/buckets", handlers.ListBuckets(db.DB))
 	app.Get("/api/buckets/:bucketName", handlers.GetBucketInfo(db.DB))
 	app.Delete("/api/buckets/:bucketName", handlers.DeleteBucket(db.DB))
+	app.Get("/api/buckets/:bucketName/notification", handlers.GetBucketNotification(db.DB))
+	app.Put("/api/buckets/:bucketName/notification", handlers.PutBucketNotification(db.DB, notifier))
+	app.Get("/api/buckets/:bucketName/notification/dead-letters", handlers.ListNotificationDeadLetters(db.DB))
+	app.Get("/api/buckets/:bucketName/events", handlers.ListBucketEvents(db.DB, redisClient))
+	app.Get("/api/buckets/:bucketName/replication", handlers.GetBucketReplication(db.DB))
+	app.Put("/api/buckets/:bucketName/replication", handlers.PutBucketReplication(db.DB, notifier))
+	app.Get("/api/buckets/:bucketName/object-lock", handlers.GetObjectLockConfiguration(db.DB))
+	app.Put("/api/buckets/:bucketName/object-lock", handlers.PutObjectLockConfiguration(db.DB, notifier))
+	app.Get("/api/buckets/:bucketName/logging", handlers.GetBucketLogging(db.DB))
+	app.Put("/api/buckets/:bucketName/logging", handlers.PutBucketLogging(db.DB, notifier))
+	app.Get("/api/buckets/:bucketName/mfa-delete", handlers.GetBucketMFADelete(db.DB))
+	app.Put("/api/buckets/:bucketName/mfa-delete", handlers.PutBucketMFADelete(db.DB, notifier))
 
 	// Presigned URL generation routes (bucket owner only)
 	app.Post("/api/presigned/url/download", handlers.CreateDownloadPresignedURL(db.DB))
 	app.Post("/api/presigned/url/upload", handlers.CreateUploadPresignedURL(db.DB))
 
-	app.Post("/api/buckets/:bucketName/files/:fileName", handlers.UploadFile(db.DB))
+	app.Post("/api/buckets/:bucketName/files/:fileName", handlers.UploadFile(db.DB, notifier))
+	// registered before the GET route, which would otherwise also answer HEAD
+	app.Head("/api/buckets/:bucketName/files/:fileName", handlers.HeadFile(db.DB))
 	app.Get("/api/buckets/:bucketName/files/:fileName", handlers.DownloadFile(db.DB))
-	app.Delete("/api/buckets/:bucketName/files/:fileName", handlers.DeleteFile(db.DB))
-	app.Post("/api/buckets/:bucketName/files", handlers.UploadFileMultipart(db.DB))
+	app.Delete("/api/buckets/:bucketName/files/:fileName", handlers.DeleteFile(db.DB, notifier))
+	app.Post("/api/buckets/:bucketName/files", handlers.UploadFileMultipart(db.DB, notifier))
+	app.Put("/api/buckets/:bucketName/files/:fileName/retention", handlers.PutObjectRetention(db.DB, notifier))
+	app.Put("/api/buckets/:bucketName/files/:fileName/legal-hold", handlers.PutObjectLegalHold(db.DB, notifier))
 	app.Post("/api/tasks/empty-bucket/:bucketName", handlers.EnqueueEmptyBucketTask(asynqClient, db.DB))
 	app.Post("/api/tasks/copy-bucket/:bucketSrc/:bucketDest", handlers.EnqueueCopyBucketTask(asynqClient, db.DB))
+	app.Post("/api/tasks/sync-bucket/:bucketSrc/:bucketDest", handlers.EnqueueSyncBucketTask(asynqClient, db.DB))
+	app.Get("/api/tasks", handlers.ListTasks(db.DB))
+	app.Get("/api/tasks/events", handlers.StreamTaskProgress(db.DB, redisClient, streams))
+	app.Get("/api/tasks/ws", handlers.TaskProgressWebSocket(db.DB, redisClient, streams))
 	app.Get("/api/tasks/:taskID", handlers.GetTaskProgress(db.DB))
+	app.Get("/api/tasks/:taskID/events", handlers.StreamTaskProgress(db.DB, redisClient, streams))
+	app.Get("/api/tasks/:taskID/ws", handlers.TaskProgressWebSocket(db.DB, redisClient, streams))
+	app.Post("/api/tasks/:taskID/cancel", handlers.CancelTask(asynqInspector, db.DB))
+	app.Post("/api/tasks/:taskID/retry", handlers.RetryTask(asynqClient, asynqInspector, db.DB))
+	app.Get("/api/usage", handlers.GetUsage(db.DB))
+	app.Get("/api/account", handlers.GetAccount(db.DB))
+	app.Put("/api/account/password", handlers.ChangePassword(db.DB, passwords))
+	app.Put("/api/account/email", handlers.ChangeEmail(db.DB, mailQueue, cfg.Server.AppURL, cfg.Verification.ResendInterval))
+	app.Delete("/api/account", handlers.DeleteAccount(asynqClient, asynqInspector, db.DB))
+	app.Post("/api/auth/logout", handlers.Logout(db.DB))
+	app.Get("/api/account/sessions", handlers.ListSessions(db.DB))
+	app.Delete("/api/account/sessions/:sessionID", handlers.RevokeSession(db.DB))
+	app.Post("/api/account/mfa", handlers.EnrollMFA(db.DB, cfg.MFA.Issuer))
+	app.Post("/api/account/mfa/confirm", handlers.ConfirmMFA(db.DB))
+	app.Delete("/api/account/mfa", handlers.DisableMFA(db.DB))
+	app.Post("/api/account/mfa/recovery-codes", handlers.RegenerateRecoveryCodes(db.DB))
 	log.Info("Authenticated routes registered")
 
+	// Admin routes
+	admin := app.Group("/api/admin", middleware.RequireAdmin())
+	// destructive admin actions need a fresh MFA code
+	adminMFA := middleware.RequireMFA(db.DB, cfg.MFA.RequireForAdmins)
+	admin.Get("/users", handlers.AdminListUsers(db.DB))
+	admin.Get("/users/:userID", handlers.AdminGetUser(db.DB))
+	admin.Post("/users/:userID/disable", adminMFA, handlers.AdminSetUserDisabled(db.DB, true))
+	admin.Post("/users/:userID/enable", handlers.AdminSetUserDisabled(db.DB, false))
+	admin.Post("/users/:userID/rotate-keys", adminMFA, handlers.AdminRotateUserKeys(db.DB))
+	admin.Delete("/users/:userID/mfa", adminMFA, handlers.AdminResetUserMFA(db.DB))
+	admin.Patch("/users/:userID/limits", adminMFA, handlers.AdminUpdateUserLimits(db.DB))
+	admin.Get("/buckets", handlers.AdminListBuckets(db.DB))
+	admin.Put("/buckets/:bucketName/owner", adminMFA, handlers.AdminTransferBucket(db.DB))
+	admin.Get("/queues", handlers.AdminQueueStats(asynqInspector))
+	admin.Get("/audit", handlers.AdminListAuditEvents(db.DB))
+	log.Info("Admin routes registered")
+
 	// Start server
-	port := ":8080"
-	log.WithField("port", port).Info("Starting server...")
-	if err := app.Listen(port); err != nil {
-		log.Fatal("Server failed:", err)
+	log.WithField("addr", cfg.Server.Addr).Info("Starting server...")
+	go func() {
+		if err := app.Listen(cfg.Server.Addr); err != nil {
+			log.Fatal("Server failed:", err)
+		}
+	}()
+
+	// Graceful shutdown: fail readiness, stop accepting, let in-flight
+	// requests such as uploads finish, then flush and close the clients
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGTERM)
+	<-done
+
+	timeout := cfg.Server.ShutdownTimeout
+	log.WithField("timeout", timeout.String()).Info("Shutting down server...")
+	checker.Drain()
+	stopStreams()
+	if err := app.ShutdownWithTimeout(timeout); err != nil {
+		log.WithError(err).Warn("In-flight requests did not finish in time")
 	}
+	stopBackground()
+	flushers.Wait()
+	log.Info("Server stopped")
 }
@@ -1,39 +1,141 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/SysTechSalihY/mini-s3-clone/config"
 	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/health"
+	"github.com/SysTechSalihY/mini-s3-clone/mail"
+	"github.com/SysTechSalihY/mini-s3-clone/metrics"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/SysTechSalihY/mini-s3-clone/tracing"
 	"github.com/SysTechSalihY/mini-s3-clone/worker"
 	"github.com/hibiken/asynq"
+	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
 )
 
 func main() {
+	// Configuration: file, then environment, then flags
+	godotenv.Load(".env")
+	cfg, err := config.Load("worker", os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.PrintOnly {
+		cfg.Print(os.Stdout)
+		return
+	}
+	cfg.Apply()
+
+	// Tracing
+	shutdownTracing, err := tracing.Setup(context.Background(), "mini-s3-worker", cfg.Tracing.Exporter)
+	if err != nil {
+		log.Fatal("Tracing setup failed:", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// Connect to DB
-	if err := db.ConnectDb(); err != nil {
+	if err := db.ConnectDb(cfg.Database.URL); err != nil {
 		log.Fatal("DB connection failed:", err)
 	}
+	if err := metrics.InstrumentGORM(db.DB); err != nil {
+		log.Fatal("DB instrumentation failed:", err)
+	}
+	if err := tracing.InstrumentGORM(db.DB); err != nil {
+		log.Fatal("DB instrumentation failed:", err)
+	}
+	if sqlDB, err := db.DB.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+
+	redisAddr := cfg.Redis.Addr
+
+	redisClient := redis.NewClient(&redis.Options{Addr: redisAddr})
+	metrics.InstrumentRedis(redisClient)
+	tracing.InstrumentRedis(redisClient)
+	defer redisClient.Close()
+
+	// Tasks raise bucket events too; their webhook deliveries go through
+	// this same server.
+	asynqClient := asynq.NewClient(asynq.RedisClientOpt{Addr: redisAddr})
+	defer asynqClient.Close()
+
+	mailer, err := mail.New(context.Background(), cfg.MailOptions())
+	if err != nil {
+		log.Fatal("Mailer setup failed:", err)
+	}
 
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
+	newWorker := &worker.Worker{
+		DB:    db.DB,
+		Redis: redisClient,
+		Notifier: &notify.Notifier{
+			DB:     db.DB,
+			Client: asynqClient,
+			Redis:  redisClient,
+			Stream: cfg.StreamOptions(),
+		},
+		Mailer: mailer,
 	}
 
 	srv := asynq.NewServer(
 		asynq.RedisClientOpt{Addr: redisAddr},
 		asynq.Config{
-			Concurrency: 10,
+			Concurrency:     cfg.Worker.Concurrency,
+			ErrorHandler:    asynq.ErrorHandlerFunc(newWorker.HandleTaskError),
+			RetryDelayFunc:  tasks.RetryDelay,
+			ShutdownTimeout: cfg.Server.ShutdownTimeout,
 		},
 	)
 
-	newWorker := &worker.Worker{DB: db.DB}
-
 	mux := asynq.NewServeMux()
-	mux.HandleFunc("empty_bucket", newWorker.HandleEmptyBucketTask)
-	mux.HandleFunc("copy_bucket", newWorker.HandleCopyBucketTask)
+	mux.Use(tracing.TaskMiddleware, metrics.TaskMiddleware)
+	mux.HandleFunc(tasks.TaskTypeEmptyBucket, newWorker.HandleEmptyBucketTask)
+	mux.HandleFunc(tasks.TaskTypeCopyBucket, newWorker.HandleCopyBucketTask)
+	mux.HandleFunc(tasks.TaskTypeSyncBucket, newWorker.HandleSyncBucketTask)
+	mux.HandleFunc(tasks.TaskTypeDeliverWebhook, newWorker.HandleDeliverWebhookTask)
+	mux.HandleFunc(tasks.TaskTypeReplicateObject, newWorker.HandleReplicateObjectTask)
+	mux.HandleFunc(tasks.TaskTypeDeliverAccessLogs, newWorker.HandleDeliverAccessLogsTask)
+	mux.HandleFunc(tasks.TaskTypeSendEmail, newWorker.HandleSendEmailTask)
+	mux.HandleFunc(tasks.TaskTypeDeleteAccount, newWorker.HandleDeleteAccountTask)
+	mux.HandleFunc(tasks.TaskTypeCleanupTokens, newWorker.HandleCleanupTokensTask)
+
+	// Periodic tasks; Unique keeps several workers from queueing the same run
+	scheduler := asynq.NewScheduler(asynq.RedisClientOpt{Addr: redisAddr}, nil)
+	cleanupInterval := cfg.Verification.CleanupInterval
+	if _, err := scheduler.Register("@every "+cleanupInterval.String(), tasks.NewCleanupTokensTask(asynq.Unique(cleanupInterval))); err != nil {
+		log.Fatal("Scheduling token cleanup failed:", err)
+	}
+
+	// Metrics and probe listener, with queue depths read from the inspector
+	// on scrape
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: redisAddr})
+	defer inspector.Close()
+	if err := metrics.RegisterQueueCollector(inspector); err != nil {
+		log.Fatal("Queue metrics registration failed:", err)
+	}
+	metricsAddr := cfg.Worker.MetricsAddr
+	checker := health.NewChecker(
+		health.Database(db.DB),
+		health.Redis(redisClient),
+		health.Storage(cfg.Storage.Root, cfg.Storage.MinFreeBytes),
+	)
+	probeMux := metrics.ServeMux()
+	checker.Handle(probeMux)
+	probeServer := &http.Server{Addr: metricsAddr, Handler: probeMux}
+	go func() {
+		log.Println("Serving metrics and probes on", metricsAddr)
+		if err := probeServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("Metrics listener stopped:", err)
+		}
+	}()
 
 	// Graceful shutdown
 	done := make(chan os.Signal, 1)
@@ -45,8 +147,15 @@ func main() {
 			log.Fatal(err)
 		}
 	}()
+	if err := scheduler.Start(); err != nil {
+		log.Fatal("Starting scheduler failed:", err)
+	}
 
 	<-done
 	log.Println("Shutting down worker...")
+	checker.Drain()
+	scheduler.Shutdown()
+	// waits up to the shutdown timeout for running tasks, then requeues them
 	srv.Shutdown()
+	probeServer.Shutdown(context.Background())
 }
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/auth"
+	"github.com/SysTechSalihY/mini-s3-clone/lockout"
+	"github.com/SysTechSalihY/mini-s3-clone/mail"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/quota"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/SysTechSalihY/mini-s3-clone/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Apply hands the settings read through package variables to their
+// packages: the log level, the storage root, webhook address checks, task
+// timeouts, the default quota plan and the sandbox of unverified accounts.
+// Both commands call it once, before serving.
+func (cfg *Config) Apply() {
+	log.SetLevel(cfg.LogLevel())
+	utils.StorageRoot = cfg.Storage.Root
+	notify.AllowPrivateAddresses = cfg.Events.WebhookAllowPrivate
+	tasks.Timeouts = map[string]time.Duration{
+		tasks.TaskTypeEmptyBucket:       cfg.Tasks.EmptyBucketTimeout,
+		tasks.TaskTypeCopyBucket:        cfg.Tasks.CopyBucketTimeout,
+		tasks.TaskTypeSyncBucket:        cfg.Tasks.SyncBucketTimeout,
+		tasks.TaskTypeDeliverWebhook:    cfg.Tasks.WebhookTimeout,
+		tasks.TaskTypeReplicateObject:   cfg.Tasks.ReplicationTimeout,
+		tasks.TaskTypeDeliverAccessLogs: cfg.Tasks.AccessLogTimeout,
+		tasks.TaskTypeSendEmail:         cfg.Tasks.SendEmailTimeout,
+		tasks.TaskTypeDeleteAccount:     cfg.Tasks.DeleteAccountTimeout,
+		tasks.TaskTypeCleanupTokens:     cfg.Tasks.CleanupTokensTimeout,
+	}
+	quota.SetPlan(quota.Limits{
+		MaxStorageBytes: cfg.Quota.MaxStorageBytes,
+		MaxBuckets:      cfg.Quota.MaxBuckets,
+		MaxObjects:      cfg.Quota.MaxObjects,
+		MaxObjectSize:   cfg.Quota.MaxObjectSize,
+	})
+	if cfg.Verification.Mode == VerificationSandbox {
+		quota.SetSandbox(&quota.Limits{
+			MaxStorageBytes: cfg.Verification.SandboxMaxStorageBytes,
+			MaxBuckets:      cfg.Verification.SandboxMaxBuckets,
+			MaxObjects:      cfg.Verification.SandboxMaxObjects,
+			MaxObjectSize:   cfg.Verification.SandboxMaxObjectSize,
+		})
+	} else {
+		quota.SetSandbox(nil)
+	}
+}
+
+// MailOptions select the mailer of the worker.
+func (cfg *Config) MailOptions() mail.Options {
+	return mail.Options{
+		Driver:       cfg.Mail.Driver,
+		From:         cfg.Mail.From,
+		AWSRegion:    cfg.Mail.AWSRegion,
+		SMTPAddr:     cfg.Mail.SMTPAddr,
+		SMTPUsername: cfg.Mail.SMTPUsername,
+		SMTPPassword: cfg.Mail.SMTPPassword,
+		OutboxDir:    cfg.Mail.OutboxDir,
+	}
+}
+
+// StreamOptions are the event stream settings for notify.Notifier.
+func (cfg *Config) StreamOptions() notify.StreamOptions {
+	return notify.StreamOptions{MaxLen: cfg.Events.StreamMaxLen, Global: cfg.Events.StreamGlobal}
+}
+
+// Sessions issues console login tokens, signed with a random secret when
+// none is configured.
+func (cfg *Config) Sessions() *auth.Sessions {
+	secret := []byte(cfg.Session.Secret)
+	if len(secret) == 0 {
+		log.Warn("session.secret is not set; console logins end when the server restarts")
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+	return &auth.Sessions{
+		Secret:     secret,
+		AccessTTL:  cfg.Session.AccessTokenTTL,
+		RefreshTTL: cfg.Session.RefreshTokenTTL,
+	}
+}
+
+// PasswordPolicy loads the password rules, with the breached password list
+// when one is configured.
+func (cfg *Config) PasswordPolicy() (*auth.PasswordPolicy, error) {
+	policy, err := auth.LoadPasswordPolicy(cfg.Password.MinLength, cfg.Password.BreachedList)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Password.BreachedList != "" {
+		log.WithField("passwords", policy.Breached()).Info("Loaded breached password list")
+	}
+	return policy, nil
+}
+
+// LockoutPolicy is the brute-force protection of logins.
+func (cfg *Config) LockoutPolicy() lockout.Policy {
+	return lockout.Policy{
+		Window:             cfg.Lockout.Window,
+		FreeAttempts:       cfg.Lockout.FreeAttempts,
+		BaseDelay:          cfg.Lockout.BaseDelay,
+		MaxDelay:           cfg.Lockout.MaxDelay,
+		MaxAccountFailures: cfg.Lockout.MaxAccountFailures,
+		MaxIPFailures:      cfg.Lockout.MaxIPFailures,
+		LockDuration:       cfg.Lockout.Duration,
+	}
+}
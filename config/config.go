@@ -0,0 +1,460 @@
+// Package config loads the settings shared by cmd/server and cmd/worker.
+// Values come from, in increasing precedence: the defaults below, a YAML or
+// TOML file, environment variables and command-line flags. Load validates
+// the result so a bad value stops the process at startup rather than
+// surfacing later.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the whole configuration. Each field names the environment
+// variables overriding it in its env tag, the first set one winning; secret
+// fields are redacted when printed.
+type Config struct {
+	Server       Server       `yaml:"server" toml:"server"`
+	Worker       Worker       `yaml:"worker" toml:"worker"`
+	Database     Database     `yaml:"database" toml:"database"`
+	Redis        Redis        `yaml:"redis" toml:"redis"`
+	Storage      Storage      `yaml:"storage" toml:"storage"`
+	Log          Log          `yaml:"log" toml:"log"`
+	RateLimit    RateLimit    `yaml:"rate_limit" toml:"rate_limit"`
+	Tasks        Tasks        `yaml:"tasks" toml:"tasks"`
+	Quota        Quota        `yaml:"quota" toml:"quota"`
+	Events       Events       `yaml:"events" toml:"events"`
+	Mail         Mail         `yaml:"mail" toml:"mail"`
+	Tracing      Tracing      `yaml:"tracing" toml:"tracing"`
+	Verification Verification `yaml:"verification" toml:"verification"`
+	Session      Session      `yaml:"session" toml:"session"`
+	MFA          MFA          `yaml:"mfa" toml:"mfa"`
+	Password     Password     `yaml:"password" toml:"password"`
+	Lockout      Lockout      `yaml:"lockout" toml:"lockout"`
+
+	// set by -print-config: print the configuration and exit
+	PrintOnly bool `yaml:"-" toml:"-"`
+}
+
+type Server struct {
+	Addr            string        `yaml:"addr" toml:"addr" env:"SERVER_ADDR"`
+	AppURL          string        `yaml:"app_url" toml:"app_url" env:"APP_URL"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+type Worker struct {
+	Concurrency int    `yaml:"concurrency" toml:"concurrency" env:"WORKER_CONCURRENCY"`
+	MetricsAddr string `yaml:"metrics_addr" toml:"metrics_addr" env:"WORKER_METRICS_ADDR"`
+}
+
+type Database struct {
+	URL string `yaml:"url" toml:"url" env:"DATABASE_URL" secret:"true"`
+}
+
+type Redis struct {
+	Addr string `yaml:"addr" toml:"addr" env:"REDIS_ADDR"`
+}
+
+type Storage struct {
+	// directory holding one subdirectory per bucket
+	Root string `yaml:"root" toml:"root" env:"STORAGE_ROOT"`
+	// readiness fails below this much free space
+	MinFreeBytes uint64 `yaml:"min_free_bytes" toml:"min_free_bytes" env:"READY_MIN_FREE_BYTES"`
+}
+
+type Log struct {
+	Level string `yaml:"level" toml:"level" env:"LOG_LEVEL"`
+}
+
+// RateLimit applies per client IP and again per authenticated user.
+type RateLimit struct {
+	Requests int           `yaml:"requests" toml:"requests" env:"RATE_LIMIT_REQUESTS"`
+	Window   time.Duration `yaml:"window" toml:"window" env:"RATE_LIMIT_WINDOW"`
+}
+
+// Tasks holds the longest each task type may run before asynq cancels it.
+type Tasks struct {
+	EmptyBucketTimeout   time.Duration `yaml:"empty_bucket_timeout" toml:"empty_bucket_timeout" env:"TASK_EMPTY_BUCKET_TIMEOUT"`
+	CopyBucketTimeout    time.Duration `yaml:"copy_bucket_timeout" toml:"copy_bucket_timeout" env:"TASK_COPY_BUCKET_TIMEOUT"`
+	SyncBucketTimeout    time.Duration `yaml:"sync_bucket_timeout" toml:"sync_bucket_timeout" env:"TASK_SYNC_BUCKET_TIMEOUT"`
+	WebhookTimeout       time.Duration `yaml:"webhook_timeout" toml:"webhook_timeout" env:"TASK_WEBHOOK_TIMEOUT"`
+	ReplicationTimeout   time.Duration `yaml:"replication_timeout" toml:"replication_timeout" env:"TASK_REPLICATION_TIMEOUT"`
+	AccessLogTimeout     time.Duration `yaml:"access_log_timeout" toml:"access_log_timeout" env:"TASK_ACCESS_LOG_TIMEOUT"`
+	SendEmailTimeout     time.Duration `yaml:"send_email_timeout" toml:"send_email_timeout" env:"TASK_SEND_EMAIL_TIMEOUT"`
+	DeleteAccountTimeout time.Duration `yaml:"delete_account_timeout" toml:"delete_account_timeout" env:"TASK_DELETE_ACCOUNT_TIMEOUT"`
+	CleanupTokensTimeout time.Duration `yaml:"cleanup_tokens_timeout" toml:"cleanup_tokens_timeout" env:"TASK_CLEANUP_TOKENS_TIMEOUT"`
+}
+
+// Quota is the default plan; 0 lifts a limit.
+type Quota struct {
+	MaxStorageBytes int64 `yaml:"max_storage_bytes" toml:"max_storage_bytes" env:"QUOTA_MAX_STORAGE_BYTES"`
+	MaxBuckets      int64 `yaml:"max_buckets" toml:"max_buckets" env:"QUOTA_MAX_BUCKETS"`
+	MaxObjects      int64 `yaml:"max_objects" toml:"max_objects" env:"QUOTA_MAX_OBJECTS"`
+	MaxObjectSize   int64 `yaml:"max_object_size" toml:"max_object_size" env:"QUOTA_MAX_OBJECT_SIZE"`
+}
+
+type Events struct {
+	StreamMaxLen   int64    `yaml:"stream_max_len" toml:"stream_max_len" env:"EVENT_STREAM_MAXLEN"`
+	StreamGlobal   bool     `yaml:"stream_global" toml:"stream_global" env:"EVENT_STREAM_GLOBAL"`
+	ConsumerGroups []string `yaml:"consumer_groups" toml:"consumer_groups" env:"EVENT_STREAM_GROUPS"`
+	// lets webhooks and replication endpoints reach loopback and private
+	// addresses, for development
+	WebhookAllowPrivate bool `yaml:"webhook_allow_private" toml:"webhook_allow_private" env:"WEBHOOK_ALLOW_PRIVATE"`
+}
+
+type Mail struct {
+	// ses, smtp, file or memory
+	Driver string `yaml:"driver" toml:"driver" env:"MAIL_DRIVER"`
+	From   string `yaml:"from" toml:"from" env:"MAIL_FROM,AWS_EMAIL"`
+
+	AWSRegion string `yaml:"aws_region" toml:"aws_region" env:"AWS_REGION"`
+
+	SMTPAddr     string `yaml:"smtp_addr" toml:"smtp_addr" env:"SMTP_ADDR"`
+	SMTPUsername string `yaml:"smtp_username" toml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword string `yaml:"smtp_password" toml:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+
+	// where the file driver writes .eml files
+	OutboxDir string `yaml:"outbox_dir" toml:"outbox_dir" env:"MAIL_OUTBOX_DIR"`
+	// replaces the shipped templates when set
+	TemplatesDir  string `yaml:"templates_dir" toml:"templates_dir" env:"MAIL_TEMPLATES_DIR"`
+	DefaultLocale string `yaml:"default_locale" toml:"default_locale" env:"MAIL_DEFAULT_LOCALE"`
+}
+
+// What accounts may do before verifying their email address.
+const (
+	VerificationOff     = "off"     // everything
+	VerificationSandbox = "sandbox" // everything within the sandbox quota
+	VerificationBlock   = "block"   // read, and verify or delete the account
+)
+
+type Verification struct {
+	// off, sandbox or block
+	Mode string `yaml:"mode" toml:"mode" env:"VERIFICATION_MODE"`
+
+	// the quota of unverified accounts in sandbox mode, capping their own;
+	// 0 leaves a limit alone
+	SandboxMaxStorageBytes int64 `yaml:"sandbox_max_storage_bytes" toml:"sandbox_max_storage_bytes" env:"VERIFICATION_SANDBOX_MAX_STORAGE_BYTES"`
+	SandboxMaxBuckets      int64 `yaml:"sandbox_max_buckets" toml:"sandbox_max_buckets" env:"VERIFICATION_SANDBOX_MAX_BUCKETS"`
+	SandboxMaxObjects      int64 `yaml:"sandbox_max_objects" toml:"sandbox_max_objects" env:"VERIFICATION_SANDBOX_MAX_OBJECTS"`
+	SandboxMaxObjectSize   int64 `yaml:"sandbox_max_object_size" toml:"sandbox_max_object_size" env:"VERIFICATION_SANDBOX_MAX_OBJECT_SIZE"`
+
+	// least time between two verification emails to one account
+	ResendInterval time.Duration `yaml:"resend_interval" toml:"resend_interval" env:"VERIFICATION_RESEND_INTERVAL"`
+	// how often the worker deletes expired verification and reset tokens
+	CleanupInterval time.Duration `yaml:"cleanup_interval" toml:"cleanup_interval" env:"VERIFICATION_CLEANUP_INTERVAL"`
+}
+
+// Session configures the console logins of POST /api/auth/login.
+type Session struct {
+	// signs access tokens; without one each server process makes up its own,
+	// so tokens do not survive a restart or work across several servers
+	Secret          string        `yaml:"secret" toml:"secret" env:"SESSION_SECRET" secret:"true"`
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl" toml:"access_token_ttl" env:"SESSION_ACCESS_TOKEN_TTL"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl" toml:"refresh_token_ttl" env:"SESSION_REFRESH_TOKEN_TTL"`
+}
+
+// MFA configures the TOTP second factor.
+type MFA struct {
+	// names the account in authenticator apps
+	Issuer string `yaml:"issuer" toml:"issuer" env:"MFA_ISSUER"`
+	// refuse destructive admin routes to admins who have not enabled MFA
+	RequireForAdmins bool `yaml:"require_for_admins" toml:"require_for_admins" env:"MFA_REQUIRE_FOR_ADMINS"`
+}
+
+// Password sets what new passwords must be, at signup, reset and change.
+type Password struct {
+	MinLength int `yaml:"min_length" toml:"min_length" env:"PASSWORD_MIN_LENGTH"`
+	// file of breached passwords to refuse, one per line, plain or as
+	// SHA-1 hashes like the Have I Been Pwned downloads
+	BreachedList string `yaml:"breached_list" toml:"breached_list" env:"PASSWORD_BREACHED_LIST"`
+}
+
+// Lockout slows down and stops password guessing on logins and secret key
+// creation, counting failures per account and per IP.
+type Lockout struct {
+	Window       time.Duration `yaml:"window" toml:"window" env:"LOCKOUT_WINDOW"`
+	FreeAttempts int           `yaml:"free_attempts" toml:"free_attempts" env:"LOCKOUT_FREE_ATTEMPTS"`
+	// each failure past the free ones doubles the wait, up to max_delay
+	BaseDelay time.Duration `yaml:"base_delay" toml:"base_delay" env:"LOCKOUT_BASE_DELAY"`
+	MaxDelay  time.Duration `yaml:"max_delay" toml:"max_delay" env:"LOCKOUT_MAX_DELAY"`
+	// failures that lock an account or IP for duration; 0 never locks
+	MaxAccountFailures int           `yaml:"max_account_failures" toml:"max_account_failures" env:"LOCKOUT_MAX_ACCOUNT_FAILURES"`
+	MaxIPFailures      int           `yaml:"max_ip_failures" toml:"max_ip_failures" env:"LOCKOUT_MAX_IP_FAILURES"`
+	Duration           time.Duration `yaml:"duration" toml:"duration" env:"LOCKOUT_DURATION"`
+}
+
+type Tracing struct {
+	// otlp, stdout or none
+	Exporter string `yaml:"exporter" toml:"exporter" env:"OTEL_TRACES_EXPORTER"`
+}
+
+// Default returns the configuration used where nothing overrides it.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Addr:            ":8080",
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Worker: Worker{
+			Concurrency: 10,
+			MetricsAddr: ":9091",
+		},
+		Redis:   Redis{Addr: "localhost:6379"},
+		Storage: Storage{Root: "./storage", MinFreeBytes: 1 << 30},
+		Log:     Log{Level: "debug"},
+		RateLimit: RateLimit{
+			Requests: 20,
+			Window:   time.Minute,
+		},
+		Tasks: Tasks{
+			EmptyBucketTimeout:   10 * time.Minute,
+			CopyBucketTimeout:    30 * time.Minute,
+			SyncBucketTimeout:    30 * time.Minute,
+			WebhookTimeout:       30 * time.Second,
+			ReplicationTimeout:   30 * time.Minute,
+			AccessLogTimeout:     time.Minute,
+			SendEmailTimeout:     time.Minute,
+			DeleteAccountTimeout: 30 * time.Minute,
+			CleanupTokensTimeout: 5 * time.Minute,
+		},
+		Quota: Quota{
+			MaxStorageBytes: 10 << 30, // 10 GiB
+			MaxBuckets:      100,
+			MaxObjects:      100000,
+			MaxObjectSize:   5 << 30, // 5 GiB
+		},
+		Events: Events{StreamMaxLen: 10000},
+		Mail: Mail{
+			Driver:        "ses",
+			OutboxDir:     "./outbox",
+			DefaultLocale: "en",
+		},
+		Tracing: Tracing{Exporter: "none"},
+		Verification: Verification{
+			Mode:                   VerificationSandbox,
+			SandboxMaxStorageBytes: 100 << 20, // 100 MiB
+			SandboxMaxBuckets:      1,
+			SandboxMaxObjects:      1000,
+			SandboxMaxObjectSize:   10 << 20, // 10 MiB
+			ResendInterval:         time.Minute,
+			CleanupInterval:        time.Hour,
+		},
+		Session: Session{
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 30 * 24 * time.Hour,
+		},
+		MFA: MFA{
+			Issuer:           "mini-s3",
+			RequireForAdmins: true,
+		},
+		Password: Password{MinLength: 8},
+		Lockout: Lockout{
+			Window:             15 * time.Minute,
+			FreeAttempts:       3,
+			BaseDelay:          time.Second,
+			MaxDelay:           30 * time.Second,
+			MaxAccountFailures: 10,
+			MaxIPFailures:      100,
+			Duration:           15 * time.Minute,
+		},
+	}
+}
+
+// Load builds the configuration of a command from its arguments:
+//
+//	-config path     YAML (.yaml, .yml) or TOML (.toml) file, or CONFIG_FILE
+//	-addr addr       listen address of the server
+//	-log-level lvl   logrus level
+//	-print-config    print the configuration, secrets redacted, and exit
+func Load(name string, args []string) (*Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "configuration file (.yaml, .yml or .toml)")
+	addr := fs.String("addr", "", "server listen address")
+	level := fs.String("log-level", "", "log level")
+	printOnly := fs.Bool("print-config", false, "print the configuration and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(cfg, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if *addr != "" {
+		cfg.Server.Addr = *addr
+	}
+	if *level != "" {
+		cfg.Log.Level = *level
+	}
+	cfg.PrintOnly = *printOnly
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(strings.NewReader(string(data)))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("parse %s: unknown key %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("config file %s: want .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// Validate reports every invalid value at once.
+func (cfg *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(cfg.Server.Addr != "", "server.addr must be set")
+	check(cfg.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(cfg.Worker.Concurrency > 0, "worker.concurrency must be positive, got %d", cfg.Worker.Concurrency)
+	check(cfg.Worker.MetricsAddr != "", "worker.metrics_addr must be set")
+	check(cfg.Database.URL != "", "database.url (DATABASE_URL) must be set")
+	check(cfg.Redis.Addr != "", "redis.addr must be set")
+	check(cfg.Storage.Root != "", "storage.root must be set")
+	_, err := log.ParseLevel(cfg.Log.Level)
+	check(err == nil, "log.level: unknown level %q", cfg.Log.Level)
+	check(cfg.RateLimit.Requests > 0, "rate_limit.requests must be positive, got %d", cfg.RateLimit.Requests)
+	check(cfg.RateLimit.Window > 0, "rate_limit.window must be positive")
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"empty_bucket_timeout", cfg.Tasks.EmptyBucketTimeout},
+		{"copy_bucket_timeout", cfg.Tasks.CopyBucketTimeout},
+		{"sync_bucket_timeout", cfg.Tasks.SyncBucketTimeout},
+		{"webhook_timeout", cfg.Tasks.WebhookTimeout},
+		{"replication_timeout", cfg.Tasks.ReplicationTimeout},
+		{"access_log_timeout", cfg.Tasks.AccessLogTimeout},
+		{"send_email_timeout", cfg.Tasks.SendEmailTimeout},
+		{"delete_account_timeout", cfg.Tasks.DeleteAccountTimeout},
+		{"cleanup_tokens_timeout", cfg.Tasks.CleanupTokensTimeout},
+	} {
+		check(t.d > 0, "tasks.%s must be positive", t.name)
+	}
+	for _, q := range []struct {
+		name string
+		v    int64
+	}{
+		{"max_storage_bytes", cfg.Quota.MaxStorageBytes},
+		{"max_buckets", cfg.Quota.MaxBuckets},
+		{"max_objects", cfg.Quota.MaxObjects},
+		{"max_object_size", cfg.Quota.MaxObjectSize},
+	} {
+		check(q.v >= 0, "quota.%s must not be negative", q.name)
+	}
+	switch cfg.Verification.Mode {
+	case VerificationOff, VerificationSandbox, VerificationBlock:
+	default:
+		check(false, "verification.mode: unknown mode %q", cfg.Verification.Mode)
+	}
+	for _, q := range []struct {
+		name string
+		v    int64
+	}{
+		{"sandbox_max_storage_bytes", cfg.Verification.SandboxMaxStorageBytes},
+		{"sandbox_max_buckets", cfg.Verification.SandboxMaxBuckets},
+		{"sandbox_max_objects", cfg.Verification.SandboxMaxObjects},
+		{"sandbox_max_object_size", cfg.Verification.SandboxMaxObjectSize},
+	} {
+		check(q.v >= 0, "verification.%s must not be negative", q.name)
+	}
+	check(cfg.Verification.ResendInterval >= 0, "verification.resend_interval must not be negative")
+	check(cfg.Verification.CleanupInterval >= time.Second, "verification.cleanup_interval must be at least 1s")
+	check(cfg.Session.Secret == "" || len(cfg.Session.Secret) >= 32, "session.secret (SESSION_SECRET) must be at least 32 characters")
+	check(cfg.Session.AccessTokenTTL > 0, "session.access_token_ttl must be positive")
+	check(cfg.Session.RefreshTokenTTL > cfg.Session.AccessTokenTTL, "session.refresh_token_ttl must be longer than session.access_token_ttl")
+	check(cfg.MFA.Issuer != "" && !strings.Contains(cfg.MFA.Issuer, ":"), "mfa.issuer must be set and must not contain ':'")
+	check(cfg.Password.MinLength >= 8 && cfg.Password.MinLength <= 72, "password.min_length must be between 8 and 72")
+	if cfg.Password.BreachedList != "" {
+		_, err := os.Stat(cfg.Password.BreachedList)
+		check(err == nil, "password.breached_list: %v", err)
+	}
+	check(cfg.Lockout.Window > 0, "lockout.window must be positive")
+	check(cfg.Lockout.FreeAttempts >= 0, "lockout.free_attempts must not be negative")
+	check(cfg.Lockout.BaseDelay > 0 && cfg.Lockout.MaxDelay >= cfg.Lockout.BaseDelay, "lockout.base_delay must be positive and at most lockout.max_delay")
+	check(cfg.Lockout.MaxAccountFailures >= 0 && cfg.Lockout.MaxIPFailures >= 0, "lockout.max_account_failures and lockout.max_ip_failures must not be negative")
+	check(cfg.Lockout.Duration > 0, "lockout.duration must be positive")
+	check(cfg.Events.StreamMaxLen > 0, "events.stream_max_len must be positive")
+	// consumer groups read the global stream, which is otherwise never written
+	check(len(cfg.Events.ConsumerGroups) == 0 || cfg.Events.StreamGlobal, "events.consumer_groups need events.stream_global")
+	switch cfg.Mail.Driver {
+	case "ses", "smtp":
+		check(cfg.Mail.From != "", "mail.from (MAIL_FROM) must be set for the %s driver", cfg.Mail.Driver)
+		check(cfg.Mail.Driver != "smtp" || cfg.Mail.SMTPAddr != "", "mail.smtp_addr must be set for the smtp driver")
+	case "file":
+		check(cfg.Mail.OutboxDir != "", "mail.outbox_dir must be set for the file driver")
+	case "memory":
+	default:
+		check(false, "mail.driver: unknown driver %q", cfg.Mail.Driver)
+	}
+	check(cfg.Mail.DefaultLocale != "", "mail.default_locale must be set")
+	switch cfg.Tracing.Exporter {
+	case "", "none", "otlp", "stdout":
+	default:
+		check(false, "tracing.exporter: unknown exporter %q", cfg.Tracing.Exporter)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// LogLevel is the parsed Log.Level; Validate has already rejected bad ones.
+func (cfg *Config) LogLevel() log.Level {
+	level, err := log.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		return log.InfoLevel
+	}
+	return level
+}
+
+// Print writes the configuration as YAML with secrets redacted.
+func (cfg *Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(redacted(cfg)); err != nil {
+		return err
+	}
+	return enc.Close()
+}
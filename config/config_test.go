@@ -0,0 +1,125 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+server:
+  addr: ":9000"
+database:
+  url: "root:secret@tcp(db:3306)/clone"
+worker:
+  concurrency: 4
+rate_limit:
+  requests: 50
+  window: 30s
+tasks:
+  copy_bucket_timeout: 2h
+`)
+	t.Setenv("WORKER_CONCURRENCY", "8")
+	t.Setenv("AWS_EMAIL", "noreply@example.com")
+	t.Setenv("EVENT_STREAM_GLOBAL", "true")
+	t.Setenv("EVENT_STREAM_GROUPS", "audit, search")
+
+	cfg, err := Load("server", []string{"-config", path, "-addr", ":9100"})
+	require.NoError(t, err)
+	require.Equal(t, ":9100", cfg.Server.Addr, "flag beats file")
+	require.Equal(t, 8, cfg.Worker.Concurrency, "env beats file")
+	require.Equal(t, 50, cfg.RateLimit.Requests)
+	require.Equal(t, 30*time.Second, cfg.RateLimit.Window)
+	require.Equal(t, 2*time.Hour, cfg.Tasks.CopyBucketTimeout)
+	require.Equal(t, 10*time.Minute, cfg.Tasks.EmptyBucketTimeout, "default kept")
+	require.Equal(t, "./storage", cfg.Storage.Root)
+	require.Equal(t, []string{"audit", "search"}, cfg.Events.ConsumerGroups)
+	require.Equal(t, "noreply@example.com", cfg.Mail.From, "older variable still read")
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeFile(t, "config.toml", `
+[database]
+url = "dsn"
+
+[storage]
+root = "/data/objects"
+
+[log]
+level = "warn"
+
+[mail]
+driver = "smtp"
+from = "noreply@example.com"
+smtp_addr = "mail:587"
+`)
+	cfg, err := Load("worker", []string{"-config", path})
+	require.NoError(t, err)
+	require.Equal(t, "/data/objects", cfg.Storage.Root)
+	require.Equal(t, "noreply@example.com", cfg.Mail.From)
+	require.Equal(t, log.WarnLevel, cfg.LogLevel())
+}
+
+func TestLoadRejectsInvalidValues(t *testing.T) {
+	t.Setenv("DATABASE_URL", "dsn")
+
+	path := writeFile(t, "config.yaml", "worker:\n  concurrency: 0\nlog:\n  level: loud\nverification:\n  mode: strict\nevents:\n  consumer_groups: [indexer]\n")
+	_, err := Load("worker", []string{"-config", path})
+	require.ErrorContains(t, err, "worker.concurrency must be positive")
+	require.ErrorContains(t, err, `unknown level "loud"`)
+	require.ErrorContains(t, err, `verification.mode: unknown mode "strict"`)
+	require.ErrorContains(t, err, "events.consumer_groups need events.stream_global")
+
+	// unknown keys are typos, not ignored
+	path = writeFile(t, "config.yaml", "server:\n  adress: \":80\"\n")
+	_, err = Load("server", []string{"-config", path})
+	require.Error(t, err)
+
+	t.Setenv("MAIL_DRIVER", "smtp")
+	_, err = Load("server", nil)
+	require.ErrorContains(t, err, "mail.from (MAIL_FROM) must be set")
+	require.ErrorContains(t, err, "mail.smtp_addr must be set")
+	t.Setenv("MAIL_DRIVER", "file")
+
+	t.Setenv("RATE_LIMIT_WINDOW", "a minute")
+	_, err = Load("server", nil)
+	require.ErrorContains(t, err, "RATE_LIMIT_WINDOW")
+
+	t.Setenv("RATE_LIMIT_WINDOW", "")
+	t.Setenv("DATABASE_URL", "")
+	_, err = Load("server", nil)
+	require.ErrorContains(t, err, "DATABASE_URL")
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	t.Setenv("DATABASE_URL", "root:hunter2@tcp(db:3306)/clone")
+	t.Setenv("MAIL_DRIVER", "smtp")
+	t.Setenv("MAIL_FROM", "noreply@example.com")
+	t.Setenv("SMTP_ADDR", "mail:587")
+	t.Setenv("SMTP_PASSWORD", "mailpass")
+	cfg, err := Load("server", []string{"-print-config"})
+	require.NoError(t, err)
+	require.True(t, cfg.PrintOnly)
+
+	var out bytes.Buffer
+	require.NoError(t, cfg.Print(&out))
+	require.NotContains(t, out.String(), "hunter2")
+	require.NotContains(t, out.String(), "mailpass")
+	require.Contains(t, out.String(), "url: REDACTED")
+	require.Contains(t, out.String(), "shutdown_timeout: 30s")
+	// the loaded configuration itself is untouched
+	require.Equal(t, "root:hunter2@tcp(db:3306)/clone", cfg.Database.URL)
+}
@@ -1,8 +1,9 @@
 package db
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -18,67 +19,267 @@ type User struct {
 	PasswordHash string `gorm:"type:varchar(255);not null"`
 	IsVerified   bool   `gorm:"default:false"`
 	// //For tests remove sqllite does not support enum UserRole string `gorm:"type:varchar(16);default:'user';not null"`
-	UserRole  string    `gorm:"type:enum('user','admin');default:'user';not null"`
-	CreatedAt time.Time `gorm:"autoCreateTime"`
-	Buckets   []Bucket  `gorm:"foreignKey:UserID"`
+	UserRole string `gorm:"type:enum('user','admin');default:'user';not null"`
+	// Disabled accounts are rejected by every authenticated route
+	Disabled  bool `gorm:"default:false"`
+	RateLimit *int `gorm:"default:null"` // requests per minute, nil uses the server default
+	// account quotas; nil uses the default plan
+	MaxStorageBytes *int64 `gorm:"default:null"`
+	MaxBuckets      *int   `gorm:"default:null"`
+	MaxObjects      *int64 `gorm:"default:null"`
+	MaxObjectSize   *int64 `gorm:"default:null"`
+	// TOTP second factor: the secret is set at enrollment and MFAEnabled
+	// once a first code confirmed it. MFALastStep is the time step of the
+	// last accepted code, which cannot be used again.
+	MFASecret   string `gorm:"type:varchar(64)"`
+	MFAEnabled  bool   `gorm:"default:false"`
+	MFALastStep int64  `gorm:"default:0"`
+	// set when the user deleted their account; the worker removes it
+	DeletionRequestedAt *time.Time `gorm:"default:null"`
+	CreatedAt           time.Time  `gorm:"autoCreateTime"`
+	Buckets             []Bucket   `gorm:"foreignKey:UserID"`
 }
 
 type Bucket struct {
-	ID         string     `gorm:"primaryKey;type:varchar(36)"`
-	BucketName string     `gorm:"unique;type:varchar(64);not null"`
-	UserID     string     `gorm:"type:varchar(36);not null;index"`
-	Region     string     `gorm:"type:enum('USA','TR','CHINA','JP');not null"`                   //For tests remove sqllite does not support enum
-	ACL        *string    `gorm:"type:enum('private','public-read');default:'private';not null"` //For tests remove sqllite does not support enum
-	Versioning bool       `gorm:"default:false"`
-	Quota      *int64     `gorm:"default:null"` // bytes, optional
-	CreatedAt  time.Time  `gorm:"autoCreateTime"`
-	UpdatedAt  *time.Time `gorm:"autoUpdateTime"`
+	ID         string  `gorm:"primaryKey;type:varchar(36)"`
+	BucketName string  `gorm:"unique;type:varchar(64);not null"`
+	UserID     string  `gorm:"type:varchar(36);not null;index"`
+	Region     string  `gorm:"type:enum('USA','TR','CHINA','JP');not null"`                   //For tests remove sqllite does not support enum
+	ACL        *string `gorm:"type:enum('private','public-read');default:'private';not null"` //For tests remove sqllite does not support enum
+	Versioning bool    `gorm:"default:false"`
+	Quota      *int64  `gorm:"default:null"` // bytes, optional
+	// Object Lock, versioned buckets only. Once enabled it stays on; the
+	// default retention applies to every new version when LockMode is set.
+	ObjectLockEnabled bool   `gorm:"default:false"`
+	LockMode          string `gorm:"type:varchar(16)"` // GOVERNANCE or COMPLIANCE
+	LockDays          int    `gorm:"default:0"`
+	// Server access logging: records of requests to this bucket are written
+	// as objects under LoggingTargetPrefix in LoggingTargetBucket.
+	LoggingTargetBucket string `gorm:"type:varchar(64)"`
+	LoggingTargetPrefix string `gorm:"type:varchar(255)"`
+	// MFA delete, versioned buckets only: deleting a version, which is
+	// always permanent here, needs a TOTP code of the owner
+	MFADelete bool       `gorm:"default:false"`
+	CreatedAt time.Time  `gorm:"autoCreateTime"`
+	UpdatedAt *time.Time `gorm:"autoUpdateTime"`
 
 	Files []File `gorm:"foreignKey:BucketID;constraint:OnDelete:CASCADE"`
 }
 
 type File struct {
-	ID          string     `gorm:"primaryKey;type:varchar(36)"`
-	BucketID    string     `gorm:"type:varchar(36);not null;index:idx_bucket_file"`
-	FileName    string     `gorm:"type:varchar(255);not null;index:idx_bucket_file"`
-	Size        int64      `gorm:"not null"`
-	ContentType string     `gorm:"type:varchar(128)"`
-	VersionID   string     `gorm:"type:varchar(36);default:null;index"` // for versioning
-	IsLatest    bool       `gorm:"default:true"`                        // marks latest version
-	CreatedAt   time.Time  `gorm:"autoCreateTime;index:idx_bucket_created"`
-	UpdatedAt   *time.Time `gorm:"autoUpdateTime"`
+	ID          string `gorm:"primaryKey;type:varchar(36)"`
+	BucketID    string `gorm:"type:varchar(36);not null;index:idx_bucket_file"`
+	FileName    string `gorm:"type:varchar(255);not null;index:idx_bucket_file"`
+	Size        int64  `gorm:"not null"`
+	ContentType string `gorm:"type:varchar(128)"`
+	Checksum    string `gorm:"type:varchar(64)"`                    // hex sha256 of the stored blob
+	VersionID   string `gorm:"type:varchar(36);default:null;index"` // for versioning
+	IsLatest    bool   `gorm:"default:true"`                        // marks latest version
+	// PENDING, COMPLETED or FAILED on source objects, REPLICA on copies
+	// written by replication; empty when no replication rule applies
+	ReplicationStatus string `gorm:"type:varchar(16)"`
+	// all classes share the same local storage; the class only drives metering
+	StorageClass string `gorm:"type:varchar(32);default:'STANDARD'"`
+	// Object Lock state of this version
+	RetentionMode string     `gorm:"type:varchar(16)"` // GOVERNANCE or COMPLIANCE
+	RetainUntil   *time.Time `gorm:"default:null"`
+	LegalHold     bool       `gorm:"default:false"`
+	CreatedAt     time.Time  `gorm:"autoCreateTime;index:idx_bucket_created"`
+	UpdatedAt     *time.Time `gorm:"autoUpdateTime"`
 
 	Bucket Bucket `gorm:"foreignKey:BucketID;constraint:OnDelete:CASCADE"`
 }
 
 type EmailVerification struct {
-	ID        string    `gorm:"primaryKey;type:varchar(36)"`
-	UserID    string    `gorm:"type:varchar(36);not null"`
+	ID     string `gorm:"primaryKey;type:varchar(36)"`
+	UserID string `gorm:"type:varchar(36);not null"`
+	// the address being verified; it replaces the user's email once
+	// verified when they asked to change it
+	Email     string    `gorm:"type:varchar(254)"`
 	Token     string    `gorm:"unique;type:varchar(64);not null"`
 	ExpiresAt time.Time `gorm:"not null"`
 	CreatedAt time.Time `gorm:"autoCreateTime"`
 }
 
+// PasswordResetToken lets a user who forgot their password set a new one.
+// Only the SHA-256 of the token is stored; all of a user's tokens are
+// removed once one is used or the password changes.
+type PasswordResetToken struct {
+	ID        string    `gorm:"primaryKey;type:varchar(36)"`
+	UserID    string    `gorm:"type:varchar(36);not null;index"`
+	TokenHash string    `gorm:"unique;type:varchar(64);not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// Session is a console login. It lives as long as its refresh token, whose
+// SHA-256 is stored and replaced on every refresh; deleting the row logs
+// the session out.
+type Session struct {
+	ID               string    `gorm:"primaryKey;type:varchar(36)"`
+	UserID           string    `gorm:"type:varchar(36);not null;index"`
+	RefreshTokenHash string    `gorm:"unique;type:varchar(64);not null"`
+	UserAgent        string    `gorm:"type:varchar(255)"`
+	IP               string    `gorm:"type:varchar(45)"`
+	ExpiresAt        time.Time `gorm:"not null"`
+	LastUsedAt       time.Time
+	CreatedAt        time.Time `gorm:"autoCreateTime"`
+}
+
+// MFARecoveryCode is a single-use code that stands in for a TOTP code when
+// the authenticator is lost. Only its SHA-256 is stored.
+type MFARecoveryCode struct {
+	ID        string    `gorm:"primaryKey;type:varchar(36)"`
+	UserID    string    `gorm:"type:varchar(36);not null;index"`
+	CodeHash  string    `gorm:"unique;type:varchar(64);not null"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
 type Task struct {
-	ID         string     `gorm:"primaryKey;type:varchar(36)"`
-	UserID     string     `gorm:"type:varchar(36);not null"`
-	Type       string     `gorm:"type:enum('copy','empty');not null"` //For tests remove sqllite does not support enum
-	BucketSrc  *string    `gorm:"type:varchar(64)"`
-	BucketDest *string    `gorm:"type:varchar(64)"`
-	Status     string     `gorm:"type:enum('running','completed','failed');default:'running'"` //For tests remove sqllite does not support enum
-	Progress   int        `gorm:"default:0"`
-	Message    string     `gorm:"type:varchar(255)"`
-	CreatedAt  time.Time  `gorm:"autoCreateTime"`
-	UpdatedAt  *time.Time `gorm:"autoUpdateTime"`
+	ID         string  `gorm:"primaryKey;type:varchar(36)"`
+	UserID     string  `gorm:"type:varchar(36);not null"`
+	Type       string  `gorm:"type:enum('copy','empty','sync');not null"` //For tests remove sqllite does not support enum
+	BucketSrc  *string `gorm:"type:varchar(64)"`
+	BucketDest *string `gorm:"type:varchar(64)"`
+	Status     string  `gorm:"type:enum('queued','running','retrying','completed','failed','cancelled');default:'queued'"` //For tests remove sqllite does not support enum
+	Progress   int     `gorm:"default:0"`
+	Message    string  `gorm:"type:varchar(255)"`
+	Params     *string `gorm:"type:text"` // JSON task options, needed to rebuild the task on retry
+	Result     *string `gorm:"type:text"` // JSON summary written when the task finishes
+	// resume point of copy tasks: the last source file of the last finished batch
+	CheckpointKey    string     `gorm:"type:varchar(255)"`
+	CheckpointFileID string     `gorm:"type:varchar(36)"`
+	RetryCount       int        `gorm:"default:0"`
+	StartedAt        *time.Time `gorm:"default:null"`
+	FinishedAt       *time.Time `gorm:"default:null"`
+	CreatedAt        time.Time  `gorm:"autoCreateTime"`
+	UpdatedAt        *time.Time `gorm:"autoUpdateTime"`
+}
+
+// BucketNotification sends the bucket's object events to a webhook. Events
+// is a comma separated list of event names or patterns like
+// "s3:ObjectCreated:*".
+type BucketNotification struct {
+	ID        string    `gorm:"primaryKey;type:varchar(36)"`
+	BucketID  string    `gorm:"type:varchar(36);not null;index"`
+	URL       string    `gorm:"type:varchar(2048);not null"`
+	Events    string    `gorm:"type:varchar(512);not null"`
+	Prefix    string    `gorm:"type:varchar(255)"`
+	Suffix    string    `gorm:"type:varchar(255)"`
+	Secret    string    `gorm:"type:varchar(128);not null"` // HMAC key for the signature header
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+func (n *BucketNotification) EventList() []string {
+	if n.Events == "" {
+		return nil
+	}
+	return strings.Split(n.Events, ",")
+}
+
+// NotificationDeadLetter keeps a webhook delivery that ran out of retries, so
+// the event is not lost and can be inspected or replayed.
+type NotificationDeadLetter struct {
+	ID             string    `gorm:"primaryKey;type:varchar(36)"`
+	NotificationID string    `gorm:"type:varchar(36);not null;index"`
+	BucketID       string    `gorm:"type:varchar(36);not null;index"`
+	URL            string    `gorm:"type:varchar(2048);not null"`
+	EventName      string    `gorm:"type:varchar(64);not null"`
+	Payload        string    `gorm:"type:text;not null"`
+	Attempts       int       `gorm:"not null"`
+	LastError      string    `gorm:"type:varchar(255)"`
+	CreatedAt      time.Time `gorm:"autoCreateTime"`
+}
+
+const (
+	ReplicationPending   = "PENDING"
+	ReplicationCompleted = "COMPLETED"
+	ReplicationFailed    = "FAILED"
+	ReplicationReplica   = "REPLICA"
+)
+
+// ReplicationRule copies new objects of a bucket, optionally only those under
+// Prefix, to DestBucket. With Endpoint empty DestBucket is a bucket of the
+// same owner on this server; otherwise it lives on the remote server at
+// Endpoint, which is called with the given key pair.
+type ReplicationRule struct {
+	ID               string    `gorm:"primaryKey;type:varchar(36)"`
+	BucketID         string    `gorm:"type:varchar(36);not null;index"`
+	DestBucket       string    `gorm:"type:varchar(64);not null"`
+	Endpoint         string    `gorm:"type:varchar(2048)"`
+	AccessKey        string    `gorm:"type:varchar(128)"`
+	SecretKey        string    `gorm:"type:varchar(128)"`
+	Prefix           string    `gorm:"type:varchar(255)"`
+	ReplicateDeletes bool      `gorm:"default:false"`
+	CreatedAt        time.Time `gorm:"autoCreateTime"`
 }
 
+// Applies reports whether the rule replicates a write of key or, with
+// isDelete set, a delete of it.
+func (r *ReplicationRule) Applies(key string, isDelete bool) bool {
+	return strings.HasPrefix(key, r.Prefix) && (!isDelete || r.ReplicateDeletes)
+}
+
+const (
+	StorageClassStandard   = "STANDARD"
+	StorageClassStandardIA = "STANDARD_IA"
+	StorageClassGlacier    = "GLACIER"
+)
+
+// UsageRequestHourly counts a user's requests and transferred bytes per
+// operation and hour.
+type UsageRequestHourly struct {
+	UserID    string    `gorm:"primaryKey;type:varchar(36)"`
+	Hour      time.Time `gorm:"primaryKey"`
+	Operation string    `gorm:"primaryKey;type:varchar(32)"`
+	Requests  int64     `gorm:"not null;default:0"`
+	BytesIn   int64     `gorm:"not null;default:0"`
+	BytesOut  int64     `gorm:"not null;default:0"`
+}
+
+// UsageStorageHourly is what a bucket stored in one storage class, as last
+// measured during the hour. BucketName is kept so the row still reads after
+// the bucket is deleted.
+type UsageStorageHourly struct {
+	BucketID     string    `gorm:"primaryKey;type:varchar(36)"`
+	StorageClass string    `gorm:"primaryKey;type:varchar(32)"`
+	Hour         time.Time `gorm:"primaryKey"`
+	UserID       string    `gorm:"type:varchar(36);not null;index:idx_usage_storage_user_hour"`
+	BucketName   string    `gorm:"type:varchar(64);not null"`
+	Bytes        int64     `gorm:"not null;default:0"`
+	Objects      int64     `gorm:"not null;default:0"`
+}
+
+// AuditEvent is one entry of the append-only audit log of management
+// actions. Before and After hold, as JSON, only the fields the action
+// changed. Each entry's Hash covers its content and the previous entry's
+// Hash, so editing or removing an entry breaks the chain after it.
+type AuditEvent struct {
+	ID         uint64    `gorm:"primaryKey;autoIncrement"`
+	ActorID    string    `gorm:"type:varchar(36);index"`
+	AccessKey  string    `gorm:"type:varchar(32)"`
+	IP         string    `gorm:"type:varchar(64)"`
+	Action     string    `gorm:"type:varchar(64);not null;index"`
+	TargetType string    `gorm:"type:varchar(32);not null"`
+	Target     string    `gorm:"type:varchar(255);index"`
+	Before     *string   `gorm:"type:text"`
+	After      *string   `gorm:"type:text"`
+	PrevHash   string    `gorm:"type:varchar(64)"`
+	Hash       string    `gorm:"type:varchar(64);not null"`
+	CreatedAt  time.Time `gorm:"not null;index"`
+}
+
+var ErrAuditImmutable = errors.New("audit events cannot be changed or deleted")
+
+func (*AuditEvent) BeforeUpdate(*gorm.DB) error { return ErrAuditImmutable }
+func (*AuditEvent) BeforeDelete(*gorm.DB) error { return ErrAuditImmutable }
+
 var DB *gorm.DB
 
-func ConnectDb() error {
-	dsn := os.Getenv("DATABASE_URL")
+// ConnectDb opens the MySQL database at dsn into DB and migrates it.
+func ConnectDb(dsn string) error {
 	if dsn == "" {
-		log.Error("DATABASE_URL environment variable is not set")
-		return fmt.Errorf("DATABASE_URL not set")
+		return fmt.Errorf("database URL not set")
 	}
 
 	var err error
@@ -95,7 +296,16 @@ func ConnectDb() error {
 		&Bucket{},
 		&File{},
 		&EmailVerification{},
+		&PasswordResetToken{},
+		&Session{},
+		&MFARecoveryCode{},
 		&Task{},
+		&BucketNotification{},
+		&NotificationDeadLetter{},
+		&ReplicationRule{},
+		&UsageRequestHourly{},
+		&UsageStorageHourly{},
+		&AuditEvent{},
 	)
 	if err != nil {
 		log.WithError(err).Error("Failed to auto-migrate tables")
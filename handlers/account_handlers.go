@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
+	"github.com/SysTechSalihY/mini-s3-clone/auth"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/mail"
+	"github.com/SysTechSalihY/mini-s3-clone/quota"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// GetAccount reports the caller's quotas next to what they currently use.
+// A limit of 0 means unlimited.
+func GetAccount(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+
+		usage, err := quota.UsageOf(DB, user.ID)
+		if err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to read account usage")
+			return apierror.Send(c, apierror.InternalError, "failed to read account usage")
+		}
+		return c.JSON(fiber.Map{
+			"userID":     user.ID,
+			"email":      user.Email,
+			"mfaEnabled": user.MFAEnabled,
+			"limits":     quota.For(user),
+			"usage":      usage,
+		})
+	}
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type ChangeEmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+	MFACode  string `json:"mfaCode,omitempty"`
+}
+
+// EmailChangedData is what the email_changed templates render.
+type EmailChangedData struct {
+	Email    string
+	NewEmail string
+}
+
+// passwordMatches reports whether password is the user's.
+func passwordMatches(user *db.User, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
+}
+
+// ChangePassword replaces the caller's password after checking the current
+// one.
+func ChangePassword(DB *gorm.DB, passwords *auth.PasswordPolicy) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		var req ChangePasswordRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if err := passwords.Check(req.NewPassword); err != nil {
+			return apierror.Send(c, apierror.InvalidArgument, err.Error())
+		}
+		if !passwordMatches(user, req.CurrentPassword) {
+			return apierror.Send(c, apierror.AccessDenied, "current password is incorrect")
+		}
+
+		// the session changing the password stays logged in
+		keep := ""
+		if session, ok := c.Locals("session").(*db.Session); ok && session != nil {
+			keep = session.ID
+		}
+		if err := setPassword(DB, user, req.NewPassword, keep); err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to change password")
+			return apierror.Send(c, apierror.InternalError, "failed to change password")
+		}
+		audit.Record(DB, c, user, audit.Event{Action: "user.change_password", TargetType: "user", Target: user.ID})
+
+		return c.JSON(fiber.Map{"message": "password changed"})
+	}
+}
+
+// ChangeEmail sends a verification link to a new address, at most once per
+// resendInterval. The account keeps its current address until the link is
+// opened, and the current address is told about the change.
+func ChangeEmail(DB *gorm.DB, mailer *mail.Queue, appUrl string, resendInterval time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		var req ChangeEmailRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		req.Email = strings.TrimSpace(req.Email)
+		if addr, err := netmail.ParseAddress(req.Email); err != nil || addr.Address != req.Email {
+			return apierror.Send(c, apierror.InvalidArgument, "invalid email address")
+		}
+		if strings.EqualFold(req.Email, user.Email) {
+			return apierror.Send(c, apierror.InvalidArgument, "email is unchanged")
+		}
+		if !passwordMatches(user, req.Password) {
+			return apierror.Send(c, apierror.AccessDenied, "current password is incorrect")
+		}
+		var taken int64
+		if err := DB.Model(&db.User{}).Where("email = ?", req.Email).Count(&taken).Error; err != nil {
+			return apierror.Send(c, apierror.InternalError, "database error")
+		}
+		if taken > 0 {
+			return apierror.Send(c, apierror.EmailAlreadyExists, "email already exists")
+		}
+		if throttled, err := resendThrottled(c, DB, user, resendInterval); throttled {
+			return err
+		}
+
+		if err := sendVerification(c, DB, mailer, appUrl, user, req.Email); err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to send verification email")
+			return apierror.Send(c, apierror.InternalError, "failed to send verification email")
+		}
+		data := EmailChangedData{Email: user.Email, NewEmail: req.Email}
+		if err := mailer.Send(c.UserContext(), user.Email, "email_changed", c.Get(fiber.HeaderAcceptLanguage), data); err != nil {
+			// the change still needs the new address verified, so carry on
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Warn("Failed to notify old email address")
+		}
+
+		return c.Status(202).JSON(fiber.Map{"message": "verification email sent to the new address"})
+	}
+}
+
+// retainedObjects explains why userID's objects cannot all be deleted yet:
+// some are under legal hold, or retained until the date in the returned
+// message, the last retention to expire. It returns "" when nothing is
+// locked.
+func retainedObjects(DB *gorm.DB, userID string) (string, error) {
+	files := DB.Model(&db.File{}).Where("bucket_id IN (?)", DB.Model(&db.Bucket{}).Select("id").Where("user_id = ?", userID))
+	var held int64
+	if err := files.Session(&gorm.Session{}).Where("legal_hold = ?", true).Count(&held).Error; err != nil {
+		return "", err
+	}
+	if held > 0 {
+		return fmt.Sprintf("%d objects are under legal hold; release them before deleting the account", held), nil
+	}
+	var latest db.File
+	err := files.Session(&gorm.Session{}).Where("retention_mode <> '' AND retain_until > ?", time.Now()).
+		Order("retain_until desc").First(&latest).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return "objects are retained by object lock until " + latest.RetainUntil.UTC().Format(time.RFC3339) + "; delete the account after that", nil
+}
+
+// enqueueAccountDeletion schedules the deletion of userID. A deletion already
+// queued counts as scheduled, but one asynq archived after it kept failing
+// is replaced so the account is not stuck disabled.
+func enqueueAccountDeletion(ctx context.Context, client *asynq.Client, inspector *asynq.Inspector, userID string) error {
+	task, err := tasks.NewDeleteAccountTask(ctx, userID)
+	if err != nil {
+		return err
+	}
+	_, err = client.EnqueueContext(ctx, task)
+	if !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return err
+	}
+	taskID := tasks.DeleteAccountTaskID(userID)
+	info, err := inspector.GetTaskInfo(tasks.QueueDefault, taskID)
+	switch {
+	case errors.Is(err, asynq.ErrTaskNotFound):
+		// it finished in the meantime
+	case err != nil:
+		return err
+	case info.State == asynq.TaskStateArchived:
+		if err := inspector.DeleteTask(tasks.QueueDefault, taskID); err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+			return err
+		}
+	default:
+		return nil
+	}
+	_, err = client.EnqueueContext(ctx, task)
+	return err
+}
+
+// DeleteAccount disables the caller's account at once and schedules the
+// deletion of their buckets, objects and the account itself on the worker.
+// It is refused while objects under Object Lock would hold the deletion up.
+func DeleteAccount(client *asynq.Client, inspector *asynq.Inspector, DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		var req DeleteAccountRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if !passwordMatches(user, req.Password) {
+			return apierror.Send(c, apierror.AccessDenied, "current password is incorrect")
+		}
+		if ok, err := requireMFA(c, DB, user, req.MFACode); !ok {
+			return err
+		}
+
+		retained, err := retainedObjects(DB, user.ID)
+		if err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to check retained objects")
+			return apierror.Send(c, apierror.InternalError, "failed to delete account")
+		}
+		if retained != "" {
+			return apierror.Send(c, apierror.ObjectLocked, retained)
+		}
+
+		now := time.Now()
+		if err := DB.Model(user).Updates(map[string]interface{}{"disabled": true, "deletion_requested_at": now}).Error; err != nil {
+			return apierror.Send(c, apierror.InternalError, "failed to delete account")
+		}
+		if err := enqueueAccountDeletion(c.UserContext(), client, inspector, user.ID); err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to enqueue account deletion")
+			DB.Model(user).Updates(map[string]interface{}{"disabled": false, "deletion_requested_at": nil})
+			return apierror.Send(c, apierror.InternalError, "failed to delete account")
+		}
+		audit.Record(DB, c, user, audit.Event{
+			Action:     "user.delete",
+			TargetType: "user",
+			Target:     user.ID,
+			After:      fiber.Map{"deletionRequestedAt": now},
+		})
+
+		return c.Status(202).JSON(fiber.Map{"message": "account scheduled for deletion"})
+	}
+}
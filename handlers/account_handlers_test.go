@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/auth"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/mail"
+	"github.com/SysTechSalihY/mini-s3-clone/middleware"
+	"github.com/SysTechSalihY/mini-s3-clone/quota"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAccountQuotas(t *testing.T) {
+	DB := setupTestDB(t)
+	maxBuckets, maxSize, maxStorage := 1, int64(8), int64(10)
+	user := db.User{ID: "user-1", Email: "quota@example.com", AccessKey: "ak-1",
+		MaxBuckets: &maxBuckets, MaxObjectSize: &maxSize, MaxStorageBytes: &maxStorage}
+	require.NoError(t, DB.Create(&user).Error)
+	defer os.RemoveAll("./storage")
+
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &user)
+		return c.Next()
+	})
+	app.Post("/api/buckets", CreateBucket(DB))
+	app.Post("/api/buckets/:bucketName/files/:fileName", UploadFile(DB, nil))
+	app.Get("/api/account", GetAccount(DB))
+
+	createBucket := func(name string) int {
+		req := httptest.NewRequest("POST", "/api/buckets", strings.NewReader(`{"bucketName":"`+name+`","region":"USA"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	upload := func(name, content string) int {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		part, err := w.CreateFormFile("file", name)
+		require.NoError(t, err)
+		part.Write([]byte(content))
+		require.NoError(t, w.Close())
+		req := httptest.NewRequest("POST", "/api/buckets/quotabucket/files/"+name, &body)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	require.Equal(t, 201, createBucket("quotabucket"))
+	require.Equal(t, 403, createBucket("secondbucket"))
+
+	require.Equal(t, 413, upload("big.txt", "123456789"))
+	require.Equal(t, 201, upload("a.txt", "1234567"))
+	require.Equal(t, 403, upload("b.txt", "1234"))
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/account", nil))
+	require.NoError(t, err)
+	var out struct {
+		Limits struct {
+			MaxBuckets    int64 `json:"maxBuckets"`
+			MaxObjectSize int64 `json:"maxObjectSize"`
+		} `json:"limits"`
+		Usage struct {
+			StoredBytes int64 `json:"storedBytes"`
+			Buckets     int64 `json:"buckets"`
+			Objects     int64 `json:"objects"`
+		} `json:"usage"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	require.Equal(t, int64(1), out.Limits.MaxBuckets)
+	require.Equal(t, int64(8), out.Limits.MaxObjectSize)
+	require.Equal(t, int64(7), out.Usage.StoredBytes)
+	require.Equal(t, int64(1), out.Usage.Buckets)
+	require.Equal(t, int64(1), out.Usage.Objects)
+}
+
+func accountApp(user *db.User) *fiber.App {
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", user)
+		return c.Next()
+	})
+	return app
+}
+
+func sendJSON(t *testing.T, app *fiber.App, method, path string, body interface{}) int {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, 5000)
+	require.NoError(t, err)
+	return resp.StatusCode
+}
+
+func TestChangePassword(t *testing.T) {
+	DB := setupTestDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("old-password"), bcrypt.DefaultCost)
+	user := db.User{ID: uuid.NewString(), Email: "change@example.com", PasswordHash: string(hash), AccessKey: "ak-change"}
+	require.NoError(t, DB.Create(&user).Error)
+	require.NoError(t, DB.Create(&db.PasswordResetToken{ID: uuid.NewString(), UserID: user.ID, TokenHash: auth.HashToken("pending"), ExpiresAt: time.Now().Add(time.Hour)}).Error)
+
+	app := accountApp(&user)
+	app.Put("/api/account/password", ChangePassword(DB, nil))
+
+	require.Equal(t, 403, sendJSON(t, app, "PUT", "/api/account/password", ChangePasswordRequest{CurrentPassword: "wrong", NewPassword: "new-password"}))
+	require.Equal(t, 400, sendJSON(t, app, "PUT", "/api/account/password", ChangePasswordRequest{CurrentPassword: "old-password", NewPassword: "short"}))
+	require.Equal(t, 200, sendJSON(t, app, "PUT", "/api/account/password", ChangePasswordRequest{CurrentPassword: "old-password", NewPassword: "new-password"}))
+
+	var updated db.User
+	require.NoError(t, DB.First(&updated, "id = ?", user.ID).Error)
+	require.NoError(t, bcrypt.CompareHashAndPassword([]byte(updated.PasswordHash), []byte("new-password")))
+	var tokens int64
+	DB.Model(&db.PasswordResetToken{}).Where("user_id = ?", user.ID).Count(&tokens)
+	require.Zero(t, tokens, "a password change invalidates reset links")
+}
+
+func TestChangeEmailNeedsVerification(t *testing.T) {
+	DB := setupTestDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password1"), bcrypt.DefaultCost)
+	user := db.User{ID: uuid.NewString(), Email: "old@example.com", PasswordHash: string(hash), AccessKey: "ak-email", IsVerified: true}
+	require.NoError(t, DB.Create(&user).Error)
+	require.NoError(t, DB.Create(&db.User{ID: uuid.NewString(), Email: "taken@example.com", AccessKey: "ak-taken"}).Error)
+
+	templates, err := mail.LoadTemplates("", "en")
+	require.NoError(t, err)
+	outbox := &mail.Memory{}
+	app := accountApp(&user)
+	app.Put("/api/account/email", ChangeEmail(DB, &mail.Queue{Templates: templates, Direct: outbox}, "https://s3.example.com", 0))
+	app.Get("/verify-email", VerifyEmail(DB))
+
+	require.Equal(t, 400, sendJSON(t, app, "PUT", "/api/account/email", ChangeEmailRequest{Email: "not an address", Password: "password1"}))
+	require.Equal(t, 403, sendJSON(t, app, "PUT", "/api/account/email", ChangeEmailRequest{Email: "new@example.com", Password: "wrong"}))
+	require.Equal(t, 409, sendJSON(t, app, "PUT", "/api/account/email", ChangeEmailRequest{Email: "taken@example.com", Password: "password1"}))
+	require.Equal(t, 202, sendJSON(t, app, "PUT", "/api/account/email", ChangeEmailRequest{Email: "new@example.com", Password: "password1"}))
+
+	sent := outbox.Sent()
+	require.Len(t, sent, 2)
+	require.Equal(t, "new@example.com", sent[0].To)
+	require.Equal(t, "old@example.com", sent[1].To)
+	require.Contains(t, sent[1].Text, "new@example.com")
+
+	var unchanged db.User
+	require.NoError(t, DB.First(&unchanged, "id = ?", user.ID).Error)
+	require.Equal(t, "old@example.com", unchanged.Email, "the address changes only once verified")
+
+	var verification db.EmailVerification
+	require.NoError(t, DB.Where("user_id = ? AND email = ?", user.ID, "new@example.com").First(&verification).Error)
+	resp, err := app.Test(httptest.NewRequest("GET", "/verify-email?token="+verification.Token, nil))
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	var changed db.User
+	require.NoError(t, DB.First(&changed, "id = ?", user.ID).Error)
+	require.Equal(t, "new@example.com", changed.Email)
+	require.True(t, changed.IsVerified)
+}
+
+func TestDeleteAccountRollsBackWhenEnqueueFails(t *testing.T) {
+	DB := setupTestDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password1"), bcrypt.DefaultCost)
+	user := db.User{ID: uuid.NewString(), Email: "delete@example.com", PasswordHash: string(hash), AccessKey: "ak-delete"}
+	require.NoError(t, DB.Create(&user).Error)
+
+	// nothing listens there, so every enqueue fails
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond})
+	defer client.Close()
+	app := accountApp(&user)
+	app.Delete("/api/account", DeleteAccount(client, nil, DB))
+
+	require.Equal(t, 403, sendJSON(t, app, "DELETE", "/api/account", DeleteAccountRequest{Password: "wrong"}))
+	require.Equal(t, 500, sendJSON(t, app, "DELETE", "/api/account", DeleteAccountRequest{Password: "password1"}))
+
+	var stored db.User
+	require.NoError(t, DB.First(&stored, "id = ?", user.ID).Error)
+	require.False(t, stored.Disabled)
+	require.Nil(t, stored.DeletionRequestedAt)
+}
+
+func TestDeleteAccountRefusedWhileObjectsLocked(t *testing.T) {
+	DB := setupTestDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password1"), bcrypt.DefaultCost)
+	user := db.User{ID: uuid.NewString(), Email: "locked@example.com", PasswordHash: string(hash), AccessKey: "ak-locked"}
+	require.NoError(t, DB.Create(&user).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-1", BucketName: "lockedbucket", UserID: user.ID, ObjectLockEnabled: true}).Error)
+	soon, later := time.Now().Add(time.Hour), time.Now().Add(30*24*time.Hour)
+	require.NoError(t, DB.Create(&db.File{ID: "file-1", BucketID: "bucket-1", FileName: "a.txt", RetentionMode: "GOVERNANCE", RetainUntil: &soon}).Error)
+	require.NoError(t, DB.Create(&db.File{ID: "file-2", BucketID: "bucket-1", FileName: "b.txt", RetentionMode: "COMPLIANCE", RetainUntil: &later}).Error)
+	require.NoError(t, DB.Create(&db.File{ID: "file-3", BucketID: "bucket-1", FileName: "c.txt", LegalHold: true}).Error)
+
+	// the enqueue would fail, but the request is refused before it
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond})
+	defer client.Close()
+	app := accountApp(&user)
+	app.Delete("/api/account", DeleteAccount(client, nil, DB))
+	deleteAccount := func() (int, string) {
+		body, _ := json.Marshal(DeleteAccountRequest{Password: "password1"})
+		req := httptest.NewRequest("DELETE", "/api/account", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		var out map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+		require.Equal(t, "ObjectLocked", out["code"])
+		return resp.StatusCode, out["error"].(string)
+	}
+
+	status, msg := deleteAccount()
+	require.Equal(t, 403, status)
+	require.Contains(t, msg, "legal hold")
+
+	require.NoError(t, DB.Model(&db.File{}).Where("id = ?", "file-3").Update("legal_hold", false).Error)
+	status, msg = deleteAccount()
+	require.Equal(t, 403, status)
+	require.Contains(t, msg, later.UTC().Format(time.RFC3339), "the last retention to expire")
+
+	var stored db.User
+	require.NoError(t, DB.First(&stored, "id = ?", user.ID).Error)
+	require.False(t, stored.Disabled)
+	require.Nil(t, stored.DeletionRequestedAt)
+}
+
+func TestUnverifiedAccounts(t *testing.T) {
+	DB := setupTestDB(t)
+	user := db.User{ID: uuid.NewString(), Email: "unverified@example.com", AccessKey: "ak-unverified"}
+	require.NoError(t, DB.Create(&user).Error)
+	defer os.RemoveAll("./storage")
+	quota.SetSandbox(&quota.Limits{MaxBuckets: 1})
+	defer quota.SetSandbox(nil)
+
+	app := accountApp(&user)
+	app.Use(middleware.RequireVerified("/api/account"))
+	app.Post("/api/buckets", CreateBucket(DB))
+	app.Get("/api/account", GetAccount(DB))
+	app.Delete("/api/account", func(c *fiber.Ctx) error { return c.SendStatus(202) })
+	request := func(app *fiber.App, method, path, body string) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		var out map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&out)
+		code, _ := out["code"].(string)
+		return resp.StatusCode, code
+	}
+
+	status, code := request(app, "POST", "/api/buckets", `{"bucketName":"sandboxbucket","region":"USA"}`)
+	require.Equal(t, 403, status)
+	require.Equal(t, "EmailNotVerified", code, "writes are blocked")
+	status, _ = request(app, "GET", "/api/account", "")
+	require.Equal(t, 200, status, "reads stay open")
+	status, _ = request(app, "DELETE", "/api/account", "")
+	require.Equal(t, 202, status, "exempt paths stay open")
+
+	// without the middleware the sandbox quota applies instead
+	sandbox := accountApp(&user)
+	sandbox.Post("/api/buckets", CreateBucket(DB))
+	status, _ = request(sandbox, "POST", "/api/buckets", `{"bucketName":"sandboxbucket","region":"USA"}`)
+	require.Equal(t, 201, status)
+	status, code = request(sandbox, "POST", "/api/buckets", `{"bucketName":"secondbucket","region":"USA"}`)
+	require.Equal(t, 403, status)
+	require.Equal(t, "EmailNotVerified", code)
+
+	user.IsVerified = true
+	status, _ = request(sandbox, "POST", "/api/buckets", `{"bucketName":"secondbucket","region":"USA"}`)
+	require.Equal(t, 201, status)
+}
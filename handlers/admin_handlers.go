@@ -0,0 +1,476 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
+	"github.com/SysTechSalihY/mini-s3-clone/auth"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/mfa"
+	"github.com/SysTechSalihY/mini-s3-clone/quota"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Admin API. Every route here sits behind middleware.RequireAdmin.
+
+// UserLimitsRequest changes only the limits it names. For each, 0 removes
+// the user's override so the server default or default plan applies.
+type UserLimitsRequest struct {
+	RateLimit       *int   `json:"rateLimit"` // requests per minute
+	MaxStorageBytes *int64 `json:"maxStorageBytes"`
+	MaxBuckets      *int   `json:"maxBuckets"`
+	MaxObjects      *int64 `json:"maxObjects"`
+	MaxObjectSize   *int64 `json:"maxObjectSize"`
+}
+
+type TransferBucketRequest struct {
+	UserID string `json:"userID"`
+}
+
+// adminUserView is a user without its password hash and secret key.
+func adminUserView(u *db.User) fiber.Map {
+	return fiber.Map{
+		"id":         u.ID,
+		"email":      u.Email,
+		"accessKey":  u.AccessKey,
+		"role":       u.UserRole,
+		"isVerified": u.IsVerified,
+		"disabled":   u.Disabled,
+		"mfaEnabled": u.MFAEnabled,
+		"rateLimit":  u.RateLimit,
+		"limits":     quota.For(u),
+		"createdAt":  u.CreatedAt,
+	}
+}
+
+// userLimitsAudit is the limits of a user as recorded in the audit log, with
+// 0 for a rate limit left to the server default.
+func userLimitsAudit(u *db.User) fiber.Map {
+	limits := quota.For(u)
+	rateLimit := 0
+	if u.RateLimit != nil {
+		rateLimit = *u.RateLimit
+	}
+	return fiber.Map{
+		"rateLimit":       rateLimit,
+		"maxStorageBytes": limits.MaxStorageBytes,
+		"maxBuckets":      limits.MaxBuckets,
+		"maxObjects":      limits.MaxObjects,
+		"maxObjectSize":   limits.MaxObjectSize,
+	}
+}
+
+func intPtr64(v *int) *int64 {
+	if v == nil {
+		return nil
+	}
+	n := int64(*v)
+	return &n
+}
+
+func findUser(c *fiber.Ctx, DB *gorm.DB) (*db.User, error) {
+	var user db.User
+	if err := DB.First(&user, "id = ?", c.Params("userID")).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apierror.Send(c, apierror.NoSuchUser, "user not found")
+		}
+		requestid.Log(c).WithError(err).Error("Database error while fetching user")
+		return nil, apierror.Send(c, apierror.InternalError, "database error")
+	}
+	return &user, nil
+}
+
+// AdminListUsers lists users, optionally filtered by an email substring (?q=)
+// and ?disabled=true|false.
+func AdminListUsers(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		page, limit, err := parsePagination(c)
+		if err != nil {
+			return apierror.Send(c, apierror.InvalidArgument, err.Error())
+		}
+
+		query := DB.Model(&db.User{})
+		if q := strings.TrimSpace(c.Query("q")); q != "" {
+			query = query.Where("email LIKE ?", "%"+q+"%")
+		}
+		switch c.Query("disabled") {
+		case "":
+		case "true":
+			query = query.Where("disabled = ?", true)
+		case "false":
+			query = query.Where("disabled = ?", false)
+		default:
+			return apierror.Send(c, apierror.InvalidArgument, "disabled must be true or false")
+		}
+
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			requestid.Log(c).WithError(err).Error("Failed to count users")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch users")
+		}
+		var users []db.User
+		if err := query.Order("created_at desc").
+			Offset((page - 1) * limit).
+			Limit(limit).
+			Find(&users).Error; err != nil {
+			requestid.Log(c).WithError(err).Error("Failed to fetch users")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch users")
+		}
+
+		views := make([]fiber.Map, 0, len(users))
+		for i := range users {
+			views = append(views, adminUserView(&users[i]))
+		}
+		return c.JSON(fiber.Map{
+			"users": views,
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		})
+	}
+}
+
+func AdminGetUser(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, err := findUser(c, DB)
+		if user == nil {
+			return err
+		}
+		return c.JSON(fiber.Map{"user": adminUserView(user)})
+	}
+}
+
+// AdminSetUserDisabled disables or enables an account. Admins cannot disable
+// themselves, so there is always someone left to undo it.
+func AdminSetUserDisabled(DB *gorm.DB, disabled bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, err := findUser(c, DB)
+		if user == nil {
+			return err
+		}
+		admin := c.Locals("user").(*db.User)
+		if disabled && user.ID == admin.ID {
+			return apierror.Send(c, apierror.InvalidArgument, "cannot disable your own account")
+		}
+
+		was := user.Disabled
+		if err := DB.Model(user).Update("disabled", disabled).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to update account status")
+			return apierror.Send(c, apierror.InternalError, "failed to update user")
+		}
+		action := "user.enable"
+		if disabled {
+			action = "user.disable"
+		}
+		audit.Record(DB, c, admin, audit.Event{
+			Action:     action,
+			TargetType: "user",
+			Target:     user.ID,
+			Before:     fiber.Map{"disabled": was},
+			After:      fiber.Map{"disabled": disabled},
+		})
+		requestid.Log(c).WithFields(log.Fields{
+			"user_id":  user.ID,
+			"admin_id": admin.ID,
+			"disabled": disabled,
+		}).Info("Account status changed")
+		return c.JSON(fiber.Map{"user": adminUserView(user)})
+	}
+}
+
+// AdminRotateUserKeys replaces a user's key pair. The old keys stop working
+// at once and the new secret is not returned; the user fetches it through
+// /api/auth/secret-key with their password.
+func AdminRotateUserKeys(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, err := findUser(c, DB)
+		if user == nil {
+			return err
+		}
+
+		accessKey, secretKey, err := auth.GenerateKeys()
+		if err != nil {
+			return apierror.Send(c, apierror.InternalError, "failed to generate keys")
+		}
+		oldAccessKey := user.AccessKey
+		if err := DB.Model(user).Updates(map[string]interface{}{
+			"access_key": accessKey,
+			"secret_key": secretKey,
+		}).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to rotate keys")
+			return apierror.Send(c, apierror.InternalError, "failed to update keys")
+		}
+		audit.Record(DB, c, nil, audit.Event{
+			Action:     "user.rotate_keys",
+			TargetType: "user",
+			Target:     user.ID,
+			Before:     fiber.Map{"accessKey": oldAccessKey},
+			After:      fiber.Map{"accessKey": accessKey},
+		})
+		requestid.Log(c).WithFields(log.Fields{
+			"user_id":  user.ID,
+			"admin_id": c.Locals("user").(*db.User).ID,
+		}).Info("Access keys rotated by admin")
+		return c.JSON(fiber.Map{"message": "keys rotated", "user": adminUserView(user)})
+	}
+}
+
+// AdminResetUserMFA turns MFA off for a user who lost both their
+// authenticator and their recovery codes, so they can enroll again.
+func AdminResetUserMFA(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, err := findUser(c, DB)
+		if user == nil {
+			return err
+		}
+
+		was := user.MFAEnabled
+		if err := mfa.Disable(DB, user.ID); err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to reset MFA")
+			return apierror.Send(c, apierror.InternalError, "failed to reset MFA")
+		}
+		user.MFAEnabled = false
+		audit.Record(DB, c, nil, audit.Event{
+			Action:     "user.reset_mfa",
+			TargetType: "user",
+			Target:     user.ID,
+			Before:     fiber.Map{"mfaEnabled": was},
+			After:      fiber.Map{"mfaEnabled": false},
+		})
+		requestid.Log(c).WithFields(log.Fields{
+			"user_id":  user.ID,
+			"admin_id": c.Locals("user").(*db.User).ID,
+		}).Info("MFA reset by admin")
+		return c.JSON(fiber.Map{"message": "MFA reset", "user": adminUserView(user)})
+	}
+}
+
+func AdminUpdateUserLimits(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, err := findUser(c, DB)
+		if user == nil {
+			return err
+		}
+
+		var req UserLimitsRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		fields := map[string]interface{}{}
+		for column, value := range map[string]*int64{
+			"rate_limit":        intPtr64(req.RateLimit),
+			"max_storage_bytes": req.MaxStorageBytes,
+			"max_buckets":       intPtr64(req.MaxBuckets),
+			"max_objects":       req.MaxObjects,
+			"max_object_size":   req.MaxObjectSize,
+		} {
+			switch {
+			case value == nil:
+			case *value < 0:
+				return apierror.Send(c, apierror.InvalidArgument, "limits must not be negative")
+			case *value == 0:
+				fields[column] = nil
+			default:
+				fields[column] = *value
+			}
+		}
+		if len(fields) == 0 {
+			return apierror.Send(c, apierror.InvalidArgument, "no limits given")
+		}
+
+		before := userLimitsAudit(user)
+		if err := DB.Model(user).Updates(fields).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to update user limits")
+			return apierror.Send(c, apierror.InternalError, "failed to update user")
+		}
+		if err := DB.First(user, "id = ?", user.ID).Error; err != nil {
+			return apierror.Send(c, apierror.InternalError, "database error")
+		}
+		audit.Record(DB, c, nil, audit.Event{
+			Action:     "user.update_limits",
+			TargetType: "user",
+			Target:     user.ID,
+			Before:     before,
+			After:      userLimitsAudit(user),
+		})
+		requestid.Log(c).WithFields(log.Fields{"user_id": user.ID, "limits": fields}).Info("User limits updated")
+		return c.JSON(fiber.Map{"user": adminUserView(user)})
+	}
+}
+
+type bucketUsage struct {
+	BucketID    string
+	ObjectCount int64
+	TotalSize   int64
+}
+
+// AdminListBuckets lists buckets of all users (or of ?userID=) with their
+// object count and stored bytes.
+func AdminListBuckets(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		page, limit, err := parsePagination(c)
+		if err != nil {
+			return apierror.Send(c, apierror.InvalidArgument, err.Error())
+		}
+
+		query := DB.Model(&db.Bucket{})
+		if userID := c.Query("userID"); userID != "" {
+			query = query.Where("user_id = ?", userID)
+		}
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			requestid.Log(c).WithError(err).Error("Failed to count buckets")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch buckets")
+		}
+		var buckets []db.Bucket
+		if err := query.Order("bucket_name").
+			Offset((page - 1) * limit).
+			Limit(limit).
+			Find(&buckets).Error; err != nil {
+			requestid.Log(c).WithError(err).Error("Failed to fetch buckets")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch buckets")
+		}
+
+		ids := make([]string, 0, len(buckets))
+		for _, b := range buckets {
+			ids = append(ids, b.ID)
+		}
+		usage := map[string]bucketUsage{}
+		if len(ids) > 0 {
+			var rows []bucketUsage
+			if err := DB.Model(&db.File{}).
+				Select("bucket_id, COUNT(*) AS object_count, COALESCE(SUM(size),0) AS total_size").
+				Where("bucket_id IN ?", ids).
+				Group("bucket_id").
+				Scan(&rows).Error; err != nil {
+				requestid.Log(c).WithError(err).Error("Failed to calculate bucket usage")
+				return apierror.Send(c, apierror.InternalError, "failed to calculate bucket usage")
+			}
+			for _, r := range rows {
+				usage[r.BucketID] = r
+			}
+		}
+
+		views := make([]fiber.Map, 0, len(buckets))
+		for _, b := range buckets {
+			views = append(views, fiber.Map{
+				"id":          b.ID,
+				"bucketName":  b.BucketName,
+				"userID":      b.UserID,
+				"region":      b.Region,
+				"acl":         b.ACL,
+				"versioning":  b.Versioning,
+				"objectCount": usage[b.ID].ObjectCount,
+				"totalSize":   usage[b.ID].TotalSize,
+				"createdAt":   b.CreatedAt,
+			})
+		}
+		return c.JSON(fiber.Map{
+			"buckets": views,
+			"page":    page,
+			"limit":   limit,
+			"total":   total,
+		})
+	}
+}
+
+// AdminTransferBucket hands a bucket and everything in it to another user.
+func AdminTransferBucket(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		var req TransferBucketRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil || req.UserID == "" {
+			return apierror.Send(c, apierror.InvalidArgument, "userID is required")
+		}
+
+		var bucket db.Bucket
+		if err := DB.Where("bucket_name = ?", c.Params("bucketName")).First(&bucket).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.Send(c, apierror.NoSuchBucket, "bucket not found")
+			}
+			return apierror.Send(c, apierror.InternalError, "database error")
+		}
+		var newOwner db.User
+		if err := DB.First(&newOwner, "id = ?", req.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.Send(c, apierror.NoSuchUser, "user not found")
+			}
+			return apierror.Send(c, apierror.InternalError, "database error")
+		}
+
+		previous := bucket.UserID
+		if err := DB.Model(&bucket).Update("user_id", newOwner.ID).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to transfer bucket")
+			return apierror.Send(c, apierror.InternalError, "failed to transfer bucket")
+		}
+		audit.Record(DB, c, nil, audit.Event{
+			Action:     "bucket.transfer",
+			TargetType: "bucket",
+			Target:     bucket.BucketName,
+			Before:     fiber.Map{"owner": previous},
+			After:      fiber.Map{"owner": newOwner.ID},
+		})
+		requestid.Log(c).WithFields(log.Fields{
+			"bucket":   bucket.BucketName,
+			"from":     previous,
+			"to":       newOwner.ID,
+			"admin_id": c.Locals("user").(*db.User).ID,
+		}).Info("Bucket ownership transferred")
+		return c.JSON(fiber.Map{
+			"message":       "bucket transferred",
+			"bucket":        bucket.BucketName,
+			"previousOwner": previous,
+			"owner":         newOwner.ID,
+		})
+	}
+}
+
+// AdminQueueStats reports the asynq queues: sizes per task state, the day's
+// processed and failed counts and how long the oldest pending task waited.
+func AdminQueueStats(inspector *asynq.Inspector) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		queues, err := inspector.Queues()
+		if err != nil {
+			requestid.Log(c).WithError(err).Error("Failed to list queues")
+			return apierror.Send(c, apierror.InternalError, "failed to read queue stats")
+		}
+
+		stats := make([]fiber.Map, 0, len(queues))
+		for _, q := range queues {
+			info, err := inspector.GetQueueInfo(q)
+			if err != nil {
+				requestid.Log(c).WithError(err).WithField("queue", q).Error("Failed to read queue info")
+				return apierror.Send(c, apierror.InternalError, "failed to read queue stats")
+			}
+			stats = append(stats, fiber.Map{
+				"queue":          info.Queue,
+				"size":           info.Size,
+				"pending":        info.Pending,
+				"active":         info.Active,
+				"scheduled":      info.Scheduled,
+				"retry":          info.Retry,
+				"archived":       info.Archived,
+				"completed":      info.Completed,
+				"processedToday": info.Processed,
+				"failedToday":    info.Failed,
+				"paused":         info.Paused,
+				"latencySeconds": info.Latency.Seconds(),
+			})
+		}
+		return c.JSON(fiber.Map{"queues": stats})
+	}
+}
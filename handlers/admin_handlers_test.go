@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminAPI(t *testing.T) {
+	DB := setupTestDB(t)
+
+	admin := db.User{ID: "admin-1", Email: "root@example.com", AccessKey: "ak-admin", SecretKey: "sk-admin", UserRole: "admin"}
+	alice := db.User{ID: "user-1", Email: "alice@example.com", AccessKey: "ak-alice", SecretKey: "sk-alice", UserRole: "user"}
+	bob := db.User{ID: "user-2", Email: "bob@example.com", AccessKey: "ak-bob", SecretKey: "sk-bob", UserRole: "user"}
+	for _, u := range []*db.User{&admin, &alice, &bob} {
+		require.NoError(t, DB.Create(u).Error)
+	}
+	acl := "private"
+	bucket := db.Bucket{ID: "bucket-1", BucketName: "alicebucket", UserID: alice.ID, Region: "USA", ACL: &acl}
+	require.NoError(t, DB.Create(&bucket).Error)
+	require.NoError(t, DB.Create(&db.File{ID: "file-1", BucketID: bucket.ID, FileName: "a.txt", Size: 7}).Error)
+	require.NoError(t, DB.Create(&db.File{ID: "file-2", BucketID: bucket.ID, FileName: "b.txt", Size: 5}).Error)
+
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		switch c.Get("X-User") {
+		case admin.ID:
+			c.Locals("user", &admin)
+		case alice.ID:
+			c.Locals("user", &alice)
+		}
+		return c.Next()
+	})
+	group := app.Group("/api/admin", middleware.RequireAdmin())
+	group.Get("/users", AdminListUsers(DB))
+	group.Post("/users/:userID/disable", AdminSetUserDisabled(DB, true))
+	group.Post("/users/:userID/rotate-keys", AdminRotateUserKeys(DB))
+	group.Patch("/users/:userID/limits", AdminUpdateUserLimits(DB))
+	group.Get("/buckets", AdminListBuckets(DB))
+	group.Put("/buckets/:bucketName/owner", AdminTransferBucket(DB))
+
+	do := func(method, path, userID, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-User", userID)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		var out map[string]interface{}
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	status, _ := do("GET", "/api/admin/users", alice.ID, "")
+	require.Equal(t, 403, status)
+
+	status, out := do("GET", "/api/admin/users?q=alice", admin.ID, "")
+	require.Equal(t, 200, status)
+	require.Equal(t, float64(1), out["total"])
+	users := out["users"].([]interface{})
+	require.Equal(t, "alice@example.com", users[0].(map[string]interface{})["email"])
+	require.NotContains(t, users[0], "secretKey")
+
+	status, _ = do("POST", "/api/admin/users/admin-1/disable", admin.ID, "")
+	require.Equal(t, 400, status)
+	status, _ = do("POST", "/api/admin/users/user-2/disable", admin.ID, "")
+	require.Equal(t, 200, status)
+	reload := func(id string) db.User {
+		var u db.User
+		require.NoError(t, DB.First(&u, "id = ?", id).Error)
+		return u
+	}
+	require.True(t, reload(bob.ID).Disabled)
+
+	status, _ = do("POST", "/api/admin/users/user-1/rotate-keys", admin.ID, "")
+	require.Equal(t, 200, status)
+	rotated := reload(alice.ID)
+	require.NotEqual(t, alice.AccessKey, rotated.AccessKey)
+	require.NotEqual(t, alice.SecretKey, rotated.SecretKey)
+
+	status, _ = do("PATCH", "/api/admin/users/user-1/limits", admin.ID, `{"rateLimit": 100}`)
+	require.Equal(t, 200, status)
+	require.Equal(t, 100, *reload(alice.ID).RateLimit)
+	status, _ = do("PATCH", "/api/admin/users/user-1/limits", admin.ID, `{"rateLimit": 0}`)
+	require.Equal(t, 200, status)
+	require.Nil(t, reload(alice.ID).RateLimit)
+
+	status, out = do("GET", "/api/admin/buckets", admin.ID, "")
+	require.Equal(t, 200, status)
+	listed := out["buckets"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, float64(2), listed["objectCount"])
+	require.Equal(t, float64(12), listed["totalSize"])
+
+	status, _ = do("PUT", "/api/admin/buckets/alicebucket/owner", admin.ID, `{"userID": "missing"}`)
+	require.Equal(t, 404, status)
+	status, _ = do("PUT", "/api/admin/buckets/alicebucket/owner", admin.ID, `{"userID": "user-2"}`)
+	require.Equal(t, 200, status)
+	var moved db.Bucket
+	require.NoError(t, DB.First(&moved, "id = ?", bucket.ID).Error)
+	require.Equal(t, bob.ID, moved.UserID)
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditTrail(t *testing.T) {
+	DB := setupTestDB(t)
+	user := db.User{ID: "user-1", Email: "audit@example.com", AccessKey: "ak-1", UserRole: "admin"}
+	require.NoError(t, DB.Create(&user).Error)
+	defer os.RemoveAll("./storage")
+
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &user)
+		return c.Next()
+	})
+	app.Post("/api/buckets", CreateBucket(DB))
+	app.Delete("/api/buckets/:bucketName", DeleteBucket(DB))
+	app.Post("/api/presigned/url/download", CreateDownloadPresignedURL(DB))
+	app.Get("/api/admin/audit", AdminListAuditEvents(DB))
+
+	send := func(method, target, body string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	require.Equal(t, 201, send("POST", "/api/buckets", `{"bucketName":"auditbucket","region":"USA","acl":"public-read"}`))
+	require.Equal(t, 200, send("POST", "/api/presigned/url/download?bucket=auditbucket&key=a.txt&duration=60", ""))
+	require.Equal(t, 200, send("DELETE", "/api/buckets/auditbucket", ""))
+
+	list := func(query string) []map[string]interface{} {
+		resp, err := app.Test(httptest.NewRequest("GET", "/api/admin/audit"+query, nil))
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		var body struct {
+			Events []map[string]interface{} `json:"events"`
+			Total  int                      `json:"total"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		require.Equal(t, len(body.Events), body.Total)
+		return body.Events
+	}
+
+	events := list("")
+	require.Len(t, events, 3)
+	require.Equal(t, "bucket.delete", events[0]["action"])
+	require.Equal(t, "presigned_url.create", events[1]["action"])
+	require.Equal(t, "auditbucket/a.txt", events[1]["target"])
+	require.Equal(t, "bucket.create", events[2]["action"])
+	require.Equal(t, "user-1", events[2]["actorID"])
+	require.Equal(t, "ak-1", events[2]["accessKey"])
+	require.Equal(t, "public-read", events[2]["after"].(map[string]interface{})["acl"])
+
+	created := list("?action=bucket.create&target=auditbucket")
+	require.Len(t, created, 1)
+	require.Empty(t, list("?actor=someone-else"))
+	require.Equal(t, 400, send("GET", "/api/admin/audit?from=yesterday", ""))
+
+	checked, err := audit.Verify(DB)
+	require.NoError(t, err)
+	require.Equal(t, 3, checked)
+}
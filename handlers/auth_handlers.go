@@ -1,23 +1,26 @@
 package handlers
 
 import (
-	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"math"
 	"strings"
 	"time"
 
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
 	"github.com/SysTechSalihY/mini-s3-clone/auth"
 	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/lockout"
+	"github.com/SysTechSalihY/mini-s3-clone/mail"
+	"github.com/SysTechSalihY/mini-s3-clone/metrics"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	sesv2 "github.com/aws/aws-sdk-go-v2/service/sesv2"
-	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
 	"gorm.io/gorm"
 )
 
@@ -36,23 +39,28 @@ type SignUpResponse struct {
 type CreateAccessRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	MFACode  string `json:"mfaCode,omitempty"` // TOTP or recovery code, when MFA is enabled
 }
 
-func SignUp(DB *gorm.DB) fiber.Handler {
+func SignUp(DB *gorm.DB, passwords *auth.PasswordPolicy) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		var req SignUpRequest
 		if err := json.Unmarshal(c.Body(), &req); err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if err := passwords.Check(req.Password); err != nil {
+			return apierror.Send(c, apierror.InvalidArgument, err.Error())
 		}
 
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to hash password"})
+			return apierror.Send(c, apierror.InternalError, "failed to hash password")
 		}
 
 		accessKey, secretKey, err := auth.GenerateKeys()
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to generate keys"})
+			return apierror.Send(c, apierror.InternalError, "failed to generate keys")
 		}
 
 		user := db.User{
@@ -65,9 +73,9 @@ func SignUp(DB *gorm.DB) fiber.Handler {
 		}
 		if err := DB.Create(&user).Error; err != nil {
 			if strings.Contains(err.Error(), "Duplicate entry") {
-				return c.Status(400).JSON(fiber.Map{"error": "email already exists"})
+				return apierror.Send(c, apierror.EmailAlreadyExists, "email already exists")
 			}
-			return c.Status(500).JSON(fiber.Map{"error": "failed to create user"})
+			return apierror.Send(c, apierror.InternalError, "failed to create user")
 		}
 
 		resp := SignUpResponse{
@@ -80,65 +88,88 @@ func SignUp(DB *gorm.DB) fiber.Handler {
 	}
 }
 
-func CreateVerificationLink(DB *gorm.DB, sesClient *sesv2.Client, senderEmail string, appUrl string) fiber.Handler {
+// VerifyEmailData is what the verify_email templates render.
+type VerifyEmailData struct {
+	Email string
+	Link  string
+}
+
+// newToken returns a random token for links sent by email.
+func newToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tokenBytes), nil
+}
+
+// sendVerification emails a verification link for email to the user. When
+// email is not the user's current address, verifying it makes it theirs.
+func sendVerification(c *fiber.Ctx, DB *gorm.DB, mailer *mail.Queue, appUrl string, user *db.User, email string) error {
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	verification := db.EmailVerification{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		Email:     email,
+		Token:     token,
+		ExpiresAt: time.Now().Add(24 * time.Hour),
+	}
+	// only the latest link for an address works
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND email = ?", user.ID, email).Delete(&db.EmailVerification{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&verification).Error
+	})
+	if err != nil {
+		return err
+	}
+	data := VerifyEmailData{Email: email, Link: appUrl + "/verify-email?token=" + token}
+	return mailer.Send(c.UserContext(), email, "verify_email", c.Get(fiber.HeaderAcceptLanguage), data)
+}
+
+// resendThrottled answers 429 when the user was sent a verification email
+// less than interval ago, and reports whether it did.
+func resendThrottled(c *fiber.Ctx, DB *gorm.DB, user *db.User, interval time.Duration) (bool, error) {
+	var last db.EmailVerification
+	err := DB.Where("user_id = ?", user.ID).Order("created_at desc").First(&last).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return true, apierror.Send(c, apierror.InternalError, "database error")
+	}
+	wait := time.Until(last.CreatedAt.Add(interval))
+	if wait <= 0 {
+		return false, nil
+	}
+	return true, apierror.SendWith(c, apierror.SlowDown, "a verification email was sent recently", fiber.Map{
+		"retry_after": int(math.Ceil(wait.Seconds())),
+	})
+}
+
+// CreateVerificationLink (re)sends the verification email, at most once per
+// resendInterval.
+func CreateVerificationLink(DB *gorm.DB, mailer *mail.Queue, appUrl string, resendInterval time.Duration) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		var user *db.User
 		user, ok := c.Locals("user").(*db.User)
 		if !ok {
-			return c.Status(401).JSON(fiber.Map{"error": "User does not exist"})
+			return apierror.Send(c, apierror.Unauthenticated, "User does not exist")
 		}
-		tokenBytes := make([]byte, 32)
-		_, err := rand.Read(tokenBytes)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to generate token"})
+		if user.IsVerified {
+			return apierror.Send(c, apierror.InvalidArgument, "email already verified")
 		}
-		token := hex.EncodeToString(tokenBytes)
-		verification := db.EmailVerification{
-			ID:        uuid.New().String(),
-			UserID:    user.ID,
-			Token:     token,
-			ExpiresAt: time.Now().Add(24 * time.Hour),
-		}
-		if err := DB.Create(&verification).Error; err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to save verification token"})
-		}
-		link := appUrl + "/verify-email?token=" + token
-		input := &sesv2.SendEmailInput{
-			FromEmailAddress: aws.String(senderEmail),
-			ReplyToAddresses: []string{},
-			Destination: &types.Destination{
-				ToAddresses: []string{user.Email},
-			},
-			Content: &types.EmailContent{
-				Simple: &types.Message{
-					Subject: &types.Content{
-						Data: aws.String("Verify your email for AwesomeApp"),
-					},
-					Body: &types.Body{
-						Html: &types.Content{
-							Data: aws.String(fmt.Sprintf(`
-                        <html>
-                        <body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333;">
-                            <h2 style="color: #4CAF50;">Welcome to AwesomeApp!</h2>
-                            <p>Hi there,</p>
-                            <p>Thanks for signing up. Please verify your email by clicking the button below:</p>
-                            <a href="%s" style="display:inline-block; padding:10px 20px; margin:20px 0; 
-                               background-color:#4CAF50; color:white; text-decoration:none; border-radius:5px;">
-                               Verify Email
-                            </a>
-                            <p>If you did not sign up, you can ignore this email.</p>
-                            <hr/>
-                            <p style="font-size:12px; color:#888;">AwesomeApp Inc.</p>
-                        </body>
-                        </html>
-                    `, link)),
-						},
-					},
-				},
-			},
-		}
-		if _, err := sesClient.SendEmail(context.Background(), input); err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to send verification email"})
+		if throttled, err := resendThrottled(c, DB, user, resendInterval); throttled {
+			return err
+		}
+		if err := sendVerification(c, DB, mailer, appUrl, user, user.Email); err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to send verification email")
+			return apierror.Send(c, apierror.InternalError, "failed to send verification email")
 		}
 
 		return c.Status(201).JSON(fiber.Map{"message": "verification email sent"})
@@ -147,56 +178,176 @@ func CreateVerificationLink(DB *gorm.DB, sesClient *sesv2.Client, senderEmail st
 
 func VerifyEmail(DB *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		token := c.Query("token")
 		if token == "" {
-			return c.Status(400).JSON(fiber.Map{"error": "missing token"})
+			return apierror.Send(c, apierror.InvalidToken, "missing token")
 		}
+
 		var verification db.EmailVerification
 		if err := DB.Where("token = ?", token).First(&verification).Error; err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "invalid or expired token"})
+			return apierror.Send(c, apierror.InvalidToken, "invalid or expired token")
 		}
 
 		if time.Now().After(verification.ExpiresAt) {
-			return c.Status(400).JSON(fiber.Map{"error": "token expired"})
+			return apierror.Send(c, apierror.InvalidToken, "token expired")
 		}
-		if err := DB.Model(&db.User{}).Where("id = ?", verification.UserID).Update("is_verified", true).Error; err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to verify user"})
+
+		var user db.User
+		if err := DB.First(&user, "id = ?", verification.UserID).Error; err != nil {
+			return apierror.Send(c, apierror.InvalidToken, "invalid or expired token")
+		}
+		updates := map[string]interface{}{"is_verified": true}
+		changed := verification.Email != "" && verification.Email != user.Email
+		if changed {
+			var taken int64
+			DB.Model(&db.User{}).Where("email = ? AND id <> ?", verification.Email, user.ID).Count(&taken)
+			if taken > 0 {
+				return apierror.Send(c, apierror.EmailAlreadyExists, "email already exists")
+			}
+			updates["email"] = verification.Email
+		}
+		if err := DB.Model(&user).Updates(updates).Error; err != nil {
+			return apierror.Send(c, apierror.InternalError, "failed to verify user")
 		}
 		DB.Delete(&verification)
+		if changed {
+			audit.Record(DB, c, &user, audit.Event{
+				Action:     "user.change_email",
+				TargetType: "user",
+				Target:     user.ID,
+				Before:     fiber.Map{"email": user.Email},
+				After:      fiber.Map{"email": verification.Email},
+			})
+		}
 
 		return c.Status(200).JSON(fiber.Map{"message": "email verified successfully"})
 	}
 }
 
-func CreateSecretKey(DB *gorm.DB) fiber.Handler {
+// AccountLockedData is what the account_locked templates render.
+type AccountLockedData struct {
+	Email    string
+	IP       string
+	Failures int64
+	Until    string
+}
+
+// attemptAllowed refuses a password attempt for email while the account or
+// the client IP is locked out or has to wait after failed attempts. On
+// refusal the returned error is the already written response.
+func attemptAllowed(c *fiber.Ctx, guard *lockout.Guard, email string) (bool, error) {
+	verdict, err := guard.Check(c.UserContext(), email, c.IP())
+	if err != nil {
+		requestid.Log(c).WithError(err).Error("Failed to check login attempts")
+		return false, apierror.Send(c, apierror.InternalError, "login attempt tracking error")
+	}
+	if verdict.RetryAfter <= 0 {
+		return true, nil
+	}
+	retryAfter := fiber.Map{"retry_after": int(math.Ceil(verdict.RetryAfter.Seconds()))}
+	if verdict.Locked {
+		metrics.AuthFailures.WithLabelValues("login_locked").Inc()
+		return false, apierror.SendWith(c, apierror.AccountLocked, "too many failed attempts, try again later", retryAfter)
+	}
+	metrics.AuthFailures.WithLabelValues("login_throttled").Inc()
+	return false, apierror.SendWith(c, apierror.SlowDown, "too many failed attempts, slow down", retryAfter)
+}
+
+// attemptFailed records a failed password or MFA code for email and, when
+// that locks out user, tells them by email. user is nil for unknown
+// addresses, which are counted all the same.
+func attemptFailed(c *fiber.Ctx, guard *lockout.Guard, mailer *mail.Queue, email string, user *db.User) {
+	failures, locked, err := guard.Fail(c.UserContext(), email, c.IP())
+	if err != nil {
+		requestid.Log(c).WithError(err).Error("Failed to record failed login")
+		return
+	}
+	if !locked || user == nil {
+		return
+	}
+	requestid.Log(c).WithFields(log.Fields{
+		"user_id":  user.ID,
+		"failures": failures,
+	}).Warn("Account locked after failed logins")
+	data := AccountLockedData{
+		Email:    user.Email,
+		IP:       c.IP(),
+		Failures: failures,
+		Until:    time.Now().Add(guard.LockDuration()).UTC().Format(time.RFC1123),
+	}
+	if err := mailer.Send(c.UserContext(), user.Email, "account_locked", c.Get(fiber.HeaderAcceptLanguage), data); err != nil {
+		requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to send lockout email")
+	}
+}
+
+// attemptSucceeded forgets the failed attempts of email.
+func attemptSucceeded(c *fiber.Ctx, guard *lockout.Guard, email string) {
+	if err := guard.Succeed(c.UserContext(), email); err != nil {
+		requestid.Log(c).WithError(err).Error("Failed to reset failed logins")
+	}
+}
+
+// CreateSecretKey issues a new key pair for an email and password, and an
+// MFA code when the account has MFA. Failed attempts are slowed down and
+// eventually locked out by guard.
+func CreateSecretKey(DB *gorm.DB, guard *lockout.Guard, mailer *mail.Queue) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		var req CreateAccessRequest
 		if err := json.Unmarshal(c.Body(), &req); err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if ok, err := attemptAllowed(c, guard, req.Email); !ok {
+			return err
 		}
 
 		var user db.User
 		if err := DB.Where("email = ?", req.Email).First(&user).Error; err != nil {
 			if err == gorm.ErrRecordNotFound {
-				return c.Status(404).JSON(fiber.Map{"error": "user not found"})
+				metrics.AuthFailures.WithLabelValues("login_unknown_user").Inc()
+				attemptFailed(c, guard, mailer, req.Email, nil)
+				return apierror.Send(c, apierror.NoSuchUser, "user not found")
 			}
-			return c.Status(500).JSON(fiber.Map{"error": "database error"})
+			return apierror.Send(c, apierror.InternalError, "database error")
 		}
 
 		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-			return c.Status(401).JSON(fiber.Map{"error": "invalid credentials"})
+			metrics.AuthFailures.WithLabelValues("login_invalid_password").Inc()
+			attemptFailed(c, guard, mailer, req.Email, &user)
+			return apierror.Send(c, apierror.Unauthenticated, "invalid credentials")
+		}
+		if user.Disabled {
+			metrics.AuthFailures.WithLabelValues("account_disabled").Inc()
+			return apierror.Send(c, apierror.AccountDisabled, "account disabled")
+		}
+		if ok, err := requireMFA(c, DB, &user, req.MFACode); !ok {
+			// a wrong code counts like a wrong password; a missing one does not
+			if req.MFACode != "" {
+				attemptFailed(c, guard, mailer, req.Email, &user)
+			}
+			return err
 		}
+		attemptSucceeded(c, guard, req.Email)
 
 		accessKey, secretKey, err := auth.GenerateKeys()
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to generate keys"})
+			return apierror.Send(c, apierror.InternalError, "failed to generate keys")
 		}
 
+		actor := user
 		user.AccessKey = accessKey
 		user.SecretKey = secretKey
 		if err := DB.Save(&user).Error; err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to update keys"})
+			return apierror.Send(c, apierror.InternalError, "failed to update keys")
 		}
+		audit.Record(DB, c, &actor, audit.Event{
+			Action:     "user.rotate_keys",
+			TargetType: "user",
+			Target:     user.ID,
+			Before:     fiber.Map{"accessKey": actor.AccessKey},
+			After:      fiber.Map{"accessKey": accessKey},
+		})
 
 		return c.Status(200).JSON(fiber.Map{
 			"access_key": accessKey,
@@ -204,3 +355,131 @@ func CreateSecretKey(DB *gorm.DB) fiber.Handler {
 		})
 	}
 }
+
+// passwordResetTTL is how long a password reset link works.
+const passwordResetTTL = time.Hour
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ResetPasswordData is what the reset_password templates render.
+type ResetPasswordData struct {
+	Email string
+	Link  string
+}
+
+// RequestPasswordReset emails a reset link to the account with the given
+// address. It answers the same whether or not the account exists, so it
+// cannot be used to find registered addresses.
+func RequestPasswordReset(DB *gorm.DB, mailer *mail.Queue, appUrl string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		var req PasswordResetRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil || req.Email == "" {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		accepted := fiber.Map{"message": "if the account exists, a reset email has been sent"}
+
+		var user db.User
+		if err := DB.Where("email = ?", req.Email).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return c.Status(202).JSON(accepted)
+			}
+			return apierror.Send(c, apierror.InternalError, "database error")
+		}
+		if user.Disabled {
+			return c.Status(202).JSON(accepted)
+		}
+
+		token, err := newToken()
+		if err != nil {
+			return apierror.Send(c, apierror.InternalError, "failed to generate token")
+		}
+		reset := db.PasswordResetToken{
+			ID:        uuid.New().String(),
+			UserID:    user.ID,
+			TokenHash: auth.HashToken(token),
+			ExpiresAt: time.Now().Add(passwordResetTTL),
+		}
+		// only the latest link works
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("user_id = ?", user.ID).Delete(&db.PasswordResetToken{}).Error; err != nil {
+				return err
+			}
+			return tx.Create(&reset).Error
+		})
+		if err != nil {
+			return apierror.Send(c, apierror.InternalError, "failed to save reset token")
+		}
+
+		data := ResetPasswordData{Email: user.Email, Link: appUrl + "/reset-password?token=" + token}
+		if err := mailer.Send(c.UserContext(), user.Email, "reset_password", c.Get(fiber.HeaderAcceptLanguage), data); err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to send password reset email")
+			return apierror.Send(c, apierror.InternalError, "failed to send reset email")
+		}
+		return c.Status(202).JSON(accepted)
+	}
+}
+
+// ResetPassword sets a new password with a token from RequestPasswordReset.
+// Every reset token of the user stops working afterwards.
+func ResetPassword(DB *gorm.DB, passwords *auth.PasswordPolicy) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		var req ResetPasswordRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if req.Token == "" {
+			return apierror.Send(c, apierror.InvalidToken, "missing token")
+		}
+		if err := passwords.Check(req.Password); err != nil {
+			return apierror.Send(c, apierror.InvalidArgument, err.Error())
+		}
+
+		var reset db.PasswordResetToken
+		if err := DB.Where("token_hash = ?", auth.HashToken(req.Token)).First(&reset).Error; err != nil {
+			return apierror.Send(c, apierror.InvalidToken, "invalid or expired token")
+		}
+		if time.Now().After(reset.ExpiresAt) {
+			DB.Delete(&reset)
+			return apierror.Send(c, apierror.InvalidToken, "token expired")
+		}
+		var user db.User
+		if err := DB.First(&user, "id = ?", reset.UserID).Error; err != nil {
+			return apierror.Send(c, apierror.InvalidToken, "invalid or expired token")
+		}
+
+		if err := setPassword(DB, &user, req.Password, ""); err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to reset password")
+			return apierror.Send(c, apierror.InternalError, "failed to reset password")
+		}
+		audit.Record(DB, c, &user, audit.Event{Action: "user.reset_password", TargetType: "user", Target: user.ID})
+
+		return c.Status(200).JSON(fiber.Map{"message": "password reset successfully"})
+	}
+}
+
+// setPassword stores a new password for user, invalidates their reset
+// tokens and logs out every session but keepSession.
+func setPassword(DB *gorm.DB, user *db.User, password, keepSession string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("password_hash", string(hashed)).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&db.PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		return auth.RevokeAll(tx, user.ID, keepSession)
+	})
+}
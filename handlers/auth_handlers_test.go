@@ -5,10 +5,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/SysTechSalihY/mini-s3-clone/auth"
 	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/mail"
+	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/bcrypt"
@@ -17,7 +23,7 @@ import (
 func TestSignUp(t *testing.T) {
 	dbConn := setupTestDB(t)
 	app := setupFiber()
-	app.Post("/signup", SignUp(dbConn))
+	app.Post("/signup", SignUp(dbConn, nil))
 
 	body := SignUpRequest{
 		Email:    "test1@example.com",
@@ -36,12 +42,12 @@ func TestSignUp(t *testing.T) {
 func TestDuplicateSignUp(t *testing.T) {
 	dbConn := setupTestDB(t)
 	app := setupFiber()
-	app.Post("/signup", SignUp(dbConn))
+	app.Post("/signup", SignUp(dbConn, nil))
 
 	email := "dup1@example.com"
 
 	// first signup
-	body := SignUpRequest{Email: email, Password: "123456"}
+	body := SignUpRequest{Email: email, Password: "supersecret"}
 	jsonBody, _ := json.Marshal(body)
 	req := httptest.NewRequest("POST", "/signup", bytes.NewReader(jsonBody))
 	req.Header.Set("Content-Type", "application/json")
@@ -56,6 +62,29 @@ func TestDuplicateSignUp(t *testing.T) {
 	assert.Equal(t, 500, resp2.StatusCode)
 }
 
+func TestSignUpWeakPassword(t *testing.T) {
+	dbConn := setupTestDB(t)
+	list := filepath.Join(t.TempDir(), "breached.txt")
+	assert.NoError(t, os.WriteFile(list, []byte("qwertyuiop\n"), 0o600))
+	passwords, err := auth.LoadPasswordPolicy(10, list)
+	assert.NoError(t, err)
+	app := setupFiber()
+	app.Post("/signup", SignUp(dbConn, passwords))
+
+	for password, status := range map[string]int{
+		"short1234":            400,
+		"qwertyuiop":           400,
+		"correct horse staple": 201,
+	} {
+		jsonBody, _ := json.Marshal(SignUpRequest{Email: "weak@example.com", Password: password})
+		req := httptest.NewRequest("POST", "/signup", bytes.NewReader(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, status, resp.StatusCode, password)
+	}
+}
+
 func TestVerifyEmail(t *testing.T) {
 	dbConn := setupTestDB(t)
 
@@ -133,7 +162,7 @@ func TestCreateSecretKey(t *testing.T) {
 	dbConn.Create(&user)
 
 	app := setupFiber()
-	app.Post("/create-secret", CreateSecretKey(dbConn))
+	app.Post("/create-secret", CreateSecretKey(dbConn, nil, nil))
 
 	body := CreateAccessRequest{Email: user.Email, Password: password}
 	jsonBody, _ := json.Marshal(body)
@@ -145,3 +174,102 @@ func TestCreateSecretKey(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 200, resp.StatusCode)
 }
+
+func TestCreateVerificationLink(t *testing.T) {
+	dbConn := setupTestDB(t)
+	user := db.User{ID: uuid.NewString(), Email: "link1@example.com", PasswordHash: "hash", SecretKey: "sk4", AccessKey: "ak4"}
+	dbConn.Create(&user)
+
+	templates, err := mail.LoadTemplates("", "en")
+	assert.NoError(t, err)
+	outbox := &mail.Memory{}
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &user)
+		return c.Next()
+	})
+	app.Get("/verification-link", CreateVerificationLink(dbConn, &mail.Queue{Templates: templates, Direct: outbox}, "https://s3.example.com", time.Minute))
+
+	req := httptest.NewRequest("GET", "/verification-link", nil)
+	req.Header.Set("Accept-Language", "tr-TR,tr;q=0.9")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+
+	var verification db.EmailVerification
+	assert.NoError(t, dbConn.Where("user_id = ?", user.ID).First(&verification).Error)
+	sent := outbox.Sent()
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, user.Email, sent[0].To)
+		assert.Contains(t, sent[0].Subject, "doğrulayın")
+		assert.Contains(t, sent[0].Text, "https://s3.example.com/verify-email?token="+verification.Token)
+	}
+	// a second email within the resend interval is refused
+	resp, err = app.Test(httptest.NewRequest("GET", "/verification-link", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Len(t, outbox.Sent(), 1)
+
+	user.IsVerified = true
+	resp, err = app.Test(httptest.NewRequest("GET", "/verification-link", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestPasswordReset(t *testing.T) {
+	dbConn := setupTestDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("old-password"), bcrypt.DefaultCost)
+	user := db.User{ID: uuid.NewString(), Email: "reset@example.com", PasswordHash: string(hash), SecretKey: "sk5", AccessKey: "ak5"}
+	dbConn.Create(&user)
+
+	templates, err := mail.LoadTemplates("", "en")
+	assert.NoError(t, err)
+	outbox := &mail.Memory{}
+	app := setupFiber()
+	app.Post("/password-reset", RequestPasswordReset(dbConn, &mail.Queue{Templates: templates, Direct: outbox}, "https://s3.example.com"))
+	app.Post("/password-reset/confirm", ResetPassword(dbConn, nil))
+	post := func(path string, body interface{}) int {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", path, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	// unknown addresses look the same but send nothing
+	assert.Equal(t, 202, post("/password-reset", PasswordResetRequest{Email: "nobody@example.com"}))
+	assert.Empty(t, outbox.Sent())
+
+	assert.Equal(t, 202, post("/password-reset", PasswordResetRequest{Email: user.Email}))
+	assert.Equal(t, 202, post("/password-reset", PasswordResetRequest{Email: user.Email}))
+	sent := outbox.Sent()
+	if !assert.Len(t, sent, 2) {
+		return
+	}
+	tokenOf := func(msg mail.Message) string {
+		_, token, _ := strings.Cut(msg.Text, "reset-password?token=")
+		return strings.Fields(token)[0]
+	}
+	first, latest := tokenOf(sent[0]), tokenOf(sent[1])
+	var stored db.PasswordResetToken
+	assert.NoError(t, dbConn.Where("user_id = ?", user.ID).First(&stored).Error)
+	assert.Equal(t, auth.HashToken(latest), stored.TokenHash, "only a hash of the token is stored")
+
+	assert.Equal(t, 400, post("/password-reset/confirm", ResetPasswordRequest{Token: first, Password: "new-password"}), "older links stop working")
+	assert.Equal(t, 400, post("/password-reset/confirm", ResetPasswordRequest{Token: latest, Password: "short"}))
+	dbConn.Create(&db.Session{ID: uuid.NewString(), UserID: user.ID, RefreshTokenHash: "h", ExpiresAt: time.Now().Add(time.Hour)})
+	assert.Equal(t, 200, post("/password-reset/confirm", ResetPasswordRequest{Token: latest, Password: "new-password"}))
+	assert.Equal(t, 400, post("/password-reset/confirm", ResetPasswordRequest{Token: latest, Password: "other-password"}), "tokens work once")
+
+	var updated db.User
+	dbConn.First(&updated, "id = ?", user.ID)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(updated.PasswordHash), []byte("new-password")))
+	var sessions int64
+	dbConn.Model(&db.Session{}).Where("user_id = ?", user.ID).Count(&sessions)
+	assert.Zero(t, sessions, "a reset logs out every session")
+
+	// expired tokens are refused
+	dbConn.Create(&db.PasswordResetToken{ID: uuid.NewString(), UserID: user.ID, TokenHash: auth.HashToken("expired"), ExpiresAt: time.Now().Add(-time.Minute)})
+	assert.Equal(t, 400, post("/password-reset/confirm", ResetPasswordRequest{Token: "expired", Password: "new-password"}))
+}
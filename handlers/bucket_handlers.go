@@ -5,12 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
-	"time"
 
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
 	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/quota"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
 	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/SysTechSalihY/mini-s3-clone/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
@@ -24,6 +27,7 @@ type CreateBucketRequest struct {
 	ACL        *string `json:"acl,omitempty"`        // optional string
 	Versioning *bool   `json:"versioning,omitempty"` // optional bool
 	Quota      *int64  `json:"quota,omitempty"`      // optional int64
+	ObjectLock *bool   `json:"objectLock,omitempty"` // optional bool, needs versioning
 }
 
 // fake regions
@@ -36,25 +40,26 @@ var allowedRegions = map[string]bool{
 
 func ListBuckets(DB *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		user, ok := c.Locals("user").(*db.User)
 		if !ok {
-			log.Error("ListBuckets: missing user in context")
-			return c.Status(500).JSON(fiber.Map{"error": "internal server error"})
+			requestid.Log(c).Error("ListBuckets: missing user in context")
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
 		}
 
 		var buckets []db.Bucket
 		if err := DB.Where("user_id = ?", user.ID).Find(&buckets).Error; err != nil {
-			log.WithError(err).WithField("user_id", user.ID).Error("Failed to fetch buckets")
-			return c.Status(500).JSON(fiber.Map{"error": "failed to fetch buckets"})
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to fetch buckets")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch buckets")
 		}
 
-		log.WithField("user_id", user.ID).Info("Buckets listed successfully")
+		requestid.Log(c).WithField("user_id", user.ID).Info("Buckets listed successfully")
 		return c.Status(200).JSON(fiber.Map{"buckets": buckets})
 	}
 }
 
 func CreateBucketDir(bucketName string) error {
-	dirPath := filepath.Join("/storage", bucketName)
+	dirPath := utils.BucketDir(bucketName)
 	err := os.MkdirAll(dirPath, 0755)
 	if err != nil {
 		log.WithError(err).WithField("bucket", bucketName).Error("Failed to create bucket directory")
@@ -67,33 +72,37 @@ func CreateBucketDir(bucketName string) error {
 
 func CreateBucket(DB *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		var req CreateBucketRequest
 		if err := json.Unmarshal(c.Body(), &req); err != nil {
-			log.WithError(err).Error("Invalid bucket creation request")
-			return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+			requestid.Log(c).WithError(err).Error("Invalid bucket creation request")
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
 		}
 
 		if err := validateBucketName(req.BucketName); err != nil {
-			log.WithError(err).WithField("bucket", req.BucketName).Warn("Invalid bucket name")
-			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+			requestid.Log(c).WithError(err).WithField("bucket", req.BucketName).Warn("Invalid bucket name")
+			return apierror.Send(c, apierror.InvalidArgument, err.Error())
 		}
 
 		if !allowedRegions[strings.ToUpper(req.Region)] {
-			log.WithField("region", req.Region).Warn("Invalid region provided")
-			return c.Status(400).JSON(fiber.Map{"error": "invalid region"})
+			requestid.Log(c).WithField("region", req.Region).Warn("Invalid region provided")
+			return apierror.Send(c, apierror.InvalidArgument, "invalid region")
 		}
 
 		user, ok := c.Locals("user").(*db.User)
 		if !ok {
-			log.Error("CreateBucket: missing user in context")
-			return c.Status(500).JSON(fiber.Map{"error": "internal server error"})
+			requestid.Log(c).Error("CreateBucket: missing user in context")
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		if err := quota.CheckBucket(DB, user); err != nil {
+			return quotaError(c, err)
 		}
 
 		// Check if bucket already exists
 		var existing db.Bucket
 		if err := DB.Where("bucket_name = ?", req.BucketName).First(&existing).Error; err == nil {
-			log.WithField("bucket", req.BucketName).Warn("Bucket name already exists")
-			return c.Status(409).JSON(fiber.Map{"error": "bucket name already exists"})
+			requestid.Log(c).WithField("bucket", req.BucketName).Warn("Bucket name already exists")
+			return apierror.Send(c, apierror.BucketAlreadyExists, "bucket name already exists")
 		}
 
 		newBucket := &db.Bucket{
@@ -117,21 +126,29 @@ func CreateBucket(DB *gorm.DB) fiber.Handler {
 			newBucket.Versioning = false
 		}
 
+		if req.ObjectLock != nil && *req.ObjectLock {
+			if !newBucket.Versioning {
+				return apierror.Send(c, apierror.InvalidArgument, "object lock requires versioning")
+			}
+			newBucket.ObjectLockEnabled = true
+		}
+
 		if req.Quota != nil {
 			newBucket.Quota = req.Quota
 		} else {
 			newBucket.Quota = nil
 		}
 		if err := CreateBucketDir(req.BucketName); err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to create bucket"})
+			return apierror.Send(c, apierror.InternalError, "failed to create bucket")
 		}
 
 		if err := DB.Create(newBucket).Error; err != nil {
-			log.WithError(err).WithField("bucket", req.BucketName).Error("Failed to insert bucket into DB")
-			return c.Status(500).JSON(fiber.Map{"error": "failed to create bucket"})
+			requestid.Log(c).WithError(err).WithField("bucket", req.BucketName).Error("Failed to insert bucket into DB")
+			return apierror.Send(c, apierror.InternalError, "failed to create bucket")
 		}
+		audit.Record(DB, c, user, audit.Event{Action: "bucket.create", TargetType: "bucket", Target: newBucket.BucketName, After: bucketAuditView(newBucket)})
 
-		log.WithFields(log.Fields{
+		requestid.Log(c).WithFields(log.Fields{
 			"bucket":     req.BucketName,
 			"userID":     user.ID,
 			"ACL":        newBucket.ACL,
@@ -148,81 +165,84 @@ func CreateBucket(DB *gorm.DB) fiber.Handler {
 
 func DeleteBucket(DB *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		bucketName := c.Params("bucketName")
 		if bucketName == "" {
-			return c.Status(400).JSON(fiber.Map{"error": "bucket name is required"})
+			return apierror.Send(c, apierror.InvalidArgument, "bucket name is required")
 		}
 
 		user, ok := c.Locals("user").(*db.User)
 		if !ok {
-			log.Error("DeleteBucket: missing user in context")
-			return c.Status(500).JSON(fiber.Map{"error": "internal server error"})
+			requestid.Log(c).Error("DeleteBucket: missing user in context")
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
 		}
 
 		var bucket db.Bucket
 		if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
-				log.WithField("bucket", bucketName).Warn("Bucket not found")
-				return c.Status(404).JSON(fiber.Map{"error": "bucket not found"})
+				requestid.Log(c).WithField("bucket", bucketName).Warn("Bucket not found")
+				return apierror.Send(c, apierror.NoSuchBucket, "bucket not found")
 			}
-			log.WithError(err).Error("Database error while fetching bucket")
-			return c.Status(500).JSON(fiber.Map{"error": "database error"})
+			requestid.Log(c).WithError(err).Error("Database error while fetching bucket")
+			return apierror.Send(c, apierror.InternalError, "database error")
 		}
 
 		if bucket.UserID != user.ID {
-			log.WithFields(log.Fields{
+			requestid.Log(c).WithFields(log.Fields{
 				"bucket":  bucketName,
 				"user_id": user.ID,
 			}).Warn("Unauthorized bucket delete attempt")
-			return c.Status(403).JSON(fiber.Map{"error": "forbidden"})
+			return apierror.Send(c, apierror.AccessDenied, "forbidden")
 		}
 
 		var fileCount int64
 		DB.Model(&db.File{}).Where("bucket_id = ?", bucket.ID).Count(&fileCount)
 		if fileCount > 0 {
-			log.WithField("bucket", bucketName).Warn("Bucket not empty, cannot delete")
-			return c.Status(400).JSON(fiber.Map{"error": "bucket is not empty"})
+			requestid.Log(c).WithField("bucket", bucketName).Warn("Bucket not empty, cannot delete")
+			return apierror.Send(c, apierror.BucketNotEmpty, "bucket is not empty")
 		}
 
 		if err := DB.Delete(&bucket).Error; err != nil {
-			log.WithError(err).WithField("bucket", bucketName).Error("Failed to delete bucket")
-			return c.Status(500).JSON(fiber.Map{"error": "failed to delete bucket"})
+			requestid.Log(c).WithError(err).WithField("bucket", bucketName).Error("Failed to delete bucket")
+			return apierror.Send(c, apierror.InternalError, "failed to delete bucket")
 		}
+		audit.Record(DB, c, user, audit.Event{Action: "bucket.delete", TargetType: "bucket", Target: bucket.BucketName, Before: bucketAuditView(&bucket)})
 
-		log.WithField("bucket", bucketName).Info("Bucket deleted successfully")
+		requestid.Log(c).WithField("bucket", bucketName).Info("Bucket deleted successfully")
 		return c.Status(200).JSON(fiber.Map{"message": "bucket deleted successfully"})
 	}
 }
 
 func GetBucketInfo(DB *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		bucketName := c.Params("bucketName")
 		if bucketName == "" {
-			return c.Status(400).JSON(fiber.Map{"error": "bucket name is required"})
+			return apierror.Send(c, apierror.InvalidArgument, "bucket name is required")
 		}
 
 		user, ok := c.Locals("user").(*db.User)
 		if !ok {
-			log.Error("GetBucketInfo: missing user in context")
-			return c.Status(500).JSON(fiber.Map{"error": "internal server error"})
+			requestid.Log(c).Error("GetBucketInfo: missing user in context")
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
 		}
 
 		var bucket db.Bucket
 		if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
-				log.WithField("bucket", bucketName).Warn("Bucket not found")
-				return c.Status(404).JSON(fiber.Map{"error": "bucket not found"})
+				requestid.Log(c).WithField("bucket", bucketName).Warn("Bucket not found")
+				return apierror.Send(c, apierror.NoSuchBucket, "bucket not found")
 			}
-			log.WithError(err).Error("Database error while fetching bucket info")
-			return c.Status(500).JSON(fiber.Map{"error": "database error"})
+			requestid.Log(c).WithError(err).Error("Database error while fetching bucket info")
+			return apierror.Send(c, apierror.InternalError, "database error")
 		}
 
 		if bucket.UserID != user.ID {
-			log.WithFields(log.Fields{
+			requestid.Log(c).WithFields(log.Fields{
 				"bucket":  bucketName,
 				"user_id": user.ID,
 			}).Warn("Unauthorized bucket info access attempt")
-			return c.Status(403).JSON(fiber.Map{"error": "forbidden"})
+			return apierror.Send(c, apierror.AccessDenied, "forbidden")
 		}
 
 		var totalSize int64
@@ -230,11 +250,11 @@ func GetBucketInfo(DB *gorm.DB) fiber.Handler {
 			Where("bucket_id = ?", bucket.ID).
 			Select("COALESCE(SUM(size),0)").
 			Scan(&totalSize).Error; err != nil {
-			log.WithError(err).WithField("bucket", bucketName).Error("Failed to calculate bucket size")
-			return c.Status(500).JSON(fiber.Map{"error": "failed to calculate bucket size"})
+			requestid.Log(c).WithError(err).WithField("bucket", bucketName).Error("Failed to calculate bucket size")
+			return apierror.Send(c, apierror.InternalError, "failed to calculate bucket size")
 		}
 
-		log.WithField("bucket", bucketName).Info("Bucket info retrieved successfully")
+		requestid.Log(c).WithField("bucket", bucketName).Info("Bucket info retrieved successfully")
 		return c.Status(200).JSON(fiber.Map{
 			"data": fiber.Map{
 				"id":          bucket.ID,
@@ -250,123 +270,265 @@ func GetBucketInfo(DB *gorm.DB) fiber.Handler {
 
 func EnqueueEmptyBucketTask(client *asynq.Client, DB *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		user, ok := c.Locals("user").(*db.User)
 		if !ok {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthenticated"})
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
 		}
 
 		bucketName := c.Params("bucketName")
 		if bucketName == "" {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "bucketName is required"})
+			return apierror.Send(c, apierror.InvalidArgument, "bucketName is required")
 		}
 
-		var bucket db.Bucket
-		if err := DB.Where("bucket_name = ? AND user_id = ?", bucketName, user.ID).First(&bucket).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "bucket not found or you do not have permission"})
-			}
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "internal server error"})
+		bucket, bypass, err := governedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+		if ok, err := requireMFADelete(c, DB, bucket, user); !ok {
+			return err
 		}
 
-		payload, _ := json.Marshal(tasks.EmptyBucketPayload{
-			UserID:     user.ID,
-			BucketName: bucketName,
-		})
+		params, _ := json.Marshal(tasks.EmptyBucketOptions{BypassGovernance: bypass})
+		paramsStr := string(params)
 
-		task := asynq.NewTask(tasks.TaskTypeEmptyBucket, payload)
-		info, err := client.Enqueue(task, asynq.MaxRetry(5), asynq.Timeout(10*time.Minute))
-		if err != nil {
-			log.Println("Failed to enqueue task:", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to enqueue task"})
-		}
 		newTask := db.Task{
-			ID:        info.ID,
+			ID:        uuid.NewString(),
 			UserID:    user.ID,
 			Type:      "empty",
-			Status:    "running",
+			Status:    "queued",
 			BucketSrc: &bucketName,
 			Progress:  0,
+			Params:    &paramsStr,
 		}
 		if err := DB.Create(&newTask).Error; err != nil {
-			log.Println("Failed to save task record:", err)
+			requestid.Log(c).WithError(err).Error("Failed to save task record")
+			return apierror.Send(c, apierror.InternalError, "failed to save task")
 		}
 
+		task, err := tasks.NewEmptyBucketTask(c.UserContext(), newTask.ID, user.ID, bucketName, bypass)
+		if err == nil {
+			_, err = client.Enqueue(task)
+		}
+		if err != nil {
+			requestid.Log(c).WithError(err).WithField("task_id", newTask.ID).Error("Failed to enqueue task")
+			failTaskRecord(DB, &newTask, err)
+			return apierror.Send(c, apierror.InternalError, "failed to enqueue task")
+		}
+		audit.Record(DB, c, user, audit.Event{Action: "task.enqueue", TargetType: "task", Target: newTask.ID, After: taskAuditView(&newTask)})
+
 		return c.JSON(fiber.Map{"task_id": newTask.ID, "message": "task enqueued"})
 	}
 }
 
 func EnqueueCopyBucketTask(client *asynq.Client, DB *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		user := c.Locals("user").(*db.User)
 		bucketSrc := c.Params("bucketSrc")
 		bucketDest := c.Params("bucketDest")
 
 		if bucketSrc == "" || bucketDest == "" {
-			return c.Status(400).JSON(fiber.Map{"error": "source and destination bucket names are required"})
+			return apierror.Send(c, apierror.InvalidArgument, "source and destination bucket names are required")
+		}
+
+		var req CopyBucketRequest
+		if len(c.Body()) > 0 {
+			if err := json.Unmarshal(c.Body(), &req); err != nil {
+				return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+			}
+		}
+		if req.Parallelism < 0 || req.Parallelism > tasks.MaxCopyParallelism {
+			return apierror.Send(c, apierror.InvalidArgument, fmt.Sprintf("parallelism must be between 1 and %d", tasks.MaxCopyParallelism))
 		}
 
 		var srcBucket db.Bucket
 		if err := DB.Where("bucket_name = ? AND user_id = ?", bucketSrc, user.ID).First(&srcBucket).Error; err != nil {
-			return c.Status(404).JSON(fiber.Map{"error": "source bucket not found or not owned by user"})
+			return apierror.Send(c, apierror.NoSuchBucket, "source bucket not found or not owned by user")
 		}
 
-		var destBucket db.Bucket
-		if err := DB.Where("bucket_name = ? AND user_id = ?", bucketDest, user.ID).First(&destBucket).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				destBucket = db.Bucket{
-					ID:         uuid.NewString(),
-					BucketName: bucketDest,
-					UserID:     user.ID,
-					ACL:        srcBucket.ACL,
-					Versioning: srcBucket.Versioning,
-					Region:     srcBucket.Region,
-				}
-				if err := DB.Create(&destBucket).Error; err != nil {
-					return c.Status(500).JSON(fiber.Map{"error": "failed to create destination bucket"})
-				}
-			} else {
-				return c.Status(500).JSON(fiber.Map{"error": "failed to check destination bucket"})
-			}
+		if dest, err := destinationBucket(c, DB, user, bucketDest, &srcBucket); dest == nil {
+			return err
 		}
 
-		payload, _ := json.Marshal(struct {
-			UserID     string `json:"user_id"`
-			BucketSrc  string `json:"bucket_src"`
-			BucketDest string `json:"bucket_dest"`
-		}{
+		params, _ := json.Marshal(req)
+		paramsStr := string(params)
+
+		newTask := db.Task{
+			ID:         uuid.NewString(),
 			UserID:     user.ID,
-			BucketSrc:  bucketSrc,
-			BucketDest: bucketDest,
+			Type:       "copy",
+			BucketSrc:  &bucketSrc,
+			BucketDest: &bucketDest,
+			Status:     "queued",
+			Progress:   0,
+			Params:     &paramsStr,
+		}
+		if err := DB.Create(&newTask).Error; err != nil {
+			return apierror.Send(c, apierror.InternalError, "failed to save copy task")
+		}
+
+		task, err := tasks.NewCopyBucketTask(c.UserContext(), newTask.ID, user.ID, bucketSrc, bucketDest, req.Parallelism)
+		if err == nil {
+			_, err = client.Enqueue(task)
+		}
+		if err != nil {
+			requestid.Log(c).WithError(err).WithField("task_id", newTask.ID).Error("Failed to enqueue copy task")
+			failTaskRecord(DB, &newTask, err)
+			return apierror.Send(c, apierror.InternalError, "failed to enqueue copy task")
+		}
+		audit.Record(DB, c, user, audit.Event{Action: "task.enqueue", TargetType: "task", Target: newTask.ID, After: taskAuditView(&newTask)})
+
+		return c.JSON(fiber.Map{
+			"task_id": newTask.ID,
+			"message": "copy bucket task enqueued",
 		})
+	}
+}
 
-		task := asynq.NewTask("copy_bucket", payload)
+type CopyBucketRequest struct {
+	Parallelism int `json:"parallelism,omitempty"` // concurrent file copies, 0 picks the default
+}
 
-		info, err := client.Enqueue(task,
-			asynq.MaxRetry(5),
-			asynq.Timeout(30*time.Minute),
-		)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to enqueue copy task"})
+type SyncBucketRequest struct {
+	Prefix           string `json:"prefix"`
+	DeleteExtraneous bool   `json:"deleteExtraneous"`
+	DryRun           bool   `json:"dryRun"`
+}
+
+func EnqueueSyncBucketTask(client *asynq.Client, DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		bucketSrc := c.Params("bucketSrc")
+		bucketDest := c.Params("bucketDest")
+		if bucketSrc == "" || bucketDest == "" {
+			return apierror.Send(c, apierror.InvalidArgument, "source and destination bucket names are required")
+		}
+		if bucketSrc == bucketDest {
+			return apierror.Send(c, apierror.InvalidArgument, "source and destination buckets must differ")
+		}
+
+		var req SyncBucketRequest
+		if len(c.Body()) > 0 {
+			if err := json.Unmarshal(c.Body(), &req); err != nil {
+				return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+			}
+		}
+
+		var srcBucket db.Bucket
+		if err := DB.Where("bucket_name = ? AND user_id = ?", bucketSrc, user.ID).First(&srcBucket).Error; err != nil {
+			return apierror.Send(c, apierror.NoSuchBucket, "source bucket not found or not owned by user")
+		}
+
+		// Same rule as copy: the destination is created on first use, except
+		// for dry runs which must not change anything.
+		if req.DryRun {
+			var destBucket db.Bucket
+			err := DB.Where("bucket_name = ?", bucketDest).First(&destBucket).Error
+			if err == nil && destBucket.UserID != user.ID {
+				return apierror.Send(c, apierror.AccessDenied, "destination bucket not owned by user")
+			}
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return apierror.Send(c, apierror.InternalError, "failed to check destination bucket")
+			}
+		} else {
+			destBucket, err := destinationBucket(c, DB, user, bucketDest, &srcBucket)
+			if destBucket == nil {
+				return err
+			}
+			if req.DeleteExtraneous {
+				if ok, err := requireMFADelete(c, DB, destBucket, user); !ok {
+					return err
+				}
+			}
+		}
+
+		opts := tasks.SyncOptions{
+			Prefix:           req.Prefix,
+			DeleteExtraneous: req.DeleteExtraneous,
+			DryRun:           req.DryRun,
 		}
+		params, _ := json.Marshal(opts)
+		paramsStr := string(params)
 
 		newTask := db.Task{
-			ID:         info.ID,
+			ID:         uuid.NewString(),
 			UserID:     user.ID,
-			Type:       "copy",
+			Type:       "sync",
 			BucketSrc:  &bucketSrc,
 			BucketDest: &bucketDest,
-			Status:     "running",
-			Progress:   0,
+			Status:     "queued",
+			Params:     &paramsStr,
+		}
+		if err := DB.Create(&newTask).Error; err != nil {
+			return apierror.Send(c, apierror.InternalError, "failed to save sync task")
+		}
+
+		task, err := tasks.NewSyncBucketTask(c.UserContext(), newTask.ID, user.ID, bucketSrc, bucketDest, opts)
+		if err == nil {
+			_, err = client.Enqueue(task)
+		}
+		if err != nil {
+			requestid.Log(c).WithError(err).WithField("task_id", newTask.ID).Error("Failed to enqueue sync task")
+			failTaskRecord(DB, &newTask, err)
+			return apierror.Send(c, apierror.InternalError, "failed to enqueue sync task")
 		}
-		DB.Create(&newTask)
+		audit.Record(DB, c, user, audit.Event{Action: "task.enqueue", TargetType: "task", Target: newTask.ID, After: taskAuditView(&newTask)})
 
 		return c.JSON(fiber.Map{
 			"task_id": newTask.ID,
-			"message": "copy bucket task enqueued",
+			"message": "sync bucket task enqueued",
 		})
 	}
 }
 
+// destinationBucket returns the caller's bucket called name, the destination
+// of a copy or sync, creating it with the settings of src when it does not
+// exist yet. Creating it goes through the same checks as CreateBucket. On
+// failure the returned error is the already written response.
+func destinationBucket(c *fiber.Ctx, DB *gorm.DB, user *db.User, name string, src *db.Bucket) (*db.Bucket, error) {
+	var dest db.Bucket
+	err := DB.Where("bucket_name = ?", name).First(&dest).Error
+	if err == nil {
+		if dest.UserID != user.ID {
+			return nil, apierror.Send(c, apierror.AccessDenied, "destination bucket not owned by user")
+		}
+		return &dest, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, apierror.Send(c, apierror.InternalError, "failed to check destination bucket")
+	}
+
+	if err := validateBucketName(name); err != nil {
+		requestid.Log(c).WithError(err).WithField("bucket", name).Warn("Invalid bucket name")
+		return nil, apierror.Send(c, apierror.InvalidArgument, err.Error())
+	}
+	if err := quota.CheckBucket(DB, user); err != nil {
+		return nil, quotaError(c, err)
+	}
+	dest = db.Bucket{
+		ID:         uuid.NewString(),
+		BucketName: name,
+		UserID:     user.ID,
+		ACL:        src.ACL,
+		Versioning: src.Versioning,
+		Region:     src.Region,
+	}
+	if err := CreateBucketDir(name); err != nil {
+		return nil, apierror.Send(c, apierror.InternalError, "failed to create destination bucket")
+	}
+	if err := DB.Create(&dest).Error; err != nil {
+		requestid.Log(c).WithError(err).WithField("bucket", name).Error("Failed to insert bucket into DB")
+		return nil, apierror.Send(c, apierror.InternalError, "failed to create destination bucket")
+	}
+	audit.Record(DB, c, user, audit.Event{Action: "bucket.create", TargetType: "bucket", Target: dest.BucketName, After: bucketAuditView(&dest)})
+	return &dest, nil
+}
+
 func validateBucketName(name string) error {
 	if len(name) < 3 || len(name) > 63 {
 		return errors.New("bucket name must be between 3 and 63 characters")
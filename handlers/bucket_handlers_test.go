@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketErrorCodes(t *testing.T) {
+	DB := setupTestDB(t)
+	maxBuckets := 1
+	user := db.User{ID: "user-1", Email: "codes@example.com", AccessKey: "ak-1", IsVerified: true, MaxBuckets: &maxBuckets}
+	require.NoError(t, DB.Create(&user).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-1", BucketName: "source", UserID: user.ID}).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-2", BucketName: "others", UserID: "user-2"}).Error)
+
+	app := setupFiber()
+	// no user in context: unauthenticated, not an internal error
+	app.Get("/anonymous/buckets", ListBuckets(DB))
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &user)
+		return c.Next()
+	})
+	app.Post("/api/tasks/empty-bucket/:bucketName", EnqueueEmptyBucketTask(nil, DB))
+	app.Post("/api/tasks/sync-bucket/:bucketSrc/:bucketDest", EnqueueSyncBucketTask(nil, DB))
+	app.Post("/api/tasks/copy-bucket/:bucketSrc/:bucketDest", EnqueueCopyBucketTask(nil, DB))
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+		wantCode   string
+	}{
+		{"missing user", "GET", "/anonymous/buckets", 401, "Unauthenticated"},
+		{"unknown bucket", "POST", "/api/tasks/empty-bucket/missing", 404, "NoSuchBucket"},
+		{"unknown route", "GET", "/api/nothing-here", 404, "NotFound"},
+		{"invalid sync destination", "POST", "/api/tasks/sync-bucket/source/AB", 400, "InvalidArgument"},
+		{"foreign sync destination", "POST", "/api/tasks/sync-bucket/source/others", 403, "AccessDenied"},
+		{"sync destination over bucket limit", "POST", "/api/tasks/sync-bucket/source/fresh", 403, "QuotaExceeded"},
+		{"foreign copy destination", "POST", "/api/tasks/copy-bucket/source/others", 403, "AccessDenied"},
+		{"copy destination over bucket limit", "POST", "/api/tasks/copy-bucket/source/fresh", 403, "QuotaExceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := app.Test(httptest.NewRequest(tt.method, tt.target, nil))
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStatus, resp.StatusCode)
+
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.Equal(t, tt.wantCode, body["code"])
+			require.NotEmpty(t, body["error"])
+			require.NotEmpty(t, resp.Header.Get(requestid.Header))
+			require.Equal(t, resp.Header.Get(requestid.Header), body["requestId"])
+		})
+	}
+	var buckets int64
+	DB.Model(&db.Bucket{}).Count(&buckets)
+	require.EqualValues(t, 2, buckets, "refused destinations are not created")
+}
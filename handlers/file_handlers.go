@@ -7,9 +7,16 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
 	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/objectlock"
+	"github.com/SysTechSalihY/mini-s3-clone/quota"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
 	"github.com/SysTechSalihY/mini-s3-clone/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -17,77 +24,136 @@ import (
 	"gorm.io/gorm"
 )
 
-func DownloadFile(DB *gorm.DB) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		bucketName := c.Params("bucketName", "")
-		fileName := c.Params("fileName", "")
-		versionID := c.Query("versionID", "")
+// readableFile resolves the :bucketName/:fileName object (or ?versionID=)
+// for a caller allowed to read it: the bucket owner, or anyone on a
+// public-read bucket. On failure the returned error is the already written
+// response.
+func readableFile(c *fiber.Ctx, DB *gorm.DB) (*db.File, string, error) {
+	bucketName := c.Params("bucketName", "")
+	fileName := c.Params("fileName", "")
+	versionID := c.Query("versionID", "")
+
+	if bucketName == "" || fileName == "" {
+		requestid.Log(c).Warn("DownloadFile: bucketName or fileName missing")
+		return nil, "", apierror.Send(c, apierror.InvalidArgument, "bucketName and fileName are required")
+	}
 
-		if bucketName == "" || fileName == "" {
-			log.Warn("DownloadFile: bucketName or fileName missing")
-			return c.Status(400).JSON(fiber.Map{"error": "bucketName and fileName are required"})
+	var bucket db.Bucket
+	if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			requestid.Log(c).WithField("bucketName", bucketName).Warn("Bucket not found")
+			return nil, "", apierror.Send(c, apierror.NoSuchBucket, "bucket not found")
 		}
+		requestid.Log(c).WithError(err).Error("DB error fetching bucket")
+		return nil, "", apierror.Send(c, apierror.InternalError, "internal server error")
+	}
 
-		var bucket db.Bucket
-		if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				log.WithField("bucketName", bucketName).Warn("Bucket not found")
-				return c.Status(404).JSON(fiber.Map{"error": "bucket not found"})
-			}
-			log.WithError(err).Error("DB error fetching bucket")
-			return c.Status(500).JSON(fiber.Map{"error": "internal server error"})
-		}
+	var file db.File
+	query := DB.Where("file_name = ? AND bucket_id = ?", fileName, bucket.ID)
+	if versionID != "" {
+		query = query.Where("version_id = ?", versionID)
+	} else {
+		query = query.Where("is_latest = ?", true)
+	}
 
-		var file db.File
-		query := DB.Where("file_name = ? AND bucket_id = ?", fileName, bucket.ID)
-		if versionID != "" {
-			query = query.Where("version_id = ?", versionID)
-		} else {
-			query = query.Where("is_latest = ?", true)
+	if err := query.First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			requestid.Log(c).WithFields(log.Fields{"file": fileName, "bucket": bucketName}).Warn("File not found")
+			return nil, "", apierror.Send(c, apierror.NoSuchKey, "file not found")
 		}
+		requestid.Log(c).WithError(err).Error("DB error fetching file")
+		return nil, "", apierror.Send(c, apierror.InternalError, "internal server error")
+	}
 
-		if err := query.First(&file).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				log.WithFields(log.Fields{"file": fileName, "bucket": bucketName}).Warn("File not found")
-				return c.Status(404).JSON(fiber.Map{"error": "file not found"})
-			}
-			log.WithError(err).Error("DB error fetching file")
-			return c.Status(500).JSON(fiber.Map{"error": "internal server error"})
+	user, ok := c.Locals("user").(*db.User)
+	isOwner := ok && user.ID == bucket.UserID
+	isPublic := bucket.ACL != nil && *bucket.ACL == "public-read"
+
+	if !isOwner && !isPublic {
+		requestid.Log(c).WithFields(log.Fields{"bucket": bucketName, "file": fileName}).Warn("Unauthorized download attempt")
+		return nil, "", apierror.Send(c, apierror.AccessDenied, "forbidden")
+	}
+	var versionedFileName string
+	if bucket.Versioning {
+		versionedFileName = fmt.Sprintf("%s_%s", file.VersionID, file.FileName)
+	} else {
+		versionedFileName = file.FileName
+	}
+	filePath := utils.ObjectPath(bucketName, versionedFileName)
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		requestid.Log(c).WithField("filePath", filePath).Warn("File not found on disk")
+		return nil, "", apierror.Send(c, apierror.NoSuchKey, "file not found")
+	}
+	return &file, filePath, nil
+}
+
+func DownloadFile(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		file, filePath, err := readableFile(c, DB)
+		if file == nil {
+			return err
 		}
 
-		user, ok := c.Locals("user").(*db.User)
-		isOwner := ok && user.ID == bucket.UserID
-		isPublic := bucket.ACL != nil && *bucket.ACL == "public-read"
+		requestid.Log(c).WithFields(log.Fields{"bucket": c.Params("bucketName"), "file": file.FileName, "versionID": file.VersionID}).Info("File download allowed")
+		return sendObject(c, filePath)
+	}
+}
 
-		if !isOwner && !isPublic {
-			log.WithFields(log.Fields{"bucket": bucketName, "file": fileName}).Warn("Unauthorized download attempt")
-			return c.Status(403).JSON(fiber.Map{"error": "forbidden"})
+// HeadFile returns the object metadata as headers, S3 style, without the
+// body.
+func HeadFile(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		file, _, err := readableFile(c, DB)
+		if file == nil {
+			return err
 		}
-		var versionedFileName string
-		if bucket.Versioning {
-			versionedFileName = fmt.Sprintf("%s_%s", file.VersionID, file.FileName)
-		} else {
-			versionedFileName = file.FileName
+
+		if file.ContentType != "" {
+			c.Set(fiber.HeaderContentType, file.ContentType)
 		}
-		filePath := fmt.Sprintf("./storage/%s/%s", bucketName, versionedFileName)
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
-			log.WithField("filePath", filePath).Warn("File not found on disk")
-			return c.Status(404).JSON(fiber.Map{"error": "file not found"})
+		if file.Checksum != "" {
+			c.Set(fiber.HeaderETag, `"`+file.Checksum+`"`)
 		}
-
-		log.WithFields(log.Fields{"user_id": user.ID, "bucket": bucketName, "file": fileName, "versionID": file.VersionID}).Info("File download allowed")
-		return c.SendFile(filePath, true)
+		lastModified := file.CreatedAt
+		if file.UpdatedAt != nil {
+			lastModified = *file.UpdatedAt
+		}
+		c.Set(fiber.HeaderLastModified, lastModified.UTC().Format(http.TimeFormat))
+		if file.VersionID != "" {
+			c.Set("x-amz-version-id", file.VersionID)
+		}
+		if file.ReplicationStatus != "" {
+			c.Set("x-amz-replication-status", file.ReplicationStatus)
+		}
+		if file.RetentionMode != "" && file.RetainUntil != nil {
+			c.Set("x-amz-object-lock-mode", file.RetentionMode)
+			c.Set("x-amz-object-lock-retain-until-date", file.RetainUntil.UTC().Format(time.RFC3339))
+		}
+		if file.LegalHold {
+			c.Set("x-amz-object-lock-legal-hold", "ON")
+		}
+		if file.StorageClass != "" && file.StorageClass != db.StorageClassStandard {
+			c.Set("x-amz-storage-class", file.StorageClass)
+		}
+		// no body, but Content-Length must still describe the object
+		c.Response().SkipBody = true
+		c.Response().Header.SetContentLength(int(file.Size))
+		c.Status(fiber.StatusOK)
+		return nil
 	}
 }
 
 func CreateDownloadPresignedURL(DB *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		bucketName := c.Query("bucket")
 		fileName := c.Query("key")
 		versionID := c.Query("versionID", "")
 		durationStr := c.Query("duration", "3600")
 
-		log.WithFields(log.Fields{
+		requestid.Log(c).WithFields(log.Fields{
 			"bucket":    bucketName,
 			"file":      fileName,
 			"versionID": versionID,
@@ -96,34 +162,40 @@ func CreateDownloadPresignedURL(DB *gorm.DB) fiber.Handler {
 
 		durationSec, err := strconv.Atoi(durationStr)
 		if err != nil {
-			log.WithError(err).WithField("duration", durationStr).Error("Invalid duration parameter")
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "invalid duration"})
+			requestid.Log(c).WithError(err).WithField("duration", durationStr).Error("Invalid duration parameter")
+			return apierror.Send(c, apierror.InvalidArgument, "invalid duration")
 		}
 
 		if bucketName == "" || fileName == "" {
-			log.Warn("Missing bucket or key parameter")
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "bucket and key are required"})
+			requestid.Log(c).Warn("Missing bucket or key parameter")
+			return apierror.Send(c, apierror.InvalidArgument, "bucket and key are required")
 		}
 
 		var bucket db.Bucket
 		if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil {
-			log.WithField("bucket", bucketName).Warn("Bucket not found in database")
-			return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "bucket not found"})
+			requestid.Log(c).WithField("bucket", bucketName).Warn("Bucket not found in database")
+			return apierror.Send(c, apierror.NoSuchBucket, "bucket not found")
 		}
 
 		user, ok := c.Locals("user").(*db.User)
 		if !ok {
-			log.Warn("User not found in context")
-			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+			requestid.Log(c).Warn("User not found in context")
+			return apierror.Send(c, apierror.Unauthenticated, "unauthorized")
 		}
 
 		if bucket.UserID != user.ID {
-			log.WithFields(log.Fields{"bucketOwner": bucket.UserID, "user": user.ID}).Warn("User not authorized to generate presigned URL for this bucket")
-			return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "only bucket owner can generate presigned URL"})
+			requestid.Log(c).WithFields(log.Fields{"bucketOwner": bucket.UserID, "user": user.ID}).Warn("User not authorized to generate presigned URL for this bucket")
+			return apierror.Send(c, apierror.AccessDenied, "only bucket owner can generate presigned URL")
 		}
 
 		url := utils.GeneratePresignedURL(bucketName, fileName, user.SecretKey, "download", time.Duration(durationSec)*time.Second, versionID)
-		log.WithFields(log.Fields{
+		audit.Record(DB, c, user, audit.Event{
+			Action:     "presigned_url.create",
+			TargetType: "object",
+			Target:     bucketName + "/" + fileName,
+			After:      fiber.Map{"operation": "download", "versionID": versionID, "expiresIn": durationSec},
+		})
+		requestid.Log(c).WithFields(log.Fields{
 			"user":      user.ID,
 			"bucket":    bucketName,
 			"file":      fileName,
@@ -137,11 +209,12 @@ func CreateDownloadPresignedURL(DB *gorm.DB) fiber.Handler {
 
 func CreateUploadPresignedURL(DB *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		bucketName := c.Query("bucket")
 		fileName := c.Query("key")
 		durationStr := c.Query("duration", "3600")
 
-		log.WithFields(log.Fields{
+		requestid.Log(c).WithFields(log.Fields{
 			"bucket":   bucketName,
 			"file":     fileName,
 			"duration": durationStr,
@@ -149,34 +222,40 @@ func CreateUploadPresignedURL(DB *gorm.DB) fiber.Handler {
 
 		durationSec, err := strconv.Atoi(durationStr)
 		if err != nil {
-			log.WithError(err).WithField("duration", durationStr).Error("Invalid duration parameter")
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "invalid duration"})
+			requestid.Log(c).WithError(err).WithField("duration", durationStr).Error("Invalid duration parameter")
+			return apierror.Send(c, apierror.InvalidArgument, "invalid duration")
 		}
 
 		if bucketName == "" || fileName == "" {
-			log.Warn("Missing bucket or key parameter")
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "bucket and key are required"})
+			requestid.Log(c).Warn("Missing bucket or key parameter")
+			return apierror.Send(c, apierror.InvalidArgument, "bucket and key are required")
 		}
 
 		var bucket db.Bucket
 		if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil {
-			log.WithField("bucket", bucketName).Warn("Bucket not found in database")
-			return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "bucket not found"})
+			requestid.Log(c).WithField("bucket", bucketName).Warn("Bucket not found in database")
+			return apierror.Send(c, apierror.NoSuchBucket, "bucket not found")
 		}
 
 		user, ok := c.Locals("user").(*db.User)
 		if !ok {
-			log.Warn("User not found in context")
-			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{"error": "unauthorized"})
+			requestid.Log(c).Warn("User not found in context")
+			return apierror.Send(c, apierror.Unauthenticated, "unauthorized")
 		}
 
 		if bucket.UserID != user.ID {
-			log.WithFields(log.Fields{"bucketOwner": bucket.UserID, "user": user.ID}).Warn("User not authorized to generate upload presigned URL for this bucket")
-			return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "only bucket owner can generate presigned URL"})
+			requestid.Log(c).WithFields(log.Fields{"bucketOwner": bucket.UserID, "user": user.ID}).Warn("User not authorized to generate upload presigned URL for this bucket")
+			return apierror.Send(c, apierror.AccessDenied, "only bucket owner can generate presigned URL")
 		}
 
 		url := utils.GeneratePresignedURL(bucketName, fileName, user.SecretKey, "upload", time.Duration(durationSec)*time.Second)
-		log.WithFields(log.Fields{
+		audit.Record(DB, c, user, audit.Event{
+			Action:     "presigned_url.create",
+			TargetType: "object",
+			Target:     bucketName + "/" + fileName,
+			After:      fiber.Map{"operation": "upload", "expiresIn": durationSec},
+		})
+		requestid.Log(c).WithFields(log.Fields{
 			"user":   user.ID,
 			"bucket": bucketName,
 			"file":   fileName,
@@ -189,18 +268,19 @@ func CreateUploadPresignedURL(DB *gorm.DB) fiber.Handler {
 
 func DownloadFilePresignedURL(DB *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		bucketName := c.Locals("bucket").(string)
 		fileName := c.Locals("key").(string)
 		versionID := c.Query("versionID", "")
 		operation := c.Locals("operation").(string)
 
 		if operation != "download" {
-			log.WithFields(log.Fields{
+			requestid.Log(c).WithFields(log.Fields{
 				"operation": operation,
 				"bucket":    bucketName,
 				"key":       fileName,
 			}).Warn("Invalid operation for presigned download")
-			return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "invalid operation for this endpoint"})
+			return apierror.Send(c, apierror.AccessDenied, "invalid operation for this endpoint")
 		}
 
 		var file db.File
@@ -212,28 +292,29 @@ func DownloadFilePresignedURL(DB *gorm.DB) fiber.Handler {
 		}
 
 		if err := query.First(&file).Error; err != nil {
-			log.WithFields(log.Fields{"bucket": bucketName, "file": fileName, "versionID": versionID}).Warn("File not found in DB")
-			return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "file not found"})
+			requestid.Log(c).WithFields(log.Fields{"bucket": bucketName, "file": fileName, "versionID": versionID}).Warn("File not found in DB")
+			return apierror.Send(c, apierror.NoSuchKey, "file not found")
 		}
 
 		versionedFileName := fmt.Sprintf("%s_%s", file.VersionID, file.FileName)
-		filePath := fmt.Sprintf("./storage/%s/%s", bucketName, versionedFileName)
+		filePath := utils.ObjectPath(bucketName, versionedFileName)
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
-			log.WithField("filePath", filePath).Warn("File not found on disk")
-			return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "file not found"})
+			requestid.Log(c).WithField("filePath", filePath).Warn("File not found on disk")
+			return apierror.Send(c, apierror.NoSuchKey, "file not found")
 		}
 
-		log.WithFields(log.Fields{"bucket": bucketName, "file": fileName, "versionID": file.VersionID}).Info("Presigned file download allowed")
-		return c.SendFile(filePath, true)
+		requestid.Log(c).WithFields(log.Fields{"bucket": bucketName, "file": fileName, "versionID": file.VersionID}).Info("Presigned file download allowed")
+		return sendObject(c, filePath)
 	}
 }
 
-func UploadFilePresignedURL(DB *gorm.DB) fiber.Handler {
+func UploadFilePresignedURL(DB *gorm.DB, notifier *notify.Notifier) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		file, err := c.FormFile("file")
 		if err != nil || file == nil {
-			log.WithError(err).Error("Presigned upload: reading file error")
-			return c.Status(400).JSON(fiber.Map{"error": "reading file error"})
+			requestid.Log(c).WithError(err).Error("Presigned upload: reading file error")
+			return apierror.Send(c, apierror.InvalidArgument, "reading file error")
 		}
 
 		bucketName := c.Locals("bucket").(string)
@@ -241,14 +322,23 @@ func UploadFilePresignedURL(DB *gorm.DB) fiber.Handler {
 		operation := c.Locals("operation").(string)
 
 		if operation != "upload" {
-			log.WithField("operation", operation).Warn("Invalid operation for presigned upload")
-			return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "invalid operation for this endpoint"})
+			requestid.Log(c).WithField("operation", operation).Warn("Invalid operation for presigned upload")
+			return apierror.Send(c, apierror.AccessDenied, "invalid operation for this endpoint")
+		}
+		class, ok := storageClass(c)
+		if !ok {
+			return apierror.Send(c, apierror.InvalidArgument, "invalid storage class")
 		}
 
 		var bucket db.Bucket
 		if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil {
-			log.WithField("bucket", bucketName).Warn("Bucket not found")
-			return c.Status(404).JSON(fiber.Map{"error": "bucket not found"})
+			requestid.Log(c).WithField("bucket", bucketName).Warn("Bucket not found")
+			return apierror.Send(c, apierror.NoSuchBucket, "bucket not found")
+		}
+		// presigned uploads count against the owner who signed the URL
+		owner := c.Locals("user").(db.User)
+		if err := quota.CheckUpload(DB, &owner, &bucket, 1, file.Size, file.Size); err != nil {
+			return quotaError(c, err)
 		}
 
 		var versionID string
@@ -265,20 +355,20 @@ func UploadFilePresignedURL(DB *gorm.DB) fiber.Handler {
 			versionedFileName = fileName
 			var existing db.File
 			if err := DB.Where("bucket_id = ? AND file_name = ? AND is_latest = ?", bucket.ID, fileName, true).First(&existing).Error; err == nil {
-				log.WithFields(log.Fields{"bucket": bucketName, "file": fileName}).Warn("File exists and versioning disabled")
-				return c.Status(400).JSON(fiber.Map{"error": "file already exists"})
+				requestid.Log(c).WithFields(log.Fields{"bucket": bucketName, "file": fileName}).Warn("File exists and versioning disabled")
+				return apierror.Send(c, apierror.ObjectAlreadyExists, "file already exists")
 			}
 		}
-		dirPath := fmt.Sprintf("./storage/%s", bucketName)
+		dirPath := utils.BucketDir(bucketName)
 		if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
-			log.WithError(err).WithField("dirPath", dirPath).Error("Failed to create bucket directory")
-			return c.Status(500).JSON(fiber.Map{"error": "failed to create directory"})
+			requestid.Log(c).WithError(err).WithField("dirPath", dirPath).Error("Failed to create bucket directory")
+			return apierror.Send(c, apierror.InternalError, "failed to create directory")
 		}
 
 		filePath := filepath.Join(dirPath, versionedFileName)
-		if err := c.SaveFile(file, filePath); err != nil {
-			log.WithError(err).WithField("filePath", filePath).Error("Failed to save file to disk")
-			return c.Status(500).JSON(fiber.Map{"error": "failed to save file"})
+		if err := saveObject(c, file, filePath); err != nil {
+			requestid.Log(c).WithError(err).WithField("filePath", filePath).Error("Failed to save file to disk")
+			return apierror.Send(c, apierror.InternalError, "failed to save file")
 		}
 
 		newFile := db.File{
@@ -287,20 +377,25 @@ func UploadFilePresignedURL(DB *gorm.DB) fiber.Handler {
 			BucketID:    bucket.ID,
 			Size:        file.Size,
 			ContentType: file.Header.Get("Content-Type"),
+			Checksum:    fileChecksum(filePath),
 			VersionID:   versionID,
 			IsLatest:    true,
+
+			StorageClass: class,
 		}
+		objectlock.ApplyDefaultRetention(&bucket, &newFile)
 
 		if err := DB.Create(&newFile).Error; err != nil {
-			log.WithError(err).WithField("file", fileName).Error("Failed to save file metadata")
-			return c.Status(500).JSON(fiber.Map{"error": "failed to save file metadata"})
+			requestid.Log(c).WithError(err).WithField("file", fileName).Error("Failed to save file metadata")
+			return apierror.Send(c, apierror.InternalError, "failed to save file metadata")
 		}
+		notifier.ObjectEvent(&bucket, notify.ObjectCreatedPut, &newFile, bucket.UserID)
 
 		logFields := log.Fields{"bucket": bucketName, "file": fileName}
 		if bucket.Versioning {
 			logFields["versionID"] = versionID
 		}
-		log.WithFields(logFields).Info("Presigned file uploaded successfully")
+		requestid.Log(c).WithFields(logFields).Info("Presigned file uploaded successfully")
 
 		resp := fiber.Map{
 			"message":  "file uploaded successfully",
@@ -316,38 +411,46 @@ func UploadFilePresignedURL(DB *gorm.DB) fiber.Handler {
 	}
 }
 
-func UploadFile(DB *gorm.DB) fiber.Handler {
+func UploadFile(DB *gorm.DB, notifier *notify.Notifier) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		// Read the file from multipart form
 		file, err := c.FormFile("file")
 		if err != nil || file == nil {
-			log.WithError(err).Error("UploadFile: reading file error")
-			return c.Status(400).JSON(fiber.Map{"error": "reading file error"})
+			requestid.Log(c).WithError(err).Error("UploadFile: reading file error")
+			return apierror.Send(c, apierror.InvalidArgument, "reading file error")
 		}
 
 		// Extract bucketName and fileName from params
 		bucketName := c.Params("bucketName", "")
 		fileName := c.Params("fileName", "")
 		if bucketName == "" || fileName == "" {
-			log.Warn("UploadFile: bucket or file name missing")
-			return c.Status(400).JSON(fiber.Map{"error": "bucket and file names are required"})
+			requestid.Log(c).Warn("UploadFile: bucket or file name missing")
+			return apierror.Send(c, apierror.InvalidArgument, "bucket and file names are required")
+		}
+		class, ok := storageClass(c)
+		if !ok {
+			return apierror.Send(c, apierror.InvalidArgument, "invalid storage class")
 		}
 
 		// Lookup bucket in DB
 		var bucket db.Bucket
 		if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil {
-			log.WithError(err).WithField("bucket", bucketName).Warn("Bucket not found")
-			return c.Status(404).JSON(fiber.Map{"error": "bucket not found"})
+			requestid.Log(c).WithError(err).WithField("bucket", bucketName).Warn("Bucket not found")
+			return apierror.Send(c, apierror.NoSuchBucket, "bucket not found")
 		}
 
 		// Authenticated user
 		user, ok := c.Locals("user").(*db.User)
 		if !ok || bucket.UserID != user.ID {
-			log.WithFields(log.Fields{
+			requestid.Log(c).WithFields(log.Fields{
 				"bucket":  bucketName,
 				"user_id": user.ID,
 			}).Warn("Unauthorized upload attempt")
-			return c.Status(403).JSON(fiber.Map{"error": "forbidden"})
+			return apierror.Send(c, apierror.AccessDenied, "forbidden")
+		}
+		if err := quota.CheckUpload(DB, user, &bucket, 1, file.Size, file.Size); err != nil {
+			return quotaError(c, err)
 		}
 
 		// Handle versioning
@@ -367,26 +470,26 @@ func UploadFile(DB *gorm.DB) fiber.Handler {
 			var existing db.File
 			if err := DB.Where("bucket_id = ? AND file_name = ? AND is_latest = ?", bucket.ID, fileName, true).
 				First(&existing).Error; err == nil {
-				log.WithFields(log.Fields{
+				requestid.Log(c).WithFields(log.Fields{
 					"bucket": bucketName,
 					"file":   fileName,
 				}).Warn("File already exists and versioning disabled")
-				return c.Status(400).JSON(fiber.Map{"error": "file already exists"})
+				return apierror.Send(c, apierror.ObjectAlreadyExists, "file already exists")
 			}
 		}
 
 		// Create directory for bucket if not exists
-		dirPath := fmt.Sprintf("./storage/%s", bucketName)
+		dirPath := utils.BucketDir(bucketName)
 		if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
-			log.WithError(err).WithField("dirPath", dirPath).Error("Failed to create bucket directory")
-			return c.Status(500).JSON(fiber.Map{"error": "failed to create directory"})
+			requestid.Log(c).WithError(err).WithField("dirPath", dirPath).Error("Failed to create bucket directory")
+			return apierror.Send(c, apierror.InternalError, "failed to create directory")
 		}
 
 		// Save file to disk
 		filePath := filepath.Join(dirPath, versionedFileName)
-		if err := c.SaveFile(file, filePath); err != nil {
-			log.WithError(err).WithField("filePath", filePath).Error("Failed to save file to disk")
-			return c.Status(500).JSON(fiber.Map{"error": "failed to save file"})
+		if err := saveObject(c, file, filePath); err != nil {
+			requestid.Log(c).WithError(err).WithField("filePath", filePath).Error("Failed to save file to disk")
+			return apierror.Send(c, apierror.InternalError, "failed to save file")
 		}
 
 		// Save file metadata in DB
@@ -396,17 +499,22 @@ func UploadFile(DB *gorm.DB) fiber.Handler {
 			BucketID:    bucket.ID,
 			Size:        file.Size,
 			ContentType: file.Header.Get("Content-Type"),
+			Checksum:    fileChecksum(filePath),
 			VersionID:   versionID,
 			IsLatest:    true,
+
+			StorageClass: class,
 		}
+		objectlock.ApplyDefaultRetention(&bucket, &newFile)
 
 		if err := DB.Create(&newFile).Error; err != nil {
-			log.WithError(err).WithField("file", fileName).Error("Failed to insert file metadata")
-			return c.Status(500).JSON(fiber.Map{"error": "failed to save file metadata"})
+			requestid.Log(c).WithError(err).WithField("file", fileName).Error("Failed to insert file metadata")
+			return apierror.Send(c, apierror.InternalError, "failed to save file metadata")
 		}
+		notifier.ObjectEvent(&bucket, notify.ObjectCreatedPut, &newFile, user.ID)
 
 		// Success response
-		log.WithFields(log.Fields{
+		requestid.Log(c).WithFields(log.Fields{
 			"user_id":   user.ID,
 			"bucket":    bucketName,
 			"file":      fileName,
@@ -423,38 +531,53 @@ func UploadFile(DB *gorm.DB) fiber.Handler {
 	}
 }
 
-func UploadFileMultipart(DB *gorm.DB) fiber.Handler {
+func UploadFileMultipart(DB *gorm.DB, notifier *notify.Notifier) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		bucketName := c.Params("bucketName", "")
 		if bucketName == "" {
-			return c.Status(400).JSON(fiber.Map{"error": "bucket name is required"})
+			return apierror.Send(c, apierror.InvalidArgument, "bucket name is required")
+		}
+		class, ok := storageClass(c)
+		if !ok {
+			return apierror.Send(c, apierror.InvalidArgument, "invalid storage class")
 		}
 
 		form, err := c.MultipartForm()
 		if err != nil {
-			log.WithError(err).Error("UploadFileMultipart: reading form error")
-			return c.Status(400).JSON(fiber.Map{"error": "failed to read multipart form"})
+			requestid.Log(c).WithError(err).Error("UploadFileMultipart: reading form error")
+			return apierror.Send(c, apierror.InvalidArgument, "failed to read multipart form")
 		}
 
 		// validate bucket
 		var bucket db.Bucket
 		if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil {
-			log.WithError(err).WithField("bucket", bucketName).Warn("Bucket not found")
-			return c.Status(404).JSON(fiber.Map{"error": "bucket not found"})
+			requestid.Log(c).WithError(err).WithField("bucket", bucketName).Warn("Bucket not found")
+			return apierror.Send(c, apierror.NoSuchBucket, "bucket not found")
 		}
 
 		// validate user
 		user, ok := c.Locals("user").(*db.User)
 		if !ok || bucket.UserID != user.ID {
-			log.WithFields(log.Fields{"bucket": bucketName, "user_id": user.ID}).Warn("Unauthorized upload attempt")
-			return c.Status(403).JSON(fiber.Map{"error": "forbidden"})
+			requestid.Log(c).WithFields(log.Fields{"bucket": bucketName, "user_id": user.ID}).Warn("Unauthorized upload attempt")
+			return apierror.Send(c, apierror.AccessDenied, "forbidden")
+		}
+
+		// the whole form has to fit, so a batch is never half stored for quota
+		var totalSize, maxSize int64
+		for _, file := range form.File["files"] {
+			totalSize += file.Size
+			maxSize = max(maxSize, file.Size)
+		}
+		if err := quota.CheckUpload(DB, user, &bucket, int64(len(form.File["files"])), totalSize, maxSize); err != nil {
+			return quotaError(c, err)
 		}
 
 		uploadedFiles := []fiber.Map{}
-		dirPath := fmt.Sprintf("./storage/%s", bucketName)
+		dirPath := utils.BucketDir(bucketName)
 		if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
-			log.WithError(err).WithField("dirPath", dirPath).Error("Failed to create bucket directory")
-			return c.Status(500).JSON(fiber.Map{"error": "failed to create directory"})
+			requestid.Log(c).WithError(err).WithField("dirPath", dirPath).Error("Failed to create bucket directory")
+			return apierror.Send(c, apierror.InternalError, "failed to create directory")
 		}
 
 		// loop over all uploaded files
@@ -474,10 +597,11 @@ func UploadFileMultipart(DB *gorm.DB) fiber.Handler {
 				// check if file exists
 				var existing db.File
 				if err := DB.Where("bucket_id = ? AND file_name = ? AND is_latest = ?", bucket.ID, fileName, true).First(&existing).Error; err == nil {
-					log.WithFields(log.Fields{"bucket": bucketName, "file": fileName}).Warn("File already exists and versioning disabled")
+					requestid.Log(c).WithFields(log.Fields{"bucket": bucketName, "file": fileName}).Warn("File already exists and versioning disabled")
 					uploadedFiles = append(uploadedFiles, fiber.Map{
 						"fileName": fileName,
 						"error":    "file already exists (versioning disabled)",
+						"code":     apierror.ObjectAlreadyExists,
 					})
 					continue
 				}
@@ -486,11 +610,12 @@ func UploadFileMultipart(DB *gorm.DB) fiber.Handler {
 
 			// save file to disk
 			filePath := filepath.Join(dirPath, versionedFileName)
-			if err := c.SaveFile(file, filePath); err != nil {
-				log.WithError(err).WithField("filePath", filePath).Error("Failed to save file to disk")
+			if err := saveObject(c, file, filePath); err != nil {
+				requestid.Log(c).WithError(err).WithField("filePath", filePath).Error("Failed to save file to disk")
 				uploadedFiles = append(uploadedFiles, fiber.Map{
 					"fileName": fileName,
 					"error":    "failed to save file",
+					"code":     apierror.InternalError,
 				})
 				continue
 			}
@@ -502,19 +627,25 @@ func UploadFileMultipart(DB *gorm.DB) fiber.Handler {
 				BucketID:    bucket.ID,
 				Size:        file.Size,
 				ContentType: file.Header.Get("Content-Type"),
+				Checksum:    fileChecksum(filePath),
 				VersionID:   versionID,
 				IsLatest:    true,
+
+				StorageClass: class,
 			}
+			objectlock.ApplyDefaultRetention(&bucket, &newFile)
 			if err := DB.Create(&newFile).Error; err != nil {
-				log.WithError(err).WithField("file", fileName).Error("Failed to insert file metadata")
+				requestid.Log(c).WithError(err).WithField("file", fileName).Error("Failed to insert file metadata")
 				uploadedFiles = append(uploadedFiles, fiber.Map{
 					"fileName": fileName,
 					"error":    "failed to save metadata",
+					"code":     apierror.InternalError,
 				})
 				continue
 			}
+			notifier.ObjectEvent(&bucket, notify.ObjectCreatedPost, &newFile, user.ID)
 
-			log.WithFields(log.Fields{
+			requestid.Log(c).WithFields(log.Fields{
 				"user_id": user.ID,
 				"bucket":  bucketName,
 				"file":    fileName,
@@ -537,28 +668,23 @@ func UploadFileMultipart(DB *gorm.DB) fiber.Handler {
 	}
 }
 
-func DeleteFile(DB *gorm.DB) fiber.Handler {
+func DeleteFile(DB *gorm.DB, notifier *notify.Notifier) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		bucketName := c.Params("bucketName")
 		fileName := c.Params("fileName")
 		versionID := c.Query("versionID")
 
 		if bucketName == "" || fileName == "" {
-			return c.Status(400).JSON(fiber.Map{"error": "bucketName and fileName are required"})
+			return apierror.Send(c, apierror.InvalidArgument, "bucketName and fileName are required")
 		}
 
-		var bucket db.Bucket
-		if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return c.Status(404).JSON(fiber.Map{"error": "bucket not found"})
-			}
-			return c.Status(500).JSON(fiber.Map{"error": "internal server error"})
-		}
-
-		user, ok := c.Locals("user").(*db.User)
-		if !ok || user.ID != bucket.UserID {
-			return c.Status(403).JSON(fiber.Map{"error": "forbidden"})
+		bucketRef, bypass, err := governedBucket(c, DB)
+		if bucketRef == nil {
+			return err
 		}
+		bucket := *bucketRef
+		user := c.Locals("user").(*db.User)
 
 		var file db.File
 		query := DB.Where("bucket_id = ? AND file_name = ?", bucket.ID, fileName)
@@ -570,19 +696,37 @@ func DeleteFile(DB *gorm.DB) fiber.Handler {
 
 		if err := query.First(&file).Error; err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return c.Status(404).JSON(fiber.Map{"error": "file not found"})
+				return apierror.Send(c, apierror.NoSuchKey, "file not found")
 			}
-			return c.Status(500).JSON(fiber.Map{"error": "internal server error"})
+			return apierror.Send(c, apierror.InternalError, "internal server error")
 		}
 
-		filePath := fmt.Sprintf("./storage/%s/%s", bucket.BucketName, file.FileName)
-		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to delete file from disk"})
+		// without delete markers every delete removes a version for good
+		if ok, err := requireMFADelete(c, DB, &bucket, user); !ok {
+			return err
+		}
+		if err := objectlock.CheckWritable(&file, bypass); err != nil {
+			requestid.Log(c).WithFields(log.Fields{
+				"bucket":    bucket.BucketName,
+				"file":      file.FileName,
+				"versionID": file.VersionID,
+			}).Warn("Delete blocked by object lock")
+			return apierror.Send(c, apierror.ObjectLocked, err.Error())
+		}
+
+		blobName := file.FileName
+		if bucket.Versioning && file.VersionID != "" {
+			blobName = fmt.Sprintf("%s_%s", file.VersionID, file.FileName)
+		}
+		filePath := utils.ObjectPath(bucket.BucketName, blobName)
+		if err := removeObject(c, filePath); err != nil && !os.IsNotExist(err) {
+			return apierror.Send(c, apierror.InternalError, "failed to delete file from disk")
 		}
 
 		if err := DB.Delete(&file).Error; err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "failed to delete file from DB"})
+			return apierror.Send(c, apierror.InternalError, "failed to delete file from DB")
 		}
+		notifier.ObjectEvent(&bucket, notify.ObjectRemovedDelete, &file, user.ID)
 
 		if bucket.Versioning && file.IsLatest {
 			var latest db.File
@@ -600,3 +744,44 @@ func DeleteFile(DB *gorm.DB) fiber.Handler {
 		})
 	}
 }
+
+// quotaError answers a failed quota check: EmailNotVerified when the
+// sandbox of an unverified account refused it, else 413 for an object over
+// the size limit and 403 for an exhausted quota.
+func quotaError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, quota.ErrUnverified):
+		return apierror.Send(c, apierror.EmailNotVerified, err.Error())
+	case errors.Is(err, quota.ErrObjectTooLarge):
+		return apierror.Send(c, apierror.EntityTooLarge, err.Error())
+	case errors.Is(err, quota.ErrExceeded):
+		requestid.Log(c).WithError(err).WithField("path", c.Path()).Info("Quota exceeded")
+		return apierror.Send(c, apierror.QuotaExceeded, err.Error())
+	default:
+		requestid.Log(c).WithError(err).Error("Failed to check quota")
+		return apierror.Send(c, apierror.InternalError, "failed to check quota")
+	}
+}
+
+var allowedStorageClasses = map[string]bool{
+	db.StorageClassStandard:   true,
+	db.StorageClassStandardIA: true,
+	db.StorageClassGlacier:    true,
+}
+
+// storageClass reads the optional x-amz-storage-class header of an upload.
+func storageClass(c *fiber.Ctx) (string, bool) {
+	class := strings.ToUpper(c.Get("x-amz-storage-class", db.StorageClassStandard))
+	return class, allowedStorageClasses[class]
+}
+
+// fileChecksum hashes a freshly saved upload. A failure only costs the sync
+// task a re-hash later, so it is logged rather than failing the upload.
+func fileChecksum(filePath string) string {
+	sum, err := utils.FileChecksum(filePath)
+	if err != nil {
+		log.WithError(err).WithField("filePath", filePath).Warn("Failed to checksum uploaded file")
+		return ""
+	}
+	return sum
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeadFile(t *testing.T) {
+	DB := setupTestDB(t)
+
+	owner := db.User{ID: "user-1", Email: "owner@example.com", AccessKey: "ak-1"}
+	require.NoError(t, DB.Create(&owner).Error)
+	acl := "private"
+	bucket := db.Bucket{ID: "bucket-1", BucketName: "headbucket", UserID: owner.ID, ACL: &acl, Versioning: true}
+	require.NoError(t, DB.Create(&bucket).Error)
+	file := db.File{
+		ID:                "file-1",
+		BucketID:          bucket.ID,
+		FileName:          "report.csv",
+		Size:              5,
+		ContentType:       "text/csv",
+		Checksum:          "abc123",
+		VersionID:         "v1",
+		IsLatest:          true,
+		ReplicationStatus: db.ReplicationCompleted,
+	}
+	require.NoError(t, DB.Create(&file).Error)
+
+	dir := filepath.Join(".", "storage", bucket.BucketName)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll("./storage")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "v1_report.csv"), []byte("a,b,c"), 0644))
+
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		if c.Get("X-User") == owner.ID {
+			c.Locals("user", &owner)
+		}
+		return c.Next()
+	})
+	app.Head("/api/buckets/:bucketName/files/:fileName", HeadFile(DB))
+
+	req := httptest.NewRequest("HEAD", "/api/buckets/headbucket/files/report.csv", nil)
+	req.Header.Set("X-User", owner.ID)
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "5", resp.Header.Get("Content-Length"))
+	require.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	require.Equal(t, `"abc123"`, resp.Header.Get("ETag"))
+	require.Equal(t, "v1", resp.Header.Get("x-amz-version-id"))
+	require.Equal(t, db.ReplicationCompleted, resp.Header.Get("x-amz-replication-status"))
+
+	req = httptest.NewRequest("HEAD", "/api/buckets/headbucket/files/report.csv", nil)
+	resp, err = app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, 403, resp.StatusCode)
+
+	req = httptest.NewRequest("HEAD", "/api/buckets/headbucket/files/missing.csv", nil)
+	req.Header.Set("X-User", owner.ID)
+	resp, err = app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, 404, resp.StatusCode)
+}
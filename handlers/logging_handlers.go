@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// maxLoggingPrefix leaves room in a 255 character key for the time and
+// random suffix of each log object.
+const maxLoggingPrefix = 200
+
+type BucketLoggingRequest struct {
+	TargetBucket string `json:"targetBucket"` // empty turns logging off
+	TargetPrefix string `json:"targetPrefix"`
+}
+
+func bucketLoggingView(bucket *db.Bucket) fiber.Map {
+	return fiber.Map{
+		"bucket":         bucket.BucketName,
+		"loggingEnabled": bucket.LoggingTargetBucket != "",
+		"targetBucket":   bucket.LoggingTargetBucket,
+		"targetPrefix":   bucket.LoggingTargetPrefix,
+	}
+}
+
+// PutBucketLogging turns server access logging on or off. Records of requests
+// to the bucket are delivered every few minutes as objects under the prefix
+// in a target bucket of the same owner, which may be the bucket itself. A
+// change applies within a minute.
+func PutBucketLogging(DB *gorm.DB, notifier *notify.Notifier) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+
+		var req BucketLoggingRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if req.TargetBucket == "" {
+			req.TargetPrefix = ""
+		} else {
+			if len(req.TargetPrefix) > maxLoggingPrefix {
+				return apierror.Send(c, apierror.InvalidArgument, "targetPrefix must be at most 200 characters")
+			}
+			var target db.Bucket
+			if err := DB.Where("bucket_name = ? AND user_id = ?", req.TargetBucket, bucket.UserID).First(&target).Error; err != nil {
+				return apierror.Send(c, apierror.InvalidArgument, "target bucket "+req.TargetBucket+" not found or not owned by user")
+			}
+		}
+
+		before := bucketAuditView(bucket)
+		if err := DB.Model(bucket).Updates(map[string]interface{}{
+			"logging_target_bucket": req.TargetBucket,
+			"logging_target_prefix": req.TargetPrefix,
+		}).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to save bucket logging configuration")
+			return apierror.Send(c, apierror.InternalError, "failed to save logging configuration")
+		}
+		bucket.LoggingTargetBucket = req.TargetBucket
+		bucket.LoggingTargetPrefix = req.TargetPrefix
+		audit.Record(DB, c, nil, audit.Event{
+			Action:     "bucket.put_logging",
+			TargetType: "bucket",
+			Target:     bucket.BucketName,
+			Before:     before,
+			After:      bucketAuditView(bucket),
+		})
+
+		notifier.BucketEvent(bucket, "logging", bucket.UserID)
+		requestid.Log(c).WithFields(log.Fields{
+			"bucket":        bucket.BucketName,
+			"target_bucket": req.TargetBucket,
+			"target_prefix": req.TargetPrefix,
+		}).Info("Bucket logging configuration updated")
+		return c.JSON(bucketLoggingView(bucket))
+	}
+}
+
+func GetBucketLogging(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+		return c.JSON(bucketLoggingView(bucket))
+	}
+}
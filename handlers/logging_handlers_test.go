@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketLogging(t *testing.T) {
+	DB := setupTestDB(t)
+	user := db.User{ID: "user-1", Email: "logs@example.com", AccessKey: "ak-1"}
+	require.NoError(t, DB.Create(&user).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-1", BucketName: "photos", UserID: user.ID}).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-2", BucketName: "logs", UserID: user.ID}).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-3", BucketName: "others", UserID: "user-2"}).Error)
+
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &user)
+		return c.Next()
+	})
+	app.Get("/api/buckets/:bucketName/logging", GetBucketLogging(DB))
+	app.Put("/api/buckets/:bucketName/logging", PutBucketLogging(DB, nil))
+
+	put := func(bucket, body string) int {
+		req := httptest.NewRequest("PUT", "/api/buckets/"+bucket+"/logging", strings.NewReader(body))
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	get := func(bucket string) map[string]interface{} {
+		resp, err := app.Test(httptest.NewRequest("GET", "/api/buckets/"+bucket+"/logging", nil))
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body
+	}
+
+	require.Equal(t, false, get("photos")["loggingEnabled"])
+	require.Equal(t, 400, put("photos", `{"targetBucket":"missing"}`))
+	require.Equal(t, 400, put("photos", `{"targetBucket":"others"}`))
+	require.Equal(t, 400, put("photos", `{"targetBucket":"logs","targetPrefix":"`+strings.Repeat("p", 201)+`"}`))
+	require.Equal(t, 403, put("others", `{"targetBucket":"logs"}`))
+
+	require.Equal(t, 200, put("photos", `{"targetBucket":"logs","targetPrefix":"photos/"}`))
+	body := get("photos")
+	require.Equal(t, true, body["loggingEnabled"])
+	require.Equal(t, "logs", body["targetBucket"])
+	require.Equal(t, "photos/", body["targetPrefix"])
+
+	require.Equal(t, 200, put("photos", `{"targetBucket":"","targetPrefix":"ignored/"}`))
+	body = get("photos")
+	require.Equal(t, false, body["loggingEnabled"])
+	require.Equal(t, "", body["targetPrefix"])
+}
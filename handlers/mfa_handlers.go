@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/metrics"
+	"github.com/SysTechSalihY/mini-s3-clone/mfa"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+type EnrollMFARequest struct {
+	Password string `json:"password"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+type DisableMFARequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type MFADeleteRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// requireMFA checks code when user has MFA enabled; users without MFA pass.
+// On failure the returned error is the already written response.
+func requireMFA(c *fiber.Ctx, DB *gorm.DB, user *db.User, code string) (bool, error) {
+	if !user.MFAEnabled {
+		return true, nil
+	}
+	if code == "" {
+		return false, apierror.Send(c, apierror.MFARequired, "MFA code required")
+	}
+	if err := mfa.Verify(DB, user, code); err != nil {
+		if errors.Is(err, mfa.ErrInvalidCode) {
+			metrics.AuthFailures.WithLabelValues("invalid_mfa_code").Inc()
+			requestid.Log(c).WithField("user_id", user.ID).Warn("Invalid MFA code")
+			return false, apierror.Send(c, apierror.MFARequired, "invalid MFA code")
+		}
+		requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to verify MFA code")
+		return false, apierror.Send(c, apierror.InternalError, "failed to verify MFA code")
+	}
+	return true, nil
+}
+
+// requireMFADelete guards the permanent deletion of versions in bucket: with
+// MFA delete on, the owner's code must come in the X-MFA-Code header. An
+// owner who has since lost MFA cannot delete until they enroll again.
+func requireMFADelete(c *fiber.Ctx, DB *gorm.DB, bucket *db.Bucket, user *db.User) (bool, error) {
+	if !bucket.MFADelete {
+		return true, nil
+	}
+	if !user.MFAEnabled {
+		return false, apierror.Send(c, apierror.AccessDenied, "bucket has MFA delete enabled; enable MFA on your account to delete versions")
+	}
+	return requireMFA(c, DB, user, c.Get(mfa.Header))
+}
+
+// EnrollMFA starts MFA enrollment: it creates a TOTP secret and returns it
+// with its otpauth:// URI for a QR code. MFA is enabled only once
+// ConfirmMFA sees a code of it; enrolling again replaces a pending secret.
+func EnrollMFA(DB *gorm.DB, issuer string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		var req EnrollMFARequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if user.MFAEnabled {
+			return apierror.Send(c, apierror.InvalidArgument, "MFA is already enabled")
+		}
+		if !passwordMatches(user, req.Password) {
+			return apierror.Send(c, apierror.AccessDenied, "current password is incorrect")
+		}
+
+		secret, err := mfa.GenerateSecret()
+		if err != nil {
+			return apierror.Send(c, apierror.InternalError, "failed to generate MFA secret")
+		}
+		if err := DB.Model(user).Updates(map[string]interface{}{"mfa_secret": secret, "mfa_last_step": 0}).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to save MFA secret")
+			return apierror.Send(c, apierror.InternalError, "failed to start MFA enrollment")
+		}
+		return c.JSON(fiber.Map{
+			"secret": secret,
+			"uri":    mfa.ProvisioningURI(issuer, user.Email, secret),
+		})
+	}
+}
+
+// ConfirmMFA enables MFA with a first code of the pending secret and returns
+// the recovery codes, which are not shown again.
+func ConfirmMFA(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		var req MFACodeRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if user.MFAEnabled {
+			return apierror.Send(c, apierror.InvalidArgument, "MFA is already enabled")
+		}
+		if user.MFASecret == "" {
+			return apierror.Send(c, apierror.InvalidArgument, "no MFA enrollment in progress")
+		}
+		if err := mfa.VerifyTOTP(DB, user, req.Code); err != nil {
+			if errors.Is(err, mfa.ErrInvalidCode) {
+				return apierror.Send(c, apierror.InvalidArgument, "invalid MFA code")
+			}
+			return apierror.Send(c, apierror.InternalError, "failed to verify MFA code")
+		}
+
+		var codes []string
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(user).Update("mfa_enabled", true).Error; err != nil {
+				return err
+			}
+			var err error
+			codes, err = mfa.NewRecoveryCodes(tx, user.ID)
+			return err
+		})
+		if err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to enable MFA")
+			return apierror.Send(c, apierror.InternalError, "failed to enable MFA")
+		}
+		audit.Record(DB, c, user, audit.Event{
+			Action:     "user.enable_mfa",
+			TargetType: "user",
+			Target:     user.ID,
+			Before:     fiber.Map{"mfaEnabled": false},
+			After:      fiber.Map{"mfaEnabled": true},
+		})
+		requestid.Log(c).WithField("user_id", user.ID).Info("MFA enabled")
+
+		return c.JSON(fiber.Map{"mfaEnabled": true, "recoveryCodes": codes})
+	}
+}
+
+// DisableMFA turns MFA off given the password and a code. Buckets with MFA
+// delete must have it turned off first.
+func DisableMFA(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		var req DisableMFARequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if !user.MFAEnabled {
+			return apierror.Send(c, apierror.InvalidArgument, "MFA is not enabled")
+		}
+		if !passwordMatches(user, req.Password) {
+			return apierror.Send(c, apierror.AccessDenied, "current password is incorrect")
+		}
+		if ok, err := requireMFA(c, DB, user, req.Code); !ok {
+			return err
+		}
+		var guarded int64
+		if err := DB.Model(&db.Bucket{}).Where("user_id = ? AND mfa_delete = ?", user.ID, true).Count(&guarded).Error; err != nil {
+			return apierror.Send(c, apierror.InternalError, "database error")
+		}
+		if guarded > 0 {
+			return apierror.Send(c, apierror.InvalidArgument, "turn off MFA delete on your buckets first")
+		}
+
+		if err := mfa.Disable(DB, user.ID); err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to disable MFA")
+			return apierror.Send(c, apierror.InternalError, "failed to disable MFA")
+		}
+		audit.Record(DB, c, user, audit.Event{
+			Action:     "user.disable_mfa",
+			TargetType: "user",
+			Target:     user.ID,
+			Before:     fiber.Map{"mfaEnabled": true},
+			After:      fiber.Map{"mfaEnabled": false},
+		})
+		requestid.Log(c).WithField("user_id", user.ID).Info("MFA disabled")
+
+		return c.JSON(fiber.Map{"mfaEnabled": false})
+	}
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes, given a
+// code, and returns the new ones.
+func RegenerateRecoveryCodes(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		var req MFACodeRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if !user.MFAEnabled {
+			return apierror.Send(c, apierror.InvalidArgument, "MFA is not enabled")
+		}
+		if ok, err := requireMFA(c, DB, user, req.Code); !ok {
+			return err
+		}
+
+		codes, err := mfa.NewRecoveryCodes(DB, user.ID)
+		if err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to create recovery codes")
+			return apierror.Send(c, apierror.InternalError, "failed to create recovery codes")
+		}
+		audit.Record(DB, c, user, audit.Event{Action: "user.regenerate_recovery_codes", TargetType: "user", Target: user.ID})
+
+		return c.JSON(fiber.Map{"recoveryCodes": codes})
+	}
+}
+
+// PutBucketMFADelete turns MFA delete on or off for a versioned bucket. Both
+// need a code of the owner in the X-MFA-Code header.
+func PutBucketMFADelete(DB *gorm.DB, notifier *notify.Notifier) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+		user := c.Locals("user").(*db.User)
+
+		var req MFADeleteRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if !bucket.Versioning {
+			return apierror.Send(c, apierror.InvalidArgument, "MFA delete requires a versioned bucket")
+		}
+		if !user.MFAEnabled {
+			return apierror.Send(c, apierror.InvalidArgument, "MFA delete requires MFA on your account")
+		}
+		if ok, err := requireMFA(c, DB, user, c.Get(mfa.Header)); !ok {
+			return err
+		}
+
+		before := bucketAuditView(bucket)
+		if err := DB.Model(bucket).Update("mfa_delete", req.Enabled).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to save MFA delete")
+			return apierror.Send(c, apierror.InternalError, "failed to save MFA delete")
+		}
+		audit.Record(DB, c, user, audit.Event{
+			Action:     "bucket.put_mfa_delete",
+			TargetType: "bucket",
+			Target:     bucket.BucketName,
+			Before:     before,
+			After:      bucketAuditView(bucket),
+		})
+		notifier.BucketEvent(bucket, "mfa-delete", bucket.UserID)
+		requestid.Log(c).WithFields(log.Fields{
+			"bucket":    bucket.BucketName,
+			"mfaDelete": req.Enabled,
+		}).Info("MFA delete updated")
+		return c.JSON(fiber.Map{"bucket": bucket.BucketName, "mfaDelete": bucket.MFADelete})
+	}
+}
+
+func GetBucketMFADelete(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+		return c.JSON(fiber.Map{"bucket": bucket.BucketName, "mfaDelete": bucket.MFADelete})
+	}
+}
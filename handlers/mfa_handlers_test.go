@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/auth"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/mfa"
+	"github.com/SysTechSalihY/mini-s3-clone/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMFA(t *testing.T) {
+	DB := setupTestDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password1"), bcrypt.DefaultCost)
+	user := db.User{ID: uuid.NewString(), Email: "mfa@example.com", PasswordHash: string(hash), AccessKey: "ak-mfa", SecretKey: "sk-mfa", IsVerified: true}
+	require.NoError(t, DB.Create(&user).Error)
+	admin := db.User{ID: uuid.NewString(), Email: "admin@example.com", AccessKey: "ak-admin", UserRole: "admin"}
+	require.NoError(t, DB.Create(&admin).Error)
+	bucket := db.Bucket{ID: uuid.NewString(), BucketName: "mfabucket", UserID: user.ID, Region: "USA", Versioning: true}
+	require.NoError(t, DB.Create(&bucket).Error)
+	sessions := &auth.Sessions{Secret: []byte("0123456789abcdef0123456789abcdef"), AccessTTL: time.Minute, RefreshTTL: time.Hour}
+
+	app := setupFiber()
+	app.Post("/api/auth/login", Login(DB, sessions, nil, nil))
+	app.Post("/api/auth/secret-key", CreateSecretKey(DB, nil, nil))
+	// load the caller afresh on every request, as AuthMiddleware does
+	app.Use(func(c *fiber.Ctx) error {
+		var caller db.User
+		require.NoError(t, DB.First(&caller, "id = ?", c.Get("X-Test-User")).Error)
+		c.Locals("user", &caller)
+		return c.Next()
+	})
+	app.Post("/api/account/mfa", EnrollMFA(DB, "mini-s3"))
+	app.Post("/api/account/mfa/confirm", ConfirmMFA(DB))
+	app.Delete("/api/account/mfa", DisableMFA(DB))
+	app.Post("/api/account/mfa/recovery-codes", RegenerateRecoveryCodes(DB))
+	app.Put("/api/buckets/:bucketName/mfa-delete", PutBucketMFADelete(DB, nil))
+	app.Delete("/api/buckets/:bucketName/files/:fileName", DeleteFile(DB, nil))
+	app.Post("/api/tasks/empty-bucket/:bucketName", EnqueueEmptyBucketTask(nil, DB))
+	app.Post("/api/admin/users/:userID/rotate-keys", middleware.RequireMFA(DB, true), AdminRotateUserKeys(DB))
+
+	do := func(method, path string, caller *db.User, code string, body interface{}, out interface{}) int {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Test-User", caller.ID)
+		if code != "" {
+			req.Header.Set(mfa.Header, code)
+		}
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		if out != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+	// every TOTP code is accepted once, so forget the last one between steps
+	totp := func(secret string) string {
+		require.NoError(t, DB.Model(&db.User{}).Where("mfa_secret = ?", secret).Update("mfa_last_step", 0).Error)
+		code, err := mfa.Code(secret, time.Now())
+		require.NoError(t, err)
+		return code
+	}
+
+	// enrollment
+	require.Equal(t, 403, do("POST", "/api/account/mfa", &user, "", EnrollMFARequest{Password: "wrong"}, nil))
+	var enrolled struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	require.Equal(t, 200, do("POST", "/api/account/mfa", &user, "", EnrollMFARequest{Password: "password1"}, &enrolled))
+	require.Equal(t, mfa.ProvisioningURI("mini-s3", user.Email, enrolled.Secret), enrolled.URI)
+	require.Equal(t, 201, do("POST", "/api/auth/login", &user, "", LoginRequest{Email: user.Email, Password: "password1"}, nil), "pending until confirmed")
+	require.Equal(t, 400, do("POST", "/api/account/mfa/confirm", &user, "", MFACodeRequest{Code: "000000"}, nil))
+	var confirmed struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	require.Equal(t, 200, do("POST", "/api/account/mfa/confirm", &user, "", MFACodeRequest{Code: totp(enrolled.Secret)}, &confirmed))
+	require.Len(t, confirmed.RecoveryCodes, mfa.RecoveryCodes)
+	var stored db.MFARecoveryCode
+	require.NoError(t, DB.First(&stored, "user_id = ?", user.ID).Error)
+	require.NotContains(t, confirmed.RecoveryCodes, stored.CodeHash, "recovery codes are stored hashed")
+
+	// logins and key creation need a code from now on
+	require.Equal(t, 401, do("POST", "/api/auth/login", &user, "", LoginRequest{Email: user.Email, Password: "password1"}, nil))
+	require.Equal(t, 401, do("POST", "/api/auth/login", &user, "", LoginRequest{Email: user.Email, Password: "password1", MFACode: "123456"}, nil))
+	require.Equal(t, 201, do("POST", "/api/auth/login", &user, "", LoginRequest{Email: user.Email, Password: "password1", MFACode: totp(enrolled.Secret)}, nil))
+	require.Equal(t, 401, do("POST", "/api/auth/secret-key", &user, "", CreateAccessRequest{Email: user.Email, Password: "password1"}, nil))
+	require.Equal(t, 200, do("POST", "/api/auth/secret-key", &user, "", CreateAccessRequest{Email: user.Email, Password: "password1", MFACode: confirmed.RecoveryCodes[0]}, nil))
+	require.Equal(t, 401, do("POST", "/api/auth/secret-key", &user, "", CreateAccessRequest{Email: user.Email, Password: "password1", MFACode: confirmed.RecoveryCodes[0]}, nil), "recovery codes work once")
+
+	// MFA delete
+	file := db.File{ID: uuid.NewString(), BucketID: bucket.ID, FileName: "a.txt", VersionID: uuid.NewString(), IsLatest: true}
+	require.NoError(t, DB.Create(&file).Error)
+	require.Equal(t, 401, do("PUT", "/api/buckets/mfabucket/mfa-delete", &user, "", MFADeleteRequest{Enabled: true}, nil))
+	require.Equal(t, 200, do("PUT", "/api/buckets/mfabucket/mfa-delete", &user, totp(enrolled.Secret), MFADeleteRequest{Enabled: true}, nil))
+	require.Equal(t, 401, do("DELETE", "/api/buckets/mfabucket/files/a.txt?versionID="+file.VersionID, &user, "", nil, nil))
+	require.Equal(t, 401, do("POST", "/api/tasks/empty-bucket/mfabucket", &user, "", nil, nil))
+	require.Equal(t, 400, do("DELETE", "/api/account/mfa", &user, "", DisableMFARequest{Password: "password1", Code: totp(enrolled.Secret)}, nil), "buckets still need MFA")
+	require.Equal(t, 200, do("DELETE", "/api/buckets/mfabucket/files/a.txt?versionID="+file.VersionID, &user, totp(enrolled.Secret), nil, nil))
+
+	// destructive admin routes need the admin's own MFA
+	require.Equal(t, 403, do("POST", "/api/admin/users/"+user.ID+"/rotate-keys", &admin, "", nil, nil))
+	adminSecret, _ := mfa.GenerateSecret()
+	require.NoError(t, DB.Model(&admin).Updates(map[string]interface{}{"mfa_secret": adminSecret, "mfa_enabled": true}).Error)
+	require.Equal(t, 401, do("POST", "/api/admin/users/"+user.ID+"/rotate-keys", &admin, "", nil, nil))
+	require.Equal(t, 200, do("POST", "/api/admin/users/"+user.ID+"/rotate-keys", &admin, totp(adminSecret), nil, nil))
+
+	var regenerated struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	require.Equal(t, 401, do("POST", "/api/account/mfa/recovery-codes", &user, "", MFACodeRequest{}, nil))
+	require.Equal(t, 200, do("POST", "/api/account/mfa/recovery-codes", &user, "", MFACodeRequest{Code: totp(enrolled.Secret)}, &regenerated))
+	require.Len(t, regenerated.RecoveryCodes, mfa.RecoveryCodes)
+	require.Equal(t, 401, do("POST", "/api/auth/login", &user, "", LoginRequest{Email: user.Email, Password: "password1", MFACode: confirmed.RecoveryCodes[1]}, nil))
+
+	// turning MFA off
+	require.Equal(t, 200, do("PUT", "/api/buckets/mfabucket/mfa-delete", &user, totp(enrolled.Secret), MFADeleteRequest{Enabled: false}, nil))
+	require.Equal(t, 403, do("DELETE", "/api/account/mfa", &user, "", DisableMFARequest{Password: "wrong", Code: totp(enrolled.Secret)}, nil))
+	require.Equal(t, 200, do("DELETE", "/api/account/mfa", &user, "", DisableMFARequest{Password: "password1", Code: totp(enrolled.Secret)}, nil))
+	require.Equal(t, 201, do("POST", "/api/auth/login", &user, "", LoginRequest{Email: user.Email, Password: "password1"}, nil))
+	var codes int64
+	DB.Model(&db.MFARecoveryCode{}).Where("user_id = ?", user.ID).Count(&codes)
+	require.Zero(t, codes)
+}
@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const maxWebhooksPerBucket = 10
+
+type WebhookConfig struct {
+	ID     string   `json:"id,omitempty"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Prefix string   `json:"prefix,omitempty"`
+	Suffix string   `json:"suffix,omitempty"`
+	// kept from the webhook with this ID, or else this URL, when empty and
+	// generated for new webhooks; only returned by PUT
+	Secret string `json:"secret,omitempty"`
+	// replaces a kept secret with a generated one
+	RotateSecret bool `json:"rotateSecret,omitempty"`
+}
+
+type BucketNotificationRequest struct {
+	Webhooks []WebhookConfig `json:"webhooks"`
+}
+
+// ownedBucket loads the :bucketName bucket for its owner. On failure the
+// returned error is the already written response.
+func ownedBucket(c *fiber.Ctx, DB *gorm.DB) (*db.Bucket, error) {
+	user, ok := c.Locals("user").(*db.User)
+	if !ok {
+		return nil, apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+	}
+	bucketName := c.Params("bucketName")
+	var bucket db.Bucket
+	if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apierror.Send(c, apierror.NoSuchBucket, "bucket not found")
+		}
+		requestid.Log(c).WithError(err).WithField("bucket", bucketName).Error("Database error while fetching bucket")
+		return nil, apierror.Send(c, apierror.InternalError, "database error")
+	}
+	if bucket.UserID != user.ID {
+		requestid.Log(c).WithFields(log.Fields{"bucket": bucketName, "user_id": user.ID}).Warn("Unauthorized bucket access attempt")
+		return nil, apierror.Send(c, apierror.AccessDenied, "forbidden")
+	}
+	return &bucket, nil
+}
+
+func validateWebhookConfig(ctx context.Context, w *WebhookConfig) error {
+	if err := notify.ValidateURL(ctx, w.URL); err != nil {
+		return err
+	}
+	if len(w.Events) == 0 {
+		return errors.New("at least one event is required")
+	}
+	for i, name := range w.Events {
+		normalized, ok := notify.NormalizeEventName(name)
+		if !ok || strings.Contains(normalized, ",") {
+			return fmt.Errorf("unsupported event %q", name)
+		}
+		w.Events[i] = "s3:" + normalized
+	}
+	return nil
+}
+
+func webhookView(n *db.BucketNotification, withSecret bool) WebhookConfig {
+	view := WebhookConfig{
+		ID:     n.ID,
+		URL:    n.URL,
+		Events: n.EventList(),
+		Prefix: n.Prefix,
+		Suffix: n.Suffix,
+	}
+	if withSecret {
+		view.Secret = n.Secret
+	}
+	return view
+}
+
+// webhookAuditViews are webhook configurations without their secrets, for
+// the audit log.
+func webhookAuditViews(configs []db.BucketNotification) []WebhookConfig {
+	views := make([]WebhookConfig, 0, len(configs))
+	for i := range configs {
+		views = append(views, webhookView(&configs[i], false))
+	}
+	return views
+}
+
+// previousSecret is the secret of the saved webhook that w edits: the one
+// with its ID, or else the first with its URL. A changed URL gets a new
+// secret, as it is a new receiver.
+func previousSecret(previous []db.BucketNotification, w *WebhookConfig) string {
+	for i := range previous {
+		if w.ID != "" && previous[i].ID == w.ID && previous[i].URL == w.URL {
+			return previous[i].Secret
+		}
+	}
+	for i := range previous {
+		if previous[i].URL == w.URL {
+			return previous[i].Secret
+		}
+	}
+	return ""
+}
+
+// PutBucketNotification replaces the bucket's webhook configuration, like
+// S3's PutBucketNotificationConfiguration. An empty list turns notifications
+// off. Webhooks sent back as GET returned them keep their IDs, so pending
+// deliveries still find them, and their secrets.
+func PutBucketNotification(DB *gorm.DB, notifier *notify.Notifier) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+
+		var req BucketNotificationRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if len(req.Webhooks) > maxWebhooksPerBucket {
+			return apierror.Send(c, apierror.InvalidArgument, fmt.Sprintf("at most %d webhooks per bucket", maxWebhooksPerBucket))
+		}
+
+		var previous []db.BucketNotification
+		if err := DB.Where("bucket_id = ?", bucket.ID).Order("created_at").Find(&previous).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to fetch bucket notifications")
+			return apierror.Send(c, apierror.InternalError, "failed to save notification configuration")
+		}
+
+		configs := make([]db.BucketNotification, 0, len(req.Webhooks))
+		kept := make(map[string]bool, len(req.Webhooks))
+		for i := range req.Webhooks {
+			w := &req.Webhooks[i]
+			if err := validateWebhookConfig(c.UserContext(), w); err != nil {
+				return apierror.Send(c, apierror.InvalidArgument, err.Error())
+			}
+			if w.Secret == "" && !w.RotateSecret {
+				w.Secret = previousSecret(previous, w)
+			}
+			if w.Secret == "" {
+				secret := make([]byte, 32)
+				if _, err := rand.Read(secret); err != nil {
+					requestid.Log(c).WithError(err).Error("Failed to generate webhook secret")
+					return apierror.Send(c, apierror.InternalError, "internal server error")
+				}
+				w.Secret = hex.EncodeToString(secret)
+			}
+			cfg := db.BucketNotification{ID: uuid.NewString(), BucketID: bucket.ID}
+			for j := range previous {
+				if w.ID != "" && previous[j].ID == w.ID {
+					if kept[w.ID] {
+						return apierror.Send(c, apierror.InvalidArgument, fmt.Sprintf("duplicate webhook id %s", w.ID))
+					}
+					cfg = previous[j]
+					kept[w.ID] = true
+				}
+			}
+			cfg.URL = w.URL
+			cfg.Events = strings.Join(w.Events, ",")
+			cfg.Prefix = w.Prefix
+			cfg.Suffix = w.Suffix
+			cfg.Secret = w.Secret
+			configs = append(configs, cfg)
+		}
+
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			for i := range previous {
+				if kept[previous[i].ID] {
+					continue
+				}
+				if err := tx.Delete(&previous[i]).Error; err != nil {
+					return err
+				}
+			}
+			for i := range configs {
+				var err error
+				if kept[configs[i].ID] {
+					err = tx.Save(&configs[i]).Error
+				} else {
+					err = tx.Create(&configs[i]).Error
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to save bucket notifications")
+			return apierror.Send(c, apierror.InternalError, "failed to save notification configuration")
+		}
+
+		webhooks := make([]WebhookConfig, 0, len(configs))
+		for i := range configs {
+			webhooks = append(webhooks, webhookView(&configs[i], true))
+		}
+		audit.Record(DB, c, nil, audit.Event{
+			Action:     "bucket.put_notification",
+			TargetType: "bucket",
+			Target:     bucket.BucketName,
+			Before:     fiber.Map{"webhooks": webhookAuditViews(previous)},
+			After:      fiber.Map{"webhooks": webhookAuditViews(configs)},
+		})
+		notifier.BucketEvent(bucket, "notification", bucket.UserID)
+		requestid.Log(c).WithFields(log.Fields{
+			"bucket":   bucket.BucketName,
+			"webhooks": len(configs),
+		}).Info("Bucket notification configuration updated")
+		return c.JSON(fiber.Map{"bucket": bucket.BucketName, "webhooks": webhooks})
+	}
+}
+
+func GetBucketNotification(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+
+		var configs []db.BucketNotification
+		if err := DB.Where("bucket_id = ?", bucket.ID).Order("created_at").Find(&configs).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to fetch bucket notifications")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch notification configuration")
+		}
+		webhooks := make([]WebhookConfig, 0, len(configs))
+		for i := range configs {
+			webhooks = append(webhooks, webhookView(&configs[i], false))
+		}
+		return c.JSON(fiber.Map{"bucket": bucket.BucketName, "webhooks": webhooks})
+	}
+}
+
+// ListNotificationDeadLetters returns the webhook deliveries of the bucket
+// that failed permanently, newest first.
+func ListNotificationDeadLetters(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+		page, limit, err := parsePagination(c)
+		if err != nil {
+			return apierror.Send(c, apierror.InvalidArgument, err.Error())
+		}
+
+		query := DB.Model(&db.NotificationDeadLetter{}).Where("bucket_id = ?", bucket.ID)
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to count dead letters")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch dead letters")
+		}
+		var deadLetters []db.NotificationDeadLetter
+		if err := query.Order("created_at desc").
+			Offset((page - 1) * limit).
+			Limit(limit).
+			Find(&deadLetters).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to fetch dead letters")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch dead letters")
+		}
+
+		items := make([]fiber.Map, 0, len(deadLetters))
+		for _, d := range deadLetters {
+			items = append(items, fiber.Map{
+				"id":              d.ID,
+				"notification_id": d.NotificationID,
+				"url":             d.URL,
+				"event":           d.EventName,
+				"payload":         rawJSON(&d.Payload),
+				"attempts":        d.Attempts,
+				"last_error":      d.LastError,
+				"created_at":      d.CreatedAt,
+			})
+		}
+		return c.JSON(fiber.Map{
+			"dead_letters": items,
+			"page":         page,
+			"limit":        limit,
+			"total":        total,
+		})
+	}
+}
+
+// ListBucketEvents reads the bucket's object event stream. Pass the returned
+// next_cursor as ?cursor= to poll for events after the ones already seen.
+func ListBucketEvents(DB *gorm.DB, rdb *redis.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		cursor := c.Query("cursor")
+		if cursor != "" && !notify.ValidStreamCursor(cursor) {
+			return apierror.Send(c, apierror.InvalidArgument, "invalid cursor")
+		}
+		limit, err := strconv.Atoi(c.Query("limit", "50"))
+		if err != nil || limit < 1 || limit > 100 {
+			return apierror.Send(c, apierror.InvalidArgument, "limit must be between 1 and 100")
+		}
+
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+
+		events, err := notify.ReadBucketEvents(c.Context(), rdb, bucket.ID, cursor, int64(limit))
+		if err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to read bucket event stream")
+			return apierror.Send(c, apierror.InternalError, "failed to read events")
+		}
+		nextCursor := cursor
+		if len(events) > 0 {
+			nextCursor = events[len(events)-1].ID
+		}
+		return c.JSON(fiber.Map{
+			"bucket":      bucket.BucketName,
+			"events":      events,
+			"next_cursor": nextCursor,
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketNotificationSecrets(t *testing.T) {
+	DB := setupTestDB(t)
+	user := db.User{ID: "user-1", Email: "hooks@example.com", AccessKey: "ak-1"}
+	require.NoError(t, DB.Create(&user).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-1", BucketName: "hooks", UserID: user.ID}).Error)
+
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &user)
+		return c.Next()
+	})
+	app.Get("/api/buckets/:bucketName/notification", GetBucketNotification(DB))
+	app.Put("/api/buckets/:bucketName/notification", PutBucketNotification(DB, nil))
+
+	type config struct {
+		Webhooks []WebhookConfig `json:"webhooks"`
+	}
+	do := func(method string, body interface{}, out *config) int {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, "/api/buckets/hooks/notification", &buf)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		if out != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+	hook := WebhookConfig{URL: "https://93.184.216.34/hook", Events: []string{"s3:ObjectCreated:*"}}
+
+	for _, url := range []string{"http://127.0.0.1:9000/hook", "http://169.254.169.254/latest/meta-data", "http://10.1.2.3/hook"} {
+		require.Equal(t, 400, do("PUT", BucketNotificationRequest{Webhooks: []WebhookConfig{{URL: url, Events: hook.Events}}}, nil), url)
+	}
+
+	var created config
+	require.Equal(t, 200, do("PUT", BucketNotificationRequest{Webhooks: []WebhookConfig{hook}}, &created))
+	secret := created.Webhooks[0].Secret
+	require.NotEmpty(t, secret)
+
+	// GET hides the secret; sending its output back keeps it
+	var fetched config
+	require.Equal(t, 200, do("GET", nil, &fetched))
+	require.Empty(t, fetched.Webhooks[0].Secret)
+	fetched.Webhooks[0].Prefix = "images/"
+	var updated config
+	require.Equal(t, 200, do("PUT", BucketNotificationRequest{Webhooks: fetched.Webhooks}, &updated))
+	require.Equal(t, secret, updated.Webhooks[0].Secret)
+	require.Equal(t, created.Webhooks[0].ID, updated.Webhooks[0].ID, "pending deliveries still find the webhook")
+	require.Equal(t, 400, do("PUT", BucketNotificationRequest{Webhooks: []WebhookConfig{fetched.Webhooks[0], fetched.Webhooks[0]}}, nil), "duplicate ids")
+
+	rotate := updated.Webhooks[0]
+	rotate.Secret = ""
+	rotate.RotateSecret = true
+	var rotated config
+	require.Equal(t, 200, do("PUT", BucketNotificationRequest{Webhooks: []WebhookConfig{rotate}}, &rotated))
+	require.NotEqual(t, secret, rotated.Webhooks[0].Secret)
+
+	moved := rotated.Webhooks[0]
+	moved.Secret = ""
+	moved.URL = "https://93.184.216.35/hook"
+	var replaced config
+	require.Equal(t, 200, do("PUT", BucketNotificationRequest{Webhooks: []WebhookConfig{moved}}, &replaced))
+	require.NotEqual(t, rotated.Webhooks[0].Secret, replaced.Webhooks[0].Secret, "a new URL gets a new secret")
+
+	var stored []db.BucketNotification
+	require.NoError(t, DB.Where("bucket_id = ?", "bucket-1").Find(&stored).Error)
+	require.Len(t, stored, 1)
+	require.Equal(t, created.Webhooks[0].ID, stored[0].ID)
+
+	require.Equal(t, 200, do("PUT", BucketNotificationRequest{Webhooks: []WebhookConfig{}}, nil))
+	require.NoError(t, DB.Where("bucket_id = ?", "bucket-1").Find(&stored).Error)
+	require.Empty(t, stored, "webhooks missing from the request are removed")
+}
@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/objectlock"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+type ObjectLockConfigRequest struct {
+	Enabled bool   `json:"enabled"`
+	Mode    string `json:"mode,omitempty"` // default retention, GOVERNANCE or COMPLIANCE
+	Days    int    `json:"days,omitempty"`
+	Years   int    `json:"years,omitempty"`
+}
+
+type RetentionRequest struct {
+	Mode        string     `json:"mode"` // empty removes the retention
+	RetainUntil *time.Time `json:"retainUntil"`
+}
+
+type LegalHoldRequest struct {
+	Status string `json:"status"` // ON or OFF
+}
+
+// governanceBypass reads the bypass header. Only admins may send it; for
+// anyone else the returned error is the already written 403 response.
+func governanceBypass(c *fiber.Ctx, user *db.User) (bool, error) {
+	if c.Get(objectlock.BypassHeader) != "true" {
+		return false, nil
+	}
+	if user == nil || user.UserRole != "admin" {
+		requestid.Log(c).WithField("path", c.Path()).Warn("Governance bypass attempted by non-admin")
+		return false, apierror.Send(c, apierror.AccessDenied, "only admins may bypass governance retention")
+	}
+	return true, nil
+}
+
+// governedBucket loads the :bucketName bucket for its owner or, when the
+// caller is an admin sending the bypass header, for that admin whoever owns
+// it: bypassing governance retention is how admins deal with other users'
+// locked data. It returns whether the bypass was granted. On failure the
+// returned bucket is nil and the error is the already written response.
+func governedBucket(c *fiber.Ctx, DB *gorm.DB) (*db.Bucket, bool, error) {
+	user, _ := c.Locals("user").(*db.User)
+	bypass, err := governanceBypass(c, user)
+	if err != nil {
+		return nil, false, err
+	}
+	if !bypass {
+		bucket, err := ownedBucket(c, DB)
+		return bucket, false, err
+	}
+	bucketName := c.Params("bucketName")
+	var bucket db.Bucket
+	if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, apierror.Send(c, apierror.NoSuchBucket, "bucket not found")
+		}
+		requestid.Log(c).WithError(err).WithField("bucket", bucketName).Error("Database error while fetching bucket")
+		return nil, false, apierror.Send(c, apierror.InternalError, "database error")
+	}
+	if bucket.UserID != user.ID {
+		requestid.Log(c).WithFields(log.Fields{"bucket": bucketName, "admin_id": user.ID}).Warn("Admin bypassing governance retention on another user's bucket")
+	}
+	return &bucket, true, nil
+}
+
+func objectLockView(b *db.Bucket) fiber.Map {
+	view := fiber.Map{"enabled": b.ObjectLockEnabled}
+	if b.LockMode != "" {
+		view["mode"] = b.LockMode
+		view["days"] = b.LockDays
+	}
+	return view
+}
+
+// PutObjectLockConfiguration enables Object Lock on a versioned bucket and
+// sets its default retention. Like S3, Object Lock cannot be turned off
+// again once enabled; sending no mode clears the default retention.
+func PutObjectLockConfiguration(DB *gorm.DB, notifier *notify.Notifier) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+
+		var req ObjectLockConfigRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if !req.Enabled {
+			return apierror.Send(c, apierror.InvalidArgument, "object lock cannot be disabled")
+		}
+		if !bucket.Versioning {
+			return apierror.Send(c, apierror.InvalidArgument, "object lock requires a versioned bucket")
+		}
+
+		fields := map[string]interface{}{"object_lock_enabled": true, "lock_mode": "", "lock_days": 0}
+		if req.Mode != "" {
+			mode, ok := objectlock.NormalizeMode(req.Mode)
+			if !ok {
+				return apierror.Send(c, apierror.InvalidArgument, "mode must be GOVERNANCE or COMPLIANCE")
+			}
+			if (req.Days > 0) == (req.Years > 0) {
+				return apierror.Send(c, apierror.InvalidArgument, "exactly one of days or years must be set")
+			}
+			days := req.Days
+			if req.Years > 0 {
+				days = req.Years * 365
+			}
+			fields["lock_mode"] = mode
+			fields["lock_days"] = days
+		}
+
+		before := bucketAuditView(bucket)
+		if err := DB.Model(bucket).Updates(fields).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to save object lock configuration")
+			return apierror.Send(c, apierror.InternalError, "failed to save object lock configuration")
+		}
+		audit.Record(DB, c, nil, audit.Event{
+			Action:     "bucket.put_object_lock",
+			TargetType: "bucket",
+			Target:     bucket.BucketName,
+			Before:     before,
+			After:      bucketAuditView(bucket),
+		})
+		notifier.BucketEvent(bucket, "object-lock", bucket.UserID)
+		requestid.Log(c).WithFields(log.Fields{
+			"bucket": bucket.BucketName,
+			"mode":   bucket.LockMode,
+			"days":   bucket.LockDays,
+		}).Info("Object lock configuration updated")
+		return c.JSON(fiber.Map{"bucket": bucket.BucketName, "objectLock": objectLockView(bucket)})
+	}
+}
+
+func GetObjectLockConfiguration(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+		return c.JSON(fiber.Map{"bucket": bucket.BucketName, "objectLock": objectLockView(bucket)})
+	}
+}
+
+// lockedObject loads the version addressed by :fileName and ?versionID= in
+// bucket, which must have Object Lock enabled. On failure the returned file
+// is nil and the error is the already written response.
+func lockedObject(c *fiber.Ctx, DB *gorm.DB, bucket *db.Bucket) (*db.File, error) {
+	if !bucket.ObjectLockEnabled {
+		return nil, apierror.Send(c, apierror.InvalidArgument, "object lock is not enabled on this bucket")
+	}
+
+	var file db.File
+	query := DB.Where("bucket_id = ? AND file_name = ?", bucket.ID, c.Params("fileName"))
+	if versionID := c.Query("versionID"); versionID != "" {
+		query = query.Where("version_id = ?", versionID)
+	} else {
+		query = query.Where("is_latest = ?", true)
+	}
+	if err := query.First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apierror.Send(c, apierror.NoSuchKey, "file not found")
+		}
+		return nil, apierror.Send(c, apierror.InternalError, "internal server error")
+	}
+	return &file, nil
+}
+
+func PutObjectRetention(DB *gorm.DB, notifier *notify.Notifier) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, bypass, err := governedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+		file, err := lockedObject(c, DB, bucket)
+		if file == nil {
+			return err
+		}
+		user, _ := c.Locals("user").(*db.User)
+
+		var req RetentionRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		mode := ""
+		if req.Mode != "" {
+			var ok bool
+			if mode, ok = objectlock.NormalizeMode(req.Mode); !ok {
+				return apierror.Send(c, apierror.InvalidArgument, "mode must be GOVERNANCE or COMPLIANCE")
+			}
+		} else {
+			req.RetainUntil = nil
+		}
+		if err := objectlock.CheckRetentionChange(file, mode, req.RetainUntil, bypass); err != nil {
+			code := apierror.InvalidArgument
+			if errors.Is(err, objectlock.ErrLocked) {
+				code = apierror.ObjectLocked
+			}
+			return apierror.Send(c, code, err.Error())
+		}
+
+		before := fiber.Map{"mode": file.RetentionMode, "retainUntil": file.RetainUntil}
+		if err := DB.Model(file).Updates(map[string]interface{}{
+			"retention_mode": mode,
+			"retain_until":   req.RetainUntil,
+		}).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("file", file.FileName).Error("Failed to save object retention")
+			return apierror.Send(c, apierror.InternalError, "failed to save retention")
+		}
+		audit.Record(DB, c, user, audit.Event{
+			Action:     "object.put_retention",
+			TargetType: "object",
+			Target:     objectAuditTarget(c, file),
+			Before:     before,
+			After:      fiber.Map{"mode": mode, "retainUntil": req.RetainUntil, "bypassGovernance": bypass},
+		})
+		notifier.ObjectEvent(bucket, notify.ObjectRetentionPut, file, user.ID)
+		requestid.Log(c).WithFields(log.Fields{
+			"file":      file.FileName,
+			"versionID": file.VersionID,
+			"mode":      mode,
+			"bypass":    bypass,
+		}).Info("Object retention updated")
+		return c.JSON(fiber.Map{
+			"fileName":    file.FileName,
+			"versionID":   file.VersionID,
+			"mode":        mode,
+			"retainUntil": req.RetainUntil,
+		})
+	}
+}
+
+func PutObjectLegalHold(DB *gorm.DB, notifier *notify.Notifier) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+		file, err := lockedObject(c, DB, bucket)
+		if file == nil {
+			return err
+		}
+		user, _ := c.Locals("user").(*db.User)
+
+		var req LegalHoldRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil || (req.Status != "ON" && req.Status != "OFF") {
+			return apierror.Send(c, apierror.InvalidArgument, "status must be ON or OFF")
+		}
+		before := file.LegalHold
+		if err := DB.Model(file).Update("legal_hold", req.Status == "ON").Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("file", file.FileName).Error("Failed to save legal hold")
+			return apierror.Send(c, apierror.InternalError, "failed to save legal hold")
+		}
+		audit.Record(DB, c, user, audit.Event{
+			Action:     "object.put_legal_hold",
+			TargetType: "object",
+			Target:     objectAuditTarget(c, file),
+			Before:     fiber.Map{"legalHold": before},
+			After:      fiber.Map{"legalHold": req.Status == "ON"},
+		})
+		notifier.ObjectEvent(bucket, notify.ObjectLegalHoldPut, file, user.ID)
+		requestid.Log(c).WithFields(log.Fields{
+			"file":      file.FileName,
+			"versionID": file.VersionID,
+			"status":    req.Status,
+		}).Info("Object legal hold updated")
+		return c.JSON(fiber.Map{"fileName": file.FileName, "versionID": file.VersionID, "legalHold": req.Status})
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/objectlock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectLockEnforcement(t *testing.T) {
+	DB := setupTestDB(t)
+
+	owner := db.User{ID: "user-1", Email: "owner@example.com", AccessKey: "ak-1", UserRole: "user"}
+	require.NoError(t, DB.Create(&owner).Error)
+	admin := db.User{ID: "admin-1", Email: "admin@example.com", AccessKey: "ak-2", UserRole: "admin"}
+	require.NoError(t, DB.Create(&admin).Error)
+	acl := "private"
+	bucket := db.Bucket{ID: "bucket-1", BucketName: "lockbucket", UserID: owner.ID, ACL: &acl, Versioning: true, ObjectLockEnabled: true}
+	require.NoError(t, DB.Create(&bucket).Error)
+
+	until := time.Now().Add(24 * time.Hour)
+	files := []db.File{
+		{ID: "file-1", BucketID: bucket.ID, FileName: "compliance.txt", VersionID: "v1", IsLatest: true, RetentionMode: objectlock.ModeCompliance, RetainUntil: &until},
+		{ID: "file-2", BucketID: bucket.ID, FileName: "governance.txt", VersionID: "v2", IsLatest: true, RetentionMode: objectlock.ModeGovernance, RetainUntil: &until},
+		{ID: "file-3", BucketID: bucket.ID, FileName: "held.txt", VersionID: "v3", IsLatest: true, LegalHold: true},
+	}
+	for _, f := range files {
+		require.NoError(t, DB.Create(&f).Error)
+	}
+
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		if c.Get("X-Role") == "admin" {
+			c.Locals("user", &admin)
+		} else {
+			c.Locals("user", &owner)
+		}
+		return c.Next()
+	})
+	app.Delete("/api/buckets/:bucketName/files/:fileName", DeleteFile(DB, nil))
+	app.Put("/api/buckets/:bucketName/files/:fileName/retention", PutObjectRetention(DB, nil))
+	app.Put("/api/buckets/:bucketName/files/:fileName/legal-hold", PutObjectLegalHold(DB, nil))
+
+	do := func(method, path, role, body string, bypass bool) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-Role", role)
+		req.Header.Set("Content-Type", "application/json")
+		if bypass {
+			req.Header.Set(objectlock.BypassHeader, "true")
+		}
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	// compliance retention cannot be deleted or shortened, not even by an admin
+	require.Equal(t, 403, do("DELETE", "/api/buckets/lockbucket/files/compliance.txt", "admin", "", true))
+	require.Equal(t, 403, do("PUT", "/api/buckets/lockbucket/files/compliance.txt/retention", "admin", `{"mode":""}`, true))
+	later := time.Now().Add(48 * time.Hour).UTC().Format(time.RFC3339)
+	require.Equal(t, 200, do("PUT", "/api/buckets/lockbucket/files/compliance.txt/retention", "user", `{"mode":"COMPLIANCE","retainUntil":"`+later+`"}`, false))
+
+	// governance retention can only be bypassed by admins
+	require.Equal(t, 403, do("DELETE", "/api/buckets/lockbucket/files/governance.txt", "user", "", false))
+	require.Equal(t, 403, do("DELETE", "/api/buckets/lockbucket/files/governance.txt", "user", "", true))
+	// admins do not own the bucket, so only the bypass lets them in
+	require.Equal(t, 403, do("DELETE", "/api/buckets/lockbucket/files/governance.txt", "admin", "", false))
+	require.Equal(t, 200, do("DELETE", "/api/buckets/lockbucket/files/governance.txt", "admin", "", true))
+
+	// a legal hold blocks everyone until it is released
+	require.Equal(t, 403, do("DELETE", "/api/buckets/lockbucket/files/held.txt", "admin", "", true))
+	require.Equal(t, 200, do("PUT", "/api/buckets/lockbucket/files/held.txt/legal-hold", "user", `{"status":"OFF"}`, false))
+	require.Equal(t, 200, do("DELETE", "/api/buckets/lockbucket/files/held.txt", "user", "", false))
+
+	var remaining []db.File
+	require.NoError(t, DB.Where("bucket_id = ?", bucket.ID).Find(&remaining).Error)
+	require.Len(t, remaining, 1)
+	require.Equal(t, "compliance.txt", remaining[0].FileName)
+	require.True(t, remaining[0].RetainUntil.After(until))
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const maxReplicationRulesPerBucket = 10
+
+type ReplicationRuleConfig struct {
+	ID               string `json:"id,omitempty"`
+	DestBucket       string `json:"destBucket"`
+	Endpoint         string `json:"endpoint,omitempty"` // remote server base URL, empty for this server
+	AccessKey        string `json:"accessKey,omitempty"`
+	SecretKey        string `json:"secretKey,omitempty"` // write only
+	Prefix           string `json:"prefix,omitempty"`
+	ReplicateDeletes bool   `json:"replicateDeletes"`
+}
+
+type BucketReplicationRequest struct {
+	Rules []ReplicationRuleConfig `json:"rules"`
+}
+
+func validateReplicationRule(ctx context.Context, DB *gorm.DB, bucket *db.Bucket, r *ReplicationRuleConfig) error {
+	if r.DestBucket == "" {
+		return errors.New("destBucket is required")
+	}
+	if r.Endpoint != "" {
+		u, err := url.Parse(r.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("endpoint must be an absolute http or https URL")
+		}
+		if err := notify.ValidateURL(ctx, r.Endpoint); err != nil {
+			return fmt.Errorf("endpoint: %w", err)
+		}
+		if r.AccessKey == "" || r.SecretKey == "" {
+			return errors.New("accessKey and secretKey are required for a remote endpoint")
+		}
+		return nil
+	}
+
+	if r.DestBucket == bucket.BucketName {
+		return errors.New("a bucket cannot replicate to itself")
+	}
+	var dest db.Bucket
+	if err := DB.Where("bucket_name = ? AND user_id = ?", r.DestBucket, bucket.UserID).First(&dest).Error; err != nil {
+		return fmt.Errorf("destination bucket %s not found or not owned by user", r.DestBucket)
+	}
+	return nil
+}
+
+// previousRule is the saved rule that r edits, found by ID, so queued
+// replications that name it keep working.
+func previousRule(previous []db.ReplicationRule, r *ReplicationRuleConfig) *db.ReplicationRule {
+	if r.ID == "" {
+		return nil
+	}
+	for i := range previous {
+		if previous[i].ID == r.ID {
+			return &previous[i]
+		}
+	}
+	return nil
+}
+
+func replicationRuleView(r *db.ReplicationRule) ReplicationRuleConfig {
+	return ReplicationRuleConfig{
+		ID:               r.ID,
+		DestBucket:       r.DestBucket,
+		Endpoint:         r.Endpoint,
+		AccessKey:        r.AccessKey,
+		Prefix:           r.Prefix,
+		ReplicateDeletes: r.ReplicateDeletes,
+	}
+}
+
+// PutBucketReplication replaces the bucket's replication rules. Only objects
+// written afterwards are replicated; an empty list turns replication off.
+// Rules sent back with their ID are updated in place and keep their secret
+// key unless a new one is given or the endpoint or access key changes.
+func PutBucketReplication(DB *gorm.DB, notifier *notify.Notifier) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+
+		var req BucketReplicationRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if len(req.Rules) > maxReplicationRulesPerBucket {
+			return apierror.Send(c, apierror.InvalidArgument, fmt.Sprintf("at most %d replication rules per bucket", maxReplicationRulesPerBucket))
+		}
+
+		var previous []db.ReplicationRule
+		if err := DB.Where("bucket_id = ?", bucket.ID).Order("created_at").Find(&previous).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to fetch replication rules")
+			return apierror.Send(c, apierror.InternalError, "failed to save replication configuration")
+		}
+
+		rules := make([]db.ReplicationRule, 0, len(req.Rules))
+		kept := make(map[string]bool, len(req.Rules))
+		for i := range req.Rules {
+			r := &req.Rules[i]
+			old := previousRule(previous, r)
+			if old != nil && kept[old.ID] {
+				return apierror.Send(c, apierror.InvalidArgument, fmt.Sprintf("duplicate rule id %s", r.ID))
+			}
+			if old != nil && r.SecretKey == "" && r.Endpoint == old.Endpoint && r.AccessKey == old.AccessKey {
+				r.SecretKey = old.SecretKey
+			}
+			if err := validateReplicationRule(c.UserContext(), DB, bucket, r); err != nil {
+				return apierror.Send(c, apierror.InvalidArgument, err.Error())
+			}
+			rule := db.ReplicationRule{ID: uuid.NewString(), BucketID: bucket.ID}
+			if old != nil {
+				rule = *old
+				kept[old.ID] = true
+			}
+			rule.DestBucket = r.DestBucket
+			rule.Endpoint = r.Endpoint
+			rule.AccessKey = r.AccessKey
+			rule.SecretKey = r.SecretKey
+			rule.Prefix = r.Prefix
+			rule.ReplicateDeletes = r.ReplicateDeletes
+			rules = append(rules, rule)
+		}
+
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			for i := range previous {
+				if kept[previous[i].ID] {
+					continue
+				}
+				if err := tx.Delete(&previous[i]).Error; err != nil {
+					return err
+				}
+			}
+			for i := range rules {
+				var err error
+				if kept[rules[i].ID] {
+					err = tx.Save(&rules[i]).Error
+				} else {
+					err = tx.Create(&rules[i]).Error
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to save replication rules")
+			return apierror.Send(c, apierror.InternalError, "failed to save replication configuration")
+		}
+
+		views := make([]ReplicationRuleConfig, 0, len(rules))
+		for i := range rules {
+			views = append(views, replicationRuleView(&rules[i]))
+		}
+		previousViews := make([]ReplicationRuleConfig, 0, len(previous))
+		for i := range previous {
+			previousViews = append(previousViews, replicationRuleView(&previous[i]))
+		}
+		audit.Record(DB, c, nil, audit.Event{
+			Action:     "bucket.put_replication",
+			TargetType: "bucket",
+			Target:     bucket.BucketName,
+			Before:     fiber.Map{"rules": previousViews},
+			After:      fiber.Map{"rules": views},
+		})
+		notifier.BucketEvent(bucket, "replication", bucket.UserID)
+		requestid.Log(c).WithFields(log.Fields{
+			"bucket": bucket.BucketName,
+			"rules":  len(rules),
+		}).Info("Bucket replication configuration updated")
+		return c.JSON(fiber.Map{"bucket": bucket.BucketName, "rules": views})
+	}
+}
+
+func GetBucketReplication(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		bucket, err := ownedBucket(c, DB)
+		if bucket == nil {
+			return err
+		}
+
+		var rules []db.ReplicationRule
+		if err := DB.Where("bucket_id = ?", bucket.ID).Order("created_at").Find(&rules).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("bucket", bucket.BucketName).Error("Failed to fetch replication rules")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch replication configuration")
+		}
+		views := make([]ReplicationRuleConfig, 0, len(rules))
+		for i := range rules {
+			views = append(views, replicationRuleView(&rules[i]))
+		}
+		return c.JSON(fiber.Map{"bucket": bucket.BucketName, "rules": views})
+	}
+}
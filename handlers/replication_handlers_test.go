@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutBucketReplication(t *testing.T) {
+	DB := setupTestDB(t)
+	user := db.User{ID: "user-1", Email: "repl@example.com", AccessKey: "ak-1"}
+	require.NoError(t, DB.Create(&user).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-1", BucketName: "replsrc", UserID: user.ID}).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-2", BucketName: "repldest", UserID: user.ID}).Error)
+
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &user)
+		return c.Next()
+	})
+	app.Get("/api/buckets/:bucketName/replication", GetBucketReplication(DB))
+	app.Put("/api/buckets/:bucketName/replication", PutBucketReplication(DB, nil))
+
+	type config struct {
+		Rules []ReplicationRuleConfig `json:"rules"`
+	}
+	do := func(method string, body interface{}, out *config) int {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, "/api/buckets/replsrc/replication", &buf)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		if out != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+	remote := ReplicationRuleConfig{DestBucket: "far", Endpoint: "https://93.184.216.34", AccessKey: "remote-ak", SecretKey: "remote-sk"}
+	local := ReplicationRuleConfig{DestBucket: "repldest"}
+
+	for _, endpoint := range []string{"http://127.0.0.1:3000", "http://169.254.169.254", "http://10.1.2.3"} {
+		rule := remote
+		rule.Endpoint = endpoint
+		require.Equal(t, 400, do("PUT", BucketReplicationRequest{Rules: []ReplicationRuleConfig{rule}}, nil), endpoint)
+	}
+
+	var created config
+	require.Equal(t, 200, do("PUT", BucketReplicationRequest{Rules: []ReplicationRuleConfig{remote, local}}, &created))
+	require.Len(t, created.Rules, 2)
+
+	// GET hides the secret key; sending its output back keeps the rules
+	var fetched config
+	require.Equal(t, 200, do("GET", nil, &fetched))
+	require.Empty(t, fetched.Rules[0].SecretKey)
+	fetched.Rules[0].Prefix = "images/"
+	var updated config
+	require.Equal(t, 200, do("PUT", BucketReplicationRequest{Rules: fetched.Rules[:1]}, &updated))
+	require.Equal(t, created.Rules[0].ID, updated.Rules[0].ID)
+
+	var rules []db.ReplicationRule
+	require.NoError(t, DB.Where("bucket_id = ?", "bucket-1").Find(&rules).Error)
+	require.Len(t, rules, 1, "rules missing from the request are removed")
+	require.Equal(t, "remote-sk", rules[0].SecretKey)
+	require.Equal(t, "images/", rules[0].Prefix)
+
+	// a new access key needs its secret key
+	moved := updated.Rules[0]
+	moved.AccessKey = "other-ak"
+	require.Equal(t, 400, do("PUT", BucketReplicationRequest{Rules: []ReplicationRuleConfig{moved}}, nil))
+	require.Equal(t, 400, do("PUT", BucketReplicationRequest{Rules: []ReplicationRuleConfig{updated.Rules[0], updated.Rules[0]}}, nil), "duplicate ids")
+}
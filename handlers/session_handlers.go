@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
+	"github.com/SysTechSalihY/mini-s3-clone/auth"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/lockout"
+	"github.com/SysTechSalihY/mini-s3-clone/mail"
+	"github.com/SysTechSalihY/mini-s3-clone/metrics"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	MFACode  string `json:"mfaCode,omitempty"` // TOTP or recovery code, when MFA is enabled
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// SessionView is a session as listed to its user.
+type SessionView struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+// Login opens a console session for an email and password, and an MFA code
+// when the account has MFA, and returns its access and refresh tokens.
+// Unknown addresses and wrong passwords get the same answer, and failed
+// attempts are slowed down and eventually locked out by guard.
+func Login(DB *gorm.DB, sessions *auth.Sessions, guard *lockout.Guard, mailer *mail.Queue) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		var req LoginRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if ok, err := attemptAllowed(c, guard, req.Email); !ok {
+			return err
+		}
+
+		var user db.User
+		if err := DB.Where("email = ?", req.Email).First(&user).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				metrics.AuthFailures.WithLabelValues("login_unknown_user").Inc()
+				attemptFailed(c, guard, mailer, req.Email, nil)
+				return apierror.Send(c, apierror.Unauthenticated, "invalid credentials")
+			}
+			return apierror.Send(c, apierror.InternalError, "database error")
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+			metrics.AuthFailures.WithLabelValues("login_invalid_password").Inc()
+			attemptFailed(c, guard, mailer, req.Email, &user)
+			return apierror.Send(c, apierror.Unauthenticated, "invalid credentials")
+		}
+		if user.Disabled {
+			metrics.AuthFailures.WithLabelValues("account_disabled").Inc()
+			return apierror.Send(c, apierror.AccountDisabled, "account disabled")
+		}
+		if ok, err := requireMFA(c, DB, &user, req.MFACode); !ok {
+			if req.MFACode != "" {
+				attemptFailed(c, guard, mailer, req.Email, &user)
+			}
+			return err
+		}
+		attemptSucceeded(c, guard, req.Email)
+
+		tokens, err := sessions.Start(DB, &user, c.Get(fiber.HeaderUserAgent), c.IP())
+		if err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to start session")
+			return apierror.Send(c, apierror.InternalError, "failed to start session")
+		}
+		audit.Record(DB, c, &user, audit.Event{Action: "session.create", TargetType: "session", Target: tokens.SessionID})
+
+		return c.Status(201).JSON(tokens)
+	}
+}
+
+// RefreshSession exchanges a refresh token for a new access token and a new
+// refresh token; the one sent stops working.
+func RefreshSession(DB *gorm.DB, sessions *auth.Sessions) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		var req RefreshRequest
+		if err := json.Unmarshal(c.Body(), &req); err != nil {
+			return apierror.Send(c, apierror.MalformedRequest, "invalid request")
+		}
+		if req.RefreshToken == "" {
+			return apierror.Send(c, apierror.InvalidToken, "missing refresh token")
+		}
+
+		tokens, err := sessions.Refresh(DB, req.RefreshToken)
+		switch {
+		case errors.Is(err, auth.ErrInvalidToken):
+			metrics.AuthFailures.WithLabelValues("invalid_refresh_token").Inc()
+			return apierror.Send(c, apierror.InvalidToken, "invalid or expired refresh token")
+		case errors.Is(err, auth.ErrAccountDisabled):
+			metrics.AuthFailures.WithLabelValues("account_disabled").Inc()
+			return apierror.Send(c, apierror.AccountDisabled, "account disabled")
+		case err != nil:
+			requestid.Log(c).WithError(err).Error("Failed to refresh session")
+			return apierror.Send(c, apierror.InternalError, "failed to refresh session")
+		}
+		return c.JSON(tokens)
+	}
+}
+
+// Logout ends the session whose access token authenticated the request.
+func Logout(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		session, ok := c.Locals("session").(*db.Session)
+		if !ok || session == nil {
+			return apierror.Send(c, apierror.InvalidArgument, "request is not authenticated by a session")
+		}
+		if err := DB.Delete(session).Error; err != nil {
+			return apierror.Send(c, apierror.InternalError, "failed to end session")
+		}
+		audit.Record(DB, c, user, audit.Event{Action: "session.revoke", TargetType: "session", Target: session.ID})
+
+		return c.SendStatus(204)
+	}
+}
+
+// ListSessions lists the caller's active sessions, newest first.
+func ListSessions(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		current := ""
+		if session, ok := c.Locals("session").(*db.Session); ok && session != nil {
+			current = session.ID
+		}
+
+		var sessions []db.Session
+		if err := DB.Where("user_id = ? AND expires_at > ?", user.ID, time.Now()).
+			Order("created_at desc").Find(&sessions).Error; err != nil {
+			return apierror.Send(c, apierror.InternalError, "failed to list sessions")
+		}
+		views := make([]SessionView, 0, len(sessions))
+		for _, s := range sessions {
+			views = append(views, SessionView{
+				ID:         s.ID,
+				UserAgent:  s.UserAgent,
+				IP:         s.IP,
+				CreatedAt:  s.CreatedAt,
+				LastUsedAt: s.LastUsedAt,
+				ExpiresAt:  s.ExpiresAt,
+				Current:    s.ID == current,
+			})
+		}
+		return c.JSON(fiber.Map{"sessions": views})
+	}
+}
+
+// RevokeSession ends one of the caller's sessions, such as a forgotten
+// login on another device.
+func RevokeSession(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		sessionID := c.Params("sessionID")
+
+		res := DB.Where("id = ? AND user_id = ?", sessionID, user.ID).Delete(&db.Session{})
+		if res.Error != nil {
+			return apierror.Send(c, apierror.InternalError, "failed to end session")
+		}
+		if res.RowsAffected == 0 {
+			return apierror.Send(c, apierror.NotFound, "session not found")
+		}
+		audit.Record(DB, c, user, audit.Event{Action: "session.revoke", TargetType: "session", Target: sessionID})
+
+		return c.SendStatus(204)
+	}
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/auth"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/middleware"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSessionLogin(t *testing.T) {
+	DB := setupTestDB(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password1"), bcrypt.DefaultCost)
+	user := db.User{ID: uuid.NewString(), Email: "console@example.com", PasswordHash: string(hash), AccessKey: "ak-console", SecretKey: "sk-console"}
+	require.NoError(t, DB.Create(&user).Error)
+	sessions := &auth.Sessions{Secret: []byte("0123456789abcdef0123456789abcdef"), AccessTTL: time.Minute, RefreshTTL: time.Hour}
+
+	app := setupFiber()
+	app.Post("/api/auth/login", Login(DB, sessions, nil, nil))
+	app.Post("/api/auth/refresh", RefreshSession(DB, sessions))
+	app.Use(middleware.AuthMiddleware(DB, sessions))
+	app.Post("/api/auth/logout", Logout(DB))
+	app.Get("/api/account", GetAccount(DB))
+	app.Get("/api/account/sessions", ListSessions(DB))
+	app.Delete("/api/account/sessions/:sessionID", RevokeSession(DB))
+
+	do := func(method, path, token string, body interface{}, out interface{}) int {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "console-test")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		if out != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+
+	require.Equal(t, 401, do("POST", "/api/auth/login", "", LoginRequest{Email: user.Email, Password: "wrong"}, nil))
+	require.Equal(t, 401, do("POST", "/api/auth/login", "", LoginRequest{Email: "nobody@example.com", Password: "password1"}, nil))
+
+	var first, second auth.Tokens
+	require.Equal(t, 201, do("POST", "/api/auth/login", "", LoginRequest{Email: user.Email, Password: "password1"}, &first))
+	require.Equal(t, 201, do("POST", "/api/auth/login", "", LoginRequest{Email: user.Email, Password: "password1"}, &second))
+	require.Equal(t, 200, do("GET", "/api/account", first.AccessToken, nil, nil))
+	require.Equal(t, 401, do("GET", "/api/account", "not-a-token", nil, nil))
+
+	var listed struct {
+		Sessions []SessionView `json:"sessions"`
+	}
+	require.Equal(t, 200, do("GET", "/api/account/sessions", first.AccessToken, nil, &listed))
+	require.Len(t, listed.Sessions, 2)
+	for _, s := range listed.Sessions {
+		require.Equal(t, s.ID == first.SessionID, s.Current)
+		require.Equal(t, "console-test", s.UserAgent)
+	}
+
+	// refreshing rotates the refresh token
+	var refreshed auth.Tokens
+	require.Equal(t, 200, do("POST", "/api/auth/refresh", "", RefreshRequest{RefreshToken: first.RefreshToken}, &refreshed))
+	require.Equal(t, 400, do("POST", "/api/auth/refresh", "", RefreshRequest{RefreshToken: first.RefreshToken}, nil))
+	require.Equal(t, 200, do("GET", "/api/account", refreshed.AccessToken, nil, nil))
+
+	// one session ends another, then itself
+	require.Equal(t, 204, do("DELETE", "/api/account/sessions/"+second.SessionID, refreshed.AccessToken, nil, nil))
+	require.Equal(t, 404, do("DELETE", "/api/account/sessions/"+second.SessionID, refreshed.AccessToken, nil, nil))
+	require.Equal(t, 401, do("GET", "/api/account", second.AccessToken, nil, nil))
+	require.Equal(t, 204, do("POST", "/api/auth/logout", refreshed.AccessToken, nil, nil))
+	require.Equal(t, 401, do("GET", "/api/account", refreshed.AccessToken, nil, nil), "logged out")
+	require.Equal(t, 400, do("POST", "/api/auth/refresh", "", RefreshRequest{RefreshToken: refreshed.RefreshToken}, nil))
+
+	// disabled accounts cannot log in
+	require.NoError(t, DB.Model(&user).Update("disabled", true).Error)
+	require.Equal(t, 403, do("POST", "/api/auth/login", "", LoginRequest{Email: user.Email, Password: "password1"}, nil))
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"mime/multipart"
+	"os"
+
+	"github.com/SysTechSalihY/mini-s3-clone/tracing"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Blob I/O on local storage goes through these so each read, write and
+// delete shows up as a span of the request.
+
+func saveObject(c *fiber.Ctx, file *multipart.FileHeader, path string) error {
+	_, span := tracing.StartStorage(c.UserContext(), "write", path)
+	err := c.SaveFile(file, path)
+	tracing.End(span, err)
+	return err
+}
+
+// sendObject covers opening the blob; fasthttp streams the body after the
+// handler returns.
+func sendObject(c *fiber.Ctx, path string) error {
+	_, span := tracing.StartStorage(c.UserContext(), "read", path)
+	err := c.SendFile(path, true)
+	tracing.End(span, err)
+	return err
+}
+
+func removeObject(c *fiber.Ctx, path string) error {
+	_, span := tracing.StartStorage(c.UserContext(), "delete", path)
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		tracing.End(span, nil)
+	} else {
+		tracing.End(span, err)
+	}
+	return err
+}
@@ -1,29 +1,303 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/audit"
 	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
 	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
+var allowedTaskStatuses = map[string]bool{
+	"queued":    true,
+	"running":   true,
+	"retrying":  true,
+	"completed": true,
+	"failed":    true,
+	"cancelled": true,
+}
+
+var allowedTaskTypes = map[string]bool{
+	"copy":  true,
+	"empty": true,
+	"sync":  true,
+}
+
 func GetTaskProgress(DB *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		taskID := c.Params("taskID")
 		user, ok := c.Locals("user").(*db.User)
 		if !ok {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "unauthenticated"})
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
 		}
 		var task db.Task
 		if err := DB.First(&task, "id = ?", taskID).Error; err != nil {
-			return c.Status(404).JSON(fiber.Map{"error": "task not found"})
+			return apierror.Send(c, apierror.NoSuchTask, "task not found")
 		}
 		if task.UserID != user.ID {
-			return c.Status(403).JSON(fiber.Map{"error": "forbidden"})
+			return apierror.Send(c, apierror.AccessDenied, "forbidden")
 		}
 		return c.JSON(fiber.Map{
-			"status":   task.Status,
-			"progress": task.Progress,
-			"message":  task.Message,
+			"status":      task.Status,
+			"progress":    task.Progress,
+			"message":     task.Message,
+			"retry_count": task.RetryCount,
+			"started_at":  task.StartedAt,
+			"finished_at": task.FinishedAt,
+			"result":      rawJSON(task.Result),
 		})
 	}
 }
+
+func ListTasks(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, ok := c.Locals("user").(*db.User)
+		if !ok {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+
+		status := c.Query("status")
+		taskType := c.Query("type")
+		if status != "" && !allowedTaskStatuses[status] {
+			return apierror.Send(c, apierror.InvalidArgument, "invalid status filter")
+		}
+		if taskType != "" && !allowedTaskTypes[taskType] {
+			return apierror.Send(c, apierror.InvalidArgument, "invalid type filter")
+		}
+
+		page, limit, err := parsePagination(c)
+		if err != nil {
+			return apierror.Send(c, apierror.InvalidArgument, err.Error())
+		}
+
+		query := DB.WithContext(c.UserContext()).Model(&db.Task{}).Where("user_id = ?", user.ID)
+		if status != "" {
+			query = query.Where("status = ?", status)
+		}
+		if taskType != "" {
+			query = query.Where("type = ?", taskType)
+		}
+
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to count tasks")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch tasks")
+		}
+
+		var taskList []db.Task
+		if err := query.Order("created_at desc").
+			Offset((page - 1) * limit).
+			Limit(limit).
+			Find(&taskList).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to fetch tasks")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch tasks")
+		}
+
+		return c.JSON(fiber.Map{
+			"tasks": taskList,
+			"page":  page,
+			"limit": limit,
+			"total": total,
+		})
+	}
+}
+
+func CancelTask(inspector *asynq.Inspector, DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+
+		var task db.Task
+		if err := DB.First(&task, "id = ? AND user_id = ?", c.Params("taskID"), user.ID).Error; err != nil {
+			return apierror.Send(c, apierror.NoSuchTask, "task not found")
+		}
+
+		switch task.Status {
+		case "completed", "failed", "cancelled":
+			return apierror.Send(c, apierror.InvalidTaskState, "task is already "+task.Status)
+		}
+
+		// Mark it first so the worker stops between files and a pending
+		// delivery is dropped even if it races with the queue update below.
+		// The status condition keeps a task the worker just finished as it is.
+		result := DB.Model(&task).Where("status NOT IN ?", []string{"completed", "failed", "cancelled"}).Update("status", "cancelled")
+		if result.Error != nil {
+			requestid.Log(c).WithError(result.Error).WithField("task_id", task.ID).Error("Failed to mark task cancelled")
+			return apierror.Send(c, apierror.InternalError, "failed to cancel task")
+		}
+		if result.RowsAffected == 0 {
+			return apierror.Send(c, apierror.InvalidTaskState, "task has already finished")
+		}
+
+		info, err := inspector.GetTaskInfo(tasks.QueueDefault, task.ID)
+		switch {
+		case errors.Is(err, asynq.ErrTaskNotFound):
+			// Nothing left in the queue, the DB status is all there is to update.
+		case err != nil:
+			requestid.Log(c).WithError(err).WithField("task_id", task.ID).Error("Failed to inspect task")
+			return apierror.Send(c, apierror.InternalError, "failed to cancel task")
+		case info.State == asynq.TaskStateActive:
+			if err := inspector.CancelProcessing(task.ID); err != nil {
+				requestid.Log(c).WithError(err).WithField("task_id", task.ID).Error("Failed to cancel active task")
+				return apierror.Send(c, apierror.InternalError, "failed to cancel task")
+			}
+		case info.State == asynq.TaskStatePending, info.State == asynq.TaskStateScheduled, info.State == asynq.TaskStateRetry:
+			if err := inspector.DeleteTask(tasks.QueueDefault, task.ID); err != nil && !errors.Is(err, asynq.ErrTaskNotFound) {
+				requestid.Log(c).WithError(err).WithField("task_id", task.ID).Error("Failed to delete queued task")
+				return apierror.Send(c, apierror.InternalError, "failed to cancel task")
+			}
+		}
+
+		audit.Record(DB, c, user, audit.Event{Action: "task.cancel", TargetType: "task", Target: task.ID})
+		requestid.Log(c).WithFields(log.Fields{"task_id": task.ID, "user_id": user.ID}).Info("Task cancelled")
+		return c.JSON(fiber.Map{"task_id": task.ID, "status": "cancelled", "message": "task cancelled"})
+	}
+}
+
+func RetryTask(client *asynq.Client, inspector *asynq.Inspector, DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+
+		var task db.Task
+		if err := DB.First(&task, "id = ? AND user_id = ?", c.Params("taskID"), user.ID).Error; err != nil {
+			return apierror.Send(c, apierror.NoSuchTask, "task not found")
+		}
+
+		if task.Status != "failed" && task.Status != "cancelled" {
+			return apierror.Send(c, apierror.InvalidTaskState, "only failed or cancelled tasks can be retried")
+		}
+
+		if err := DB.Model(&task).Updates(map[string]interface{}{
+			"status":      "retrying",
+			"progress":    0,
+			"message":     "",
+			"retry_count": 0,
+			"finished_at": nil,
+		}).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("task_id", task.ID).Error("Failed to mark task retrying")
+			return apierror.Send(c, apierror.InternalError, "failed to retry task")
+		}
+
+		info, err := inspector.GetTaskInfo(tasks.QueueDefault, task.ID)
+		switch {
+		case errors.Is(err, asynq.ErrTaskNotFound):
+			// The queue no longer holds the task, so build it again under the same ID.
+			if err := requeueTask(c.UserContext(), client, &task); err != nil {
+				requestid.Log(c).WithError(err).WithField("task_id", task.ID).Error("Failed to re-enqueue task")
+				return apierror.Send(c, apierror.InternalError, "failed to retry task")
+			}
+		case err != nil:
+			requestid.Log(c).WithError(err).WithField("task_id", task.ID).Error("Failed to inspect task")
+			return apierror.Send(c, apierror.InternalError, "failed to retry task")
+		case info.State == asynq.TaskStateArchived, info.State == asynq.TaskStateRetry, info.State == asynq.TaskStateScheduled:
+			if err := inspector.RunTask(tasks.QueueDefault, task.ID); err != nil {
+				requestid.Log(c).WithError(err).WithField("task_id", task.ID).Error("Failed to run task")
+				return apierror.Send(c, apierror.InternalError, "failed to retry task")
+			}
+		}
+
+		audit.Record(DB, c, user, audit.Event{Action: "task.retry", TargetType: "task", Target: task.ID})
+		requestid.Log(c).WithFields(log.Fields{"task_id": task.ID, "user_id": user.ID}).Info("Task retry requested")
+		return c.JSON(fiber.Map{"task_id": task.ID, "status": "retrying", "message": "task retry enqueued"})
+	}
+}
+
+func requeueTask(ctx context.Context, client *asynq.Client, task *db.Task) error {
+	var (
+		t   *asynq.Task
+		err error
+	)
+	switch task.Type {
+	case "empty":
+		if task.BucketSrc == nil {
+			return errors.New("task has no source bucket")
+		}
+		var opts tasks.EmptyBucketOptions
+		if task.Params != nil {
+			if err := json.Unmarshal([]byte(*task.Params), &opts); err != nil {
+				return err
+			}
+		}
+		t, err = tasks.NewEmptyBucketTask(ctx, task.ID, task.UserID, *task.BucketSrc, opts.BypassGovernance)
+	case "copy":
+		if task.BucketSrc == nil || task.BucketDest == nil {
+			return errors.New("task has no source or destination bucket")
+		}
+		var req CopyBucketRequest
+		if task.Params != nil {
+			if err := json.Unmarshal([]byte(*task.Params), &req); err != nil {
+				return err
+			}
+		}
+		t, err = tasks.NewCopyBucketTask(ctx, task.ID, task.UserID, *task.BucketSrc, *task.BucketDest, req.Parallelism)
+	case "sync":
+		if task.BucketSrc == nil || task.BucketDest == nil {
+			return errors.New("task has no source or destination bucket")
+		}
+		var opts tasks.SyncOptions
+		if task.Params != nil {
+			if err := json.Unmarshal([]byte(*task.Params), &opts); err != nil {
+				return err
+			}
+		}
+		t, err = tasks.NewSyncBucketTask(ctx, task.ID, task.UserID, *task.BucketSrc, *task.BucketDest, opts)
+	default:
+		return errors.New("unknown task type: " + task.Type)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = client.Enqueue(t)
+	return err
+}
+
+func parsePagination(c *fiber.Ctx) (page, limit int, err error) {
+	page, err = strconv.Atoi(c.Query("page", "1"))
+	if err != nil || page < 1 {
+		return 0, 0, errors.New("invalid page")
+	}
+	limit, err = strconv.Atoi(c.Query("limit", "20"))
+	if err != nil || limit < 1 || limit > 100 {
+		return 0, 0, errors.New("limit must be between 1 and 100")
+	}
+	return page, limit, nil
+}
+
+// failTaskRecord marks a task that never reached the queue as failed so it
+// does not sit in "queued" forever.
+func failTaskRecord(DB *gorm.DB, task *db.Task, cause error) {
+	now := time.Now()
+	if err := DB.Model(task).Updates(map[string]interface{}{
+		"status":      "failed",
+		"message":     tasks.TruncateMessage(cause.Error()),
+		"finished_at": &now,
+	}).Error; err != nil {
+		log.WithError(err).WithField("task_id", task.ID).Error("Failed to mark task failed")
+	}
+}
+
+// rawJSON embeds a stored JSON document as-is instead of as a string.
+func rawJSON(s *string) json.RawMessage {
+	if s == nil || *s == "" {
+		return nil
+	}
+	return json.RawMessage(*s)
+}
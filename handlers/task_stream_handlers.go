@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+)
+
+// streamHeartbeat is how often idle streams are pinged. For task streams it
+// is also when the DB is re-checked, which catches tasks that were cancelled
+// before the worker ever picked them up.
+const streamHeartbeat = 15 * time.Second
+
+// progressStream relays task progress events from Redis pub/sub to a client.
+// With taskID set it follows a single task and ends once that task reaches a
+// terminal status; otherwise it follows every task of the user until the
+// client goes away.
+type progressStream struct {
+	DB     *gorm.DB
+	Redis  *redis.Client
+	userID string
+	taskID string
+}
+
+func (s progressStream) channel() string {
+	if s.taskID != "" {
+		return tasks.TaskChannel(s.taskID)
+	}
+	return tasks.UserChannel(s.userID)
+}
+
+func (s progressStream) snapshot() (tasks.ProgressEvent, error) {
+	var task db.Task
+	if err := s.DB.First(&task, "id = ?", s.taskID).Error; err != nil {
+		return tasks.ProgressEvent{}, err
+	}
+	return taskProgressEvent(&task), nil
+}
+
+func (s progressStream) run(ctx context.Context, send func(tasks.ProgressEvent) error, ping func() error) {
+	// Subscribe before reading the snapshot so no event falls in between.
+	sub := s.Redis.Subscribe(ctx, s.channel())
+	defer sub.Close()
+
+	if s.taskID != "" {
+		ev, err := s.snapshot()
+		if err != nil {
+			log.WithError(err).WithField("task_id", s.taskID).Warn("Failed to load task for stream")
+			return
+		}
+		if err := send(ev); err != nil || ev.Terminal() {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(streamHeartbeat)
+	defer ticker.Stop()
+	messages := sub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			var ev tasks.ProgressEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+				log.WithError(err).Warn("Dropping malformed progress event")
+				continue
+			}
+			if err := send(ev); err != nil {
+				return
+			}
+			if s.taskID != "" && ev.Terminal() {
+				return
+			}
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return
+			}
+			if s.taskID == "" {
+				continue
+			}
+			if ev, err := s.snapshot(); err == nil && ev.Terminal() {
+				send(ev)
+				return
+			}
+		}
+	}
+}
+
+func taskProgressEvent(task *db.Task) tasks.ProgressEvent {
+	ts := task.CreatedAt
+	if task.UpdatedAt != nil {
+		ts = *task.UpdatedAt
+	}
+	return tasks.ProgressEvent{
+		TaskID:    task.ID,
+		UserID:    task.UserID,
+		Status:    task.Status,
+		Progress:  task.Progress,
+		Message:   task.Message,
+		Timestamp: ts,
+	}
+}
+
+// resolveProgressStream authorizes the caller and builds the stream for the
+// route: a single task when :taskID is present, all of the user's tasks
+// otherwise.
+func resolveProgressStream(c *fiber.Ctx, DB *gorm.DB, rdb *redis.Client) (*progressStream, error) {
+	user, ok := c.Locals("user").(*db.User)
+	if !ok {
+		return nil, apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+	}
+	stream := &progressStream{DB: DB, Redis: rdb, userID: user.ID}
+
+	if taskID := c.Params("taskID"); taskID != "" {
+		var task db.Task
+		if err := DB.First(&task, "id = ?", taskID).Error; err != nil {
+			return nil, apierror.Send(c, apierror.NoSuchTask, "task not found")
+		}
+		if task.UserID != user.ID {
+			return nil, apierror.Send(c, apierror.AccessDenied, "forbidden")
+		}
+		stream.taskID = task.ID
+	}
+	return stream, nil
+}
+
+// StreamTaskProgress serves task progress as Server-Sent Events. Streams end
+// when lifetime is cancelled, so open ones do not hold up shutdown.
+func StreamTaskProgress(DB *gorm.DB, rdb *redis.Client, lifetime context.Context) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		stream, err := resolveProgressStream(c, DB, rdb)
+		if stream == nil {
+			return err
+		}
+
+		c.Set("Content-Type", "text/event-stream")
+		c.Set("Cache-Control", "no-cache")
+		c.Set("Connection", "keep-alive")
+		c.Set("X-Accel-Buffering", "no")
+
+		c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+			// fasthttp gives no disconnect signal here; a failed flush is how
+			// we notice the client left.
+			ctx, cancel := context.WithCancel(lifetime)
+			defer cancel()
+
+			send := func(ev tasks.ProgressEvent) error {
+				data, err := json.Marshal(ev)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Status, data)
+				return w.Flush()
+			}
+			ping := func() error {
+				fmt.Fprint(w, ": ping\n\n")
+				return w.Flush()
+			}
+			stream.run(ctx, send, ping)
+		}))
+		return nil
+	}
+}
+
+// TaskProgressWebSocket serves the same events as StreamTaskProgress over a
+// WebSocket, one JSON message per event, until lifetime is cancelled.
+func TaskProgressWebSocket(DB *gorm.DB, rdb *redis.Client, lifetime context.Context) fiber.Handler {
+	upgrade := func(stream *progressStream) fiber.Handler {
+		return websocket.New(func(conn *websocket.Conn) {
+			ctx, cancel := context.WithCancel(lifetime)
+			defer cancel()
+
+			// Drain client frames so close and ping control messages are
+			// processed; any read error means the client is gone.
+			go func() {
+				defer cancel()
+				for {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+
+			send := func(ev tasks.ProgressEvent) error {
+				return conn.WriteJSON(ev)
+			}
+			ping := func() error {
+				return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second))
+			}
+			stream.run(ctx, send, ping)
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		})
+	}
+
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		if !websocket.IsWebSocketUpgrade(c) {
+			return apierror.Send(c, apierror.UpgradeRequired, "websocket upgrade required")
+		}
+		stream, err := resolveProgressStream(c, DB, rdb)
+		if stream == nil {
+			return err
+		}
+		return upgrade(stream)(c)
+	}
+}
@@ -1,14 +1,21 @@
 package handlers
 
 import (
+	"context"
+	"io"
 	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
 )
 
 func TestGetTaskProgress(t *testing.T) {
@@ -94,3 +101,167 @@ func TestGetTaskProgress(t *testing.T) {
 		})
 	}
 }
+
+func TestListTasksRejectsInvalidQuery(t *testing.T) {
+	owner := &db.User{ID: "user-1", Email: "owner@example.com"}
+
+	tests := []struct {
+		name       string
+		user       *db.User
+		query      string
+		wantStatus int
+	}{
+		{name: "unauthenticated", user: nil, query: "", wantStatus: 401},
+		{name: "unknown status", user: owner, query: "?status=paused", wantStatus: 400},
+		{name: "unknown type", user: owner, query: "?type=move", wantStatus: 400},
+		{name: "invalid page", user: owner, query: "?page=0", wantStatus: 400},
+		{name: "limit too large", user: owner, query: "?limit=500", wantStatus: 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/tasks", func(c *fiber.Ctx) error {
+				if tt.user != nil {
+					c.Locals("user", tt.user)
+				}
+				// validation runs before any query, so no DB is needed
+				return ListTasks(nil)(c)
+			})
+
+			req := httptest.NewRequest("GET", "/tasks"+tt.query, nil)
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestCancelAndRetryTask(t *testing.T) {
+	DB := setupTestDB(t)
+	redis := miniredis.RunT(t)
+	client := asynq.NewClient(asynq.RedisClientOpt{Addr: redis.Addr()})
+	defer client.Close()
+	inspector := asynq.NewInspector(asynq.RedisClientOpt{Addr: redis.Addr()})
+	defer inspector.Close()
+
+	owner := db.User{ID: "user-1", Email: "owner@example.com", AccessKey: uuid.NewString()}
+	require.NoError(t, DB.Create(&owner).Error)
+	src, dest := "src", "dest"
+	finishedAt := time.Now()
+	for _, task := range []db.Task{
+		{ID: "task-queued", Status: "queued"},
+		{ID: "task-completed", Status: "completed", FinishedAt: &finishedAt},
+		{ID: "task-failed", Status: "failed", RetryCount: 5, Message: "boom", FinishedAt: &finishedAt},
+		{ID: "task-racing", Status: "running"},
+	} {
+		task.UserID, task.Type, task.BucketSrc, task.BucketDest = owner.ID, "copy", &src, &dest
+		require.NoError(t, DB.Create(&task).Error)
+	}
+	queued, err := tasks.NewCopyBucketTask(context.Background(), "task-queued", owner.ID, src, dest, 0)
+	require.NoError(t, err)
+	_, err = client.Enqueue(queued)
+	require.NoError(t, err)
+
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &owner)
+		return c.Next()
+	})
+	app.Post("/api/tasks/:taskID/cancel", CancelTask(inspector, DB))
+	app.Post("/api/tasks/:taskID/retry", RetryTask(client, inspector, DB))
+	post := func(path string) int {
+		resp, err := app.Test(httptest.NewRequest("POST", path, nil))
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	status := func(id string) db.Task {
+		var task db.Task
+		require.NoError(t, DB.First(&task, "id = ?", id).Error)
+		return task
+	}
+
+	// a queued task is marked cancelled and taken off the queue
+	require.Equal(t, 200, post("/api/tasks/task-queued/cancel"))
+	require.Equal(t, "cancelled", status("task-queued").Status)
+	_, err = inspector.GetTaskInfo(tasks.QueueDefault, "task-queued")
+	require.ErrorIs(t, err, asynq.ErrTaskNotFound)
+	require.Equal(t, 409, post("/api/tasks/task-queued/cancel"))
+
+	// finished tasks cannot be cancelled, nor finished ones retried
+	require.Equal(t, 409, post("/api/tasks/task-completed/cancel"))
+	require.Equal(t, 409, post("/api/tasks/task-failed/cancel"))
+	require.Equal(t, 409, post("/api/tasks/task-completed/retry"))
+	require.Equal(t, "completed", status("task-completed").Status)
+
+	// the worker finishing the task after it was loaded wins
+	racing := true
+	require.NoError(t, DB.Callback().Update().Before("gorm:update").Register("test:finish_task", func(tx *gorm.DB) {
+		if racing {
+			racing = false
+			_, err := tx.Statement.ConnPool.ExecContext(tx.Statement.Context, "UPDATE tasks SET status = 'completed' WHERE id = 'task-racing'")
+			require.NoError(t, err)
+		}
+	}))
+	require.Equal(t, 409, post("/api/tasks/task-racing/cancel"))
+	require.Equal(t, "completed", status("task-racing").Status)
+	require.NoError(t, DB.Callback().Update().Remove("test:finish_task"))
+
+	// retrying resets the run and enqueues the task again
+	require.Equal(t, 200, post("/api/tasks/task-failed/retry"))
+	retried := status("task-failed")
+	require.Equal(t, "retrying", retried.Status)
+	require.Zero(t, retried.RetryCount)
+	require.Empty(t, retried.Message)
+	require.Nil(t, retried.FinishedAt)
+	info, err := inspector.GetTaskInfo(tasks.QueueDefault, "task-failed")
+	require.NoError(t, err)
+	require.Equal(t, asynq.TaskStatePending, info.State)
+
+	require.Equal(t, 200, post("/api/tasks/task-queued/retry"), "cancelled tasks can be retried")
+	require.Equal(t, "retrying", status("task-queued").Status)
+}
+
+func TestStreamTaskProgress(t *testing.T) {
+	DB := setupTestDB(t)
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer rdb.Close()
+
+	owner := db.User{ID: "user-1", Email: "owner@example.com", AccessKey: uuid.NewString()}
+	other := db.User{ID: "user-2", Email: "other@example.com", AccessKey: uuid.NewString()}
+	require.NoError(t, DB.Create(&owner).Error)
+	require.NoError(t, DB.Create(&other).Error)
+	require.NoError(t, DB.Create(&db.Task{ID: "task-1", UserID: owner.ID, Type: "copy", Status: "completed", Progress: 100}).Error)
+
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		if c.Get("X-User") == other.ID {
+			c.Locals("user", &other)
+		} else {
+			c.Locals("user", &owner)
+		}
+		return c.Next()
+	})
+	app.Get("/api/tasks/:taskID/events", StreamTaskProgress(DB, rdb, context.Background()))
+	get := func(path, userID string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-User", userID)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, _ := get("/api/tasks/task-1/events", other.ID)
+	require.Equal(t, 403, status, "another user's task")
+	status, _ = get("/api/tasks/missing/events", owner.ID)
+	require.Equal(t, 404, status)
+
+	// a finished task sends its final state and ends the stream
+	status, body := get("/api/tasks/task-1/events", owner.ID)
+	require.Equal(t, 200, status)
+	require.Contains(t, body, "event: completed\n")
+	require.Contains(t, body, `"progress":100`)
+}
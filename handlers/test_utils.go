@@ -3,7 +3,9 @@ package handlers
 import (
 	"testing"
 
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
 	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/sqlite"
@@ -13,11 +15,13 @@ import (
 func setupTestDB(t *testing.T) *gorm.DB {
 	dbConn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
 	assert.NoError(t, err)
-	err = dbConn.AutoMigrate(&db.User{}, &db.EmailVerification{}, &db.Bucket{}, &db.File{}, &db.Task{})
+	err = dbConn.AutoMigrate(&db.User{}, &db.EmailVerification{}, &db.PasswordResetToken{}, &db.Session{}, &db.MFARecoveryCode{}, &db.Bucket{}, &db.File{}, &db.Task{}, &db.BucketNotification{}, &db.ReplicationRule{}, &db.AuditEvent{})
 	assert.NoError(t, err)
 	return dbConn
 }
 
 func setupFiber() *fiber.App {
-	return fiber.New()
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+	app.Use(requestid.New())
+	return app
 }
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// maxUsageRange bounds one usage query, about a quarter of hourly rows.
+const maxUsageRange = 93 * 24 * time.Hour
+
+// parseUsageTime accepts RFC 3339 timestamps and plain dates (UTC midnight).
+func parseUsageTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.New("dates must be YYYY-MM-DD or RFC 3339")
+	}
+	return t, nil
+}
+
+// usageRange reads ?from= and ?to= as a half-open range, by default the last
+// 24 hours.
+func usageRange(c *fiber.Ctx) (from, to time.Time, err error) {
+	to = time.Now().UTC()
+	if v := c.Query("to"); v != "" {
+		if to, err = parseUsageTime(v); err != nil {
+			return
+		}
+	}
+	from = to.Add(-24 * time.Hour)
+	if v := c.Query("from"); v != "" {
+		if from, err = parseUsageTime(v); err != nil {
+			return
+		}
+	}
+	switch {
+	case !from.Before(to):
+		err = errors.New("from must be before to")
+	case to.Sub(from) > maxUsageRange:
+		err = errors.New("range must not exceed 93 days")
+	}
+	return
+}
+
+// GetUsage reports the caller's hourly request and storage usage in a date
+// range. Admins may pass ?userID= for anyone else. With ?format=csv it
+// returns one report (?report=requests, the default, or storage) as CSV.
+func GetUsage(DB *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		userID := user.ID
+		if other := c.Query("userID"); other != "" && other != user.ID {
+			if user.UserRole != "admin" {
+				return apierror.Send(c, apierror.AccessDenied, "only admins may read other users' usage")
+			}
+			userID = other
+		}
+
+		from, to, err := usageRange(c)
+		if err != nil {
+			return apierror.Send(c, apierror.InvalidArgument, err.Error())
+		}
+		format := c.Query("format", "json")
+		report := c.Query("report", "requests")
+		if format != "json" && format != "csv" {
+			return apierror.Send(c, apierror.InvalidArgument, "format must be json or csv")
+		}
+		if report != "requests" && report != "storage" {
+			return apierror.Send(c, apierror.InvalidArgument, "report must be requests or storage")
+		}
+
+		var requests []db.UsageRequestHourly
+		if err := DB.Where("user_id = ? AND hour >= ? AND hour < ?", userID, from, to).
+			Order("hour, operation").
+			Find(&requests).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", userID).Error("Failed to fetch request usage")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch usage")
+		}
+		var storage []db.UsageStorageHourly
+		if err := DB.Where("user_id = ? AND hour >= ? AND hour < ?", userID, from, to).
+			Order("hour, bucket_name, storage_class").
+			Find(&storage).Error; err != nil {
+			requestid.Log(c).WithError(err).WithField("user_id", userID).Error("Failed to fetch storage usage")
+			return apierror.Send(c, apierror.InternalError, "failed to fetch usage")
+		}
+
+		if format == "csv" {
+			data, err := usageCSV(report, requests, storage)
+			if err != nil {
+				return apierror.Send(c, apierror.InternalError, "failed to encode usage")
+			}
+			c.Set(fiber.HeaderContentType, "text/csv")
+			c.Set(fiber.HeaderContentDisposition, `attachment; filename="usage-`+report+`.csv"`)
+			return c.Send(data)
+		}
+
+		byOperation := map[string]int64{}
+		var totalRequests, bytesIn, bytesOut, byteHours int64
+		requestRows := make([]fiber.Map, 0, len(requests))
+		for _, r := range requests {
+			byOperation[r.Operation] += r.Requests
+			totalRequests += r.Requests
+			bytesIn += r.BytesIn
+			bytesOut += r.BytesOut
+			requestRows = append(requestRows, fiber.Map{
+				"hour":      r.Hour,
+				"operation": r.Operation,
+				"requests":  r.Requests,
+				"bytesIn":   r.BytesIn,
+				"bytesOut":  r.BytesOut,
+			})
+		}
+		storageRows := make([]fiber.Map, 0, len(storage))
+		for _, s := range storage {
+			byteHours += s.Bytes
+			storageRows = append(storageRows, fiber.Map{
+				"hour":         s.Hour,
+				"bucketID":     s.BucketID,
+				"bucketName":   s.BucketName,
+				"storageClass": s.StorageClass,
+				"bytes":        s.Bytes,
+				"objects":      s.Objects,
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"userID":   userID,
+			"from":     from,
+			"to":       to,
+			"requests": requestRows,
+			"storage":  storageRows,
+			"totals": fiber.Map{
+				"requests":    totalRequests,
+				"byOperation": byOperation,
+				"bytesIn":     bytesIn,
+				"bytesOut":    bytesOut,
+				"byteHours":   byteHours,
+			},
+		})
+	}
+}
+
+func usageCSV(report string, requests []db.UsageRequestHourly, storage []db.UsageStorageHourly) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	hour := func(t time.Time) string { return t.UTC().Format(time.RFC3339) }
+	itoa := func(n int64) string { return strconv.FormatInt(n, 10) }
+
+	if report == "storage" {
+		w.Write([]string{"hour", "bucket_id", "bucket_name", "storage_class", "bytes", "objects"})
+		for _, s := range storage {
+			w.Write([]string{hour(s.Hour), s.BucketID, s.BucketName, s.StorageClass, itoa(s.Bytes), itoa(s.Objects)})
+		}
+	} else {
+		w.Write([]string{"hour", "operation", "requests", "bytes_in", "bytes_out"})
+		for _, r := range requests {
+			w.Write([]string{hour(r.Hour), r.Operation, itoa(r.Requests), itoa(r.BytesIn), itoa(r.BytesOut)})
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetUsage(t *testing.T) {
+	DB := setupTestDB(t)
+	require.NoError(t, DB.AutoMigrate(&db.UsageRequestHourly{}, &db.UsageStorageHourly{}))
+
+	user := db.User{ID: "user-1", UserRole: "user"}
+	hour := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	rows := []db.UsageRequestHourly{
+		{UserID: user.ID, Hour: hour, Operation: "PutObject", Requests: 4, BytesIn: 400},
+		{UserID: user.ID, Hour: hour.Add(time.Hour), Operation: "GetObject", Requests: 2, BytesOut: 50},
+		{UserID: user.ID, Hour: hour.AddDate(0, 0, 2), Operation: "GetObject", Requests: 9},
+		{UserID: "user-2", Hour: hour, Operation: "GetObject", Requests: 7},
+	}
+	require.NoError(t, DB.Create(&rows).Error)
+	require.NoError(t, DB.Create(&db.UsageStorageHourly{
+		BucketID: "bucket-1", StorageClass: db.StorageClassStandard, Hour: hour,
+		UserID: user.ID, BucketName: "photos", Bytes: 1000, Objects: 3,
+	}).Error)
+
+	app := setupFiber()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &user)
+		return c.Next()
+	})
+	app.Get("/api/usage", GetUsage(DB))
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/usage?from=2026-03-01&to=2026-03-02", nil))
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	var out struct {
+		Requests []map[string]interface{} `json:"requests"`
+		Storage  []map[string]interface{} `json:"storage"`
+		Totals   struct {
+			Requests  int64 `json:"requests"`
+			BytesIn   int64 `json:"bytesIn"`
+			BytesOut  int64 `json:"bytesOut"`
+			ByteHours int64 `json:"byteHours"`
+		} `json:"totals"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	require.Len(t, out.Requests, 2)
+	require.Equal(t, int64(6), out.Totals.Requests)
+	require.Equal(t, int64(400), out.Totals.BytesIn)
+	require.Equal(t, int64(50), out.Totals.BytesOut)
+	require.Equal(t, int64(1000), out.Totals.ByteHours)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/api/usage?from=2026-03-01&to=2026-03-02&format=csv", nil))
+	require.NoError(t, err)
+	require.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	body, _ := io.ReadAll(resp.Body)
+	require.Equal(t, "hour,operation,requests,bytes_in,bytes_out\n"+
+		"2026-03-01T10:00:00Z,PutObject,4,400,0\n"+
+		"2026-03-01T11:00:00Z,GetObject,2,0,50\n", string(body))
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/api/usage?userID=user-2", nil))
+	require.NoError(t, err)
+	require.Equal(t, 403, resp.StatusCode)
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/api/usage?from=2026-01-01&to=2026-06-01", nil))
+	require.NoError(t, err)
+	require.Equal(t, 400, resp.StatusCode)
+}
@@ -0,0 +1,189 @@
+// Package health answers liveness and readiness probes for the server and
+// the worker. Readiness runs a set of named checks (MySQL, Redis, storage)
+// and reports failure as soon as a shutdown begins, so the orchestrator
+// stops routing traffic before connections are drained.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// DefaultTimeout bounds a whole readiness run.
+const DefaultTimeout = 2 * time.Second
+
+// ErrShuttingDown is reported by readiness once Drain was called.
+var ErrShuttingDown = errors.New("shutting down")
+
+var errUnsupported = errors.New("free space not available on this platform")
+
+// Check is one readiness dependency.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Checker runs the readiness checks of one process.
+type Checker struct {
+	Checks  []Check
+	Timeout time.Duration
+
+	draining atomic.Bool
+}
+
+// NewChecker returns a checker over checks with DefaultTimeout.
+func NewChecker(checks ...Check) *Checker {
+	return &Checker{Checks: checks, Timeout: DefaultTimeout}
+}
+
+// Drain marks the process as shutting down; readiness fails from then on.
+func (h *Checker) Drain() {
+	h.draining.Store(true)
+}
+
+// Report is the readiness result, with "ok" or the error of each check.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Ready runs every check concurrently and reports whether all passed.
+func (h *Checker) Ready(ctx context.Context) (bool, Report) {
+	report := Report{Status: "ok", Checks: make(map[string]string, len(h.Checks))}
+	if h.draining.Load() {
+		report.Status = ErrShuttingDown.Error()
+		return false, report
+	}
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ready := true
+	for _, check := range h.Checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+			result := "ok"
+			if err := check.Run(ctx); err != nil {
+				result = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.Name] = result
+			if result != "ok" {
+				ready = false
+			}
+		}(check)
+	}
+	wg.Wait()
+	if !ready {
+		report.Status = "unavailable"
+	}
+	return ready, report
+}
+
+// Live answers the liveness probe: the process is up and serving.
+func Live() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "ok"})
+	}
+}
+
+// Readiness answers the readiness probe with 200 or 503 and the report.
+func (h *Checker) Readiness() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ready, report := h.Ready(c.UserContext())
+		status := fiber.StatusOK
+		if !ready {
+			status = fiber.StatusServiceUnavailable
+		}
+		return c.Status(status).JSON(report)
+	}
+}
+
+// Handle registers /healthz and /readyz on mux, for processes without a
+// Fiber app like the worker.
+func (h *Checker) Handle(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready, report := h.Ready(r.Context())
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Database pings the database behind DB.
+func Database(DB *gorm.DB) Check {
+	return Check{Name: "mysql", Run: func(ctx context.Context) error {
+		sqlDB, err := DB.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.PingContext(ctx)
+	}}
+}
+
+// Redis pings client.
+func Redis(client *redis.Client) Check {
+	return Check{Name: "redis", Run: func(ctx context.Context) error {
+		return client.Ping(ctx).Err()
+	}}
+}
+
+// Storage checks that dir accepts new files and has at least minFree bytes
+// left.
+func Storage(dir string, minFree uint64) Check {
+	return Check{Name: "storage", Run: func(ctx context.Context) error {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		f, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return fmt.Errorf("not writable: %w", err)
+		}
+		name := f.Name()
+		f.Close()
+		os.Remove(name)
+
+		free, err := freeBytes(filepath.Clean(dir))
+		if errors.Is(err, errUnsupported) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if free < minFree {
+			return fmt.Errorf("%d bytes free, need %d", free, minFree)
+		}
+		return nil
+	}}
+}
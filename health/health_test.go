@@ -0,0 +1,96 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestReadiness(t *testing.T) {
+	DB, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+
+	failing := errors.New("connection refused")
+	redisErr := failing
+	checker := NewChecker(
+		Database(DB),
+		Check{Name: "redis", Run: func(ctx context.Context) error { return redisErr }},
+		Storage(t.TempDir(), 0),
+	)
+
+	app := fiber.New()
+	app.Get("/healthz", Live())
+	app.Get("/readyz", checker.Readiness())
+	get := func(path string) (int, Report) {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		require.NoError(t, err)
+		var report Report
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		return resp.StatusCode, report
+	}
+
+	status, report := get("/readyz")
+	require.Equal(t, 503, status)
+	require.Equal(t, "unavailable", report.Status)
+	require.Equal(t, "ok", report.Checks["mysql"])
+	require.Equal(t, "ok", report.Checks["storage"])
+	require.Equal(t, "connection refused", report.Checks["redis"])
+
+	redisErr = nil
+	status, report = get("/readyz")
+	require.Equal(t, 200, status)
+	require.Equal(t, "ok", report.Status)
+
+	// once draining, readiness fails but liveness does not
+	checker.Drain()
+	status, report = get("/readyz")
+	require.Equal(t, 503, status)
+	require.Equal(t, "shutting down", report.Status)
+	status, _ = get("/healthz")
+	require.Equal(t, 200, status)
+}
+
+func TestStorageCheck(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, Storage(dir, 0).Run(context.Background()))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries, "probe file left behind")
+
+	err = Storage(dir, ^uint64(0)).Run(context.Background())
+	require.ErrorContains(t, err, "bytes free")
+
+	// a file where the directory should be
+	blocked := filepath.Join(dir, "blocked")
+	require.NoError(t, os.WriteFile(blocked, nil, 0644))
+	require.Error(t, Storage(blocked, 0).Run(context.Background()))
+}
+
+func TestHandleServesProbes(t *testing.T) {
+	checker := NewChecker(Check{Name: "redis", Run: func(ctx context.Context) error {
+		return errors.New("down")
+	}})
+	mux := http.NewServeMux()
+	checker.Handle(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(t, 200, rec.Code)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	require.Equal(t, 503, rec.Code)
+	var report Report
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+	require.Equal(t, "down", report.Checks["redis"])
+}
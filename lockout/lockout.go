@@ -0,0 +1,162 @@
+// Package lockout slows down and stops password guessing. Failed attempts
+// are counted in Redis per account and per client IP: past a few free
+// failures every further attempt has to wait, twice as long each time, and
+// too many failures lock the account or IP for a while.
+package lockout
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type Policy struct {
+	// how long a failure counts
+	Window time.Duration
+	// failures before attempts are delayed
+	FreeAttempts int
+	// the first delay, doubled by every further failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// failures that lock an account, or an IP, for LockDuration
+	MaxAccountFailures int
+	MaxIPFailures      int
+	LockDuration       time.Duration
+}
+
+// Delay is how long the attempt after the given number of failures waits.
+func (p Policy) Delay(failures int64) time.Duration {
+	n := failures - int64(p.FreeAttempts)
+	if n <= 0 {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := int64(1); i < n && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Verdict is whether an attempt may go ahead: it may when RetryAfter is 0.
+// Locked tells a lockout from a progressive delay.
+type Verdict struct {
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+// Guard applies a Policy. A nil Guard lets every attempt through.
+type Guard struct {
+	client *redis.Client
+	policy Policy
+}
+
+func New(client *redis.Client, policy Policy) *Guard {
+	return &Guard{client: client, policy: policy}
+}
+
+// Check tells whether an attempt for account from ip may go ahead now.
+func (g *Guard) Check(ctx context.Context, account, ip string) (Verdict, error) {
+	if g == nil {
+		return Verdict{}, nil
+	}
+	pipe := g.client.Pipeline()
+	locks := []*redis.DurationCmd{
+		pipe.PTTL(ctx, key("lock", "account", account)),
+		pipe.PTTL(ctx, key("lock", "ip", ip)),
+	}
+	waits := []*redis.DurationCmd{
+		pipe.PTTL(ctx, key("wait", "account", account)),
+		pipe.PTTL(ctx, key("wait", "ip", ip)),
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Verdict{}, err
+	}
+	var v Verdict
+	for _, cmd := range locks {
+		if ttl := cmd.Val(); ttl > v.RetryAfter {
+			v = Verdict{Locked: true, RetryAfter: ttl}
+		}
+	}
+	if v.Locked {
+		return v, nil
+	}
+	for _, cmd := range waits {
+		if ttl := cmd.Val(); ttl > v.RetryAfter {
+			v.RetryAfter = ttl
+		}
+	}
+	return v, nil
+}
+
+// Fail records a failed attempt for account from ip. It returns the number
+// of failures of the account and whether this one locked it.
+func (g *Guard) Fail(ctx context.Context, account, ip string) (int64, bool, error) {
+	if g == nil {
+		return 0, false, nil
+	}
+	accountFailures, accountLocked, err := g.fail(ctx, "account", account, g.policy.MaxAccountFailures)
+	if err != nil {
+		return 0, false, err
+	}
+	if _, _, err := g.fail(ctx, "ip", ip, g.policy.MaxIPFailures); err != nil {
+		return 0, false, err
+	}
+	return accountFailures, accountLocked, nil
+}
+
+// Succeed forgets the failures of account after a successful attempt. Those
+// of the IP stay, or one valid login would hide guesses at other accounts.
+func (g *Guard) Succeed(ctx context.Context, account string) error {
+	if g == nil {
+		return nil
+	}
+	return g.client.Del(ctx, key("failures", "account", account), key("wait", "account", account)).Err()
+}
+
+// LockDuration is how long a lockout lasts.
+func (g *Guard) LockDuration() time.Duration {
+	if g == nil {
+		return 0
+	}
+	return g.policy.LockDuration
+}
+
+func (g *Guard) fail(ctx context.Context, scope, id string, max int) (int64, bool, error) {
+	failures := key("failures", scope, id)
+	count, err := g.client.Incr(ctx, failures).Result()
+	if err != nil {
+		return 0, false, err
+	}
+	if count == 1 {
+		g.client.Expire(ctx, failures, g.policy.Window)
+	}
+
+	if max > 0 && count >= int64(max) {
+		// the count starts over once the lock ends
+		pipe := g.client.TxPipeline()
+		pipe.Set(ctx, key("lock", scope, id), 1, g.policy.LockDuration)
+		pipe.Del(ctx, failures, key("wait", scope, id))
+		if _, err := pipe.Exec(ctx); err != nil {
+			return 0, false, err
+		}
+		return count, true, nil
+	}
+	if delay := g.policy.Delay(count); delay > 0 {
+		if err := g.client.Set(ctx, key("wait", scope, id), 1, delay).Err(); err != nil {
+			return 0, false, err
+		}
+	}
+	return count, false, nil
+}
+
+// key names the Redis key of kind for an account, by lower-cased email, or
+// an IP.
+func key(kind, scope, id string) string {
+	return fmt.Sprintf("login_%s:%s:%s", kind, scope, strings.ToLower(strings.TrimSpace(id)))
+}
@@ -0,0 +1,43 @@
+package lockout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyDelay(t *testing.T) {
+	p := Policy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	for failures, want := range map[int64]time.Duration{
+		0:  0,
+		3:  0,
+		4:  time.Second,
+		5:  2 * time.Second,
+		6:  4 * time.Second,
+		7:  8 * time.Second,
+		8:  10 * time.Second,
+		50: 10 * time.Second,
+	} {
+		require.Equal(t, want, p.Delay(failures), "after %d failures", failures)
+	}
+}
+
+func TestNilGuard(t *testing.T) {
+	var g *Guard
+	ctx := context.Background()
+	v, err := g.Check(ctx, "a@example.com", "127.0.0.1")
+	require.NoError(t, err)
+	require.Zero(t, v.RetryAfter)
+	failures, locked, err := g.Fail(ctx, "a@example.com", "127.0.0.1")
+	require.NoError(t, err)
+	require.Zero(t, failures)
+	require.False(t, locked)
+	require.NoError(t, g.Succeed(ctx, "a@example.com"))
+	require.Zero(t, g.LockDuration())
+}
+
+func TestKey(t *testing.T) {
+	require.Equal(t, "login_failures:account:a@example.com", key("failures", "account", " A@Example.com "))
+}
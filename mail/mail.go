@@ -0,0 +1,96 @@
+// Package mail sends the account emails. A Mailer delivers one rendered
+// Message through SES, SMTP, a directory of .eml files or memory; Templates
+// render messages per locale; Queue renders a message in the request and
+// leaves delivery, with retries, to the worker.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Message is a rendered email with an HTML and a plain text body.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Mailer delivers messages. An error means the message may be retried.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Options select and configure a Mailer.
+type Options struct {
+	// ses, smtp, file or memory
+	Driver string
+	From   string
+
+	AWSRegion string
+
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+
+	OutboxDir string
+}
+
+// New returns the Mailer chosen by opts.Driver.
+func New(ctx context.Context, opts Options) (Mailer, error) {
+	switch opts.Driver {
+	case "ses":
+		return NewSES(ctx, opts.AWSRegion, opts.From)
+	case "smtp":
+		return &SMTP{Addr: opts.SMTPAddr, Username: opts.SMTPUsername, Password: opts.SMTPPassword, From: opts.From}, nil
+	case "file":
+		return &FileOutbox{Dir: opts.OutboxDir, From: opts.From}, nil
+	case "memory":
+		return &Memory{}, nil
+	}
+	return nil, fmt.Errorf("unknown mail driver %q", opts.Driver)
+}
+
+// encode writes msg as a multipart/alternative MIME message.
+func encode(msg Message) ([]byte, error) {
+	var buf bytes.Buffer
+	body := multipart.NewWriter(&buf)
+
+	header := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMessage-ID: <%s@mini-s3>\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=%s\r\n\r\n",
+		msg.From, msg.To, mime.QEncoding.Encode("utf-8", msg.Subject),
+		time.Now().Format(time.RFC1123Z), uuid.NewString(), body.Boundary())
+
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return append([]byte(header), buf.Bytes()...), nil
+}
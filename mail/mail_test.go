@@ -0,0 +1,115 @@
+package mail
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type verifyData struct {
+	Email string
+	Link  string
+}
+
+func TestRenderPicksLocale(t *testing.T) {
+	templates, err := LoadTemplates("", "en")
+	require.NoError(t, err)
+	data := verifyData{Email: "a@example.com", Link: "https://s3.example.com/verify-email?token=abc&x=<y>"}
+
+	msg, err := templates.Render("verify_email", "tr-TR,tr;q=0.9,en;q=0.8", data)
+	require.NoError(t, err)
+	require.Equal(t, "Mini S3 için e-posta adresinizi doğrulayın", msg.Subject)
+	require.Contains(t, msg.Text, data.Link)
+	// the link is escaped in HTML only
+	require.Contains(t, msg.HTML, "token=abc&amp;x=%3cy%3e")
+
+	msg, err = templates.Render("verify_email", "fr-CA, de", data)
+	require.NoError(t, err)
+	require.Equal(t, "Verify your email for Mini S3", msg.Subject, "falls back to the default locale")
+
+	_, err = templates.Render("reset_password_typo", "", data)
+	require.Error(t, err)
+}
+
+func TestLoadTemplatesFromDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "de"), 0755))
+	for name, content := range map[string]string{
+		"welcome.subject.txt": "Willkommen",
+		"welcome.txt":         "Hallo {{.}}",
+		"welcome.html":        "<p>Hallo {{.}}</p>",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "de", name), []byte(content), 0644))
+	}
+
+	templates, err := LoadTemplates(dir, "de")
+	require.NoError(t, err)
+	msg, err := templates.Render("welcome", "", "Ada")
+	require.NoError(t, err)
+	require.Equal(t, Message{Subject: "Willkommen", Text: "Hallo Ada", HTML: "<p>Hallo Ada</p>"}, msg)
+
+	_, err = LoadTemplates(dir, "en")
+	require.ErrorContains(t, err, `default locale "en"`)
+}
+
+func TestFileOutboxWritesMIME(t *testing.T) {
+	dir := t.TempDir()
+	outbox := &FileOutbox{Dir: dir, From: "noreply@example.com"}
+	require.NoError(t, outbox.Send(context.Background(), Message{
+		To:      "a@example.com",
+		Subject: "Doğrulama",
+		Text:    "plain body",
+		HTML:    "<b>html body</b>",
+	}))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	f, err := os.Open(files[0])
+	require.NoError(t, err)
+	defer f.Close()
+
+	parsed, err := netmail.ReadMessage(f)
+	require.NoError(t, err)
+	require.Equal(t, "a@example.com", parsed.Header.Get("To"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	require.NoError(t, err)
+	require.Equal(t, "Doğrulama", subject)
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mediaType)
+	parts := multipart.NewReader(parsed.Body, params["boundary"])
+	var bodies []string
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		body, err := io.ReadAll(part)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+	}
+	require.Equal(t, []string{"plain body", "<b>html body</b>"}, bodies)
+}
+
+func TestQueueWithoutClientSendsDirectly(t *testing.T) {
+	templates, err := LoadTemplates("", "en")
+	require.NoError(t, err)
+	outbox := &Memory{}
+	queue := &Queue{Templates: templates, Direct: outbox}
+
+	require.NoError(t, queue.Send(context.Background(), "a@example.com", "verify_email", "tr", verifyData{Link: "https://x"}))
+	sent := outbox.Sent()
+	require.Len(t, sent, 1)
+	require.Equal(t, "a@example.com", sent[0].To)
+	require.Contains(t, sent[0].HTML, "E-postayı doğrula")
+}
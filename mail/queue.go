@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"context"
+
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/hibiken/asynq"
+)
+
+// Queue renders messages in the request and enqueues their delivery as a
+// send_email task, so a slow or failing mail server never fails the request
+// and the worker retries. With a nil Client the message goes to Direct at
+// once instead, for tests and tools without a worker.
+type Queue struct {
+	Client    *asynq.Client
+	Templates *Templates
+	Direct    Mailer
+}
+
+// Send renders template name for acceptLanguage and queues it to to.
+func (q *Queue) Send(ctx context.Context, to, name, acceptLanguage string, data interface{}) error {
+	msg, err := q.Templates.Render(name, acceptLanguage, data)
+	if err != nil {
+		return err
+	}
+	msg.To = to
+	if q.Client == nil {
+		return q.Direct.Send(ctx, msg)
+	}
+	task, err := tasks.NewSendEmailTask(ctx, tasks.SendEmailPayload{
+		To:      msg.To,
+		Subject: msg.Subject,
+		HTML:    msg.HTML,
+		Text:    msg.Text,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = q.Client.EnqueueContext(ctx, task)
+	return err
+}
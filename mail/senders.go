@@ -0,0 +1,113 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	sesv2 "github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/google/uuid"
+)
+
+// SES sends through Amazon SES.
+type SES struct {
+	Client *sesv2.Client
+	From   string
+}
+
+// NewSES loads the default AWS credentials for region.
+func NewSES(ctx context.Context, region, from string) (*SES, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	return &SES{Client: sesv2.NewFromConfig(cfg), From: from}, nil
+}
+
+func (s *SES) Send(ctx context.Context, msg Message) error {
+	_, err := s.Client.SendEmail(ctx, &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(s.From),
+		Destination:      &types.Destination{ToAddresses: []string{msg.To}},
+		Content: &types.EmailContent{
+			Simple: &types.Message{
+				Subject: &types.Content{Data: aws.String(msg.Subject), Charset: aws.String("UTF-8")},
+				Body: &types.Body{
+					Html: &types.Content{Data: aws.String(msg.HTML), Charset: aws.String("UTF-8")},
+					Text: &types.Content{Data: aws.String(msg.Text), Charset: aws.String("UTF-8")},
+				},
+			},
+		},
+	})
+	return err
+}
+
+// SMTP sends through a mail server, authenticating with PLAIN when a
+// username is set. net/smtp upgrades to STARTTLS when the server offers it.
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	msg.From = s.From
+	data, err := encode(msg)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{msg.To}, data)
+}
+
+// FileOutbox writes every message to Dir as an .eml file, for development
+// without a mail server.
+type FileOutbox struct {
+	Dir  string
+	From string
+}
+
+func (f *FileOutbox) Send(ctx context.Context, msg Message) error {
+	msg.From = f.From
+	data, err := encode(msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.Dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405Z"), uuid.NewString())
+	return os.WriteFile(filepath.Join(f.Dir, name), data, 0644)
+}
+
+// Memory keeps messages in memory, for tests.
+type Memory struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func (m *Memory) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns the messages sent so far.
+func (m *Memory) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.sent...)
+}
@@ -0,0 +1,133 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"strings"
+	texttemplate "text/template"
+)
+
+// embedded holds the shipped templates, used unless a directory replaces
+// them.
+//
+//go:embed templates
+var embedded embed.FS
+
+// Templates are the email templates of every locale. Each template is three
+// files in the locale's directory:
+//
+//	<locale>/<name>.subject.txt
+//	<locale>/<name>.txt
+//	<locale>/<name>.html
+type Templates struct {
+	defaultLocale string
+	locales       map[string]*localeTemplates
+}
+
+type localeTemplates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// LoadTemplates parses the templates under dir, or the shipped ones when dir
+// is empty. Every locale must exist in full, so a broken template stops the
+// server at startup rather than failing a signup.
+func LoadTemplates(dir, defaultLocale string) (*Templates, error) {
+	fsys, err := fs.Sub(embedded, "templates")
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		fsys = os.DirFS(dir)
+	}
+	return parseTemplates(fsys, defaultLocale)
+}
+
+func parseTemplates(fsys fs.FS, defaultLocale string) (*Templates, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("read mail templates: %w", err)
+	}
+	t := &Templates{defaultLocale: defaultLocale, locales: map[string]*localeTemplates{}}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		locale := entry.Name()
+		text, err := texttemplate.ParseFS(fsys, locale+"/*.txt")
+		if err != nil {
+			return nil, fmt.Errorf("parse %s text templates: %w", locale, err)
+		}
+		html, err := htmltemplate.ParseFS(fsys, locale+"/*.html")
+		if err != nil {
+			return nil, fmt.Errorf("parse %s html templates: %w", locale, err)
+		}
+		t.locales[strings.ToLower(locale)] = &localeTemplates{text: text, html: html}
+	}
+	if _, ok := t.locales[strings.ToLower(defaultLocale)]; !ok {
+		return nil, fmt.Errorf("no mail templates for default locale %q", defaultLocale)
+	}
+	return t, nil
+}
+
+// Render renders template name for the first locale of acceptLanguage (an
+// Accept-Language value such as "tr-TR,tr;q=0.9,en;q=0.8") that has
+// templates, trying each tag and then its base language, and falls back to
+// the default locale.
+func (t *Templates) Render(name, acceptLanguage string, data interface{}) (Message, error) {
+	lt := t.locales[strings.ToLower(t.defaultLocale)]
+	for _, locale := range candidates(acceptLanguage) {
+		if found, ok := t.locales[locale]; ok {
+			lt = found
+			break
+		}
+	}
+
+	var msg Message
+	var buf bytes.Buffer
+	for _, part := range []struct {
+		file string
+		dst  *string
+		html bool
+	}{
+		{name + ".subject.txt", &msg.Subject, false},
+		{name + ".txt", &msg.Text, false},
+		{name + ".html", &msg.HTML, true},
+	} {
+		buf.Reset()
+		var err error
+		if part.html {
+			err = lt.html.ExecuteTemplate(&buf, part.file, data)
+		} else {
+			err = lt.text.ExecuteTemplate(&buf, part.file, data)
+		}
+		if err != nil {
+			return Message{}, fmt.Errorf("render %s: %w", part.file, err)
+		}
+		*part.dst = buf.String()
+	}
+	msg.Subject = strings.TrimSpace(msg.Subject)
+	return msg, nil
+}
+
+// candidates lists the locales of an Accept-Language value in order, each
+// followed by its base language.
+func candidates(acceptLanguage string) []string {
+	var out []string
+	for _, tag := range strings.Split(acceptLanguage, ",") {
+		tag, _, _ = strings.Cut(tag, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		out = append(out, tag)
+		if base, _, ok := strings.Cut(tag, "-"); ok {
+			out = append(out, base)
+		}
+	}
+	return out
+}
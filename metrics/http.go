@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Middleware records every request by its route pattern, so label values
+// stay bounded whatever paths clients send. It must be registered first so
+// requests the rate limiters and auth middlewares reject are counted too.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		// a returned error is turned into a response after this middleware runs
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var fe *fiber.Error
+			if errors.As(err, &fe) {
+				status = fe.Code
+			}
+		}
+		route := c.Route().Path
+		method := c.Method()
+		code := strconv.Itoa(status)
+		HTTPRequests.WithLabelValues(method, route, code).Inc()
+		HTTPDuration.WithLabelValues(method, route, code).Observe(time.Since(start).Seconds())
+
+		if n := c.Request().Header.ContentLength(); n > 0 {
+			BytesUploaded.WithLabelValues(route).Add(float64(n))
+		}
+		if !c.Response().SkipBody {
+			n := c.Response().Header.ContentLength()
+			if n <= 0 {
+				n = len(c.Response().Body())
+			}
+			if n > 0 {
+				BytesDownloaded.WithLabelValues(route).Add(float64(n))
+			}
+		}
+		return err
+	}
+}
+
+// Handler serves the Prometheus exposition format.
+func Handler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.Handler())
+}
@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestMiddleware(t *testing.T) {
+	app := fiber.New()
+	app.Use(Middleware())
+	app.Get("/metrics", Handler())
+	app.Post("/api/buckets/:bucketName/files/:fileName", func(c *fiber.Ctx) error {
+		return c.SendString("stored")
+	})
+	app.Get("/api/buckets/:bucketName", func(c *fiber.Ctx) error {
+		return fiber.NewError(fiber.StatusNotFound, "bucket not found")
+	})
+
+	route := "/api/buckets/:bucketName/files/:fileName"
+	before := testutil.ToFloat64(HTTPRequests.WithLabelValues("POST", route, "200"))
+	uploaded := testutil.ToFloat64(BytesUploaded.WithLabelValues(route))
+	downloaded := testutil.ToFloat64(BytesDownloaded.WithLabelValues(route))
+
+	for _, name := range []string{"a", "b"} {
+		req := httptest.NewRequest("POST", "/api/buckets/photos/files/"+name, strings.NewReader("hello"))
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+	}
+	// concrete paths collapse onto the route pattern
+	require.Equal(t, before+2, testutil.ToFloat64(HTTPRequests.WithLabelValues("POST", route, "200")))
+	require.Equal(t, uploaded+10, testutil.ToFloat64(BytesUploaded.WithLabelValues(route)))
+	require.Equal(t, downloaded+12, testutil.ToFloat64(BytesDownloaded.WithLabelValues(route)))
+
+	notFound := testutil.ToFloat64(HTTPRequests.WithLabelValues("GET", "/api/buckets/:bucketName", "404"))
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/buckets/missing", nil))
+	require.NoError(t, err)
+	require.Equal(t, 404, resp.StatusCode)
+	require.Equal(t, notFound+1, testutil.ToFloat64(HTTPRequests.WithLabelValues("GET", "/api/buckets/:bucketName", "404")))
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/metrics", nil))
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	require.Contains(t, string(body), `minis3_http_requests_total{method="POST",route="/api/buckets/:bucketName/files/:fileName",status="200"}`)
+	require.Contains(t, string(body), "minis3_http_request_duration_seconds_bucket")
+}
+
+func TestTaskMiddleware(t *testing.T) {
+	failing := errors.New("boom")
+	handler := TaskMiddleware(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if string(t.Payload()) == "fail" {
+			return failing
+		}
+		return nil
+	}))
+
+	ok := testutil.ToFloat64(TasksProcessed.WithLabelValues("test:task", "success"))
+	failed := testutil.ToFloat64(TasksProcessed.WithLabelValues("test:task", "failure"))
+
+	require.NoError(t, handler.ProcessTask(context.Background(), asynq.NewTask("test:task", []byte("ok"))))
+	require.ErrorIs(t, handler.ProcessTask(context.Background(), asynq.NewTask("test:task", []byte("fail"))), failing)
+
+	require.Equal(t, ok+1, testutil.ToFloat64(TasksProcessed.WithLabelValues("test:task", "success")))
+	require.Equal(t, failed+1, testutil.ToFloat64(TasksProcessed.WithLabelValues("test:task", "failure")))
+}
+
+func TestInstrumentGORM(t *testing.T) {
+	DB, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, InstrumentGORM(DB))
+
+	type row struct {
+		ID   uint
+		Name string
+	}
+	require.NoError(t, DB.AutoMigrate(&row{}))
+
+	creates, queries := dbSamples(t, "create"), dbSamples(t, "query")
+	require.NoError(t, DB.Create(&row{Name: "a"}).Error)
+	var got row
+	require.NoError(t, DB.First(&got).Error)
+	require.Equal(t, "a", got.Name)
+
+	require.Equal(t, creates+1, dbSamples(t, "create"))
+	require.Equal(t, queries+1, dbSamples(t, "query"))
+}
+
+// dbSamples returns how many statements of operation have been observed.
+func dbSamples(t *testing.T, operation string) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != "minis3_db_query_duration_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "operation" && l.GetValue() == operation {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// TaskMiddleware records the duration and result of every task the worker
+// runs.
+func TaskMiddleware(next asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		start := time.Now()
+		err := next.ProcessTask(ctx, t)
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		TaskDuration.WithLabelValues(t.Type(), result).Observe(time.Since(start).Seconds())
+		TasksProcessed.WithLabelValues(t.Type(), result).Inc()
+		return err
+	})
+}
+
+// queueCollector reads queue depths from the asynq inspector at scrape time.
+type queueCollector struct {
+	inspector *asynq.Inspector
+	size      *prometheus.Desc
+	latency   *prometheus.Desc
+}
+
+// RegisterQueueCollector exports the size of every asynq queue per task
+// state, and how long its oldest pending task has waited.
+func RegisterQueueCollector(inspector *asynq.Inspector) error {
+	return prometheus.Register(&queueCollector{
+		inspector: inspector,
+		size: prometheus.NewDesc(namespace+"_queue_tasks",
+			"Tasks in an asynq queue by state.", []string{"queue", "state"}, nil),
+		latency: prometheus.NewDesc(namespace+"_queue_latency_seconds",
+			"Time the oldest pending task of an asynq queue has waited.", []string{"queue"}, nil),
+	})
+}
+
+func (q *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- q.size
+	ch <- q.latency
+}
+
+func (q *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	queues, err := q.inspector.Queues()
+	if err != nil {
+		log.WithError(err).Warn("Failed to list queues for metrics")
+		return
+	}
+	for _, name := range queues {
+		info, err := q.inspector.GetQueueInfo(name)
+		if err != nil {
+			log.WithError(err).WithField("queue", name).Warn("Failed to read queue for metrics")
+			continue
+		}
+		for state, n := range map[string]int{
+			"pending":   info.Pending,
+			"active":    info.Active,
+			"scheduled": info.Scheduled,
+			"retry":     info.Retry,
+			"archived":  info.Archived,
+			"completed": info.Completed,
+		} {
+			ch <- prometheus.MustNewConstMetric(q.size, prometheus.GaugeValue, float64(n), name, state)
+		}
+		ch <- prometheus.MustNewConstMetric(q.latency, prometheus.GaugeValue, info.Latency.Seconds(), name)
+	}
+}
+
+// ServeMux returns a mux exposing /metrics, for processes without an HTTP
+// server of their own, like the worker.
+func ServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
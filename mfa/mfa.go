@@ -0,0 +1,110 @@
+package mfa
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/auth"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// RecoveryCodes is how many recovery codes a user gets at a time.
+const RecoveryCodes = 10
+
+var ErrInvalidCode = errors.New("invalid MFA code")
+
+// Verify checks code for user, whose MFA is enabled: a TOTP code of their
+// secret or one of their unused recovery codes, which is used up.
+func Verify(DB *gorm.DB, user *db.User, code string) error {
+	code = strings.TrimSpace(code)
+	if IsCode(code) {
+		return VerifyTOTP(DB, user, code)
+	}
+	if code == "" {
+		return ErrInvalidCode
+	}
+	res := DB.Where("user_id = ? AND code_hash = ?", user.ID, auth.HashToken(normalizeRecoveryCode(code))).
+		Delete(&db.MFARecoveryCode{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// VerifyTOTP checks a TOTP code of user's secret, enabled or still pending
+// confirmation. Each code is accepted once: the time step of the last one
+// is stored and only later steps pass, so an observed code cannot be
+// replayed.
+func VerifyTOTP(DB *gorm.DB, user *db.User, code string) error {
+	if user.MFASecret == "" {
+		return ErrInvalidCode
+	}
+	step, ok := Match(user.MFASecret, code, time.Now())
+	if !ok {
+		return ErrInvalidCode
+	}
+	res := DB.Model(&db.User{}).Where("id = ? AND mfa_last_step < ?", user.ID, step).Update("mfa_last_step", step)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	user.MFALastStep = step
+	return nil
+}
+
+// NewRecoveryCodes replaces the recovery codes of userID and returns the new
+// ones. Only their hashes are kept, so this is the one time they are seen.
+func NewRecoveryCodes(DB *gorm.DB, userID string) ([]string, error) {
+	codes := make([]string, 0, RecoveryCodes)
+	rows := make([]db.MFARecoveryCode, 0, RecoveryCodes)
+	for i := 0; i < RecoveryCodes; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes = append(codes, code[:5]+"-"+code[5:])
+		rows = append(rows, db.MFARecoveryCode{ID: uuid.NewString(), UserID: userID, CodeHash: auth.HashToken(code)})
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&db.MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Disable turns MFA off for userID and forgets its secret and recovery
+// codes.
+func Disable(DB *gorm.DB, userID string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&db.MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&db.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"mfa_secret":    "",
+			"mfa_enabled":   false,
+			"mfa_last_step": 0,
+		}).Error
+	})
+}
+
+// normalizeRecoveryCode accepts recovery codes typed with other case,
+// without the dash or with spaces.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
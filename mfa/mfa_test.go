@@ -0,0 +1,52 @@
+package mfa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupMFADB(t *testing.T) *gorm.DB {
+	DB, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, DB.AutoMigrate(&db.User{}, &db.MFARecoveryCode{}))
+	return DB
+}
+
+func TestVerify(t *testing.T) {
+	DB := setupMFADB(t)
+	secret, err := GenerateSecret()
+	require.NoError(t, err)
+	user := db.User{ID: "user-1", Email: "a@example.com", AccessKey: "ak-1", MFASecret: secret, MFAEnabled: true}
+	require.NoError(t, DB.Create(&user).Error)
+
+	code, err := Code(secret, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, Verify(DB, &user, code))
+	require.ErrorIs(t, Verify(DB, &user, code), ErrInvalidCode, "a code works once")
+	var stored db.User
+	require.NoError(t, DB.First(&stored, "id = ?", user.ID).Error)
+	require.Equal(t, time.Now().Unix()/Period, stored.MFALastStep)
+
+	// recovery codes are single use and replaced as a set
+	codes, err := NewRecoveryCodes(DB, user.ID)
+	require.NoError(t, err)
+	require.Len(t, codes, RecoveryCodes)
+	require.NoError(t, Verify(DB, &user, " "+codes[0]+" "))
+	require.ErrorIs(t, Verify(DB, &user, codes[0]), ErrInvalidCode)
+	require.NoError(t, Verify(DB, &user, "  "+codes[1][:5]+codes[1][6:]), "the dash is optional")
+	fresh, err := NewRecoveryCodes(DB, user.ID)
+	require.NoError(t, err)
+	require.ErrorIs(t, Verify(DB, &user, codes[2]), ErrInvalidCode, "old codes are replaced")
+	require.ErrorIs(t, Verify(DB, &user, ""), ErrInvalidCode)
+
+	require.NoError(t, Disable(DB, user.ID))
+	require.NoError(t, DB.First(&stored, "id = ?", user.ID).Error)
+	require.False(t, stored.MFAEnabled)
+	require.Empty(t, stored.MFASecret)
+	require.ErrorIs(t, Verify(DB, &stored, fresh[0]), ErrInvalidCode)
+}
@@ -0,0 +1,61 @@
+package mfa
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodeRFC6238(t *testing.T) {
+	// the SHA-1 vectors of RFC 6238 appendix B, cut to six digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		got, err := Code(secret, time.Unix(unix, 0))
+		require.NoError(t, err)
+		require.Equal(t, want, got, "time %d", unix)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	secret, err := GenerateSecret()
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+
+	code, err := Code(secret, now)
+	require.NoError(t, err)
+	step, ok := Match(secret, code, now)
+	require.True(t, ok)
+	require.Equal(t, now.Unix()/Period, step)
+
+	previous, _ := Code(secret, now.Add(-Period*time.Second))
+	_, ok = Match(secret, previous, now)
+	require.True(t, ok, "one period of drift is allowed")
+	stale, _ := Code(secret, now.Add(-2*Period*time.Second))
+	_, ok = Match(secret, stale, now)
+	require.False(t, ok)
+	_, ok = Match(secret, "12345", now)
+	require.False(t, ok)
+	_, ok = Match("not base32!", code, now)
+	require.False(t, ok)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(ProvisioningURI("mini-s3", "ada@example.com", "JBSWY3DPEHPK3PXP"))
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", uri.Scheme)
+	require.Equal(t, "totp", uri.Host)
+	require.Equal(t, "/mini-s3:ada@example.com", uri.Path)
+	require.Equal(t, "JBSWY3DPEHPK3PXP", uri.Query().Get("secret"))
+	require.Equal(t, "mini-s3", uri.Query().Get("issuer"))
+	require.Equal(t, "6", uri.Query().Get("digits"))
+}
@@ -3,17 +3,26 @@ package middleware
 import (
 	"errors"
 	"strconv"
+	"strings"
 
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
 	"github.com/SysTechSalihY/mini-s3-clone/auth"
 	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/metrics"
+	"github.com/SysTechSalihY/mini-s3-clone/mfa"
+	"github.com/SysTechSalihY/mini-s3-clone/requestid"
 	"github.com/gofiber/fiber/v2"
 	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
-func AuthMiddleware(DB *gorm.DB) fiber.Handler {
+// AuthMiddleware authenticates a request signed with the user's access and
+// secret keys, or carrying a session access token as
+// "Authorization: Bearer <token>" when sessions is not nil.
+func AuthMiddleware(DB *gorm.DB, sessions *auth.Sessions) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		log.WithFields(log.Fields{
+		DB := DB.WithContext(c.UserContext())
+		requestid.Log(c).WithFields(log.Fields{
 			"method":       c.Method(),
 			"original_url": c.OriginalURL(),
 		}).Info("Incoming request for signature check")
@@ -21,8 +30,8 @@ func AuthMiddleware(DB *gorm.DB) fiber.Handler {
 		var bucket db.Bucket
 		if bucketName != "" {
 			if err := DB.Where("bucket_name = ?", bucketName).First(&bucket).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-				log.WithError(err).Error("DB error fetching bucket in AuthMiddleware")
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "internal server error"})
+				requestid.Log(c).WithError(err).Error("DB error fetching bucket in AuthMiddleware")
+				return apierror.Send(c, apierror.InternalError, "internal server error")
 			}
 		}
 
@@ -31,31 +40,148 @@ func AuthMiddleware(DB *gorm.DB) fiber.Handler {
 			return c.Next()
 		}
 
+		if token, ok := bearerToken(c); ok && sessions != nil {
+			session, user, err := sessions.Authenticate(DB, token)
+			if err != nil {
+				if !errors.Is(err, auth.ErrInvalidToken) {
+					requestid.Log(c).WithError(err).Error("DB error checking session in AuthMiddleware")
+					return apierror.Send(c, apierror.InternalError, "internal server error")
+				}
+				metrics.AuthFailures.WithLabelValues("invalid_session").Inc()
+				return apierror.Send(c, apierror.Unauthenticated, "invalid or expired access token")
+			}
+			c.Locals("session", session)
+			return authorized(c, user, &bucket)
+		}
+
 		accessKey := c.Get("X-Access-Key")
 		signature := c.Get("X-Signature")
 		expiresStr := c.Get("X-Expires")
 		if accessKey == "" || signature == "" || expiresStr == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "missing authentication headers"})
+			metrics.AuthFailures.WithLabelValues("missing_credentials").Inc()
+			return apierror.Send(c, apierror.MissingSecurityHeader, "missing authentication headers")
 		}
 
 		expires, err := strconv.ParseInt(expiresStr, 10, 64)
 		if err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid expiration timestamp"})
+			metrics.AuthFailures.WithLabelValues("invalid_expiration").Inc()
+			return apierror.Send(c, apierror.InvalidArgument, "invalid expiration timestamp")
 		}
 
 		if !auth.ValidateRequest(DB, accessKey, signature, c.Method(), c.OriginalURL(), expires) {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid or expired signature"})
+			metrics.AuthFailures.WithLabelValues("invalid_signature").Inc()
+			return apierror.Send(c, apierror.SignatureMismatch, "invalid or expired signature")
 		}
 
 		user, err := auth.GetUserByAccessKey(DB, accessKey)
 		if err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "user does not exist"})
+			metrics.AuthFailures.WithLabelValues("unknown_user").Inc()
+			return apierror.Send(c, apierror.InvalidAccessKeyID, "user does not exist")
 		}
-		if bucket.ID != "" && (bucket.ACL == nil || *bucket.ACL == "private") && user.ID != bucket.UserID {
-			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "forbidden"})
+		return authorized(c, user, &bucket)
+	}
+}
+
+// authorized lets an authenticated user through unless their account is
+// disabled or the bucket of the route is someone else's private one.
+func authorized(c *fiber.Ctx, user *db.User, bucket *db.Bucket) error {
+	if user.Disabled {
+		requestid.Log(c).WithField("user_id", user.ID).Warn("Request from disabled account")
+		metrics.AuthFailures.WithLabelValues("account_disabled").Inc()
+		return apierror.Send(c, apierror.AccountDisabled, "account disabled")
+	}
+	if bucket.ID != "" && (bucket.ACL == nil || *bucket.ACL == "private") && user.ID != bucket.UserID {
+		metrics.AuthFailures.WithLabelValues("bucket_forbidden").Inc()
+		return apierror.Send(c, apierror.AccessDenied, "forbidden")
+	}
+
+	c.Locals("user", user)
+	return c.Next()
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(c *fiber.Ctx) (string, bool) {
+	scheme, token, ok := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// RequireAdmin guards the admin API; it must run after AuthMiddleware.
+func RequireAdmin() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
 		}
+		if user.UserRole != "admin" {
+			requestid.Log(c).WithFields(log.Fields{
+				"user_id": user.ID,
+				"path":    c.Path(),
+			}).Warn("Non-admin access to admin API")
+			return apierror.Send(c, apierror.AccessDenied, "admin access required")
+		}
+		return c.Next()
+	}
+}
 
-		c.Locals("user", user)
+// RequireVerified refuses writes from accounts that have not verified their
+// email address, except under the given path prefixes, which should cover
+// what such an account needs to verify or leave. Reads stay open. It must
+// run after AuthMiddleware.
+func RequireVerified(exempt ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil || user.IsVerified {
+			return c.Next()
+		}
+		switch c.Method() {
+		case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+			return c.Next()
+		}
+		for _, prefix := range exempt {
+			if strings.HasPrefix(c.Path(), prefix) {
+				return c.Next()
+			}
+		}
+		metrics.AuthFailures.WithLabelValues("email_not_verified").Inc()
+		return apierror.Send(c, apierror.EmailNotVerified, "verify your email address first")
+	}
+}
+
+// RequireMFA asks for a code of the caller's second factor in the
+// X-MFA-Code header on routes too destructive to trust a stolen key or
+// session with. With enrolled set, callers without MFA are refused;
+// otherwise they pass. It must run after AuthMiddleware.
+func RequireMFA(DB *gorm.DB, enrolled bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return apierror.Send(c, apierror.Unauthenticated, "unauthenticated")
+		}
+		if !user.MFAEnabled {
+			if enrolled {
+				return apierror.Send(c, apierror.AccessDenied, "enable MFA on your account to use this route")
+			}
+			return c.Next()
+		}
+		code := c.Get(mfa.Header)
+		if code == "" {
+			return apierror.Send(c, apierror.MFARequired, "MFA code required")
+		}
+		if err := mfa.Verify(DB.WithContext(c.UserContext()), user, code); err != nil {
+			if errors.Is(err, mfa.ErrInvalidCode) {
+				metrics.AuthFailures.WithLabelValues("invalid_mfa_code").Inc()
+				requestid.Log(c).WithFields(log.Fields{
+					"user_id": user.ID,
+					"path":    c.Path(),
+				}).Warn("Invalid MFA code")
+				return apierror.Send(c, apierror.MFARequired, "invalid MFA code")
+			}
+			requestid.Log(c).WithError(err).WithField("user_id", user.ID).Error("Failed to verify MFA code")
+			return apierror.Send(c, apierror.InternalError, "failed to verify MFA code")
+		}
 		return c.Next()
 	}
 }
@@ -9,13 +9,16 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
 	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/metrics"
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
 )
 
 func ValidatePresignedURL(DB *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		DB := DB.WithContext(c.UserContext())
 		bucket := c.Query("bucket")
 		key := c.Query("key")
 		sig := c.Query("sig")
@@ -23,7 +26,8 @@ func ValidatePresignedURL(DB *gorm.DB) fiber.Handler {
 		versionID := c.Query("versionID", "")
 
 		if bucket == "" || key == "" || sig == "" || expiresStr == "" {
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "missing required query params"})
+			metrics.AuthFailures.WithLabelValues("presigned_missing_params").Inc()
+			return apierror.Send(c, apierror.MissingSecurityHeader, "missing required query params")
 		}
 
 		// Ensure HTTP method matches operation
@@ -34,28 +38,37 @@ func ValidatePresignedURL(DB *gorm.DB) fiber.Handler {
 		case http.MethodPost:
 			expectedOp = "upload"
 		default:
-			return c.Status(http.StatusMethodNotAllowed).JSON(fiber.Map{"error": "unsupported HTTP method"})
+			return apierror.Send(c, apierror.MethodNotAllowed, "unsupported HTTP method")
 		}
 
 		expires, err := strconv.ParseInt(expiresStr, 10, 64)
 		if err != nil {
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "invalid expiration"})
+			metrics.AuthFailures.WithLabelValues("presigned_invalid_expiration").Inc()
+			return apierror.Send(c, apierror.InvalidArgument, "invalid expiration")
 		}
 
 		if time.Now().Unix() > expires {
-			return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "URL expired"})
+			metrics.AuthFailures.WithLabelValues("presigned_expired").Inc()
+			return apierror.Send(c, apierror.AccessDenied, "URL expired")
 		}
 
 		// Fetch bucket
 		var bucketData db.Bucket
 		if err := DB.Where("bucket_name = ?", bucket).First(&bucketData).Error; err != nil {
-			return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "bucket not found"})
+			metrics.AuthFailures.WithLabelValues("presigned_unknown_bucket").Inc()
+			return apierror.Send(c, apierror.NoSuchBucket, "bucket not found")
 		}
 
 		// Fetch user
 		var user db.User
 		if err := DB.Where("id = ?", bucketData.UserID).First(&user).Error; err != nil {
-			return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "user not found"})
+			metrics.AuthFailures.WithLabelValues("presigned_unknown_user").Inc()
+			return apierror.Send(c, apierror.AccessDenied, "user not found")
+		}
+		// URLs signed before the owner was disabled stop working with it
+		if user.Disabled {
+			metrics.AuthFailures.WithLabelValues("account_disabled").Inc()
+			return apierror.Send(c, apierror.AccountDisabled, "account disabled")
 		}
 
 		// Construct HMAC message exactly like GeneratePresignedURL
@@ -65,7 +78,8 @@ func ValidatePresignedURL(DB *gorm.DB) fiber.Handler {
 		expectedSig := base64.URLEncoding.EncodeToString(h.Sum(nil))
 
 		if !hmac.Equal([]byte(sig), []byte(expectedSig)) {
-			return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "invalid signature"})
+			metrics.AuthFailures.WithLabelValues("presigned_invalid_signature").Inc()
+			return apierror.Send(c, apierror.SignatureMismatch, "invalid signature")
 		}
 
 		c.Locals("bucket", bucket)
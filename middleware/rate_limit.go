@@ -4,20 +4,22 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/metrics"
 	"github.com/gofiber/fiber/v2"
 	"github.com/redis/go-redis/v9"
-	"golang.org/x/net/context"
 )
 
 func RateLimit(client *redis.Client, limit int, window time.Duration) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		ctx := context.Background()
+		ctx := c.UserContext()
 		identifier := c.IP()
 
 		key := fmt.Sprintf("rate_limit:%s", identifier)
 		count, err := client.Incr(ctx, key).Result()
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "rate limit error"})
+			return apierror.Send(c, apierror.InternalError, "rate limit error")
 		}
 
 		if count == 1 {
@@ -25,9 +27,46 @@ func RateLimit(client *redis.Client, limit int, window time.Duration) fiber.Hand
 		}
 
 		if count > int64(limit) {
+			metrics.RateLimitRejections.WithLabelValues("ip").Inc()
 			ttl, _ := client.TTL(ctx, key).Result()
-			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
-				"error":       "rate limit exceeded",
+			return apierror.SendWith(c, apierror.SlowDown, "rate limit exceeded", fiber.Map{
+				"retry_after": int(ttl.Seconds()),
+			})
+		}
+
+		return c.Next()
+	}
+}
+
+// UserRateLimit limits authenticated users to their own RateLimit per window,
+// or defaultLimit when they have none. It must run after AuthMiddleware;
+// anonymous requests are left to the per-IP RateLimit.
+func UserRateLimit(client *redis.Client, defaultLimit int, window time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, ok := c.Locals("user").(*db.User)
+		if !ok || user == nil {
+			return c.Next()
+		}
+		limit := defaultLimit
+		if user.RateLimit != nil {
+			limit = *user.RateLimit
+		}
+
+		ctx := c.UserContext()
+		key := fmt.Sprintf("rate_limit:user:%s", user.ID)
+		count, err := client.Incr(ctx, key).Result()
+		if err != nil {
+			return apierror.Send(c, apierror.InternalError, "rate limit error")
+		}
+
+		if count == 1 {
+			client.Expire(ctx, key, window)
+		}
+
+		if count > int64(limit) {
+			metrics.RateLimitRejections.WithLabelValues("user").Inc()
+			ttl, _ := client.TTL(ctx, key).Result()
+			return apierror.SendWith(c, apierror.SlowDown, "rate limit exceeded", fiber.Map{
 				"retry_after": int(ttl.Seconds()),
 			})
 		}
@@ -0,0 +1,133 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+)
+
+// Event names follow S3. Configurations may also use the "s3:" prefixed form
+// and a trailing "*" wildcard, e.g. "s3:ObjectCreated:*".
+const (
+	ObjectCreatedPut    = "ObjectCreated:Put"
+	ObjectCreatedPost   = "ObjectCreated:Post"
+	ObjectCreatedCopy   = "ObjectCreated:Copy"
+	ObjectRemovedDelete = "ObjectRemoved:Delete"
+
+	// metadata changes of a version
+	ObjectRetentionPut = "ObjectRetention:Put"
+	ObjectLegalHoldPut = "ObjectLegalHold:Put"
+
+	// a change to a bucket configuration, which only goes to the streams
+	BucketConfigurationPut = "BucketConfiguration:Put"
+)
+
+var knownEvents = []string{
+	ObjectCreatedPut, ObjectCreatedPost, ObjectCreatedCopy, ObjectRemovedDelete,
+	ObjectRetentionPut, ObjectLegalHoldPut,
+}
+
+// NormalizeEventName strips the optional "s3:" prefix and reports whether the
+// name, or wildcard pattern, matches at least one event we emit.
+func NormalizeEventName(name string) (string, bool) {
+	name = strings.TrimPrefix(name, "s3:")
+	for _, known := range knownEvents {
+		if eventMatches(name, known) {
+			return name, true
+		}
+	}
+	return name, false
+}
+
+func eventMatches(pattern, eventName string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(eventName, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == eventName
+}
+
+// Matches reports whether cfg subscribes to eventName for the object key.
+func Matches(cfg *db.BucketNotification, eventName, key string) bool {
+	if !strings.HasPrefix(key, cfg.Prefix) || !strings.HasSuffix(key, cfg.Suffix) {
+		return false
+	}
+	for _, pattern := range cfg.EventList() {
+		if eventMatches(strings.TrimPrefix(pattern, "s3:"), eventName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Message is the webhook body, laid out like an S3 event notification so
+// existing S3 consumers can parse it.
+type Message struct {
+	Records []Record `json:"Records"`
+}
+
+type Record struct {
+	EventVersion string    `json:"eventVersion"`
+	EventSource  string    `json:"eventSource"`
+	AWSRegion    string    `json:"awsRegion"`
+	EventTime    time.Time `json:"eventTime"`
+	EventName    string    `json:"eventName"`
+	UserIdentity Identity  `json:"userIdentity"`
+	S3           S3Entity  `json:"s3"`
+}
+
+type Identity struct {
+	PrincipalID string `json:"principalId"`
+}
+
+type S3Entity struct {
+	SchemaVersion   string       `json:"s3SchemaVersion"`
+	ConfigurationID string       `json:"configurationId"`
+	Bucket          BucketEntity `json:"bucket"`
+	Object          ObjectEntity `json:"object"`
+}
+
+type BucketEntity struct {
+	Name          string   `json:"name"`
+	OwnerIdentity Identity `json:"ownerIdentity"`
+	ARN           string   `json:"arn"`
+}
+
+type ObjectEntity struct {
+	Key       string `json:"key"`
+	Size      int64  `json:"size,omitempty"`
+	ETag      string `json:"eTag,omitempty"`
+	VersionID string `json:"versionId,omitempty"`
+	Sequencer string `json:"sequencer"`
+}
+
+// NewRecord describes eventName on file for the configuration cfg.
+func NewRecord(cfg *db.BucketNotification, bucket *db.Bucket, eventName string, file *db.File, principalID string) Record {
+	now := time.Now().UTC()
+	return Record{
+		EventVersion: "2.1",
+		EventSource:  "aws:s3",
+		AWSRegion:    bucket.Region,
+		EventTime:    now,
+		EventName:    eventName,
+		UserIdentity: Identity{PrincipalID: principalID},
+		S3: S3Entity{
+			SchemaVersion:   "1.0",
+			ConfigurationID: cfg.ID,
+			Bucket: BucketEntity{
+				Name:          bucket.BucketName,
+				OwnerIdentity: Identity{PrincipalID: bucket.UserID},
+				ARN:           "arn:aws:s3:::" + bucket.BucketName,
+			},
+			Object: ObjectEntity{
+				Key:       file.FileName,
+				Size:      file.Size,
+				ETag:      file.Checksum,
+				VersionID: file.VersionID,
+				// S3 only promises sequencers grow per key; nanoseconds do that
+				Sequencer: fmt.Sprintf("%016X", now.UnixNano()),
+			},
+		},
+	}
+}
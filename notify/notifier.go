@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Notifier fans object events out to the Redis Streams feed, to webhook
+// delivery tasks and to replication tasks, and bucket configuration changes
+// to the feed. Each is skipped when its client
+// is nil, and a nil Notifier drops every event, which keeps it optional for
+// callers and tests.
+type Notifier struct {
+	DB     *gorm.DB
+	Client *asynq.Client
+	Redis  *redis.Client
+	Stream StreamOptions
+}
+
+// ObjectEvent records the event in the bucket's stream, enqueues one
+// delivery per matching notification configuration and schedules
+// replication. Failures are logged only: the object operation itself
+// already succeeded and must not be failed by them.
+func (n *Notifier) ObjectEvent(bucket *db.Bucket, eventName string, file *db.File, principalID string) {
+	if n == nil {
+		return
+	}
+	if n.Redis != nil {
+		if err := n.appendToStreams(context.Background(), newStreamEvent(bucket, eventName, file, principalID)); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"bucket": bucket.BucketName,
+				"file":   file.FileName,
+				"event":  eventName,
+			}).Warn("Failed to append object event to stream")
+		}
+	}
+	if n.Client != nil {
+		n.enqueueReplication(bucket, eventName, file)
+		n.enqueueWebhooks(bucket, eventName, file, principalID)
+	}
+}
+
+// BucketEvent records a change to the bucket configuration named config,
+// as in its route, e.g. "replication", in the bucket's stream. Webhooks and
+// replication follow objects only, so they are not involved.
+func (n *Notifier) BucketEvent(bucket *db.Bucket, config string, principalID string) {
+	if n == nil || n.Redis == nil {
+		return
+	}
+	ev := StreamEvent{
+		Event:         BucketConfigurationPut,
+		Bucket:        bucket.BucketName,
+		BucketID:      bucket.ID,
+		Configuration: config,
+		Actor:         principalID,
+		Time:          time.Now().UTC(),
+	}
+	if err := n.appendToStreams(context.Background(), ev); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"bucket":        bucket.BucketName,
+			"configuration": config,
+		}).Warn("Failed to append bucket event to stream")
+	}
+}
+
+func (n *Notifier) enqueueWebhooks(bucket *db.Bucket, eventName string, file *db.File, principalID string) {
+
+	var configs []db.BucketNotification
+	if err := n.DB.Where("bucket_id = ?", bucket.ID).Find(&configs).Error; err != nil {
+		log.WithError(err).WithField("bucket", bucket.BucketName).Warn("Failed to load bucket notifications")
+		return
+	}
+
+	for i := range configs {
+		cfg := &configs[i]
+		if !Matches(cfg, eventName, file.FileName) {
+			continue
+		}
+		logger := log.WithFields(log.Fields{
+			"bucket":          bucket.BucketName,
+			"file":            file.FileName,
+			"event":           eventName,
+			"notification_id": cfg.ID,
+		})
+
+		body, err := json.Marshal(Message{Records: []Record{NewRecord(cfg, bucket, eventName, file, principalID)}})
+		if err != nil {
+			logger.WithError(err).Warn("Failed to encode bucket event")
+			continue
+		}
+		task, err := tasks.NewDeliverWebhookTask(cfg.ID, eventName, body)
+		if err == nil {
+			_, err = n.Client.Enqueue(task)
+		}
+		if err != nil {
+			logger.WithError(err).Warn("Failed to enqueue webhook delivery")
+			continue
+		}
+		logger.Debug("Webhook delivery enqueued")
+	}
+}
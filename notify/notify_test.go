@@ -0,0 +1,136 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMatches(t *testing.T) {
+	cfg := &db.BucketNotification{
+		Events: "s3:ObjectCreated:*,ObjectRemoved:Delete",
+		Prefix: "images/",
+		Suffix: ".jpg",
+	}
+	cases := []struct {
+		event string
+		key   string
+		want  bool
+	}{
+		{ObjectCreatedPut, "images/cat.jpg", true},
+		{ObjectCreatedCopy, "images/cat.jpg", true},
+		{ObjectRemovedDelete, "images/cat.jpg", true},
+		{ObjectCreatedPut, "docs/cat.jpg", false},
+		{ObjectCreatedPut, "images/cat.png", false},
+	}
+	for _, tc := range cases {
+		if got := Matches(cfg, tc.event, tc.key); got != tc.want {
+			t.Errorf("Matches(%s, %s) = %v, want %v", tc.event, tc.key, got, tc.want)
+		}
+	}
+
+	putOnly := &db.BucketNotification{Events: "s3:ObjectCreated:Put"}
+	if Matches(putOnly, ObjectCreatedCopy, "a.txt") {
+		t.Error("Put subscription should not match Copy events")
+	}
+}
+
+func TestNormalizeEventName(t *testing.T) {
+	for _, name := range []string{"s3:ObjectCreated:*", "ObjectCreated:Put", "s3:ObjectRemoved:*", "s3:*", "s3:ObjectRetention:Put", "ObjectLegalHold:*"} {
+		if _, ok := NormalizeEventName(name); !ok {
+			t.Errorf("%s should be accepted", name)
+		}
+	}
+	// bucket configuration changes only go to the streams
+	for _, name := range []string{"s3:ObjectRestore:*", "ObjectCreated", "", "s3:BucketConfiguration:Put"} {
+		if _, ok := NormalizeEventName(name); ok {
+			t.Errorf("%s should be rejected", name)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	a := Sign("secret", 1700000000, []byte(`{"Records":[]}`))
+	if a != Sign("secret", 1700000000, []byte(`{"Records":[]}`)) {
+		t.Fatal("signature is not deterministic")
+	}
+	if a == Sign("other", 1700000000, []byte(`{"Records":[]}`)) || a == Sign("secret", 1700000001, []byte(`{"Records":[]}`)) {
+		t.Fatal("signature must depend on secret and timestamp")
+	}
+	if len(a) != len("sha256=")+64 {
+		t.Fatalf("unexpected signature format %q", a)
+	}
+}
+
+func TestValidStreamCursor(t *testing.T) {
+	for _, c := range []string{"1700000000000-0", "0-1"} {
+		if !ValidStreamCursor(c) {
+			t.Errorf("%s should be valid", c)
+		}
+	}
+	for _, c := range []string{"", "abc", "1700000000000", "-1", "1-x", "+"} {
+		if ValidStreamCursor(c) {
+			t.Errorf("%q should be invalid", c)
+		}
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	ctx := context.Background()
+	for _, u := range []string{
+		"ftp://example.com/hook",
+		"/relative",
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://10.0.0.5/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+		"http://[::1]/hook",
+		"http://[fe80::1]/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+	} {
+		if err := ValidateURL(ctx, u); err == nil {
+			t.Errorf("ValidateURL(%s) should fail", u)
+		}
+	}
+	for _, u := range []string{"https://93.184.216.34/hook", "http://[2606:4700::1111]/hook"} {
+		if err := ValidateURL(ctx, u); err != nil {
+			t.Errorf("ValidateURL(%s) = %v", u, err)
+		}
+	}
+}
+
+func TestDeliverRefusesPrivateAddress(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	err := Deliver(context.Background(), &db.BucketNotification{URL: server.URL, Secret: "s"}, ObjectCreatedPut, []byte("{}"))
+	if !errors.Is(err, ErrPrivateAddress) || !errors.Is(err, ErrRejected) {
+		t.Fatalf("Deliver to loopback = %v, want a rejected private address", err)
+	}
+	if called {
+		t.Error("the receiver should not have been reached")
+	}
+}
+
+func TestBucketStreamEvent(t *testing.T) {
+	ev := StreamEvent{Event: BucketConfigurationPut, Bucket: "photos", BucketID: "bucket-1", Configuration: "replication", Actor: "user-1"}
+	values := map[string]interface{}{}
+	for k, v := range ev.values() {
+		values[k] = fmt.Sprint(v)
+	}
+	got := streamEventFromMessage(redis.XMessage{ID: "1-0", Values: values})
+	if got.Event != BucketConfigurationPut || got.Configuration != "replication" || got.Key != "" {
+		t.Errorf("round trip = %+v", got)
+	}
+}
@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"strings"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	log "github.com/sirupsen/logrus"
+)
+
+// enqueueReplication schedules replication of a write, or of a delete when a
+// rule asks for it, to every rule of the bucket whose prefix matches. Only
+// deletes of the latest version are replicated, like S3 which does not
+// replicate version-specific deletes. Replicas are never replicated again.
+func (n *Notifier) enqueueReplication(bucket *db.Bucket, eventName string, file *db.File) {
+	if file.ReplicationStatus == db.ReplicationReplica {
+		return
+	}
+	op := tasks.ReplicationOpPut
+	switch {
+	case strings.HasPrefix(eventName, "ObjectCreated:"):
+	case strings.HasPrefix(eventName, "ObjectRemoved:"):
+		if !file.IsLatest {
+			return
+		}
+		op = tasks.ReplicationOpDelete
+	default:
+		// metadata changes are not replicated
+		return
+	}
+
+	var rules []db.ReplicationRule
+	if err := n.DB.Where("bucket_id = ?", bucket.ID).Find(&rules).Error; err != nil {
+		log.WithError(err).WithField("bucket", bucket.BucketName).Warn("Failed to load replication rules")
+		return
+	}
+	var ruleIDs []string
+	for _, rule := range rules {
+		if rule.Applies(file.FileName, op == tasks.ReplicationOpDelete) {
+			ruleIDs = append(ruleIDs, rule.ID)
+		}
+	}
+	if len(ruleIDs) == 0 {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{
+		"bucket": bucket.BucketName,
+		"file":   file.FileName,
+		"op":     op,
+	})
+	if op == tasks.ReplicationOpPut {
+		if err := n.DB.Model(&db.File{}).Where("id = ?", file.ID).Update("replication_status", db.ReplicationPending).Error; err != nil {
+			logger.WithError(err).Warn("Failed to mark file replication pending")
+		}
+		file.ReplicationStatus = db.ReplicationPending
+	}
+
+	task, err := tasks.NewReplicateObjectTask(tasks.ReplicationPayload{
+		Op:        op,
+		BucketID:  bucket.ID,
+		FileID:    file.ID,
+		Key:       file.FileName,
+		VersionID: file.VersionID,
+		RuleIDs:   ruleIDs,
+	})
+	if err == nil {
+		_, err = n.Client.Enqueue(task)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Failed to enqueue replication")
+		if op == tasks.ReplicationOpPut {
+			n.DB.Model(&db.File{}).Where("id = ?", file.ID).Update("replication_status", db.ReplicationFailed)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package notify
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/redis/go-redis/v9"
+)
+
+// GlobalStream receives the events of every bucket when StreamOptions.Global
+// is set; per-bucket streams are always written.
+const GlobalStream = "object_events:all"
+
+const DefaultStreamMaxLen = 10000
+
+func BucketStream(bucketID string) string {
+	return "object_events:bucket:" + bucketID
+}
+
+// StreamOptions control the Redis Streams feed. MaxLen is an approximate
+// per-stream retention, so Redis can trim whole nodes cheaply.
+type StreamOptions struct {
+	MaxLen int64
+	Global bool
+}
+
+// StreamEvent is one entry of an object event stream.
+type StreamEvent struct {
+	ID        string `json:"id"`
+	Event     string `json:"event"`
+	Bucket    string `json:"bucket"`
+	BucketID  string `json:"bucket_id"`
+	Key       string `json:"key"`
+	VersionID string `json:"version_id,omitempty"`
+	Size      int64  `json:"size"`
+	Checksum  string `json:"checksum,omitempty"`
+	// the configuration a BucketConfigurationPut event changed, such as
+	// "replication"; object events leave it empty
+	Configuration string    `json:"configuration,omitempty"`
+	Actor         string    `json:"actor"`
+	Time          time.Time `json:"time"`
+}
+
+func (e StreamEvent) values() map[string]interface{} {
+	return map[string]interface{}{
+		"event":         e.Event,
+		"bucket":        e.Bucket,
+		"bucket_id":     e.BucketID,
+		"key":           e.Key,
+		"version_id":    e.VersionID,
+		"size":          e.Size,
+		"checksum":      e.Checksum,
+		"configuration": e.Configuration,
+		"actor":         e.Actor,
+		"time":          e.Time.Format(time.RFC3339Nano),
+	}
+}
+
+func streamEventFromMessage(msg redis.XMessage) StreamEvent {
+	str := func(key string) string {
+		s, _ := msg.Values[key].(string)
+		return s
+	}
+	size, _ := strconv.ParseInt(str("size"), 10, 64)
+	ts, _ := time.Parse(time.RFC3339Nano, str("time"))
+	return StreamEvent{
+		ID:            msg.ID,
+		Event:         str("event"),
+		Bucket:        str("bucket"),
+		BucketID:      str("bucket_id"),
+		Key:           str("key"),
+		VersionID:     str("version_id"),
+		Size:          size,
+		Checksum:      str("checksum"),
+		Configuration: str("configuration"),
+		Actor:         str("actor"),
+		Time:          ts,
+	}
+}
+
+func (n *Notifier) appendToStreams(ctx context.Context, ev StreamEvent) error {
+	maxLen := n.Stream.MaxLen
+	if maxLen <= 0 {
+		maxLen = DefaultStreamMaxLen
+	}
+	streams := []string{BucketStream(ev.BucketID)}
+	if n.Stream.Global {
+		streams = append(streams, GlobalStream)
+	}
+	pipe := n.Redis.Pipeline()
+	for _, stream := range streams {
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: stream,
+			MaxLen: maxLen,
+			Approx: true,
+			Values: ev.values(),
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ReadBucketEvents pages through a bucket stream in append order. With an
+// empty cursor it returns the most recent limit events; otherwise the events
+// after the cursor, which is the ID of the last event already seen.
+func ReadBucketEvents(ctx context.Context, rdb *redis.Client, bucketID, cursor string, limit int64) ([]StreamEvent, error) {
+	stream := BucketStream(bucketID)
+	var msgs []redis.XMessage
+	var err error
+	if cursor == "" {
+		msgs, err = rdb.XRevRangeN(ctx, stream, "+", "-", limit).Result()
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+	} else {
+		msgs, err = rdb.XRangeN(ctx, stream, "("+cursor, "+", limit).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+	events := make([]StreamEvent, 0, len(msgs))
+	for _, msg := range msgs {
+		events = append(events, streamEventFromMessage(msg))
+	}
+	return events, nil
+}
+
+// EnsureConsumerGroups creates the consumer groups internal consumers read
+// the global stream with, so the configuration only allows groups when that
+// stream is on. New groups start at the end of the stream; groups that
+// already exist keep their position.
+func EnsureConsumerGroups(ctx context.Context, rdb *redis.Client, groups []string) error {
+	for _, group := range groups {
+		err := rdb.XGroupCreateMkStream(ctx, GlobalStream, group, "$").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidStreamCursor reports whether cursor looks like a stream entry ID
+// ("<ms>-<seq>").
+func ValidStreamCursor(cursor string) bool {
+	ms, seq, ok := strings.Cut(cursor, "-")
+	if !ok {
+		return false
+	}
+	_, errMs := strconv.ParseUint(ms, 10, 64)
+	_, errSeq := strconv.ParseUint(seq, 10, 64)
+	return errMs == nil && errSeq == nil
+}
+
+func newStreamEvent(bucket *db.Bucket, eventName string, file *db.File, actor string) StreamEvent {
+	return StreamEvent{
+		Event:     eventName,
+		Bucket:    bucket.BucketName,
+		BucketID:  bucket.ID,
+		Key:       file.FileName,
+		VersionID: file.VersionID,
+		Size:      file.Size,
+		Checksum:  file.Checksum,
+		Actor:     actor,
+		Time:      time.Now().UTC(),
+	}
+}
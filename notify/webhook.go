@@ -0,0 +1,154 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+)
+
+// Receivers verify a delivery by recomputing
+// HMAC-SHA256(secret, timestamp + "." + body) and comparing it with the
+// signature header; the timestamp lets them reject replays.
+const (
+	SignatureHeader = "X-MiniS3-Signature"
+	TimestampHeader = "X-MiniS3-Timestamp"
+	EventHeader     = "X-MiniS3-Event"
+)
+
+// ErrRejected wraps responses that retrying cannot fix, such as a 404 or a
+// 401 from the receiver.
+var ErrRejected = errors.New("webhook rejected the delivery")
+
+// ErrPrivateAddress is returned for webhooks and replication endpoints that
+// point at loopback, private, link-local or unspecified addresses, which
+// would let bucket owners reach the server's own network.
+var ErrPrivateAddress = errors.New("url must not point at a loopback, private or link-local address")
+
+// AllowPrivateAddresses lifts the ErrPrivateAddress check, for development
+// against local receivers; main sets it from the configuration.
+var AllowPrivateAddresses bool
+
+// PublicTransport returns a transport that checks every address it connects
+// to, after DNS resolution and on every redirect, so a host that resolved to
+// a public address when it was saved cannot later be pointed at an internal
+// one. It never uses a proxy, which would hide the real destination from
+// that check.
+func PublicTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: checkDial,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+var httpClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: PublicTransport(),
+}
+
+func checkAddress(ip net.IP) error {
+	if AllowPrivateAddresses {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("%w (%s)", ErrPrivateAddress, ip)
+	}
+	return nil
+}
+
+func checkDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w (%s)", ErrPrivateAddress, host)
+	}
+	return checkAddress(ip)
+}
+
+// ValidateURL checks that rawURL is an absolute http or https URL whose host
+// resolves to public addresses only.
+func ValidateURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("webhook url must be an absolute http or https URL")
+	}
+	if AllowPrivateAddresses {
+		return nil
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		return checkAddress(ip)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("host %s does not resolve", host)
+	}
+	for _, addr := range addrs {
+		if err := checkAddress(addr.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver POSTs body to the configured URL. Any 2xx counts as delivered.
+func Deliver(ctx context.Context, cfg *db.BucketNotification, eventName string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mini-s3-webhook")
+	req.Header.Set(EventHeader, eventName)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(SignatureHeader, Sign(cfg.Secret, ts, body))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrPrivateAddress) {
+			return fmt.Errorf("%w: %w", ErrRejected, err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	default:
+		return fmt.Errorf("%w: status %d", ErrRejected, resp.StatusCode)
+	}
+}
@@ -0,0 +1,87 @@
+// Package objectlock implements S3 Object Lock (WORM) rules: retention
+// periods in governance or compliance mode, and legal holds. Every path that
+// deletes or overwrites a stored version checks it through CheckWritable.
+package objectlock
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+)
+
+const (
+	ModeGovernance = "GOVERNANCE"
+	ModeCompliance = "COMPLIANCE"
+)
+
+// BypassHeader lets an admin delete or shorten governance-mode retention.
+// Compliance retention and legal holds cannot be bypassed.
+const BypassHeader = "x-amz-bypass-governance-retention"
+
+var ErrLocked = errors.New("object is locked")
+
+// NormalizeMode upper-cases mode and reports whether it is a retention mode.
+func NormalizeMode(mode string) (string, bool) {
+	mode = strings.ToUpper(mode)
+	return mode, mode == ModeGovernance || mode == ModeCompliance
+}
+
+// RetentionActive reports whether f is under retention at now.
+func RetentionActive(f *db.File, now time.Time) bool {
+	return f.RetentionMode != "" && f.RetainUntil != nil && now.Before(*f.RetainUntil)
+}
+
+// CheckWritable returns an error wrapping ErrLocked when the version f may
+// not be deleted or overwritten. bypassGovernance lifts governance-mode
+// retention only; the caller decides who may set it.
+func CheckWritable(f *db.File, bypassGovernance bool) error {
+	if f.LegalHold {
+		return fmt.Errorf("%w: %s is under legal hold", ErrLocked, f.FileName)
+	}
+	if !RetentionActive(f, time.Now()) {
+		return nil
+	}
+	if f.RetentionMode == ModeGovernance && bypassGovernance {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is retained in %s mode until %s", ErrLocked, f.FileName, f.RetentionMode, f.RetainUntil.UTC().Format(time.RFC3339))
+}
+
+// ApplyDefaultRetention gives a new version the bucket's default retention.
+func ApplyDefaultRetention(bucket *db.Bucket, f *db.File) {
+	if !bucket.ObjectLockEnabled || bucket.LockMode == "" || bucket.LockDays <= 0 {
+		return
+	}
+	until := time.Now().AddDate(0, 0, bucket.LockDays)
+	f.RetentionMode = bucket.LockMode
+	f.RetainUntil = &until
+}
+
+// CheckRetentionChange validates replacing the retention of f with mode and
+// until, where an empty mode removes it. Extending is always allowed;
+// weakening compliance retention never is, and weakening governance
+// retention needs bypassGovernance.
+func CheckRetentionChange(f *db.File, mode string, until *time.Time, bypassGovernance bool) error {
+	if mode != "" {
+		if until == nil || !until.After(time.Now()) {
+			return errors.New("retainUntil must be in the future")
+		}
+	}
+	if !RetentionActive(f, time.Now()) {
+		return nil
+	}
+
+	weakens := mode == "" ||
+		until.Before(*f.RetainUntil) ||
+		(f.RetentionMode == ModeCompliance && mode != ModeCompliance)
+	if !weakens {
+		return nil
+	}
+	if f.RetentionMode == ModeGovernance && bypassGovernance {
+		return nil
+	}
+	return fmt.Errorf("%w: retention of %s can only be extended", ErrLocked, f.FileName)
+}
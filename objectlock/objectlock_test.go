@@ -0,0 +1,70 @@
+package objectlock
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+)
+
+func lockedFile(mode string, until time.Time) *db.File {
+	return &db.File{FileName: "a.txt", RetentionMode: mode, RetainUntil: &until}
+}
+
+func TestCheckWritable(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	cases := []struct {
+		name   string
+		file   *db.File
+		bypass bool
+		locked bool
+	}{
+		{"unlocked", &db.File{FileName: "a.txt"}, false, false},
+		{"expired retention", lockedFile(ModeCompliance, past), false, false},
+		{"governance", lockedFile(ModeGovernance, future), false, true},
+		{"governance bypassed", lockedFile(ModeGovernance, future), true, false},
+		{"compliance ignores bypass", lockedFile(ModeCompliance, future), true, true},
+		{"legal hold ignores bypass", &db.File{FileName: "a.txt", LegalHold: true}, true, true},
+	}
+	for _, tc := range cases {
+		err := CheckWritable(tc.file, tc.bypass)
+		if got := errors.Is(err, ErrLocked); got != tc.locked {
+			t.Errorf("%s: locked = %v, want %v (err %v)", tc.name, got, tc.locked, err)
+		}
+	}
+}
+
+func TestCheckRetentionChange(t *testing.T) {
+	now := time.Now()
+	in1h, in2h := now.Add(time.Hour), now.Add(2*time.Hour)
+
+	compliance := lockedFile(ModeCompliance, in1h)
+	if err := CheckRetentionChange(compliance, ModeCompliance, &in2h, false); err != nil {
+		t.Errorf("extending compliance retention: %v", err)
+	}
+	if err := CheckRetentionChange(compliance, ModeGovernance, &in2h, true); err == nil {
+		t.Error("compliance must not be downgraded to governance")
+	}
+	if err := CheckRetentionChange(compliance, "", nil, true); err == nil {
+		t.Error("compliance retention must not be removed")
+	}
+
+	governance := lockedFile(ModeGovernance, in2h)
+	if err := CheckRetentionChange(governance, ModeGovernance, &in1h, false); err == nil {
+		t.Error("shortening governance retention needs the bypass")
+	}
+	if err := CheckRetentionChange(governance, ModeGovernance, &in1h, true); err != nil {
+		t.Errorf("shortening governance retention with bypass: %v", err)
+	}
+	if err := CheckRetentionChange(governance, ModeCompliance, &in2h, false); err != nil {
+		t.Errorf("upgrading governance to compliance: %v", err)
+	}
+
+	past := now.Add(-time.Minute)
+	if err := CheckRetentionChange(&db.File{}, ModeGovernance, &past, false); err == nil {
+		t.Error("retainUntil in the past must be rejected")
+	}
+}
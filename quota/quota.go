@@ -0,0 +1,219 @@
+// Package quota enforces account-wide limits: total stored bytes, bucket
+// count, object count and the size of a single object, plus the optional
+// per-bucket Bucket.Quota.
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"gorm.io/gorm"
+)
+
+// Limits are the quotas of one account; 0 means unlimited.
+type Limits struct {
+	MaxStorageBytes int64 `json:"maxStorageBytes"`
+	MaxBuckets      int64 `json:"maxBuckets"`
+	MaxObjects      int64 `json:"maxObjects"`
+	MaxObjectSize   int64 `json:"maxObjectSize"`
+}
+
+// Usage is what an account currently holds.
+type Usage struct {
+	StoredBytes int64 `json:"storedBytes"`
+	Buckets     int64 `json:"buckets"`
+	Objects     int64 `json:"objects"`
+}
+
+var (
+	ErrExceeded       = errors.New("quota exceeded")
+	ErrObjectTooLarge = errors.New("object exceeds the maximum object size")
+	// ErrUnverified joins ErrExceeded or ErrObjectTooLarge when the account
+	// is held to the sandbox until it verifies its email address.
+	ErrUnverified = errors.New("verify your email address to lift the sandbox limits")
+)
+
+// DefaultPlan applies to every user without their own limits.
+var DefaultPlan = Limits{
+	MaxStorageBytes: 10 << 30, // 10 GiB
+	MaxBuckets:      100,
+	MaxObjects:      100000,
+	MaxObjectSize:   5 << 30, // 5 GiB
+}
+
+var plan = DefaultPlan
+
+// Plan returns the limits of users without their own: DefaultPlan unless
+// main replaced it from the configuration with SetPlan.
+func Plan() Limits {
+	return plan
+}
+
+// SetPlan replaces the plan; call it before serving requests.
+func SetPlan(l Limits) {
+	plan = l
+}
+
+// sandbox caps the limits of accounts without a verified email address;
+// nil leaves them alone.
+var sandbox *Limits
+
+// SetSandbox caps every limit of unverified accounts at l, or stops
+// capping them when l is nil; call it before serving requests.
+func SetSandbox(l *Limits) {
+	sandbox = l
+}
+
+func sandboxed(user *db.User) bool {
+	return sandbox != nil && !user.IsVerified
+}
+
+// unverified marks a quota error of a sandboxed account with ErrUnverified.
+func unverified(user *db.User, err error) error {
+	if err != nil && sandboxed(user) && (errors.Is(err, ErrExceeded) || errors.Is(err, ErrObjectTooLarge)) {
+		return fmt.Errorf("%w: %w", ErrUnverified, err)
+	}
+	return err
+}
+
+// For returns the limits of user: their own where set, the plan otherwise.
+func For(user *db.User) Limits {
+	l := Plan()
+	if user.MaxStorageBytes != nil {
+		l.MaxStorageBytes = *user.MaxStorageBytes
+	}
+	if user.MaxBuckets != nil {
+		l.MaxBuckets = int64(*user.MaxBuckets)
+	}
+	if user.MaxObjects != nil {
+		l.MaxObjects = *user.MaxObjects
+	}
+	if user.MaxObjectSize != nil {
+		l.MaxObjectSize = *user.MaxObjectSize
+	}
+	if sandboxed(user) {
+		l.MaxStorageBytes = tighter(l.MaxStorageBytes, sandbox.MaxStorageBytes)
+		l.MaxBuckets = tighter(l.MaxBuckets, sandbox.MaxBuckets)
+		l.MaxObjects = tighter(l.MaxObjects, sandbox.MaxObjects)
+		l.MaxObjectSize = tighter(l.MaxObjectSize, sandbox.MaxObjectSize)
+	}
+	return l
+}
+
+// tighter returns the smaller of two limits, 0 being unlimited.
+func tighter(a, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// UsageOf counts the buckets, objects and stored bytes of userID. Every
+// version of an object counts.
+func UsageOf(DB *gorm.DB, userID string) (Usage, error) {
+	var u Usage
+	if err := DB.Model(&db.Bucket{}).Where("user_id = ?", userID).Count(&u.Buckets).Error; err != nil {
+		return u, err
+	}
+	row := DB.Model(&db.File{}).
+		Select("COUNT(*), COALESCE(SUM(files.size),0)").
+		Joins("JOIN buckets ON buckets.id = files.bucket_id").
+		Where("buckets.user_id = ?", userID).
+		Row()
+	if err := row.Scan(&u.Objects, &u.StoredBytes); err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+// CheckBucket returns ErrExceeded when user may not create another bucket.
+func CheckBucket(DB *gorm.DB, user *db.User) error {
+	limits := For(user)
+	if limits.MaxBuckets == 0 {
+		return nil
+	}
+	var buckets int64
+	if err := DB.Model(&db.Bucket{}).Where("user_id = ?", user.ID).Count(&buckets).Error; err != nil {
+		return err
+	}
+	if buckets >= limits.MaxBuckets {
+		return unverified(user, fmt.Errorf("%w: bucket limit of %d reached", ErrExceeded, limits.MaxBuckets))
+	}
+	return nil
+}
+
+// CheckUpload returns ErrObjectTooLarge or ErrExceeded when user's account,
+// or the bucket's own Quota, cannot take the given number of new objects
+// totalling bytes, the largest being maxSize.
+func CheckUpload(DB *gorm.DB, user *db.User, bucket *db.Bucket, objects, bytes, maxSize int64) error {
+	limits := For(user)
+	if limits.MaxObjectSize > 0 && maxSize > limits.MaxObjectSize {
+		return unverified(user, fmt.Errorf("%w (%d bytes)", ErrObjectTooLarge, limits.MaxObjectSize))
+	}
+	if bucket.Quota != nil && *bucket.Quota > 0 {
+		var bucketBytes int64
+		if err := DB.Model(&db.File{}).Where("bucket_id = ?", bucket.ID).
+			Select("COALESCE(SUM(size),0)").Scan(&bucketBytes).Error; err != nil {
+			return err
+		}
+		if bucketBytes+bytes > *bucket.Quota {
+			return fmt.Errorf("%w: bucket %s is limited to %d bytes", ErrExceeded, bucket.BucketName, *bucket.Quota)
+		}
+	}
+	if limits.MaxStorageBytes == 0 && limits.MaxObjects == 0 {
+		return nil
+	}
+	usage, err := UsageOf(DB, user.ID)
+	if err != nil {
+		return err
+	}
+	return unverified(user, limits.allows(usage, objects, bytes))
+}
+
+func (l Limits) allows(u Usage, objects, bytes int64) error {
+	if l.MaxStorageBytes > 0 && u.StoredBytes+bytes > l.MaxStorageBytes {
+		return fmt.Errorf("%w: storage limit of %d bytes reached", ErrExceeded, l.MaxStorageBytes)
+	}
+	if l.MaxObjects > 0 && u.Objects+objects > l.MaxObjects {
+		return fmt.Errorf("%w: object limit of %d reached", ErrExceeded, l.MaxObjects)
+	}
+	return nil
+}
+
+// Tracker enforces an account's limits over a run of writes, such as a copy
+// task, without querying usage for every object. It starts from the usage at
+// creation and is safe for concurrent use.
+type Tracker struct {
+	user   *db.User
+	limits Limits
+	mu     sync.Mutex
+	usage  Usage
+}
+
+func NewTracker(DB *gorm.DB, user *db.User) (*Tracker, error) {
+	usage, err := UsageOf(DB, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracker{user: user, limits: For(user), usage: usage}, nil
+}
+
+// Reserve accounts for one more object of size bytes, or returns why it
+// does not fit. An object that replaces an existing one still counts in
+// full, so a Tracker can refuse slightly early but never lets an account
+// past its limits.
+func (t *Tracker) Reserve(size int64) error {
+	if t.limits.MaxObjectSize > 0 && size > t.limits.MaxObjectSize {
+		return unverified(t.user, fmt.Errorf("%w (%d bytes)", ErrObjectTooLarge, t.limits.MaxObjectSize))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.limits.allows(t.usage, 1, size); err != nil {
+		return unverified(t.user, err)
+	}
+	t.usage.Objects++
+	t.usage.StoredBytes += size
+	return nil
+}
@@ -0,0 +1,90 @@
+package quota
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	dbConn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, dbConn.AutoMigrate(&db.User{}, &db.Bucket{}, &db.File{}))
+	return dbConn
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestFor(t *testing.T) {
+	limits := For(&db.User{MaxBuckets: ptr(3), MaxObjectSize: ptr(int64(0))})
+	require.Equal(t, int64(3), limits.MaxBuckets)
+	require.Equal(t, int64(0), limits.MaxObjectSize)
+	require.Equal(t, Plan().MaxStorageBytes, limits.MaxStorageBytes)
+}
+
+func TestCheckUpload(t *testing.T) {
+	DB := setupTestDB(t)
+	user := &db.User{ID: "user-1", MaxStorageBytes: ptr(int64(100)), MaxObjects: ptr(int64(3)), MaxObjectSize: ptr(int64(50))}
+	bucket := &db.Bucket{ID: "bucket-1", BucketName: "b1", UserID: user.ID, Quota: ptr(int64(60))}
+	other := &db.Bucket{ID: "bucket-2", BucketName: "b2", UserID: user.ID}
+	require.NoError(t, DB.Create(bucket).Error)
+	require.NoError(t, DB.Create(other).Error)
+	require.NoError(t, DB.Create(&db.File{ID: "f1", BucketID: bucket.ID, FileName: "a", Size: 40}).Error)
+	require.NoError(t, DB.Create(&db.File{ID: "f2", BucketID: other.ID, FileName: "b", Size: 40}).Error)
+
+	require.NoError(t, CheckUpload(DB, user, other, 1, 20, 20))
+	require.True(t, errors.Is(CheckUpload(DB, user, other, 1, 51, 51), ErrObjectTooLarge))
+	// account: 80 stored, room for 20 more
+	require.True(t, errors.Is(CheckUpload(DB, user, other, 1, 21, 21), ErrExceeded))
+	// bucket quota: 40 stored, room for 20 more
+	require.True(t, errors.Is(CheckUpload(DB, user, bucket, 1, 21, 21), ErrExceeded))
+	// objects: 2 stored, room for 1 more
+	require.True(t, errors.Is(CheckUpload(DB, user, other, 2, 2, 1), ErrExceeded))
+
+	user.MaxBuckets = ptr(2)
+	require.True(t, errors.Is(CheckBucket(DB, user), ErrExceeded))
+	user.MaxBuckets = ptr(3)
+	require.NoError(t, CheckBucket(DB, user))
+}
+
+func TestTracker(t *testing.T) {
+	DB := setupTestDB(t)
+	user := &db.User{ID: "user-1", MaxStorageBytes: ptr(int64(100)), MaxObjects: ptr(int64(0)), MaxObjectSize: ptr(int64(0))}
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-1", BucketName: "b1", UserID: user.ID}).Error)
+	require.NoError(t, DB.Create(&db.File{ID: "f1", BucketID: "bucket-1", FileName: "a", Size: 70}).Error)
+
+	tracker, err := NewTracker(DB, user)
+	require.NoError(t, err)
+	require.NoError(t, tracker.Reserve(20))
+	require.True(t, errors.Is(tracker.Reserve(20), ErrExceeded))
+	require.NoError(t, tracker.Reserve(10))
+}
+
+func TestSandbox(t *testing.T) {
+	DB := setupTestDB(t)
+	SetSandbox(&Limits{MaxBuckets: 1, MaxObjectSize: 10})
+	defer SetSandbox(nil)
+
+	user := &db.User{ID: "user-1", MaxObjectSize: ptr(int64(0))}
+	limits := For(user)
+	require.Equal(t, int64(1), limits.MaxBuckets)
+	require.Equal(t, int64(10), limits.MaxObjectSize, "the sandbox caps even unlimited accounts")
+	require.Equal(t, Plan().MaxStorageBytes, limits.MaxStorageBytes)
+
+	bucket := &db.Bucket{ID: "bucket-1", BucketName: "b1", UserID: user.ID}
+	require.NoError(t, DB.Create(bucket).Error)
+	err := CheckBucket(DB, user)
+	require.ErrorIs(t, err, ErrExceeded)
+	require.ErrorIs(t, err, ErrUnverified)
+	err = CheckUpload(DB, user, bucket, 1, 11, 11)
+	require.ErrorIs(t, err, ErrObjectTooLarge)
+	require.ErrorIs(t, err, ErrUnverified)
+
+	user.IsVerified = true
+	require.Equal(t, int64(0), For(user).MaxObjectSize)
+	require.NoError(t, CheckBucket(DB, user))
+}
@@ -0,0 +1,163 @@
+// Package replication talks to remote mini-s3 servers that replication rules
+// point at, using the same signed-header authentication as any other client.
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/apierror"
+	"github.com/SysTechSalihY/mini-s3-clone/auth"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+)
+
+// ErrExists is returned by Put when the remote bucket is not versioned and
+// already holds the key.
+var ErrExists = errors.New("object already exists on remote")
+
+// httpClient refuses private addresses like webhook deliveries do, unless
+// notify.AllowPrivateAddresses is set.
+var httpClient = &http.Client{
+	Timeout:   10 * time.Minute,
+	Transport: notify.PublicTransport(),
+}
+
+type Remote struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+}
+
+func (r *Remote) newRequest(ctx context.Context, method, bucket, key string, body io.Reader) (*http.Request, error) {
+	path := fmt.Sprintf("/api/buckets/%s/files/%s", url.PathEscape(bucket), url.PathEscape(key))
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(r.Endpoint, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(5 * time.Minute).Unix()
+	req.Header.Set("X-Access-Key", r.AccessKey)
+	req.Header.Set("X-Signature", auth.SignRequest(r.SecretKey, method, path, expires))
+	req.Header.Set("X-Expires", strconv.FormatInt(expires, 10))
+	return req, nil
+}
+
+func statusError(op string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("remote %s failed with status %d: %s", op, resp.StatusCode, strings.TrimSpace(string(msg)))
+	if alreadyExists(resp.StatusCode, msg) {
+		return fmt.Errorf("%w: %v", ErrExists, err)
+	}
+	return err
+}
+
+// alreadyExists tells the remote's refusal to overwrite a key from other
+// failures such as bad signatures or arguments, which must not be taken for
+// a finished replication. Servers from before coded errors answered it with
+// a 400 and only the message.
+func alreadyExists(status int, body []byte) bool {
+	var e struct{ Code, Error string }
+	if err := json.Unmarshal(body, &e); err != nil {
+		return false
+	}
+	switch status {
+	case http.StatusConflict:
+		return e.Code == apierror.ObjectAlreadyExists
+	case http.StatusBadRequest:
+		return e.Code == "" && e.Error == "file already exists"
+	}
+	return false
+}
+
+// Head returns the checksum the remote reports for the latest version of
+// key, and whether the key exists at all.
+func (r *Remote) Head(ctx context.Context, bucket, key string) (string, bool, error) {
+	req, err := r.newRequest(ctx, http.MethodHead, bucket, key, nil)
+	if err != nil {
+		return "", false, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", false, nil
+	case resp.StatusCode >= 300:
+		return "", false, statusError("head", resp)
+	}
+	return strings.Trim(resp.Header.Get("ETag"), `"`), true, nil
+}
+
+// Put uploads the file at path as key, streaming it as the multipart form
+// the upload endpoint expects.
+func (r *Remote) Put(ctx context.Context, bucket, key, path, contentType string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, key))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header.Set("Content-Type", contentType)
+		part, err := form.CreatePart(header)
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := r.newRequest(ctx, http.MethodPost, bucket, key, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return statusError("put", resp)
+	}
+	return nil
+}
+
+// Delete removes the latest version of key. A missing key counts as deleted.
+func (r *Remote) Delete(ctx context.Context, bucket, key string) error {
+	req, err := r.newRequest(ctx, http.MethodDelete, bucket, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return statusError("delete", resp)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package replication
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutErrors(t *testing.T) {
+	// the remote runs on loopback
+	notify.AllowPrivateAddresses = true
+	t.Cleanup(func() { notify.AllowPrivateAddresses = false })
+	var status int
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "a.txt")
+	require.NoError(t, os.WriteFile(path, []byte("hello"), 0o644))
+	remote := &Remote{Endpoint: server.URL, AccessKey: "ak", SecretKey: "sk"}
+	put := func() error {
+		return remote.Put(context.Background(), "dest", "a.txt", path, "text/plain")
+	}
+
+	status, body = http.StatusConflict, `{"error":"file already exists","code":"ObjectAlreadyExists"}`
+	require.ErrorIs(t, put(), ErrExists)
+	status, body = http.StatusBadRequest, `{"error":"file already exists"}`
+	require.ErrorIs(t, put(), ErrExists, "servers from before coded errors")
+
+	for _, tc := range []struct {
+		status int
+		body   string
+	}{
+		{http.StatusBadRequest, `{"error":"invalid file upload","code":"InvalidArgument"}`},
+		{http.StatusBadRequest, `not json`},
+		{http.StatusForbidden, `{"error":"invalid signature","code":"SignatureDoesNotMatch"}`},
+		{http.StatusConflict, `{"error":"bucket not empty","code":"BucketNotEmpty"}`},
+	} {
+		status, body = tc.status, tc.body
+		err := put()
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrExists, tc.body)
+	}
+
+	status, body = http.StatusOK, `{}`
+	require.NoError(t, put())
+}
+
+func TestRemoteRefusesPrivateAddress(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	remote := &Remote{Endpoint: server.URL, AccessKey: "ak", SecretKey: "sk"}
+	_, _, err := remote.Head(context.Background(), "dest", "a.txt")
+	require.ErrorIs(t, err, notify.ErrPrivateAddress)
+	require.ErrorIs(t, remote.Delete(context.Background(), "dest", "a.txt"), notify.ErrPrivateAddress)
+	require.False(t, called, "the remote should not have been reached")
+}
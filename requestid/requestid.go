@@ -0,0 +1,48 @@
+// Package requestid gives every request an ID, returned in X-Request-Id, and
+// a logger that tags log lines with it.
+package requestid
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Header is the response header carrying the request ID.
+const Header = "X-Request-Id"
+
+const localsKey = "requestid"
+
+type contextKey struct{}
+
+// New assigns each request a fresh ID. It must be registered first so error
+// responses from every later middleware can carry the ID.
+func New() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := uuid.NewString()
+		c.Locals(localsKey, id)
+		c.Set(Header, id)
+		c.SetUserContext(context.WithValue(c.UserContext(), contextKey{}, id))
+		return c.Next()
+	}
+}
+
+// Get returns the ID of the request, or "" outside New.
+func Get(c *fiber.Ctx) string {
+	id, _ := c.Locals(localsKey).(string)
+	return id
+}
+
+// FromContext returns the ID stored in a request's user context, for code
+// that is handed c.UserContext() rather than the request.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Log returns a logger whose lines carry the request ID.
+func Log(c *fiber.Ctx) *log.Entry {
+	return log.WithField("request_id", Get(c))
+}
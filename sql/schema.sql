@@ -7,6 +7,17 @@ CREATE TABLE IF NOT EXISTS users (
     access_key VARCHAR(32) NOT NULL UNIQUE,
     is_verified BOOLEAN DEFAULT FALSE,
     user_role ENUM('user', 'admin') NOT NULL DEFAULT 'user',
+    disabled BOOLEAN DEFAULT FALSE,
+    rate_limit INT DEFAULT NULL,
+    max_storage_bytes BIGINT DEFAULT NULL,
+    max_buckets INT DEFAULT NULL,
+    max_objects BIGINT DEFAULT NULL,
+    max_object_size BIGINT DEFAULT NULL,
+    -- TOTP second factor; mfa_last_step is the time step of the last accepted code
+    mfa_secret VARCHAR(64) DEFAULT NULL,
+    mfa_enabled BOOLEAN DEFAULT FALSE,
+    mfa_last_step BIGINT DEFAULT 0,
+    deletion_requested_at TIMESTAMP NULL DEFAULT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -14,12 +25,51 @@ CREATE TABLE IF NOT EXISTS users (
 CREATE TABLE IF NOT EXISTS email_verifications (
     id VARCHAR(36) PRIMARY KEY,
     user_id VARCHAR(36) NOT NULL,
+    email VARCHAR(254),
     token VARCHAR(64) NOT NULL UNIQUE,
     expires_at TIMESTAMP NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
+-- PASSWORD RESET TOKENS, stored as SHA-256
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    id VARCHAR(36) PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_password_reset_tokens_user ON password_reset_tokens(user_id);
+
+-- CONSOLE SESSIONS, alive while their refresh token (stored as SHA-256) is
+CREATE TABLE IF NOT EXISTS sessions (
+    id VARCHAR(36) PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    refresh_token_hash VARCHAR(64) NOT NULL UNIQUE,
+    user_agent VARCHAR(255),
+    ip VARCHAR(45),
+    expires_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_sessions_user ON sessions(user_id);
+
+-- MFA RECOVERY CODES, single use, stored as SHA-256
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+    id VARCHAR(36) PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    code_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_mfa_recovery_codes_user ON mfa_recovery_codes(user_id);
+
 -- BUCKETS with ACL, versioning, quota
 CREATE TABLE IF NOT EXISTS buckets (
     id VARCHAR(36) PRIMARY KEY,
@@ -30,6 +80,15 @@ CREATE TABLE IF NOT EXISTS buckets (
     versioning BOOLEAN DEFAULT FALSE,
     quota BIGINT DEFAULT NULL,
     -- bytes, optional
+    object_lock_enabled BOOLEAN DEFAULT FALSE,
+    lock_mode VARCHAR(16) DEFAULT NULL,
+    -- default retention: GOVERNANCE or COMPLIANCE for lock_days days
+    lock_days INTEGER DEFAULT 0,
+    -- server access logs of this bucket go to this bucket and key prefix
+    logging_target_bucket VARCHAR(64) DEFAULT NULL,
+    logging_target_prefix VARCHAR(255) DEFAULT NULL,
+    -- deleting versions needs a TOTP code of the owner
+    mfa_delete BOOLEAN DEFAULT FALSE,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT NULL,
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
@@ -42,10 +101,19 @@ CREATE TABLE IF NOT EXISTS files (
     file_name VARCHAR(255) NOT NULL,
     size BIGINT NOT NULL,
     content_type VARCHAR(128) DEFAULT NULL,
+    checksum VARCHAR(64) DEFAULT NULL,
+    -- hex sha256 of the stored blob
     version_id VARCHAR(36) DEFAULT NULL,
     -- version identifier if versioning is enabled
     is_latest BOOLEAN DEFAULT TRUE,
     -- true for the latest version of the file
+    replication_status VARCHAR(16) DEFAULT NULL,
+    -- PENDING, COMPLETED, FAILED or REPLICA
+    storage_class VARCHAR(32) DEFAULT 'STANDARD',
+    retention_mode VARCHAR(16) DEFAULT NULL,
+    -- Object Lock: GOVERNANCE or COMPLIANCE
+    retain_until TIMESTAMP NULL DEFAULT NULL,
+    legal_hold BOOLEAN DEFAULT FALSE,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT NULL,
     FOREIGN KEY (bucket_id) REFERENCES buckets(id) ON DELETE CASCADE
@@ -63,12 +131,118 @@ CREATE INDEX idx_file_version ON files(bucket_id, file_name, version_id);
 CREATE TABLE IF NOT EXISTS tasks(
     id VARCHAR(36) PRIMARY KEY,
     user_id VARCHAR(36) NOT NULL,
-    type ENUM("copy", "empty") NOT NULL,
-    status ENUM("running", "completed", "failed") DEFAULT "running",
+    type ENUM("copy", "empty", "sync") NOT NULL,
+    status ENUM("queued", "running", "retrying", "completed", "failed", "cancelled") DEFAULT "queued",
     progress INTEGER DEFAULT 0,
     bucket_src VARCHAR(64),
     bucket_dest VARCHAR(64),
     message VARCHAR(255),
+    params TEXT,
+    result TEXT,
+    checkpoint_key VARCHAR(255),
+    checkpoint_file_id VARCHAR(36),
+    retry_count INTEGER DEFAULT 0,
+    started_at TIMESTAMP DEFAULT NULL,
+    finished_at TIMESTAMP DEFAULT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT NULL
-);
\ No newline at end of file
+);
+-- Bucket event notifications
+CREATE TABLE IF NOT EXISTS bucket_notifications(
+    id VARCHAR(36) PRIMARY KEY,
+    bucket_id VARCHAR(36) NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    events VARCHAR(512) NOT NULL,
+    -- comma separated event names, e.g. "s3:ObjectCreated:*"
+    prefix VARCHAR(255),
+    suffix VARCHAR(255),
+    secret VARCHAR(128) NOT NULL,
+    -- HMAC key for the X-MiniS3-Signature header
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (bucket_id) REFERENCES buckets(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_notification_bucket ON bucket_notifications(bucket_id);
+
+-- Webhook deliveries that exhausted their retries
+CREATE TABLE IF NOT EXISTS notification_dead_letters(
+    id VARCHAR(36) PRIMARY KEY,
+    notification_id VARCHAR(36) NOT NULL,
+    bucket_id VARCHAR(36) NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    event_name VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    last_error VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_dead_letter_bucket ON notification_dead_letters(bucket_id, created_at DESC);
+
+-- Bucket replication rules
+CREATE TABLE IF NOT EXISTS replication_rules(
+    id VARCHAR(36) PRIMARY KEY,
+    bucket_id VARCHAR(36) NOT NULL,
+    dest_bucket VARCHAR(64) NOT NULL,
+    endpoint VARCHAR(2048),
+    -- base URL of a remote server, NULL or empty for a local destination
+    access_key VARCHAR(128),
+    secret_key VARCHAR(128),
+    prefix VARCHAR(255),
+    replicate_deletes BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (bucket_id) REFERENCES buckets(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_replication_bucket ON replication_rules(bucket_id);
+
+-- USAGE ROLLUPS
+CREATE TABLE IF NOT EXISTS usage_request_hourlies(
+    user_id VARCHAR(36) NOT NULL,
+    hour TIMESTAMP NOT NULL,
+    operation VARCHAR(32) NOT NULL,
+    requests BIGINT NOT NULL DEFAULT 0,
+    bytes_in BIGINT NOT NULL DEFAULT 0,
+    bytes_out BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, hour, operation)
+);
+
+CREATE TABLE IF NOT EXISTS usage_storage_hourlies(
+    bucket_id VARCHAR(36) NOT NULL,
+    storage_class VARCHAR(32) NOT NULL,
+    hour TIMESTAMP NOT NULL,
+    user_id VARCHAR(36) NOT NULL,
+    bucket_name VARCHAR(64) NOT NULL,
+    bytes BIGINT NOT NULL DEFAULT 0,
+    objects BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (bucket_id, storage_class, hour)
+);
+
+CREATE INDEX idx_usage_storage_user_hour ON usage_storage_hourlies(user_id);
+
+-- AUDIT LOG, append-only: each hash covers the row and the previous hash
+CREATE TABLE IF NOT EXISTS audit_events(
+    id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+    actor_id VARCHAR(36),
+    access_key VARCHAR(32),
+    ip VARCHAR(64),
+    action VARCHAR(64) NOT NULL,
+    target_type VARCHAR(32) NOT NULL,
+    target VARCHAR(255),
+    `before` TEXT,
+    `after` TEXT,
+    prev_hash VARCHAR(64),
+    hash VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idx_audit_events_actor ON audit_events(actor_id);
+CREATE INDEX idx_audit_events_action ON audit_events(action);
+CREATE INDEX idx_audit_events_target ON audit_events(target);
+CREATE INDEX idx_audit_events_created ON audit_events(created_at);
+
+CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_events is append-only';
+
+CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_events is append-only';
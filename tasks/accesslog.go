@@ -0,0 +1,30 @@
+package tasks
+
+import (
+	"encoding/json"
+
+	"github.com/hibiken/asynq"
+)
+
+const TaskTypeDeliverAccessLogs = "deliver_access_logs"
+
+// AccessLogPayload is one log object: the server access log records of
+// BucketID, written to Key in TargetBucket. The key is chosen when the
+// records are flushed, so a retried delivery never writes them twice.
+type AccessLogPayload struct {
+	BucketID     string   `json:"bucket_id"`
+	TargetBucket string   `json:"target_bucket"`
+	Key          string   `json:"key"`
+	Lines        []string `json:"lines"`
+}
+
+const AccessLogMaxRetry = 5
+
+func NewDeliverAccessLogsTask(payload AccessLogPayload, opts ...asynq.Option) (*asynq.Task, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]asynq.Option{asynq.MaxRetry(AccessLogMaxRetry), asynq.Timeout(Timeouts[TaskTypeDeliverAccessLogs])}, opts...)
+	return asynq.NewTask(TaskTypeDeliverAccessLogs, data, opts...), nil
+}
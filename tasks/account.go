@@ -0,0 +1,52 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/hibiken/asynq"
+)
+
+const TaskTypeDeleteAccount = "delete_account"
+
+// DeleteAccountPayload names a user whose account deletion was requested.
+type DeleteAccountPayload struct {
+	UserID string `json:"user_id"`
+	Traced
+}
+
+// DeleteAccountMaxRetry keeps retrying while objects locked after the
+// request hold up the deletion; asynq's backoff spreads the attempts over
+// weeks. Deletion is refused up front while objects are already locked.
+const DeleteAccountMaxRetry = 25
+
+// DeleteAccountTaskID is the ID NewDeleteAccountTask enqueues userID's
+// deletion under.
+func DeleteAccountTaskID(userID string) string {
+	return "delete-account-" + userID
+}
+
+// NewDeleteAccountTask is enqueued under an ID derived from the user, so a
+// repeated request does not schedule a second deletion.
+func NewDeleteAccountTask(ctx context.Context, userID string, opts ...asynq.Option) (*asynq.Task, error) {
+	payload, err := json.Marshal(DeleteAccountPayload{UserID: userID, Traced: TraceFrom(ctx)})
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]asynq.Option{
+		asynq.TaskID(DeleteAccountTaskID(userID)),
+		asynq.MaxRetry(DeleteAccountMaxRetry),
+		asynq.Timeout(Timeouts[TaskTypeDeleteAccount]),
+	}, opts...)
+	return asynq.NewTask(TaskTypeDeleteAccount, payload, opts...), nil
+}
+
+// TaskTypeCleanupTokens is scheduled periodically by the worker to delete
+// expired email verification and password reset tokens and sessions. It is not retried:
+// the next run picks up whatever a failed one left.
+const TaskTypeCleanupTokens = "cleanup_tokens"
+
+func NewCleanupTokensTask(opts ...asynq.Option) *asynq.Task {
+	opts = append([]asynq.Option{asynq.MaxRetry(0), asynq.Timeout(Timeouts[TaskTypeCleanupTokens])}, opts...)
+	return asynq.NewTask(TaskTypeCleanupTokens, nil, opts...)
+}
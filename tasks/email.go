@@ -0,0 +1,34 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/hibiken/asynq"
+)
+
+const TaskTypeSendEmail = "send_email"
+
+// SendEmailPayload is a rendered message; the worker only hands it to its
+// mailer, so templates are needed by the server alone.
+type SendEmailPayload struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+	Traced
+}
+
+// EmailMaxRetry covers a mail server being unreachable for a few hours
+// with asynq's default backoff.
+const EmailMaxRetry = 10
+
+func NewSendEmailTask(ctx context.Context, payload SendEmailPayload, opts ...asynq.Option) (*asynq.Task, error) {
+	payload.Traced = TraceFrom(ctx)
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]asynq.Option{asynq.MaxRetry(EmailMaxRetry), asynq.Timeout(Timeouts[TaskTypeSendEmail])}, opts...)
+	return asynq.NewTask(TaskTypeSendEmail, data, opts...), nil
+}
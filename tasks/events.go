@@ -0,0 +1,61 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ProgressEvent is what the worker publishes on every task state change and
+// what the server forwards to SSE and WebSocket clients.
+type ProgressEvent struct {
+	TaskID      string    `json:"task_id"`
+	UserID      string    `json:"user_id"`
+	Status      string    `json:"status"`
+	Progress    int       `json:"progress"`
+	CurrentFile string    `json:"current_file,omitempty"`
+	ETASeconds  int64     `json:"eta_seconds,omitempty"`
+	Message     string    `json:"message,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// Terminal reports whether no further events will follow for the task.
+func (e ProgressEvent) Terminal() bool {
+	return IsTerminalStatus(e.Status)
+}
+
+func IsTerminalStatus(status string) bool {
+	switch status {
+	case "completed", "failed", "cancelled":
+		return true
+	}
+	return false
+}
+
+func TaskChannel(taskID string) string {
+	return "task_progress:task:" + taskID
+}
+
+func UserChannel(userID string) string {
+	return "task_progress:user:" + userID
+}
+
+// PublishProgress fans the event out to the per-task and per-user channels.
+func PublishProgress(ctx context.Context, client *redis.Client, ev ProgressEvent) error {
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now()
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	pipe := client.Pipeline()
+	pipe.Publish(ctx, TaskChannel(ev.TaskID), data)
+	if ev.UserID != "" {
+		pipe.Publish(ctx, UserChannel(ev.UserID), data)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
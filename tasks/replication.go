@@ -0,0 +1,37 @@
+package tasks
+
+import (
+	"encoding/json"
+
+	"github.com/hibiken/asynq"
+)
+
+const TaskTypeReplicateObject = "replicate_object"
+
+const (
+	ReplicationOpPut    = "put"
+	ReplicationOpDelete = "delete"
+)
+
+// ReplicationPayload replicates one object write or delete to the
+// destinations of RuleIDs. Deletes carry the key since the file row is gone
+// by the time the task runs.
+type ReplicationPayload struct {
+	Op        string   `json:"op"`
+	BucketID  string   `json:"bucket_id"`
+	FileID    string   `json:"file_id,omitempty"`
+	Key       string   `json:"key"`
+	VersionID string   `json:"version_id,omitempty"`
+	RuleIDs   []string `json:"rule_ids"`
+}
+
+const ReplicationMaxRetry = 10
+
+func NewReplicateObjectTask(payload ReplicationPayload, opts ...asynq.Option) (*asynq.Task, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]asynq.Option{asynq.MaxRetry(ReplicationMaxRetry), asynq.Timeout(Timeouts[TaskTypeReplicateObject])}, opts...)
+	return asynq.NewTask(TaskTypeReplicateObject, data, opts...), nil
+}
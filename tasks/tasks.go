@@ -1,17 +1,179 @@
 package tasks
 
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
 const (
 	TaskTypeEmptyBucket = "empty_bucket"
 	TaskTypeCopyBucket  = "copy_bucket"
+	TaskTypeSyncBucket  = "sync_bucket"
 )
 
+// Timeouts bounds how long a task of each type may run; main replaces the
+// defaults from the configuration.
+var Timeouts = map[string]time.Duration{
+	TaskTypeEmptyBucket:       10 * time.Minute,
+	TaskTypeCopyBucket:        30 * time.Minute,
+	TaskTypeSyncBucket:        30 * time.Minute,
+	TaskTypeDeliverWebhook:    30 * time.Second,
+	TaskTypeReplicateObject:   30 * time.Minute,
+	TaskTypeDeliverAccessLogs: time.Minute,
+	TaskTypeSendEmail:         time.Minute,
+	TaskTypeDeleteAccount:     30 * time.Minute,
+	TaskTypeCleanupTokens:     5 * time.Minute,
+}
+
+// QueueDefault is the asynq queue every task is enqueued on.
+const QueueDefault = "default"
+
+// Payloads carry the task ID so the worker can update the matching db.Task
+// row; it is the same ID the task is enqueued under.
 type EmptyBucketPayload struct {
+	TaskID     string
 	UserID     string
 	BucketName string
+	// set when an admin asked to also delete governance-retained versions
+	BypassGovernance bool
+	Traced
+}
+
+// EmptyBucketOptions is what an empty_bucket task keeps in Params for retries.
+type EmptyBucketOptions struct {
+	BypassGovernance bool `json:"bypass_governance,omitempty"`
+}
+
+// EmptySummary is what an empty_bucket task reports in the task record.
+// Versions under Object Lock are retained rather than failing the task;
+// RetainedKeys is capped at SyncSummaryKeyLimit entries.
+type EmptySummary struct {
+	Deleted      int      `json:"deleted"`
+	Retained     int      `json:"retained"`
+	RetainedKeys []string `json:"retained_keys,omitempty"`
 }
 
 type CopyBucketPayload struct {
-	UserID     string
-	BucketSrc  string
-	BucketDest string
+	TaskID      string `json:"task_id"`
+	UserID      string `json:"user_id"`
+	BucketSrc   string `json:"bucket_src"`
+	BucketDest  string `json:"bucket_dest"`
+	Parallelism int    `json:"parallelism,omitempty"`
+	Traced
+}
+
+const (
+	DefaultCopyParallelism = 4
+	MaxCopyParallelism     = 16
+)
+
+// CopySummary is what a copy_bucket task reports in the task record. Errors
+// is capped at SyncSummaryKeyLimit entries; Failed is the full count.
+type CopySummary struct {
+	Copied      int      `json:"copied"`
+	Failed      int      `json:"failed"`
+	BytesCopied int64    `json:"bytes_copied"`
+	ResumedFrom string   `json:"resumed_from,omitempty"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+type SyncBucketPayload struct {
+	TaskID     string `json:"task_id"`
+	UserID     string `json:"user_id"`
+	BucketSrc  string `json:"bucket_src"`
+	BucketDest string `json:"bucket_dest"`
+	SyncOptions
+	Traced
+}
+
+// SyncOptions are the user-supplied knobs of a sync_bucket task. They are
+// also stored on the task record so a retry can rebuild the payload.
+type SyncOptions struct {
+	Prefix           string `json:"prefix,omitempty"`
+	DeleteExtraneous bool   `json:"delete_extraneous,omitempty"`
+	DryRun           bool   `json:"dry_run,omitempty"`
+}
+
+// SyncSummary is the diff a sync_bucket task reports in the task record.
+// The key lists are capped at SyncSummaryKeyLimit entries; the counts are not.
+type SyncSummary struct {
+	DryRun      bool     `json:"dry_run"`
+	Created     int      `json:"created"`
+	Updated     int      `json:"updated"`
+	Deleted     int      `json:"deleted"`
+	Unchanged   int      `json:"unchanged"`
+	Failed      int      `json:"failed"`
+	BytesCopied int64    `json:"bytes_copied"`
+	CreatedKeys []string `json:"created_keys,omitempty"`
+	UpdatedKeys []string `json:"updated_keys,omitempty"`
+	DeletedKeys []string `json:"deleted_keys,omitempty"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+const SyncSummaryKeyLimit = 100
+
+func NewEmptyBucketTask(ctx context.Context, taskID, userID, bucketName string, bypassGovernance bool, opts ...asynq.Option) (*asynq.Task, error) {
+	payload, err := json.Marshal(EmptyBucketPayload{
+		TaskID:           taskID,
+		UserID:           userID,
+		BucketName:       bucketName,
+		BypassGovernance: bypassGovernance,
+		Traced:           TraceFrom(ctx),
+	})
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]asynq.Option{asynq.TaskID(taskID), asynq.MaxRetry(5), asynq.Timeout(Timeouts[TaskTypeEmptyBucket])}, opts...)
+	return asynq.NewTask(TaskTypeEmptyBucket, payload, opts...), nil
+}
+
+func NewCopyBucketTask(ctx context.Context, taskID, userID, bucketSrc, bucketDest string, parallelism int, opts ...asynq.Option) (*asynq.Task, error) {
+	payload, err := json.Marshal(CopyBucketPayload{
+		TaskID:      taskID,
+		UserID:      userID,
+		BucketSrc:   bucketSrc,
+		BucketDest:  bucketDest,
+		Parallelism: parallelism,
+		Traced:      TraceFrom(ctx),
+	})
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]asynq.Option{asynq.TaskID(taskID), asynq.MaxRetry(5), asynq.Timeout(Timeouts[TaskTypeCopyBucket])}, opts...)
+	return asynq.NewTask(TaskTypeCopyBucket, payload, opts...), nil
+}
+
+func NewSyncBucketTask(ctx context.Context, taskID, userID, bucketSrc, bucketDest string, syncOpts SyncOptions, opts ...asynq.Option) (*asynq.Task, error) {
+	payload, err := json.Marshal(SyncBucketPayload{
+		TaskID:      taskID,
+		UserID:      userID,
+		BucketSrc:   bucketSrc,
+		BucketDest:  bucketDest,
+		SyncOptions: syncOpts,
+		Traced:      TraceFrom(ctx),
+	})
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]asynq.Option{asynq.TaskID(taskID), asynq.MaxRetry(5), asynq.Timeout(Timeouts[TaskTypeSyncBucket])}, opts...)
+	return asynq.NewTask(TaskTypeSyncBucket, payload, opts...), nil
+}
+
+// MaxMessageLength is the size of the task message column, in characters.
+const MaxMessageLength = 255
+
+// TruncateMessage cuts msg to MaxMessageLength characters, never inside a
+// UTF-8 sequence.
+func TruncateMessage(msg string) string {
+	n := 0
+	for i := range msg {
+		if n == MaxMessageLength {
+			return msg[:i]
+		}
+		n++
+	}
+	return msg
 }
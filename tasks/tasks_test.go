@@ -0,0 +1,54 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncateMessage(t *testing.T) {
+	require.Equal(t, "short", TruncateMessage("short"))
+	require.Equal(t, strings.Repeat("a", MaxMessageLength), TruncateMessage(strings.Repeat("a", 300)))
+
+	cut := TruncateMessage(strings.Repeat("ş", 300))
+	require.True(t, utf8.ValidString(cut))
+	require.Equal(t, MaxMessageLength, utf8.RuneCountInString(cut))
+}
+
+func TestPublishProgress(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	ctx := context.Background()
+
+	sub := client.Subscribe(ctx, "task_progress:task:task-1", "task_progress:user:user-1")
+	defer sub.Close()
+	_, err := sub.Receive(ctx)
+	require.NoError(t, err)
+	messages := sub.Channel()
+
+	require.NoError(t, PublishProgress(ctx, client, ProgressEvent{TaskID: "task-1", UserID: "user-1", Status: "running", Progress: 40}))
+	got := map[string]ProgressEvent{}
+	for len(got) < 2 {
+		select {
+		case msg := <-messages:
+			var ev ProgressEvent
+			require.NoError(t, json.Unmarshal([]byte(msg.Payload), &ev))
+			got[msg.Channel] = ev
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %d of 2 events", len(got))
+		}
+	}
+	for _, channel := range []string{TaskChannel("task-1"), UserChannel("user-1")} {
+		require.Equal(t, "task-1", got[channel].TaskID, channel)
+		require.Equal(t, 40, got[channel].Progress, channel)
+		require.False(t, got[channel].Timestamp.IsZero(), "the timestamp is filled in")
+	}
+}
@@ -0,0 +1,24 @@
+package tasks
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Traced carries the W3C trace context of the request that enqueued a task,
+// so the worker's spans join the same trace. Payloads embed it.
+type Traced struct {
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// TraceFrom captures the trace context of ctx, if it has one.
+func TraceFrom(ctx context.Context) Traced {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return Traced{}
+	}
+	return Traced{Trace: carrier}
+}
@@ -0,0 +1,62 @@
+package tasks
+
+import (
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+const TaskTypeDeliverWebhook = "deliver_webhook"
+
+// WebhookPayload is one event for one notification configuration. The
+// secret and URL are looked up at delivery time so a rotated secret or a
+// removed configuration takes effect for events still in the queue.
+type WebhookPayload struct {
+	NotificationID string          `json:"notification_id"`
+	EventName      string          `json:"event_name"`
+	Body           json.RawMessage `json:"body"`
+}
+
+const (
+	WebhookMaxRetry  = 8
+	webhookBaseDelay = 10 * time.Second
+	webhookMaxDelay  = time.Hour
+)
+
+func NewDeliverWebhookTask(notificationID, eventName string, body []byte, opts ...asynq.Option) (*asynq.Task, error) {
+	payload, err := json.Marshal(WebhookPayload{
+		NotificationID: notificationID,
+		EventName:      eventName,
+		Body:           body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]asynq.Option{asynq.MaxRetry(WebhookMaxRetry), asynq.Timeout(Timeouts[TaskTypeDeliverWebhook])}, opts...)
+	return asynq.NewTask(TaskTypeDeliverWebhook, payload, opts...), nil
+}
+
+// RetryDelay is the asynq RetryDelayFunc of the worker. Webhook deliveries
+// and replication back off exponentially from 10s up to an hour, with jitter
+// so a receiver coming back up is not hit by every queued event at once.
+// Other tasks keep the asynq default.
+func RetryDelay(n int, err error, t *asynq.Task) time.Duration {
+	switch t.Type() {
+	case TaskTypeDeliverWebhook, TaskTypeReplicateObject:
+		return webhookBackoff(n) + time.Duration(rand.Int63n(int64(webhookBaseDelay)))
+	}
+	return asynq.DefaultRetryDelayFunc(n, err, t)
+}
+
+func webhookBackoff(n int) time.Duration {
+	delay := webhookBaseDelay
+	for i := 0; i < n && delay < webhookMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxDelay {
+		delay = webhookMaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,102 @@
+// Package tracing sets up OpenTelemetry tracing for the server and the
+// worker and holds the hooks that create spans: a Fiber middleware, GORM
+// callbacks, a go-redis hook, storage helpers and an asynq middleware that
+// continues the trace of the request that enqueued a task.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/SysTechSalihY/mini-s3-clone"
+
+// tracer resolves through the global provider, so spans started before
+// Setup runs are dropped rather than lost to a stale provider.
+var tracer = otel.Tracer(instrumentationName)
+
+// Setup installs the W3C trace context propagator and, depending on
+// exporter, a tracer provider for service:
+//
+//   - "otlp" exports over OTLP/HTTP, configured by the standard
+//     OTEL_EXPORTER_OTLP_* variables
+//   - "stdout" prints spans, for local testing
+//   - "none" or "" records nothing but still propagates trace context
+//
+// The returned function flushes pending spans and stops the exporter.
+func Setup(ctx context.Context, service, exporterName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporterName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create trace exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(service)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span named name as a child of the span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartStorage starts a span for a read, write or delete of the blob at
+// path on local storage.
+func StartStorage(ctx context.Context, operation, path string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "storage."+operation, trace.WithAttributes(
+		attribute.String("storage.operation", operation),
+		attribute.String("storage.path", path),
+	))
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traced reports whether ctx is part of a trace. Dependency spans are only
+// recorded inside one, so background loops do not each start a new trace.
+func traced(ctx context.Context) bool {
+	return ctx != nil && trace.SpanContextFromContext(ctx).IsValid()
+}
@@ -0,0 +1,113 @@
+package tracing
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// exporter collects the spans of every test; the global provider can only
+// be installed once for the package tracer to pick it up.
+var exporter = tracetest.NewInMemoryExporter()
+
+func TestMain(m *testing.M) {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	os.Exit(m.Run())
+}
+
+func spanNamed(t *testing.T, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, s := range exporter.GetSpans() {
+		if s.Name == name {
+			return s
+		}
+	}
+	require.Failf(t, "span not found", "no span named %q", name)
+	return tracetest.SpanStub{}
+}
+
+func TestRequestAndQuerySpans(t *testing.T) {
+	exporter.Reset()
+	DB, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, InstrumentGORM(DB))
+	type row struct {
+		ID   uint
+		Name string
+	}
+	require.NoError(t, DB.AutoMigrate(&row{}))
+	// outside a trace nothing is recorded
+	require.NoError(t, DB.Create(&row{Name: "a"}).Error)
+	require.Empty(t, exporter.GetSpans())
+
+	app := fiber.New()
+	app.Use(Middleware())
+	app.Get("/api/buckets/:bucketName", func(c *fiber.Ctx) error {
+		var r row
+		if err := DB.WithContext(c.UserContext()).First(&r).Error; err != nil {
+			return err
+		}
+		return c.SendString(r.Name)
+	})
+
+	req := httptest.NewRequest("GET", "/api/buckets/photos", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+
+	server := spanNamed(t, "GET /api/buckets/:bucketName")
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext.TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", server.Parent.SpanID().String())
+	require.Equal(t, trace.SpanKindServer, server.SpanKind)
+
+	query := spanNamed(t, "gorm.query")
+	require.Equal(t, server.SpanContext.SpanID(), query.Parent.SpanID())
+	var statement string
+	for _, attr := range query.Attributes {
+		if attr.Key == "db.query.text" {
+			statement = attr.Value.AsString()
+		}
+	}
+	require.Contains(t, statement, "SELECT")
+}
+
+func TestTaskContinuesEnqueuingTrace(t *testing.T) {
+	exporter.Reset()
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "POST /api/tasks/copy-bucket/:bucketSrc/:bucketDest")
+	task, err := tasks.NewCopyBucketTask(ctx, "task-1", "user-1", "src", "dest", 0)
+	require.NoError(t, err)
+	parent.End()
+
+	var handled trace.SpanContext
+	handler := TaskMiddleware(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		handled = trace.SpanContextFromContext(ctx)
+		return nil
+	}))
+	require.NoError(t, handler.ProcessTask(context.Background(), task))
+
+	consumer := spanNamed(t, "task copy_bucket")
+	require.Equal(t, parent.SpanContext().TraceID(), consumer.SpanContext.TraceID())
+	require.Equal(t, parent.SpanContext().SpanID(), consumer.Parent.SpanID())
+	require.Equal(t, consumer.SpanContext.SpanID(), handled.SpanID())
+
+	// tasks enqueued outside a trace start their own
+	untraced, err := tasks.NewCopyBucketTask(context.Background(), "task-2", "user-1", "src", "dest", 0)
+	require.NoError(t, err)
+	require.NotContains(t, string(untraced.Payload()), `"trace"`)
+}
@@ -0,0 +1,43 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TaskMiddleware starts a consumer span for every task, as a child of the
+// span that enqueued it when the payload carries a tasks.Traced context.
+// Handlers get the span in ctx.
+func TaskMiddleware(next asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		// payloads without a trace, or that are not JSON, start a new one
+		var payload tasks.Traced
+		_ = json.Unmarshal(t.Payload(), &payload)
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(payload.Trace))
+
+		taskID, _ := asynq.GetTaskID(ctx)
+		retried, _ := asynq.GetRetryCount(ctx)
+		queue, _ := asynq.GetQueueName(ctx)
+		ctx, span := tracer.Start(ctx, "task "+t.Type(),
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				semconv.MessagingSystemKey.String("asynq"),
+				semconv.MessagingDestinationName(queue),
+				semconv.MessagingMessageID(taskID),
+				attribute.String("task.type", t.Type()),
+				attribute.Int("task.retry_count", retried),
+			),
+		)
+		err := next.ProcessTask(ctx, t)
+		End(span, err)
+		return err
+	})
+}
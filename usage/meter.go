@@ -0,0 +1,234 @@
+// Package usage meters per-user consumption for chargeback: requests and
+// transferred bytes per operation, counted by Middleware, and stored bytes
+// and objects per bucket and storage class, measured by SnapshotStorage.
+// Both are kept as hourly rollups.
+package usage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultFlushInterval is how often Run writes buffered request counts.
+const DefaultFlushInterval = time.Minute
+
+type counterKey struct {
+	userID    string
+	hour      time.Time
+	operation string
+}
+
+type counters struct {
+	requests int64
+	bytesIn  int64
+	bytesOut int64
+}
+
+// Meter buffers request counts in memory and adds them to the hourly rollup
+// on Flush, so metering costs no query per request. Counts buffered when the
+// process dies are lost.
+type Meter struct {
+	DB *gorm.DB
+
+	mu      sync.Mutex
+	pending map[counterKey]*counters
+}
+
+func NewMeter(DB *gorm.DB) *Meter {
+	return &Meter{DB: DB, pending: map[counterKey]*counters{}}
+}
+
+// Record counts one request of userID at t.
+func (m *Meter) Record(userID, operation string, bytesIn, bytesOut int64, t time.Time) {
+	if m == nil || userID == "" {
+		return
+	}
+	key := counterKey{userID: userID, hour: t.UTC().Truncate(time.Hour), operation: operation}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.pending[key]
+	if !ok {
+		c = &counters{}
+		m.pending[key] = c
+	}
+	c.requests++
+	c.bytesIn += bytesIn
+	c.bytesOut += bytesOut
+}
+
+// Flush adds the buffered counts to the database. Counts that fail to write
+// are put back and retried on the next flush.
+func (m *Meter) Flush() error {
+	m.mu.Lock()
+	batch := m.pending
+	m.pending = map[counterKey]*counters{}
+	m.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var firstErr error
+	for key, c := range batch {
+		row := db.UsageRequestHourly{
+			UserID:    key.userID,
+			Hour:      key.hour,
+			Operation: key.operation,
+			Requests:  c.requests,
+			BytesIn:   c.bytesIn,
+			BytesOut:  c.bytesOut,
+		}
+		err := m.DB.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "user_id"}, {Name: "hour"}, {Name: "operation"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"requests":  gorm.Expr("requests + ?", c.requests),
+				"bytes_in":  gorm.Expr("bytes_in + ?", c.bytesIn),
+				"bytes_out": gorm.Expr("bytes_out + ?", c.bytesOut),
+			}),
+		}).Create(&row).Error
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			m.mu.Lock()
+			if p, ok := m.pending[key]; ok {
+				p.requests += c.requests
+				p.bytesIn += c.bytesIn
+				p.bytesOut += c.bytesOut
+			} else {
+				m.pending[key] = c
+			}
+			m.mu.Unlock()
+		}
+	}
+	return firstErr
+}
+
+// Run flushes every interval and snapshots storage once per hour, starting
+// right away, until ctx is done; then it flushes one last time.
+func (m *Meter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastSnapshot time.Time
+	snapshot := func(now time.Time) {
+		hour := now.UTC().Truncate(time.Hour)
+		if hour.Equal(lastSnapshot) {
+			return
+		}
+		if err := SnapshotStorage(m.DB, now); err != nil {
+			log.WithError(err).Error("Failed to snapshot storage usage")
+			return
+		}
+		lastSnapshot = hour
+	}
+	snapshot(time.Now())
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := m.Flush(); err != nil {
+				log.WithError(err).Error("Failed to flush usage counters")
+			}
+			return
+		case now := <-ticker.C:
+			if err := m.Flush(); err != nil {
+				log.WithError(err).Warn("Failed to flush usage counters, will retry")
+			}
+			snapshot(now)
+		}
+	}
+}
+
+type storageRow struct {
+	UserID       string
+	BucketID     string
+	BucketName   string
+	StorageClass string
+	Bytes        int64
+	Objects      int64
+}
+
+// SnapshotStorage measures what every bucket stores per storage class and
+// writes it as the rollup row of the hour containing now. It reads the files
+// table, so objects written by worker tasks are counted too; running it
+// again in the same hour overwrites that hour's rows.
+func SnapshotStorage(DB *gorm.DB, now time.Time) error {
+	var rows []storageRow
+	if err := DB.Table("files").
+		Select("buckets.user_id AS user_id, files.bucket_id AS bucket_id, buckets.bucket_name AS bucket_name, " +
+			"files.storage_class AS storage_class, COALESCE(SUM(files.size),0) AS bytes, COUNT(*) AS objects").
+		Joins("JOIN buckets ON buckets.id = files.bucket_id").
+		Group("buckets.user_id, files.bucket_id, buckets.bucket_name, files.storage_class").
+		Scan(&rows).Error; err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	hour := now.UTC().Truncate(time.Hour)
+	snapshot := make([]db.UsageStorageHourly, 0, len(rows))
+	for _, r := range rows {
+		class := r.StorageClass
+		if class == "" {
+			class = db.StorageClassStandard
+		}
+		snapshot = append(snapshot, db.UsageStorageHourly{
+			BucketID:     r.BucketID,
+			StorageClass: class,
+			Hour:         hour,
+			UserID:       r.UserID,
+			BucketName:   r.BucketName,
+			Bytes:        r.Bytes,
+			Objects:      r.Objects,
+		})
+	}
+	return DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "bucket_id"}, {Name: "storage_class"}, {Name: "hour"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "bucket_name", "bytes", "objects"}),
+	}).CreateInBatches(snapshot, 200).Error
+}
+
+// Middleware counts every request made by a known user, whether signed or
+// through a presigned URL (billed to the bucket owner). It must be
+// registered before the auth middlewares so it sees the user they set.
+func (m *Meter) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+
+		var userID string
+		switch u := c.Locals("user").(type) {
+		case *db.User:
+			if u != nil {
+				userID = u.ID
+			}
+		case db.User:
+			userID = u.ID
+		}
+		if userID == "" {
+			return err
+		}
+
+		bytesIn := int64(c.Request().Header.ContentLength())
+		if bytesIn < 0 {
+			bytesIn = int64(len(c.Request().Body()))
+		}
+		var bytesOut int64
+		if !c.Response().SkipBody {
+			if n := c.Response().Header.ContentLength(); n > 0 {
+				bytesOut = int64(n)
+			} else {
+				bytesOut = int64(len(c.Response().Body()))
+			}
+		}
+		m.Record(userID, Operation(c.Method(), c.Route().Path), bytesIn, bytesOut, time.Now())
+		return err
+	}
+}
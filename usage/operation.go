@@ -0,0 +1,28 @@
+package usage
+
+// OperationOther covers every route without an entry in operations.
+const OperationOther = "Other"
+
+// operations names requests after the S3 API call they correspond to, keyed
+// by method and route pattern.
+var operations = map[string]string{
+	"POST /api/buckets/:bucketName/files/:fileName":   "PutObject",
+	"GET /api/buckets/:bucketName/files/:fileName":    "GetObject",
+	"HEAD /api/buckets/:bucketName/files/:fileName":   "HeadObject",
+	"DELETE /api/buckets/:bucketName/files/:fileName": "DeleteObject",
+	"POST /api/buckets/:bucketName/files":             "PostObject",
+	"POST /api/presigned/upload":                      "PutObject",
+	"GET /api/presigned/download":                     "GetObject",
+	"GET /api/buckets":                                "ListBuckets",
+	"POST /api/buckets":                               "CreateBucket",
+	"GET /api/buckets/:bucketName":                    "GetBucket",
+	"DELETE /api/buckets/:bucketName":                 "DeleteBucket",
+}
+
+// Operation classifies a request by its method and matched route pattern.
+func Operation(method, routePath string) string {
+	if op, ok := operations[method+" "+routePath]; ok {
+		return op
+	}
+	return OperationOther
+}
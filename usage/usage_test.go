@@ -0,0 +1,101 @@
+package usage
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	dbConn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	err = dbConn.AutoMigrate(&db.User{}, &db.Bucket{}, &db.File{}, &db.UsageRequestHourly{}, &db.UsageStorageHourly{})
+	require.NoError(t, err)
+	return dbConn
+}
+
+func TestMeterMiddleware(t *testing.T) {
+	DB := setupTestDB(t)
+	meter := NewMeter(DB)
+	user := &db.User{ID: "user-1"}
+
+	app := fiber.New()
+	app.Use(meter.Middleware())
+	app.Use(func(c *fiber.Ctx) error {
+		if c.Get("X-User") != "" {
+			c.Locals("user", user)
+		}
+		return c.Next()
+	})
+	app.Post("/api/buckets/:bucketName/files/:fileName", func(c *fiber.Ctx) error {
+		return c.Status(201).SendString("ok")
+	})
+	app.Get("/api/buckets/:bucketName/files/:fileName", func(c *fiber.Ctx) error {
+		return c.SendString("0123456789")
+	})
+
+	send := func(method, body string, signed bool) {
+		req := httptest.NewRequest(method, "/api/buckets/b/files/k.txt", strings.NewReader(body))
+		if signed {
+			req.Header.Set("X-User", user.ID)
+		}
+		_, err := app.Test(req)
+		require.NoError(t, err)
+	}
+	send("POST", "hello", true)
+	send("GET", "", true)
+	send("GET", "", true)
+	send("GET", "", false) // anonymous, not metered
+	require.NoError(t, meter.Flush())
+	send("GET", "", true)
+	require.NoError(t, meter.Flush())
+
+	var rows []db.UsageRequestHourly
+	require.NoError(t, DB.Order("operation").Find(&rows).Error)
+	require.Len(t, rows, 2)
+	require.Equal(t, "GetObject", rows[0].Operation)
+	require.Equal(t, int64(3), rows[0].Requests)
+	require.Equal(t, int64(30), rows[0].BytesOut)
+	require.Equal(t, "PutObject", rows[1].Operation)
+	require.Equal(t, int64(1), rows[1].Requests)
+	require.Equal(t, int64(5), rows[1].BytesIn)
+	require.Equal(t, time.Now().UTC().Truncate(time.Hour), rows[0].Hour.UTC())
+}
+
+func TestSnapshotStorage(t *testing.T) {
+	DB := setupTestDB(t)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-1", BucketName: "photos", UserID: "user-1"}).Error)
+	require.NoError(t, DB.Create(&db.File{ID: "f1", BucketID: "bucket-1", FileName: "a", Size: 10}).Error)
+	require.NoError(t, DB.Create(&db.File{ID: "f2", BucketID: "bucket-1", FileName: "b", Size: 20}).Error)
+	require.NoError(t, DB.Create(&db.File{ID: "f3", BucketID: "bucket-1", FileName: "c", Size: 5, StorageClass: db.StorageClassGlacier}).Error)
+
+	now := time.Now()
+	require.NoError(t, SnapshotStorage(DB, now))
+	// a second snapshot in the same hour replaces the first
+	require.NoError(t, DB.Delete(&db.File{}, "id = ?", "f2").Error)
+	require.NoError(t, SnapshotStorage(DB, now))
+
+	var rows []db.UsageStorageHourly
+	require.NoError(t, DB.Order("storage_class").Find(&rows).Error)
+	require.Len(t, rows, 2)
+	require.Equal(t, db.StorageClassGlacier, rows[0].StorageClass)
+	require.Equal(t, int64(5), rows[0].Bytes)
+	require.Equal(t, db.StorageClassStandard, rows[1].StorageClass)
+	require.Equal(t, int64(10), rows[1].Bytes)
+	require.Equal(t, int64(1), rows[1].Objects)
+	require.Equal(t, "user-1", rows[1].UserID)
+	require.Equal(t, "photos", rows[1].BucketName)
+}
+
+func TestOperation(t *testing.T) {
+	require.Equal(t, "DeleteObject", Operation("DELETE", "/api/buckets/:bucketName/files/:fileName"))
+	require.Equal(t, "GetObject", Operation("GET", "/api/presigned/download"))
+	require.Equal(t, OperationOther, Operation("GET", "/api/tasks"))
+}
@@ -0,0 +1,17 @@
+package utils
+
+import "path/filepath"
+
+// StorageRoot is the directory holding one subdirectory per bucket; main
+// sets it from the configuration before serving.
+var StorageRoot = "./storage"
+
+// BucketDir is the directory holding bucket's blobs.
+func BucketDir(bucket string) string {
+	return filepath.Join(StorageRoot, bucket)
+}
+
+// ObjectPath is where blob name of bucket is stored.
+func ObjectPath(bucket, name string) string {
+	return filepath.Join(StorageRoot, bucket, name)
+}
@@ -0,0 +1,149 @@
+package worker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/objectlock"
+	"github.com/SysTechSalihY/mini-s3-clone/quota"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/SysTechSalihY/mini-s3-clone/tracing"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// HandleDeliverAccessLogsTask writes one batch of server access log records
+// as a new object in the target bucket. The key comes with the payload, so a
+// retry that finds the object already written does nothing.
+func (w *Worker) HandleDeliverAccessLogsTask(ctx context.Context, t *asynq.Task) error {
+	w = w.withContext(ctx)
+	var payload tasks.AccessLogPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return fmt.Errorf("invalid access log payload: %v: %w", err, asynq.SkipRetry)
+	}
+
+	var source db.Bucket
+	if err := w.DB.Where("id = ?", payload.BucketID).First(&source).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("source bucket %s no longer exists: %w", payload.BucketID, asynq.SkipRetry)
+		}
+		return err
+	}
+	var target db.Bucket
+	if err := w.DB.Where("bucket_name = ?", payload.TargetBucket).First(&target).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("target bucket %s no longer exists: %w", payload.TargetBucket, asynq.SkipRetry)
+		}
+		return err
+	}
+	// ownership can change after logging was configured
+	if target.UserID != source.UserID {
+		return fmt.Errorf("target bucket %s is not owned by the owner of %s: %w", target.BucketName, source.BucketName, asynq.SkipRetry)
+	}
+
+	var existing int64
+	if err := w.DB.Model(&db.File{}).Where("bucket_id = ? AND file_name = ?", target.ID, payload.Key).Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return nil
+	}
+
+	data := []byte(strings.Join(payload.Lines, "\n") + "\n")
+	var owner db.User
+	if err := w.DB.Where("id = ?", target.UserID).First(&owner).Error; err != nil {
+		return err
+	}
+	if err := quota.CheckUpload(w.DB, &owner, &target, 1, int64(len(data)), int64(len(data))); err != nil {
+		if errors.Is(err, quota.ErrExceeded) || errors.Is(err, quota.ErrObjectTooLarge) {
+			return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+		}
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	file := db.File{
+		ID:          uuid.NewString(),
+		FileName:    payload.Key,
+		BucketID:    target.ID,
+		Size:        int64(len(data)),
+		ContentType: "text/plain",
+		Checksum:    hex.EncodeToString(sum[:]),
+		VersionID:   uuid.NewString(),
+		IsLatest:    true,
+	}
+	objectlock.ApplyDefaultRetention(&target, &file)
+	path := objectPath(&target, &file)
+	if err := writeObject(ctx, path, data); err != nil {
+		return err
+	}
+	if err := w.DB.Create(&file).Error; err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"bucket":        source.BucketName,
+		"target_bucket": target.BucketName,
+		"key":           payload.Key,
+		"records":       len(payload.Lines),
+	}).Info("Access logs delivered")
+	w.Notifier.ObjectEvent(&target, notify.ObjectCreatedPut, &file, target.UserID)
+	return nil
+}
+
+// writeObject writes data to path through a temp file, like copyObject.
+func writeObject(ctx context.Context, path string, data []byte) (err error) {
+	_, span := tracing.StartStorage(ctx, "write", path)
+	defer func() { tracing.End(span, err) }()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".write-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (w *Worker) handleAccessLogError(ctx context.Context, t *asynq.Task, err error) {
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	var payload tasks.AccessLogPayload
+	json.Unmarshal(t.Payload(), &payload)
+	logger := log.WithError(err).WithFields(log.Fields{
+		"bucket_id":     payload.BucketID,
+		"target_bucket": payload.TargetBucket,
+		"key":           payload.Key,
+		"retried":       retried,
+		"max_retry":     maxRetry,
+	})
+	if retried < maxRetry && !errors.Is(err, asynq.SkipRetry) {
+		logger.Warn("Access log delivery failed, will retry")
+		return
+	}
+	logger.WithField("records", len(payload.Lines)).Error("Access log delivery failed, records dropped")
+}
@@ -0,0 +1,150 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/objectlock"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/SysTechSalihY/mini-s3-clone/utils"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// errObjectsRetained fails a deletion run that had to keep objects under
+// Object Lock, so asynq retries it once more of them may have expired.
+var errObjectsRetained = errors.New("objects retained by object lock")
+
+// HandleDeleteAccountTask removes every bucket of a user who deleted their
+// account, then the user. Buckets holding locked objects are kept, with
+// their unlocked objects removed, until a later attempt.
+func (w *Worker) HandleDeleteAccountTask(ctx context.Context, t *asynq.Task) error {
+	w = w.withContext(ctx)
+	var payload tasks.DeleteAccountPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		log.WithError(err).Error("Failed to unmarshal delete account task payload")
+		return fmt.Errorf("invalid delete account payload: %v: %w", err, asynq.SkipRetry)
+	}
+	logger := log.WithField("user_id", payload.UserID)
+
+	var user db.User
+	if err := w.DB.First(&user, "id = ?", payload.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			logger.Info("Account already deleted")
+			return nil
+		}
+		return fmt.Errorf("failed to load user: %w", err)
+	}
+	if user.DeletionRequestedAt == nil {
+		logger.Info("Account deletion was withdrawn, skipping")
+		return nil
+	}
+
+	var buckets []db.Bucket
+	if err := w.DB.Where("user_id = ?", user.ID).Find(&buckets).Error; err != nil {
+		return fmt.Errorf("failed to list buckets: %w", err)
+	}
+	retained := 0
+	for i := range buckets {
+		n, err := w.deleteBucketContents(ctx, &buckets[i])
+		if err != nil {
+			return err
+		}
+		retained += n
+	}
+	if retained > 0 {
+		logger.WithField("retained", retained).Warn("Account deletion waiting for object lock retention to expire")
+		return fmt.Errorf("%d %w", retained, errObjectsRetained)
+	}
+
+	err := w.DB.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&db.EmailVerification{}, &db.PasswordResetToken{}, &db.Session{}, &db.MFARecoveryCode{}} {
+			if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	logger.WithField("buckets", len(buckets)).Info("Account deleted")
+	return nil
+}
+
+// deleteBucketContents removes the objects of bucket and, when none are
+// retained under Object Lock, the bucket itself with its configuration. It
+// returns how many objects were retained.
+func (w *Worker) deleteBucketContents(ctx context.Context, bucket *db.Bucket) (int, error) {
+	var files []db.File
+	if err := w.DB.Where("bucket_id = ?", bucket.ID).Find(&files).Error; err != nil {
+		return 0, fmt.Errorf("failed to list files of %s: %w", bucket.BucketName, err)
+	}
+	retained := 0
+	for i := range files {
+		if err := ctx.Err(); err != nil {
+			return 0, fmt.Errorf("account deletion interrupted: %w", err)
+		}
+		file := &files[i]
+		if objectlock.CheckWritable(file, false) != nil {
+			retained++
+			continue
+		}
+		if err := removeObject(ctx, objectPath(bucket, file)); err != nil {
+			return 0, fmt.Errorf("failed to remove %s/%s: %w", bucket.BucketName, file.FileName, err)
+		}
+		if err := w.DB.Delete(file).Error; err != nil {
+			return 0, fmt.Errorf("failed to delete file record: %w", err)
+		}
+	}
+	if retained > 0 {
+		return retained, nil
+	}
+
+	err := w.DB.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&db.BucketNotification{}, &db.NotificationDeadLetter{}, &db.ReplicationRule{}} {
+			if err := tx.Where("bucket_id = ?", bucket.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(bucket).Error
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete bucket %s: %w", bucket.BucketName, err)
+	}
+	// only succeeds once the directory is empty, which it should be now
+	os.Remove(utils.BucketDir(bucket.BucketName))
+	log.WithField("bucket", bucket.BucketName).Info("Deleted bucket of deleted account")
+	return 0, nil
+}
+
+// HandleCleanupTokensTask deletes expired email verification and password
+// reset tokens and expired sessions.
+func (w *Worker) HandleCleanupTokensTask(ctx context.Context, t *asynq.Task) error {
+	w = w.withContext(ctx)
+	now := time.Now()
+	verifications := w.DB.Where("expires_at < ?", now).Delete(&db.EmailVerification{})
+	if verifications.Error != nil {
+		return fmt.Errorf("failed to delete expired verifications: %w", verifications.Error)
+	}
+	resets := w.DB.Where("expires_at < ?", now).Delete(&db.PasswordResetToken{})
+	if resets.Error != nil {
+		return fmt.Errorf("failed to delete expired password resets: %w", resets.Error)
+	}
+	sessions := w.DB.Where("expires_at < ?", now).Delete(&db.Session{})
+	if sessions.Error != nil {
+		return fmt.Errorf("failed to delete expired sessions: %w", sessions.Error)
+	}
+	log.WithFields(log.Fields{
+		"verifications":   verifications.RowsAffected,
+		"password_resets": resets.RowsAffected,
+		"sessions":        sessions.RowsAffected,
+	}).Info("Deleted expired tokens")
+	return nil
+}
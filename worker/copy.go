@@ -0,0 +1,190 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/objectlock"
+	"github.com/SysTechSalihY/mini-s3-clone/quota"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// copyBatchSize bounds how many file rows a copy task holds at once.
+const copyBatchSize = 200
+
+// copyCheckpoint is the last source file of the last fully copied batch.
+// Files are walked in (file_name, id) order so the pair is a stable cursor.
+type copyCheckpoint struct {
+	key    string
+	fileID string
+}
+
+func (w *Worker) loadCheckpoint(taskID string) copyCheckpoint {
+	if taskID == "" {
+		return copyCheckpoint{}
+	}
+	var task db.Task
+	if err := w.DB.Select("checkpoint_key", "checkpoint_file_id").First(&task, "id = ?", taskID).Error; err != nil {
+		return copyCheckpoint{}
+	}
+	return copyCheckpoint{key: task.CheckpointKey, fileID: task.CheckpointFileID}
+}
+
+func (w *Worker) saveCheckpoint(taskID string, cp copyCheckpoint) {
+	w.updateTask(taskID, map[string]interface{}{
+		"checkpoint_key":     cp.key,
+		"checkpoint_file_id": cp.fileID,
+	})
+}
+
+// afterCheckpoint restricts q to files after cp, or with after=false to
+// files up to and including it.
+func afterCheckpoint(q *gorm.DB, cp copyCheckpoint, after bool) *gorm.DB {
+	if cp.key == "" {
+		if after {
+			return q
+		}
+		return q.Where("1 = 0")
+	}
+	if after {
+		return q.Where("(file_name > ? OR (file_name = ? AND id > ?))", cp.key, cp.key, cp.fileID)
+	}
+	return q.Where("(file_name < ? OR (file_name = ? AND id <= ?))", cp.key, cp.key, cp.fileID)
+}
+
+// copyBatch copies files with up to parallelism concurrent streams and
+// reports each one through onFile; files the owner's quota has no room for
+// are reported as failed without being copied. It stops starting new copies
+// once ctx is done; copies already running finish.
+func (w *Worker) copyBatch(ctx context.Context, srcBucket, destBucket *db.Bucket, files []db.File, parallelism int, tracker *quota.Tracker, onFile func(db.File, int64, error)) {
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for _, f := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(f db.File) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := tracker.Reserve(f.Size); err != nil {
+				onFile(f, 0, err)
+				return
+			}
+			n, err := w.copyFile(ctx, srcBucket, destBucket, f)
+			onFile(f, n, err)
+		}(f)
+	}
+	wg.Wait()
+}
+
+// copyFile streams one source object into the destination bucket. It is
+// idempotent so a batch re-run after a retry does not duplicate rows: the
+// same version in a versioned bucket, or the same key otherwise, is
+// overwritten instead of added.
+func (w *Worker) copyFile(ctx context.Context, srcBucket, destBucket *db.Bucket, f db.File) (int64, error) {
+	return w.copyFileAs(ctx, srcBucket, destBucket, f, "")
+}
+
+// copyFileAs is copyFile with the replication status to give the copy;
+// replication passes db.ReplicationReplica so replicas are not replicated
+// again.
+func (w *Worker) copyFileAs(ctx context.Context, srcBucket, destBucket *db.Bucket, f db.File, replicationStatus string) (int64, error) {
+	var existing db.File
+	q := w.DB.Where("bucket_id = ? AND file_name = ?", destBucket.ID, f.FileName)
+	switch {
+	case !destBucket.Versioning:
+		q = q.Where("is_latest = ?", true)
+	case f.VersionID == "":
+		q = q.Where("version_id IS NULL OR version_id = ''")
+	default:
+		q = q.Where("version_id = ?", f.VersionID)
+	}
+	found := true
+	if err := q.First(&existing).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, err
+		}
+		found = false
+	}
+	if found && destBucket.Versioning {
+		// overwriting a stored version in place must respect its lock
+		if err := objectlock.CheckWritable(&existing, false); err != nil {
+			return 0, err
+		}
+	}
+
+	destFile := db.File{
+		ID:          uuid.NewString(),
+		FileName:    f.FileName,
+		BucketID:    destBucket.ID,
+		Size:        f.Size,
+		ContentType: f.ContentType,
+		Checksum:    f.Checksum,
+		VersionID:   f.VersionID,
+		IsLatest:    f.IsLatest,
+
+		ReplicationStatus: replicationStatus,
+		StorageClass:      f.StorageClass,
+	}
+	if found {
+		destFile.ID = existing.ID
+		destFile.VersionID = existing.VersionID
+	} else {
+		objectlock.ApplyDefaultRetention(destBucket, &destFile)
+	}
+
+	n, err := copyObject(ctx, objectPath(srcBucket, &f), objectPath(destBucket, &destFile))
+	if err != nil {
+		return 0, fmt.Errorf("copy blob: %w", err)
+	}
+
+	if found {
+		err = w.DB.Model(&existing).Updates(map[string]interface{}{
+			"size":               f.Size,
+			"content_type":       f.ContentType,
+			"checksum":           f.Checksum,
+			"is_latest":          destFile.IsLatest || !destBucket.Versioning,
+			"replication_status": replicationStatus,
+			"storage_class":      f.StorageClass,
+		}).Error
+	} else {
+		if destBucket.Versioning && destFile.IsLatest {
+			err = w.DB.Model(&db.File{}).
+				Where("bucket_id = ? AND file_name = ? AND is_latest = ?", destBucket.ID, f.FileName, true).
+				Update("is_latest", false).Error
+		}
+		if err == nil {
+			err = w.DB.Create(&destFile).Error
+		}
+		// gorm skips zero values that have a column default, so is_latest
+		// would come back true for older versions without this
+		if err == nil && !destFile.IsLatest {
+			err = w.DB.Model(&destFile).Update("is_latest", false).Error
+		}
+	}
+	if err != nil {
+		return n, fmt.Errorf("save file record: %w", err)
+	}
+	log.WithField("file", f.FileName).Debug("Copied file to destination bucket")
+	w.Notifier.ObjectEvent(destBucket, notify.ObjectCreatedCopy, &destFile, destBucket.UserID)
+	return n, nil
+}
+
+func copyMessage(s *tasks.CopySummary) string {
+	msg := fmt.Sprintf("copied %d files", s.Copied)
+	if s.Failed > 0 {
+		msg += fmt.Sprintf(", %d failed", s.Failed)
+	}
+	return msg
+}
@@ -0,0 +1,33 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/SysTechSalihY/mini-s3-clone/mail"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+)
+
+// HandleSendEmailTask delivers a message rendered by the server. Failures
+// are returned for asynq to retry with backoff.
+func (w *Worker) HandleSendEmailTask(ctx context.Context, t *asynq.Task) error {
+	var payload tasks.SendEmailPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		log.WithError(err).Error("Failed to unmarshal email task payload")
+		return fmt.Errorf("invalid email payload: %v: %w", err, asynq.SkipRetry)
+	}
+	if w.Mailer == nil {
+		return fmt.Errorf("no mailer configured: %w", asynq.SkipRetry)
+	}
+
+	msg := mail.Message{To: payload.To, Subject: payload.Subject, HTML: payload.HTML, Text: payload.Text}
+	if err := w.Mailer.Send(ctx, msg); err != nil {
+		log.WithError(err).WithField("subject", payload.Subject).Warn("Failed to send email, will retry")
+		return fmt.Errorf("send email: %w", err)
+	}
+	log.WithField("subject", payload.Subject).Info("Email sent")
+	return nil
+}
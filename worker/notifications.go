@@ -0,0 +1,93 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+func (w *Worker) HandleDeliverWebhookTask(ctx context.Context, t *asynq.Task) error {
+	w = w.withContext(ctx)
+	var payload tasks.WebhookPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		log.WithError(err).Error("Failed to unmarshal webhook task payload")
+		return fmt.Errorf("invalid webhook payload: %v: %w", err, asynq.SkipRetry)
+	}
+	logger := log.WithFields(log.Fields{
+		"notification_id": payload.NotificationID,
+		"event":           payload.EventName,
+	})
+
+	var cfg db.BucketNotification
+	if err := w.DB.First(&cfg, "id = ?", payload.NotificationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// the configuration was removed after the event was raised
+			logger.Info("Notification configuration gone, dropping delivery")
+			return nil
+		}
+		return fmt.Errorf("failed to load notification configuration: %w", err)
+	}
+
+	if err := notify.Deliver(ctx, &cfg, payload.EventName, payload.Body); err != nil {
+		if errors.Is(err, notify.ErrRejected) {
+			return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+		}
+		return err
+	}
+	logger.WithField("url", cfg.URL).Info("Webhook delivered")
+	return nil
+}
+
+// handleWebhookError dead-letters a delivery once asynq gives up on it.
+func (w *Worker) handleWebhookError(ctx context.Context, t *asynq.Task, err error) {
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	logger := log.WithError(err).WithFields(log.Fields{
+		"task_type": t.Type(),
+		"retried":   retried,
+		"max_retry": maxRetry,
+	})
+	if retried < maxRetry && !errors.Is(err, asynq.SkipRetry) {
+		logger.Warn("Webhook delivery failed, will retry")
+		return
+	}
+
+	var payload tasks.WebhookPayload
+	if jsonErr := json.Unmarshal(t.Payload(), &payload); jsonErr != nil {
+		logger.Error("Dropping undecodable webhook delivery")
+		return
+	}
+	var cfg db.BucketNotification
+	if dbErr := w.DB.First(&cfg, "id = ?", payload.NotificationID).Error; dbErr != nil {
+		logger.WithField("notification_id", payload.NotificationID).Error("Webhook delivery failed for a removed configuration")
+		return
+	}
+
+	deadLetter := db.NotificationDeadLetter{
+		ID:             uuid.NewString(),
+		NotificationID: cfg.ID,
+		BucketID:       cfg.BucketID,
+		URL:            cfg.URL,
+		EventName:      payload.EventName,
+		Payload:        string(payload.Body),
+		Attempts:       retried + 1,
+		LastError:      tasks.TruncateMessage(err.Error()),
+	}
+	if dbErr := w.DB.Create(&deadLetter).Error; dbErr != nil {
+		logger.WithField("notification_id", cfg.ID).WithError(dbErr).Error("Failed to record dead-lettered webhook delivery")
+		return
+	}
+	logger.WithFields(log.Fields{
+		"notification_id": cfg.ID,
+		"dead_letter_id":  deadLetter.ID,
+	}).Error("Webhook delivery dead-lettered")
+}
@@ -0,0 +1,255 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/objectlock"
+	"github.com/SysTechSalihY/mini-s3-clone/quota"
+	"github.com/SysTechSalihY/mini-s3-clone/replication"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+func (w *Worker) HandleReplicateObjectTask(ctx context.Context, t *asynq.Task) error {
+	w = w.withContext(ctx)
+	var payload tasks.ReplicationPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		log.WithError(err).Error("Failed to unmarshal replication task payload")
+		return fmt.Errorf("invalid replication payload: %v: %w", err, asynq.SkipRetry)
+	}
+	logger := log.WithFields(log.Fields{
+		"op":         payload.Op,
+		"bucket_id":  payload.BucketID,
+		"file":       payload.Key,
+		"version_id": payload.VersionID,
+	})
+
+	var rules []db.ReplicationRule
+	if err := w.DB.Where("id IN ?", payload.RuleIDs).Find(&rules).Error; err != nil {
+		return fmt.Errorf("failed to load replication rules: %w", err)
+	}
+	if len(rules) == 0 {
+		// the rules were replaced since the write: replicate to the
+		// bucket's current ones instead
+		var current []db.ReplicationRule
+		if err := w.DB.Where("bucket_id = ?", payload.BucketID).Find(&current).Error; err != nil {
+			return fmt.Errorf("failed to load replication rules: %w", err)
+		}
+		for _, rule := range current {
+			if rule.Applies(payload.Key, payload.Op == tasks.ReplicationOpDelete) {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	var srcBucket db.Bucket
+	if err := w.DB.First(&srcBucket, "id = ?", payload.BucketID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			logger.Info("Source bucket gone, dropping replication")
+			return nil
+		}
+		return fmt.Errorf("failed to load source bucket: %w", err)
+	}
+
+	var file db.File
+	if payload.Op == tasks.ReplicationOpPut {
+		if err := w.DB.First(&file, "id = ?", payload.FileID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				logger.Info("Source file gone, dropping replication")
+				return nil
+			}
+			return fmt.Errorf("failed to load source file: %w", err)
+		}
+	}
+
+	if len(rules) == 0 {
+		// replication was turned off since the write, so the object was
+		// never copied anywhere
+		logger.Info("No replication rules left, dropping replication")
+		if payload.Op == tasks.ReplicationOpPut {
+			w.DB.Model(&file).Update("replication_status", db.ReplicationFailed)
+		}
+		return nil
+	}
+
+	var failures []string
+	permanent := false
+	for i := range rules {
+		rule := &rules[i]
+		var err error
+		switch payload.Op {
+		case tasks.ReplicationOpPut:
+			err = w.replicatePut(ctx, &srcBucket, &file, rule)
+		case tasks.ReplicationOpDelete:
+			err = w.replicateDelete(ctx, &srcBucket, payload.Key, rule)
+		default:
+			return fmt.Errorf("unknown replication op %q: %w", payload.Op, asynq.SkipRetry)
+		}
+		if err != nil {
+			logger.WithError(err).WithField("dest_bucket", rule.DestBucket).Warn("Replication to destination failed")
+			failures = append(failures, fmt.Sprintf("%s: %v", ruleTarget(rule), err))
+			permanent = permanent || errors.Is(err, asynq.SkipRetry)
+		}
+	}
+	if len(failures) > 0 {
+		if permanent {
+			return fmt.Errorf("replication failed: %s: %w", strings.Join(failures, "; "), asynq.SkipRetry)
+		}
+		return fmt.Errorf("replication failed: %s", strings.Join(failures, "; "))
+	}
+
+	if payload.Op == tasks.ReplicationOpPut {
+		w.DB.Model(&file).Update("replication_status", db.ReplicationCompleted)
+	}
+	logger.WithField("rules", len(rules)).Info("Object replicated")
+	return nil
+}
+
+func ruleTarget(rule *db.ReplicationRule) string {
+	if rule.Endpoint == "" {
+		return rule.DestBucket
+	}
+	return strings.TrimRight(rule.Endpoint, "/") + "/" + rule.DestBucket
+}
+
+func remoteFor(rule *db.ReplicationRule) *replication.Remote {
+	return &replication.Remote{Endpoint: rule.Endpoint, AccessKey: rule.AccessKey, SecretKey: rule.SecretKey}
+}
+
+// remoteError stops retries of endpoints that resolve to private addresses;
+// they stay refused until the rule is changed.
+func remoteError(err error) error {
+	if errors.Is(err, notify.ErrPrivateAddress) {
+		return fmt.Errorf("%w: %w", err, asynq.SkipRetry)
+	}
+	return err
+}
+
+// localDestBucket resolves a local destination; it must belong to the owner
+// of the source bucket.
+func (w *Worker) localDestBucket(srcBucket *db.Bucket, rule *db.ReplicationRule) (*db.Bucket, error) {
+	var dest db.Bucket
+	if err := w.DB.Where("bucket_name = ? AND user_id = ?", rule.DestBucket, srcBucket.UserID).First(&dest).Error; err != nil {
+		return nil, fmt.Errorf("destination bucket %s: %w", rule.DestBucket, err)
+	}
+	return &dest, nil
+}
+
+func (w *Worker) replicatePut(ctx context.Context, srcBucket *db.Bucket, file *db.File, rule *db.ReplicationRule) error {
+	if rule.Endpoint == "" {
+		dest, err := w.localDestBucket(srcBucket, rule)
+		if err != nil {
+			return err
+		}
+		var owner db.User
+		if err := w.DB.Where("id = ?", dest.UserID).First(&owner).Error; err != nil {
+			return err
+		}
+		if err := quota.CheckUpload(w.DB, &owner, dest, 1, file.Size, file.Size); err != nil {
+			if errors.Is(err, quota.ErrExceeded) || errors.Is(err, quota.ErrObjectTooLarge) {
+				return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+			}
+			return err
+		}
+		_, err = w.copyFileAs(ctx, srcBucket, dest, *file, db.ReplicationReplica)
+		if errors.Is(err, objectlock.ErrLocked) {
+			// the locked replica cannot change, retrying will not help
+			return fmt.Errorf("%w: %w", err, asynq.SkipRetry)
+		}
+		return err
+	}
+
+	remote := remoteFor(rule)
+	etag, found, err := remote.Head(ctx, rule.DestBucket, file.FileName)
+	if err != nil {
+		return remoteError(err)
+	}
+	if found && file.Checksum != "" && etag == file.Checksum {
+		// an earlier attempt already got it there
+		return nil
+	}
+	path := objectPath(srcBucket, file)
+	err = remote.Put(ctx, rule.DestBucket, file.FileName, path, file.ContentType)
+	if errors.Is(err, replication.ErrExists) && found {
+		// unversioned remote bucket: replace the stale object
+		if err = remote.Delete(ctx, rule.DestBucket, file.FileName); err == nil {
+			err = remote.Put(ctx, rule.DestBucket, file.FileName, path, file.ContentType)
+		}
+	}
+	return remoteError(err)
+}
+
+// replicateDelete removes the latest version of key from the destination,
+// promoting the previous version like DeleteFile does.
+func (w *Worker) replicateDelete(ctx context.Context, srcBucket *db.Bucket, key string, rule *db.ReplicationRule) error {
+	if rule.Endpoint != "" {
+		return remoteError(remoteFor(rule).Delete(ctx, rule.DestBucket, key))
+	}
+
+	dest, err := w.localDestBucket(srcBucket, rule)
+	if err != nil {
+		return err
+	}
+	var latest db.File
+	if err := w.DB.Where("bucket_id = ? AND file_name = ? AND is_latest = ?", dest.ID, key, true).First(&latest).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err := objectlock.CheckWritable(&latest, false); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"bucket": dest.BucketName,
+			"file":   key,
+		}).Warn("Replicated delete skipped, destination version is locked")
+		return nil
+	}
+	if err := removeObject(ctx, objectPath(dest, &latest)); err != nil {
+		return err
+	}
+	if err := w.DB.Delete(&latest).Error; err != nil {
+		return err
+	}
+	if dest.Versioning {
+		var previous db.File
+		if err := w.DB.Where("bucket_id = ? AND file_name = ?", dest.ID, key).
+			Order("created_at desc").First(&previous).Error; err == nil {
+			w.DB.Model(&previous).Update("is_latest", true)
+		}
+	}
+	// replicated deletes must not cascade into the destination's own rules
+	latest.ReplicationStatus = db.ReplicationReplica
+	w.Notifier.ObjectEvent(dest, notify.ObjectRemovedDelete, &latest, srcBucket.UserID)
+	return nil
+}
+
+// handleReplicationError marks the source object FAILED once asynq gives up.
+func (w *Worker) handleReplicationError(ctx context.Context, t *asynq.Task, err error) {
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	logger := log.WithError(err).WithFields(log.Fields{
+		"task_type": t.Type(),
+		"retried":   retried,
+		"max_retry": maxRetry,
+	})
+	if retried < maxRetry && !errors.Is(err, asynq.SkipRetry) {
+		logger.Warn("Replication attempt failed, will retry")
+		return
+	}
+
+	var payload tasks.ReplicationPayload
+	if jsonErr := json.Unmarshal(t.Payload(), &payload); jsonErr == nil && payload.Op == tasks.ReplicationOpPut {
+		w.DB.Model(&db.File{}).Where("id = ?", payload.FileID).Update("replication_status", db.ReplicationFailed)
+	}
+	logger.WithFields(log.Fields{
+		"bucket_id": payload.BucketID,
+		"file":      payload.Key,
+	}).Error("Replication failed permanently")
+}
@@ -0,0 +1,88 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/tracing"
+	"github.com/SysTechSalihY/mini-s3-clone/utils"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// objectPath mirrors where the upload handlers put a blob: versioned buckets
+// store each version as "<VersionID>_<FileName>".
+func objectPath(bucket *db.Bucket, f *db.File) string {
+	name := f.FileName
+	if bucket.Versioning && f.VersionID != "" {
+		name = fmt.Sprintf("%s_%s", f.VersionID, f.FileName)
+	}
+	return utils.ObjectPath(bucket.BucketName, name)
+}
+
+// copyObject streams src into dest through a temp file in the destination
+// directory, so a failed copy never leaves a truncated object behind.
+func copyObject(ctx context.Context, srcPath, destPath string) (n int64, err error) {
+	_, span := tracing.StartStorage(ctx, "copy", destPath)
+	span.SetAttributes(attribute.String("storage.source_path", srcPath))
+	defer func() { tracing.End(span, err) }()
+
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(destPath), ".copy-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err = io.Copy(tmp, in)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), destPath)
+}
+
+// removeObject deletes the blob at path; a blob that is already gone is
+// not an error.
+func removeObject(ctx context.Context, path string) error {
+	_, span := tracing.StartStorage(ctx, "delete", path)
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	tracing.End(span, err)
+	return err
+}
+
+// ensureChecksum fills in the checksum of files uploaded before checksums
+// were recorded and persists it for next time.
+func (w *Worker) ensureChecksum(bucket *db.Bucket, f *db.File) {
+	if f.Checksum != "" {
+		return
+	}
+	sum, err := utils.FileChecksum(objectPath(bucket, f))
+	if err != nil {
+		log.WithError(err).WithField("file", f.FileName).Warn("Failed to checksum stored file")
+		return
+	}
+	f.Checksum = sum
+	w.DB.Model(&db.File{}).Where("id = ?", f.ID).Update("checksum", sum)
+}
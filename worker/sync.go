@@ -0,0 +1,346 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/objectlock"
+	"github.com/SysTechSalihY/mini-s3-clone/quota"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// syncPlan is the set of operations that makes the destination match the
+// source. Both sides are compared on their latest versions only.
+type syncPlan struct {
+	create    []db.File
+	update    []syncPair
+	remove    []db.File
+	unchanged int
+}
+
+type syncPair struct {
+	src  db.File
+	dest db.File
+}
+
+// planSync diffs src against dest by key, size and checksum. A missing
+// checksum on either side counts as a change so unknown content is copied.
+func planSync(src, dest []db.File, deleteExtraneous bool) syncPlan {
+	var plan syncPlan
+
+	destByKey := make(map[string]db.File, len(dest))
+	for _, f := range dest {
+		destByKey[f.FileName] = f
+	}
+	srcKeys := make(map[string]bool, len(src))
+
+	sorted := append([]db.File(nil), src...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].FileName < sorted[j].FileName })
+	for _, s := range sorted {
+		srcKeys[s.FileName] = true
+		d, ok := destByKey[s.FileName]
+		switch {
+		case !ok:
+			plan.create = append(plan.create, s)
+		case s.Size == d.Size && s.Checksum != "" && s.Checksum == d.Checksum:
+			plan.unchanged++
+		default:
+			plan.update = append(plan.update, syncPair{src: s, dest: d})
+		}
+	}
+
+	if deleteExtraneous {
+		for _, d := range dest {
+			if !srcKeys[d.FileName] {
+				plan.remove = append(plan.remove, d)
+			}
+		}
+		sort.Slice(plan.remove, func(i, j int) bool { return plan.remove[i].FileName < plan.remove[j].FileName })
+	}
+	return plan
+}
+
+func (p syncPlan) summary(dryRun bool) *tasks.SyncSummary {
+	summary := &tasks.SyncSummary{
+		DryRun:    dryRun,
+		Created:   len(p.create),
+		Updated:   len(p.update),
+		Deleted:   len(p.remove),
+		Unchanged: p.unchanged,
+	}
+	for _, f := range p.create {
+		summary.CreatedKeys = appendCapped(summary.CreatedKeys, f.FileName)
+		if dryRun {
+			summary.BytesCopied += f.Size
+		}
+	}
+	for _, pair := range p.update {
+		summary.UpdatedKeys = appendCapped(summary.UpdatedKeys, pair.src.FileName)
+		if dryRun {
+			summary.BytesCopied += pair.src.Size
+		}
+	}
+	for _, f := range p.remove {
+		summary.DeletedKeys = appendCapped(summary.DeletedKeys, f.FileName)
+	}
+	return summary
+}
+
+func appendCapped(list []string, key string) []string {
+	if len(list) >= tasks.SyncSummaryKeyLimit {
+		return list
+	}
+	return append(list, key)
+}
+
+// latestFiles returns the latest version of every key in the bucket,
+// optionally restricted to keys starting with prefix.
+func (w *Worker) latestFiles(bucketID, prefix string) ([]db.File, error) {
+	query := w.DB.Where("bucket_id = ? AND is_latest = ?", bucketID, true)
+	if prefix != "" {
+		// "!" as escape character behaves the same in MySQL and SQLite,
+		// unlike a backslash
+		escaped := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(prefix)
+		query = query.Where("file_name LIKE ? ESCAPE '!'", escaped+"%")
+	}
+	var files []db.File
+	err := query.Find(&files).Error
+	return files, err
+}
+
+func (w *Worker) HandleSyncBucketTask(ctx context.Context, t *asynq.Task) error {
+	w = w.withContext(ctx)
+	var payload tasks.SyncBucketPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		log.WithError(err).Error("Failed to unmarshal sync bucket task payload")
+		return fmt.Errorf("invalid sync bucket payload: %v: %w", err, asynq.SkipRetry)
+	}
+	taskID := resolveTaskID(ctx, payload.TaskID)
+
+	logger := log.WithFields(log.Fields{
+		"task_id":     taskID,
+		"user_id":     payload.UserID,
+		"bucket_src":  payload.BucketSrc,
+		"bucket_dest": payload.BucketDest,
+		"prefix":      payload.Prefix,
+		"dry_run":     payload.DryRun,
+	})
+	logger.Info("Starting sync bucket task")
+
+	if w.isCancelled(taskID) {
+		logger.Info("Sync bucket task was cancelled, skipping")
+		return nil
+	}
+	run := w.startRun(ctx, t.Type(), taskID, payload.UserID)
+
+	var srcBucket db.Bucket
+	if err := w.DB.Where("bucket_name = ? AND user_id = ?", payload.BucketSrc, payload.UserID).First(&srcBucket).Error; err != nil {
+		logger.WithError(err).Error("Source bucket not found or not owned by user")
+		return fmt.Errorf("source bucket not found or not owned by user: %w", err)
+	}
+
+	// A dry run against a missing destination just reports everything as new.
+	var destBucket *db.Bucket
+	var existing db.Bucket
+	err := w.DB.Where("bucket_name = ? AND user_id = ?", payload.BucketDest, payload.UserID).First(&existing).Error
+	switch {
+	case err == nil:
+		destBucket = &existing
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		logger.WithError(err).Error("Failed to fetch destination bucket")
+		return fmt.Errorf("failed to fetch destination bucket: %w", err)
+	case !payload.DryRun:
+		logger.Error("Destination bucket not found or not owned by user")
+		return fmt.Errorf("destination bucket %s not found: %w", payload.BucketDest, asynq.SkipRetry)
+	}
+
+	srcFiles, err := w.latestFiles(srcBucket.ID, payload.Prefix)
+	if err != nil {
+		return fmt.Errorf("failed to fetch source files: %w", err)
+	}
+	var destFiles []db.File
+	if destBucket != nil {
+		if destFiles, err = w.latestFiles(destBucket.ID, payload.Prefix); err != nil {
+			return fmt.Errorf("failed to fetch destination files: %w", err)
+		}
+	}
+
+	// Checksums only matter where size alone cannot tell the objects apart.
+	destByKey := make(map[string]int, len(destFiles))
+	for i := range destFiles {
+		destByKey[destFiles[i].FileName] = i
+	}
+	for i := range srcFiles {
+		j, ok := destByKey[srcFiles[i].FileName]
+		if !ok || srcFiles[i].Size != destFiles[j].Size {
+			continue
+		}
+		w.ensureChecksum(&srcBucket, &srcFiles[i])
+		w.ensureChecksum(destBucket, &destFiles[j])
+	}
+
+	plan := planSync(srcFiles, destFiles, payload.DeleteExtraneous)
+	summary := plan.summary(payload.DryRun)
+	logger.WithFields(log.Fields{
+		"create":    summary.Created,
+		"update":    summary.Updated,
+		"delete":    summary.Deleted,
+		"unchanged": summary.Unchanged,
+	}).Info("Sync plan computed")
+
+	if payload.DryRun {
+		run.complete(syncMessage(summary), summary)
+		return nil
+	}
+
+	var user db.User
+	if err := w.DB.Where("id = ?", payload.UserID).First(&user).Error; err != nil {
+		logger.WithError(err).Error("User not found for sync bucket task")
+		return fmt.Errorf("user not found: %w", err)
+	}
+	tracker, err := quota.NewTracker(w.DB, &user)
+	if err != nil {
+		return fmt.Errorf("failed to read account usage: %w", err)
+	}
+
+	total := len(plan.create) + len(plan.update) + len(plan.remove)
+	done := 0
+	step := func(key string, opErr error) {
+		done++
+		if opErr != nil {
+			summary.Failed++
+			logger.WithError(opErr).WithField("file", key).Warn("Sync operation failed")
+			summary.Errors = appendCapped(summary.Errors, fmt.Sprintf("%s: %v", key, opErr))
+		}
+		run.progress(done, total, key)
+	}
+
+	for _, f := range plan.create {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("sync bucket task interrupted: %w", err)
+		}
+		n, err := w.syncObject(ctx, &srcBucket, destBucket, f, nil, tracker)
+		summary.BytesCopied += n
+		step(f.FileName, err)
+	}
+	for _, pair := range plan.update {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("sync bucket task interrupted: %w", err)
+		}
+		dest := pair.dest
+		n, err := w.syncObject(ctx, &srcBucket, destBucket, pair.src, &dest, tracker)
+		summary.BytesCopied += n
+		step(pair.src.FileName, err)
+	}
+	for _, f := range plan.remove {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("sync bucket task interrupted: %w", err)
+		}
+		step(f.FileName, w.removeAllVersions(ctx, destBucket, f.FileName))
+	}
+
+	run.complete(syncMessage(summary), summary)
+	logger.Info("Sync bucket task completed")
+	return nil
+}
+
+// syncObject copies src into the destination bucket. With existing set it
+// replaces that object: as a new version on versioned buckets, in place
+// otherwise. Objects the owner's quota has no room for are not copied.
+func (w *Worker) syncObject(ctx context.Context, srcBucket, destBucket *db.Bucket, src db.File, existing *db.File, tracker *quota.Tracker) (int64, error) {
+	if err := tracker.Reserve(src.Size); err != nil {
+		return 0, err
+	}
+	if existing != nil && !destBucket.Versioning {
+		n, err := copyObject(ctx, objectPath(srcBucket, &src), objectPath(destBucket, existing))
+		if err != nil {
+			return 0, err
+		}
+		if err := w.DB.Model(existing).Updates(map[string]interface{}{
+			"size":          src.Size,
+			"content_type":  src.ContentType,
+			"checksum":      src.Checksum,
+			"storage_class": src.StorageClass,
+		}).Error; err != nil {
+			return n, err
+		}
+		w.Notifier.ObjectEvent(destBucket, notify.ObjectCreatedCopy, existing, destBucket.UserID)
+		return n, nil
+	}
+
+	newFile := db.File{
+		ID:          uuid.NewString(),
+		FileName:    src.FileName,
+		BucketID:    destBucket.ID,
+		Size:        src.Size,
+		ContentType: src.ContentType,
+		Checksum:    src.Checksum,
+		VersionID:   uuid.NewString(),
+		IsLatest:    true,
+
+		StorageClass: src.StorageClass,
+	}
+	objectlock.ApplyDefaultRetention(destBucket, &newFile)
+	n, err := copyObject(ctx, objectPath(srcBucket, &src), objectPath(destBucket, &newFile))
+	if err != nil {
+		return 0, err
+	}
+	err = w.DB.Transaction(func(tx *gorm.DB) error {
+		if existing != nil {
+			if err := tx.Model(&db.File{}).Where("id = ?", existing.ID).Update("is_latest", false).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(&newFile).Error
+	})
+	if err != nil {
+		return n, err
+	}
+	w.Notifier.ObjectEvent(destBucket, notify.ObjectCreatedCopy, &newFile, destBucket.UserID)
+	return n, nil
+}
+
+func (w *Worker) removeAllVersions(ctx context.Context, bucket *db.Bucket, key string) error {
+	var versions []db.File
+	if err := w.DB.Where("bucket_id = ? AND file_name = ?", bucket.ID, key).Find(&versions).Error; err != nil {
+		return err
+	}
+	// a key is removed whole or not at all, so a locked version keeps the rest
+	for i := range versions {
+		if err := objectlock.CheckWritable(&versions[i], false); err != nil {
+			return err
+		}
+	}
+	for i := range versions {
+		if err := removeObject(ctx, objectPath(bucket, &versions[i])); err != nil {
+			return err
+		}
+		if err := w.DB.Delete(&versions[i]).Error; err != nil {
+			return err
+		}
+		w.Notifier.ObjectEvent(bucket, notify.ObjectRemovedDelete, &versions[i], bucket.UserID)
+	}
+	return nil
+}
+
+func syncMessage(s *tasks.SyncSummary) string {
+	prefix := "synced"
+	if s.DryRun {
+		prefix = "dry run"
+	}
+	msg := fmt.Sprintf("%s: %d created, %d updated, %d deleted, %d unchanged", prefix, s.Created, s.Updated, s.Deleted, s.Unchanged)
+	if s.Failed > 0 {
+		msg += fmt.Sprintf(", %d failed", s.Failed)
+	}
+	return msg
+}
@@ -0,0 +1,203 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/metrics"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/hibiken/asynq"
+	log "github.com/sirupsen/logrus"
+)
+
+// resolveTaskID prefers the ID carried in the payload and falls back to the
+// asynq task ID for tasks enqueued before payloads carried one.
+func resolveTaskID(ctx context.Context, payloadID string) string {
+	if payloadID != "" {
+		return payloadID
+	}
+	taskID, _ := asynq.GetTaskID(ctx)
+	return taskID
+}
+
+// isCancelled reports whether the task was cancelled through the API. asynq
+// retries a task whose context was cancelled, so the DB status is what
+// tells us to drop that delivery instead of running it again.
+func (w *Worker) isCancelled(taskID string) bool {
+	if taskID == "" {
+		return false
+	}
+	var task db.Task
+	if err := w.DB.Select("status").First(&task, "id = ?", taskID).Error; err != nil {
+		return false
+	}
+	return task.Status == "cancelled"
+}
+
+func (w *Worker) updateTask(taskID string, fields map[string]interface{}) {
+	if taskID == "" {
+		return
+	}
+	if err := w.DB.Model(&db.Task{}).Where("id = ?", taskID).Updates(fields).Error; err != nil {
+		log.WithError(err).WithField("task_id", taskID).Warn("Failed to update task record")
+	}
+}
+
+func (w *Worker) publish(ev tasks.ProgressEvent) {
+	if w.Redis == nil || ev.TaskID == "" {
+		return
+	}
+	if err := tasks.PublishProgress(context.Background(), w.Redis, ev); err != nil {
+		log.WithError(err).WithField("task_id", ev.TaskID).Warn("Failed to publish progress event")
+	}
+}
+
+// taskRun tracks one attempt of a task so progress updates can carry an ETA.
+type taskRun struct {
+	w        *Worker
+	taskType string
+	taskID   string
+	userID   string
+	started  time.Time
+}
+
+func (w *Worker) startRun(ctx context.Context, taskType, taskID, userID string) *taskRun {
+	retried, _ := asynq.GetRetryCount(ctx)
+	w.updateTask(taskID, map[string]interface{}{
+		"status":      "running",
+		"retry_count": retried,
+		"message":     "",
+	})
+	now := time.Now()
+	if taskID != "" {
+		// started_at records the first attempt only
+		w.DB.Model(&db.Task{}).Where("id = ? AND started_at IS NULL", taskID).Update("started_at", &now)
+	}
+	w.publish(tasks.ProgressEvent{TaskID: taskID, UserID: userID, Status: "running"})
+	return &taskRun{w: w, taskType: taskType, taskID: taskID, userID: userID, started: now}
+}
+
+// progress records that done of total items are finished and returns the
+// percentage written to the task.
+func (r *taskRun) progress(done, total int, currentFile string) int {
+	percent := 100
+	if total > 0 {
+		percent = int(float64(done) / float64(total) * 100)
+	}
+	metrics.FilesProcessed.WithLabelValues(r.taskType).Inc()
+	r.w.updateTask(r.taskID, map[string]interface{}{"progress": percent})
+	r.w.publish(tasks.ProgressEvent{
+		TaskID:      r.taskID,
+		UserID:      r.userID,
+		Status:      "running",
+		Progress:    percent,
+		CurrentFile: currentFile,
+		ETASeconds:  int64(estimateETA(time.Since(r.started), done, total).Seconds()),
+	})
+	return percent
+}
+
+// complete marks the task done. A non-nil result is stored as JSON in the
+// task record and message becomes its human readable summary.
+func (r *taskRun) complete(message string, result interface{}) {
+	now := time.Now()
+	fields := map[string]interface{}{
+		"status":      "completed",
+		"progress":    100,
+		"message":     tasks.TruncateMessage(message),
+		"finished_at": &now,
+	}
+	if result != nil {
+		if data, err := json.Marshal(result); err != nil {
+			log.WithError(err).WithField("task_id", r.taskID).Warn("Failed to encode task result")
+		} else {
+			encoded := string(data)
+			fields["result"] = &encoded
+		}
+	}
+	r.w.updateTask(r.taskID, fields)
+	r.w.publish(tasks.ProgressEvent{TaskID: r.taskID, UserID: r.userID, Status: "completed", Progress: 100, Message: message})
+}
+
+// estimateETA extrapolates the remaining time from the average time per item
+// so far.
+func estimateETA(elapsed time.Duration, done, total int) time.Duration {
+	if done <= 0 || done >= total {
+		return 0
+	}
+	return elapsed / time.Duration(done) * time.Duration(total-done)
+}
+
+// HandleTaskError is installed as the asynq ErrorHandler. It records every
+// failed attempt and marks the task failed once asynq stops retrying it.
+func (w *Worker) HandleTaskError(ctx context.Context, t *asynq.Task, err error) {
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	w.recordTaskError(ctx, t, err, retried, maxRetry)
+}
+
+// recordTaskError is HandleTaskError for an attempt that asynq has retried
+// retried times out of maxRetry.
+func (w *Worker) recordTaskError(ctx context.Context, t *asynq.Task, err error, retried, maxRetry int) {
+	var payloadID, userID string
+	switch t.Type() {
+	case tasks.TaskTypeDeliverWebhook:
+		// webhook deliveries, replication and access logs have no task record
+		w.handleWebhookError(ctx, t, err)
+		return
+	case tasks.TaskTypeReplicateObject:
+		w.handleReplicationError(ctx, t, err)
+		return
+	case tasks.TaskTypeDeliverAccessLogs:
+		w.handleAccessLogError(ctx, t, err)
+		return
+	case tasks.TaskTypeEmptyBucket:
+		var payload tasks.EmptyBucketPayload
+		if jsonErr := json.Unmarshal(t.Payload(), &payload); jsonErr == nil {
+			payloadID, userID = payload.TaskID, payload.UserID
+		}
+	case tasks.TaskTypeCopyBucket:
+		var payload tasks.CopyBucketPayload
+		if jsonErr := json.Unmarshal(t.Payload(), &payload); jsonErr == nil {
+			payloadID, userID = payload.TaskID, payload.UserID
+		}
+	case tasks.TaskTypeSyncBucket:
+		var payload tasks.SyncBucketPayload
+		if jsonErr := json.Unmarshal(t.Payload(), &payload); jsonErr == nil {
+			payloadID, userID = payload.TaskID, payload.UserID
+		}
+	}
+	taskID := resolveTaskID(ctx, payloadID)
+	if taskID == "" {
+		return
+	}
+	if w.isCancelled(taskID) {
+		w.publish(tasks.ProgressEvent{TaskID: taskID, UserID: userID, Status: "cancelled", Message: "task cancelled"})
+		return
+	}
+
+	status := "retrying"
+	fields := map[string]interface{}{
+		"retry_count": retried,
+		"message":     tasks.TruncateMessage(err.Error()),
+	}
+	if retried >= maxRetry || errors.Is(err, asynq.SkipRetry) {
+		now := time.Now()
+		status = "failed"
+		fields["finished_at"] = &now
+	}
+	fields["status"] = status
+	w.updateTask(taskID, fields)
+	w.publish(tasks.ProgressEvent{TaskID: taskID, UserID: userID, Status: status, Message: tasks.TruncateMessage(err.Error())})
+
+	log.WithError(err).WithFields(log.Fields{
+		"task_id":   taskID,
+		"task_type": t.Type(),
+		"retried":   retried,
+		"max_retry": maxRetry,
+		"status":    status,
+	}).Error("Task attempt failed")
+}
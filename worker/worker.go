@@ -6,33 +6,57 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
+	"sync"
 
 	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/mail"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/objectlock"
+	"github.com/SysTechSalihY/mini-s3-clone/quota"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/SysTechSalihY/mini-s3-clone/utils"
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
 	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
 type Worker struct {
-	DB *gorm.DB
+	DB       *gorm.DB
+	Redis    *redis.Client    // optional, progress events are only published when set
+	Notifier *notify.Notifier // optional, bucket events are only sent when set
+	Mailer   mail.Mailer      // delivers send_email tasks
+}
+
+// withContext returns a copy of w whose queries run under ctx, so they are
+// traced as part of the task.
+func (w *Worker) withContext(ctx context.Context) *Worker {
+	scoped := *w
+	scoped.DB = w.DB.WithContext(ctx)
+	return &scoped
 }
 
 func (w *Worker) HandleEmptyBucketTask(ctx context.Context, t *asynq.Task) error {
-	var payload struct {
-		UserID     string
-		BucketName string
-	}
+	w = w.withContext(ctx)
+	var payload tasks.EmptyBucketPayload
 	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
 		log.WithError(err).Error("Failed to unmarshal empty bucket task payload")
-		return err
+		return fmt.Errorf("invalid empty bucket payload: %v: %w", err, asynq.SkipRetry)
 	}
+	taskID := resolveTaskID(ctx, payload.TaskID)
 	log.WithFields(log.Fields{
+		"task_id":     taskID,
 		"user_id":     payload.UserID,
 		"bucket_name": payload.BucketName,
 	}).Info("Starting empty bucket task")
 
+	if w.isCancelled(taskID) {
+		log.WithField("task_id", taskID).Info("Empty bucket task was cancelled, skipping")
+		return nil
+	}
+	run := w.startRun(ctx, t.Type(), taskID, payload.UserID)
+
 	var bucket db.Bucket
 	if err := w.DB.Where("bucket_name = ?", payload.BucketName).First(&bucket).Error; err != nil {
 		log.WithError(err).WithField("bucket", payload.BucketName).Error("Bucket not found")
@@ -52,9 +76,23 @@ func (w *Worker) HandleEmptyBucketTask(ctx context.Context, t *asynq.Task) error
 		"user_id":    payload.UserID,
 	}).Info("Emptying bucket")
 
+	summary := &tasks.EmptySummary{}
 	for i, file := range files {
-		path := fmt.Sprintf("./storage/%s/%s", bucket.BucketName, file.FileName)
-		if err := os.Remove(path); err != nil {
+		if err := ctx.Err(); err != nil {
+			log.WithError(err).WithField("bucket", bucket.BucketName).Warn("Empty bucket task interrupted")
+			return fmt.Errorf("empty bucket task interrupted: %w", err)
+		}
+
+		if err := objectlock.CheckWritable(&file, payload.BypassGovernance); err != nil {
+			summary.Retained++
+			summary.RetainedKeys = appendCapped(summary.RetainedKeys, file.FileName)
+			log.WithError(err).WithField("file", file.FileName).Info("Keeping locked file")
+			run.progress(i+1, total, file.FileName)
+			continue
+		}
+
+		path := objectPath(&bucket, &file)
+		if err := removeObject(ctx, path); err != nil {
 			log.WithError(err).WithField("file", file.FileName).Warn("Failed to remove file from storage")
 		} else {
 			log.WithField("file", file.FileName).Info("Deleted file from storage")
@@ -62,40 +100,53 @@ func (w *Worker) HandleEmptyBucketTask(ctx context.Context, t *asynq.Task) error
 
 		if err := w.DB.Delete(&file).Error; err != nil {
 			log.WithError(err).WithField("file", file.FileName).Warn("Failed to delete file record from DB")
+		} else {
+			summary.Deleted++
+			w.Notifier.ObjectEvent(&bucket, notify.ObjectRemovedDelete, &file, payload.UserID)
 		}
 
-		progress := int(float64(i+1) / float64(total) * 100)
-		w.DB.Model(&db.Task{}).Where("bucket_src = ? AND user_id = ?", bucket.BucketName, payload.UserID).
-			Update("progress", progress)
+		progress := run.progress(i+1, total, file.FileName)
 		log.WithFields(log.Fields{
 			"progress": progress,
 			"bucket":   bucket.BucketName,
 		}).Info("Progress updated")
 	}
 
-	w.DB.Model(&db.Task{}).Where("bucket_src = ? AND user_id = ?", bucket.BucketName, payload.UserID).
-		Updates(map[string]interface{}{"status": "completed", "progress": 100})
-	log.WithField("bucket", bucket.BucketName).Info("Empty bucket task completed successfully")
+	msg := fmt.Sprintf("deleted %d files", summary.Deleted)
+	if summary.Retained > 0 {
+		msg += fmt.Sprintf(", %d retained by object lock", summary.Retained)
+	}
+	run.complete(msg, summary)
+	log.WithFields(log.Fields{
+		"bucket":   bucket.BucketName,
+		"deleted":  summary.Deleted,
+		"retained": summary.Retained,
+	}).Info("Empty bucket task completed successfully")
 	return nil
 }
 
 func (w *Worker) HandleCopyBucketTask(ctx context.Context, t *asynq.Task) error {
-	var payload struct {
-		UserID     string `json:"user_id"`
-		BucketSrc  string `json:"bucket_src"`
-		BucketDest string `json:"bucket_dest"`
-	}
+	w = w.withContext(ctx)
+	var payload tasks.CopyBucketPayload
 	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
 		log.WithError(err).Error("Failed to unmarshal copy bucket task payload")
-		return err
+		return fmt.Errorf("invalid copy bucket payload: %v: %w", err, asynq.SkipRetry)
 	}
+	taskID := resolveTaskID(ctx, payload.TaskID)
 
 	log.WithFields(log.Fields{
+		"task_id":     taskID,
 		"user_id":     payload.UserID,
 		"bucket_src":  payload.BucketSrc,
 		"bucket_dest": payload.BucketDest,
 	}).Info("Starting copy bucket task")
 
+	if w.isCancelled(taskID) {
+		log.WithField("task_id", taskID).Info("Copy bucket task was cancelled, skipping")
+		return nil
+	}
+	run := w.startRun(ctx, t.Type(), taskID, payload.UserID)
+
 	// Fetch user
 	var user db.User
 	if err := w.DB.Where("id = ?", payload.UserID).First(&user).Error; err != nil {
@@ -114,6 +165,10 @@ func (w *Worker) HandleCopyBucketTask(ctx context.Context, t *asynq.Task) error
 	var destBucket db.Bucket
 	if err := w.DB.Where("bucket_name = ? AND user_id = ?", payload.BucketDest, user.ID).First(&destBucket).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if err := quota.CheckBucket(w.DB, &user); err != nil {
+				log.WithError(err).WithField("user_id", user.ID).Warn("Cannot create destination bucket")
+				return fmt.Errorf("cannot create destination bucket: %v: %w", err, asynq.SkipRetry)
+			}
 			destBucket = db.Bucket{
 				ID:         uuid.NewString(),
 				BucketName: payload.BucketDest,
@@ -136,77 +191,112 @@ func (w *Worker) HandleCopyBucketTask(ctx context.Context, t *asynq.Task) error
 	}
 
 	// Ensure destination folder exists
-	destDir := fmt.Sprintf("./storage/%s", destBucket.BucketName)
+	destDir := utils.BucketDir(destBucket.BucketName)
 	if err := os.MkdirAll(destDir, 0755); err != nil {
 		log.WithError(err).Error("Failed to create destination folder")
 		return fmt.Errorf("failed to create destination folder: %w", err)
 	}
 
-	// Fetch files from source bucket
-	var files []db.File
-	if err := w.DB.Where("bucket_id = ?", srcBucket.ID).Find(&files).Error; err != nil {
-		log.WithError(err).Error("Failed to fetch files from source bucket")
-		return fmt.Errorf("failed to fetch files from source bucket: %w", err)
+	parallelism := payload.Parallelism
+	if parallelism < 1 {
+		parallelism = tasks.DefaultCopyParallelism
+	}
+	if parallelism > tasks.MaxCopyParallelism {
+		parallelism = tasks.MaxCopyParallelism
+	}
+
+	// Non-versioned destinations hold one object per key, so only the
+	// latest version of each source key is copied into them.
+	sourceFiles := func() *gorm.DB {
+		q := w.DB.Model(&db.File{}).Where("bucket_id = ?", srcBucket.ID)
+		if !destBucket.Versioning {
+			q = q.Where("is_latest = ?", true)
+		}
+		return q
+	}
+
+	var total int64
+	if err := sourceFiles().Count(&total).Error; err != nil {
+		log.WithError(err).Error("Failed to count files in source bucket")
+		return fmt.Errorf("failed to count files in source bucket: %w", err)
+	}
+
+	cp := w.loadCheckpoint(taskID)
+	var done int64
+	if cp.key != "" {
+		if err := afterCheckpoint(sourceFiles(), cp, false).Count(&done).Error; err != nil {
+			return fmt.Errorf("failed to resume from checkpoint: %w", err)
+		}
 	}
 
-	total := len(files)
 	log.WithFields(log.Fields{
 		"bucket_src":  srcBucket.BucketName,
 		"bucket_dest": destBucket.BucketName,
 		"file_count":  total,
+		"resume_from": cp.key,
+		"parallelism": parallelism,
 	}).Info("Copying files")
 
-	for i, f := range files {
-		srcPath := fmt.Sprintf("./storage/%s/%s", srcBucket.BucketName, f.FileName)
-		destPath := filepath.Join(destDir, f.FileName)
+	tracker, err := quota.NewTracker(w.DB, &user)
+	if err != nil {
+		return fmt.Errorf("failed to read account usage: %w", err)
+	}
 
-		input, err := os.ReadFile(srcPath)
+	summary := &tasks.CopySummary{ResumedFrom: cp.key}
+	var mu sync.Mutex
+	onFile := func(f db.File, n int64, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		done++
 		if err != nil {
-			log.WithError(err).WithField("file", f.FileName).Error("Failed to read source file")
-			return fmt.Errorf("failed to read source file %s: %w", f.FileName, err)
-		}
-		if err := os.WriteFile(destPath, input, 0644); err != nil {
-			log.WithError(err).WithField("file", f.FileName).Error("Failed to write destination file")
-			return fmt.Errorf("failed to write destination file %s: %w", f.FileName, err)
+			summary.Failed++
+			summary.Errors = appendCapped(summary.Errors, fmt.Sprintf("%s: %v", f.FileName, err))
+			log.WithError(err).WithField("file", f.FileName).Warn("Failed to copy file")
+		} else {
+			summary.Copied++
+			summary.BytesCopied += n
 		}
-		log.WithField("file", f.FileName).Info("Copied file to destination bucket")
-
-		newFile := db.File{
-			ID:          uuid.NewString(),
-			FileName:    f.FileName,
-			BucketID:    destBucket.ID,
-			Size:        f.Size,
-			ContentType: f.ContentType,
-			VersionID:   f.VersionID,
-			IsLatest:    f.IsLatest,
+		progress := run.progress(int(done), int(total), f.FileName)
+		log.WithFields(log.Fields{
+			"progress": progress,
+			"file":     f.FileName,
+		}).Debug("Updated copy progress")
+	}
+
+	for {
+		var batch []db.File
+		if err := afterCheckpoint(sourceFiles(), cp, true).
+			Order("file_name, id").
+			Limit(copyBatchSize).
+			Find(&batch).Error; err != nil {
+			log.WithError(err).Error("Failed to fetch files from source bucket")
+			return fmt.Errorf("failed to fetch files from source bucket: %w", err)
 		}
-		if err := w.DB.Create(&newFile).Error; err != nil {
-			log.WithError(err).WithField("file", f.FileName).Error("Failed to create DB record for copied file")
-			return fmt.Errorf("failed to create file record in DB: %w", err)
+		if len(batch) == 0 {
+			break
 		}
 
-		// Update task progress
-		progress := int(float64(i+1) / float64(total) * 100)
-		w.DB.Model(&db.Task{}).
-			Where("bucket_src = ? AND bucket_dest = ? AND user_id = ?", payload.BucketSrc, payload.BucketDest, payload.UserID).
-			Update("progress", progress)
+		w.copyBatch(ctx, &srcBucket, &destBucket, batch, parallelism, tracker, onFile)
+		if err := ctx.Err(); err != nil {
+			log.WithError(err).WithField("bucket_src", srcBucket.BucketName).Warn("Copy bucket task interrupted")
+			return fmt.Errorf("copy bucket task interrupted: %w", err)
+		}
 
-		log.WithFields(log.Fields{
-			"progress": progress,
-			"file":     f.FileName,
-		}).Info("Updated copy progress")
+		// The whole batch is finished, so a retry can start after it.
+		last := batch[len(batch)-1]
+		cp = copyCheckpoint{key: last.FileName, fileID: last.ID}
+		w.saveCheckpoint(taskID, cp)
 	}
 
-	// Mark task completed
-	w.DB.Model(&db.Task{}).
-		Where("bucket_src = ? AND bucket_dest = ? AND user_id = ?", payload.BucketSrc, payload.BucketDest, payload.UserID).
-		Updates(map[string]interface{}{"status": "completed", "progress": 100})
+	run.complete(copyMessage(summary), summary)
 
 	log.WithFields(log.Fields{
 		"bucket_src":  payload.BucketSrc,
 		"bucket_dest": payload.BucketDest,
 		"user_id":     payload.UserID,
-	}).Info("Copy bucket task completed successfully")
+		"copied":      summary.Copied,
+		"failed":      summary.Failed,
+	}).Info("Copy bucket task completed")
 
 	return nil
 }
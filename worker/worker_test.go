@@ -3,11 +3,25 @@ package worker
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/SysTechSalihY/mini-s3-clone/db"
+	"github.com/SysTechSalihY/mini-s3-clone/handlers"
+	"github.com/SysTechSalihY/mini-s3-clone/mail"
+	"github.com/SysTechSalihY/mini-s3-clone/middleware"
+	"github.com/SysTechSalihY/mini-s3-clone/notify"
+	"github.com/SysTechSalihY/mini-s3-clone/tasks"
+	"github.com/gofiber/fiber/v2"
 	"github.com/hibiken/asynq"
 	"github.com/stretchr/testify/require"
 	"gorm.io/driver/sqlite"
@@ -17,7 +31,12 @@ import (
 func setupTestDB(t *testing.T) *gorm.DB {
 	dbConn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
 	require.NoError(t, err)
-	err = dbConn.AutoMigrate(&db.User{}, &db.Bucket{}, &db.File{}, &db.Task{})
+	// every new connection would open its own empty in-memory database, and
+	// parallel copies would otherwise open more than one
+	sqlDB, err := dbConn.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+	err = dbConn.AutoMigrate(&db.User{}, &db.EmailVerification{}, &db.PasswordResetToken{}, &db.Session{}, &db.MFARecoveryCode{}, &db.Bucket{}, &db.File{}, &db.Task{}, &db.BucketNotification{}, &db.NotificationDeadLetter{}, &db.ReplicationRule{})
 	require.NoError(t, err)
 	return dbConn
 }
@@ -58,7 +77,7 @@ func TestHandleEmptyBucketTask(t *testing.T) {
 	}
 
 	worker := &Worker{DB: DB}
-	payload := map[string]string{"UserID": user.ID, "BucketName": bucket.BucketName}
+	payload := map[string]string{"TaskID": task.ID, "UserID": user.ID, "BucketName": bucket.BucketName}
 	data, _ := json.Marshal(payload)
 	asynqTask := asynq.NewTask("empty_bucket", data)
 
@@ -114,6 +133,7 @@ func TestHandleCopyBucketTask(t *testing.T) {
 
 	worker := &Worker{DB: DB}
 	payload := map[string]string{
+		"task_id":     task.ID,
 		"user_id":     user.ID,
 		"bucket_src":  src.BucketName,
 		"bucket_dest": destBucketName,
@@ -134,5 +154,709 @@ func TestHandleCopyBucketTask(t *testing.T) {
 	require.Len(t, copiedFiles, 1)
 	require.Equal(t, "file1.txt", copiedFiles[0].FileName)
 
+	// Check the task record was updated by ID
+	var updatedTask db.Task
+	require.NoError(t, DB.First(&updatedTask, "id = ?", task.ID).Error)
+	require.Equal(t, "completed", updatedTask.Status)
+	require.NotNil(t, updatedTask.StartedAt)
+	require.NotNil(t, updatedTask.FinishedAt)
+
 	os.RemoveAll("./storage")
 }
+
+func TestEstimateETA(t *testing.T) {
+	require.Equal(t, time.Duration(0), estimateETA(time.Second, 0, 10))
+	require.Equal(t, time.Duration(0), estimateETA(time.Second, 10, 10))
+	require.Equal(t, 3*time.Second, estimateETA(time.Second, 1, 4))
+	require.Equal(t, 10*time.Second, estimateETA(10*time.Second, 5, 10))
+}
+
+func TestPlanSync(t *testing.T) {
+	src := []db.File{
+		{FileName: "same.txt", Size: 4, Checksum: "aaa"},
+		{FileName: "changed.txt", Size: 4, Checksum: "bbb"},
+		{FileName: "resized.txt", Size: 8, Checksum: "ccc"},
+		{FileName: "new.txt", Size: 2, Checksum: "ddd"},
+	}
+	dest := []db.File{
+		{FileName: "same.txt", Size: 4, Checksum: "aaa"},
+		{FileName: "changed.txt", Size: 4, Checksum: "zzz"},
+		{FileName: "resized.txt", Size: 4, Checksum: "ccc"},
+		{FileName: "extra.txt", Size: 1, Checksum: "eee"},
+	}
+
+	plan := planSync(src, dest, false)
+	require.Equal(t, 1, plan.unchanged)
+	require.Len(t, plan.create, 1)
+	require.Equal(t, "new.txt", plan.create[0].FileName)
+	require.Len(t, plan.update, 2)
+	require.Equal(t, "changed.txt", plan.update[0].src.FileName)
+	require.Equal(t, "resized.txt", plan.update[1].src.FileName)
+	require.Empty(t, plan.remove)
+
+	plan = planSync(src, dest, true)
+	require.Len(t, plan.remove, 1)
+	require.Equal(t, "extra.txt", plan.remove[0].FileName)
+
+	summary := plan.summary(true)
+	require.True(t, summary.DryRun)
+	require.Equal(t, 1, summary.Created)
+	require.Equal(t, 2, summary.Updated)
+	require.Equal(t, 1, summary.Deleted)
+	require.Equal(t, int64(14), summary.BytesCopied)
+}
+
+func TestHandleSyncBucketTask(t *testing.T) {
+	DB := setupTestDB(t)
+
+	user := db.User{ID: "user-1", Email: "user@example.com"}
+	require.NoError(t, DB.Create(&user).Error)
+
+	src := db.Bucket{ID: "src-1", BucketName: "srcbucket", UserID: user.ID}
+	dest := db.Bucket{ID: "dest-1", BucketName: "destbucket", UserID: user.ID}
+	require.NoError(t, DB.Create(&src).Error)
+	require.NoError(t, DB.Create(&dest).Error)
+
+	srcFiles := []db.File{
+		{ID: "src-file-1", FileName: "keep.txt", BucketID: src.ID, Size: 4, IsLatest: true},
+		{ID: "src-file-2", FileName: "new.txt", BucketID: src.ID, Size: 4, IsLatest: true},
+	}
+	destFiles := []db.File{
+		{ID: "dest-file-1", FileName: "keep.txt", BucketID: dest.ID, Size: 4, IsLatest: true},
+		{ID: "dest-file-2", FileName: "stale.txt", BucketID: dest.ID, Size: 4, IsLatest: true},
+	}
+	for _, f := range append(srcFiles, destFiles...) {
+		require.NoError(t, DB.Create(&f).Error)
+	}
+
+	srcDir := filepath.Join(".", "storage", src.BucketName)
+	destDir := filepath.Join(".", "storage", dest.BucketName)
+	require.NoError(t, os.MkdirAll(srcDir, 0755))
+	require.NoError(t, os.MkdirAll(destDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "keep.txt"), []byte("data"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "new.txt"), []byte("newd"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(destDir, "keep.txt"), []byte("data"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(destDir, "stale.txt"), []byte("gone"), 0644))
+	defer os.RemoveAll("./storage")
+
+	task := db.Task{ID: "task-sync-1", UserID: user.ID, Type: "sync", Status: "queued"}
+	require.NoError(t, DB.Create(&task).Error)
+
+	worker := &Worker{DB: DB}
+	data, _ := json.Marshal(map[string]interface{}{
+		"task_id":           task.ID,
+		"user_id":           user.ID,
+		"bucket_src":        src.BucketName,
+		"bucket_dest":       dest.BucketName,
+		"delete_extraneous": true,
+	})
+	require.NoError(t, worker.HandleSyncBucketTask(context.Background(), asynq.NewTask("sync_bucket", data)))
+
+	var names []string
+	require.NoError(t, DB.Model(&db.File{}).Where("bucket_id = ?", dest.ID).Order("file_name").Pluck("file_name", &names).Error)
+	require.Equal(t, []string{"keep.txt", "new.txt"}, names)
+	_, err := os.Stat(filepath.Join(destDir, "stale.txt"))
+	require.True(t, os.IsNotExist(err))
+
+	var updatedTask db.Task
+	require.NoError(t, DB.First(&updatedTask, "id = ?", task.ID).Error)
+	require.Equal(t, "completed", updatedTask.Status)
+	require.NotNil(t, updatedTask.Result)
+	require.Contains(t, *updatedTask.Result, `"created":1`)
+	require.Contains(t, *updatedTask.Result, `"unchanged":1`)
+
+	// A second run finds nothing to do.
+	require.NoError(t, worker.HandleSyncBucketTask(context.Background(), asynq.NewTask("sync_bucket", data)))
+	require.NoError(t, DB.First(&updatedTask, "id = ?", task.ID).Error)
+	require.Contains(t, *updatedTask.Result, `"created":0`)
+	require.Contains(t, *updatedTask.Result, `"unchanged":2`)
+}
+
+func TestHandleSyncBucketTaskQuota(t *testing.T) {
+	DB := setupTestDB(t)
+
+	maxObjects := int64(2)
+	user := db.User{ID: "user-1", Email: "user@example.com", MaxObjects: &maxObjects}
+	require.NoError(t, DB.Create(&user).Error)
+
+	src := db.Bucket{ID: "src-1", BucketName: "srcbucket", UserID: user.ID}
+	dest := db.Bucket{ID: "dest-1", BucketName: "destbucket", UserID: user.ID}
+	require.NoError(t, DB.Create(&src).Error)
+	require.NoError(t, DB.Create(&dest).Error)
+
+	srcDir := filepath.Join(".", "storage", src.BucketName)
+	require.NoError(t, os.MkdirAll(srcDir, 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(".", "storage", dest.BucketName), 0755))
+	defer os.RemoveAll("./storage")
+	for _, name := range []string{"a.txt", "b.txt"} {
+		require.NoError(t, DB.Create(&db.File{ID: "src-" + name, FileName: name, BucketID: src.ID, Size: 4, IsLatest: true}).Error)
+		require.NoError(t, os.WriteFile(filepath.Join(srcDir, name), []byte("data"), 0644))
+	}
+
+	task := db.Task{ID: "task-sync-1", UserID: user.ID, Type: "sync", Status: "queued"}
+	require.NoError(t, DB.Create(&task).Error)
+
+	worker := &Worker{DB: DB}
+	data, _ := json.Marshal(map[string]interface{}{
+		"task_id":     task.ID,
+		"user_id":     user.ID,
+		"bucket_src":  src.BucketName,
+		"bucket_dest": dest.BucketName,
+	})
+	require.NoError(t, worker.HandleSyncBucketTask(context.Background(), asynq.NewTask("sync_bucket", data)))
+
+	// the two source objects already fill the account, so nothing is copied
+	var copied int64
+	require.NoError(t, DB.Model(&db.File{}).Where("bucket_id = ?", dest.ID).Count(&copied).Error)
+	require.Zero(t, copied)
+	var updatedTask db.Task
+	require.NoError(t, DB.First(&updatedTask, "id = ?", task.ID).Error)
+	require.NotNil(t, updatedTask.Result)
+	require.Contains(t, *updatedTask.Result, `"failed":2`)
+}
+
+func TestHandleCopyBucketTaskVersionedResume(t *testing.T) {
+	DB := setupTestDB(t)
+
+	user := db.User{ID: "user-1", Email: "user@example.com"}
+	require.NoError(t, DB.Create(&user).Error)
+
+	src := db.Bucket{ID: "src-1", BucketName: "srcbucket", UserID: user.ID, Versioning: true}
+	require.NoError(t, DB.Create(&src).Error)
+
+	files := []db.File{
+		{ID: "file-a1", FileName: "a.txt", BucketID: src.ID, VersionID: "v1", Size: 2},
+		{ID: "file-a2", FileName: "a.txt", BucketID: src.ID, VersionID: "v2", Size: 2},
+		{ID: "file-b1", FileName: "b.txt", BucketID: src.ID, VersionID: "v3", Size: 2},
+	}
+	srcDir := filepath.Join(".", "storage", src.BucketName)
+	require.NoError(t, os.MkdirAll(srcDir, 0755))
+	defer os.RemoveAll("./storage")
+	for _, f := range files {
+		require.NoError(t, DB.Create(&f).Error)
+		blob := filepath.Join(srcDir, f.VersionID+"_"+f.FileName)
+		require.NoError(t, os.WriteFile(blob, []byte(f.VersionID), 0644))
+	}
+
+	// A previous attempt already copied everything up to a.txt/file-a1.
+	destBucketName := "destbucket"
+	task := db.Task{
+		ID:               "task-copy-1",
+		UserID:           user.ID,
+		Type:             "copy",
+		BucketSrc:        &src.BucketName,
+		BucketDest:       &destBucketName,
+		Status:           "retrying",
+		CheckpointKey:    "a.txt",
+		CheckpointFileID: "file-a1",
+	}
+	require.NoError(t, DB.Create(&task).Error)
+
+	worker := &Worker{DB: DB}
+	data, _ := json.Marshal(map[string]interface{}{
+		"task_id":     task.ID,
+		"user_id":     user.ID,
+		"bucket_src":  src.BucketName,
+		"bucket_dest": destBucketName,
+		"parallelism": 2,
+	})
+	require.NoError(t, worker.HandleCopyBucketTask(context.Background(), asynq.NewTask("copy_bucket", data)))
+
+	var destBucket db.Bucket
+	require.NoError(t, DB.Where("bucket_name = ?", destBucketName).First(&destBucket).Error)
+	require.True(t, destBucket.Versioning)
+
+	var versions []string
+	require.NoError(t, DB.Model(&db.File{}).Where("bucket_id = ?", destBucket.ID).Order("version_id").Pluck("version_id", &versions).Error)
+	require.Equal(t, []string{"v2", "v3"}, versions)
+
+	destDir := filepath.Join(".", "storage", destBucketName)
+	content, err := os.ReadFile(filepath.Join(destDir, "v2_a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(content))
+
+	var updatedTask db.Task
+	require.NoError(t, DB.First(&updatedTask, "id = ?", task.ID).Error)
+	require.Equal(t, "completed", updatedTask.Status)
+	require.Equal(t, "b.txt", updatedTask.CheckpointKey)
+	require.Contains(t, *updatedTask.Result, `"copied":2`)
+
+	// Running it again from the start must not duplicate rows.
+	require.NoError(t, DB.Model(&updatedTask).Updates(map[string]interface{}{"checkpoint_key": "", "checkpoint_file_id": ""}).Error)
+	require.NoError(t, worker.HandleCopyBucketTask(context.Background(), asynq.NewTask("copy_bucket", data)))
+	var count int64
+	DB.Model(&db.File{}).Where("bucket_id = ?", destBucket.ID).Count(&count)
+	require.Equal(t, int64(3), count)
+}
+
+func TestHandleDeliverWebhookTask(t *testing.T) {
+	DB := setupTestDB(t)
+	// the receiver runs on loopback
+	notify.AllowPrivateAddresses = true
+	t.Cleanup(func() { notify.AllowPrivateAddresses = false })
+
+	var gotSignature, gotTimestamp string
+	var gotBody []byte
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSignature = r.Header.Get(notify.SignatureHeader)
+		gotTimestamp = r.Header.Get(notify.TimestampHeader)
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	cfg := db.BucketNotification{
+		ID:       "notif-1",
+		BucketID: "bucket-1",
+		URL:      server.URL,
+		Events:   "s3:ObjectCreated:*",
+		Secret:   "s3cr3t",
+	}
+	require.NoError(t, DB.Create(&cfg).Error)
+
+	worker := &Worker{DB: DB}
+	body := []byte(`{"Records":[{"eventName":"ObjectCreated:Put"}]}`)
+	task, err := tasks.NewDeliverWebhookTask(cfg.ID, notify.ObjectCreatedPut, body)
+	require.NoError(t, err)
+
+	require.NoError(t, worker.HandleDeliverWebhookTask(context.Background(), task))
+	require.JSONEq(t, string(body), string(gotBody))
+	ts, err := strconv.ParseInt(gotTimestamp, 10, 64)
+	require.NoError(t, err)
+	require.Equal(t, notify.Sign(cfg.Secret, ts, gotBody), gotSignature)
+
+	// A rejected delivery is not retried and ends up as a dead letter.
+	status = http.StatusNotFound
+	err = worker.HandleDeliverWebhookTask(context.Background(), task)
+	require.ErrorIs(t, err, asynq.SkipRetry)
+	worker.HandleTaskError(context.Background(), task, err)
+
+	var deadLetters []db.NotificationDeadLetter
+	require.NoError(t, DB.Find(&deadLetters).Error)
+	require.Len(t, deadLetters, 1)
+	require.Equal(t, cfg.ID, deadLetters[0].NotificationID)
+	require.Equal(t, cfg.BucketID, deadLetters[0].BucketID)
+	require.JSONEq(t, string(body), deadLetters[0].Payload)
+	require.Contains(t, deadLetters[0].LastError, "status 404")
+}
+
+func TestHandleTaskErrorRetryingThenFailed(t *testing.T) {
+	DB := setupTestDB(t)
+	worker := &Worker{DB: DB}
+	ctx := context.Background()
+
+	copyTask, err := tasks.NewCopyBucketTask(ctx, "task-copy", "user-1", "src", "dest", 0)
+	require.NoError(t, err)
+	syncTask, err := tasks.NewSyncBucketTask(ctx, "task-sync", "user-1", "src", "dest", tasks.SyncOptions{})
+	require.NoError(t, err)
+	emptyTask, err := tasks.NewEmptyBucketTask(ctx, "task-empty", "user-1", "src", false)
+	require.NoError(t, err)
+
+	for id, task := range map[string]*asynq.Task{"task-copy": copyTask, "task-sync": syncTask, "task-empty": emptyTask} {
+		require.NoError(t, DB.Create(&db.Task{ID: id, UserID: "user-1", Type: task.Type(), Status: "running"}).Error)
+		load := func() db.Task {
+			var record db.Task
+			require.NoError(t, DB.First(&record, "id = ?", id).Error)
+			return record
+		}
+
+		worker.recordTaskError(ctx, task, errors.New("disk full"), 1, 3)
+		record := load()
+		require.Equal(t, "retrying", record.Status, task.Type())
+		require.Equal(t, 1, record.RetryCount)
+		require.Equal(t, "disk full", record.Message)
+		require.Nil(t, record.FinishedAt)
+
+		worker.recordTaskError(ctx, task, errors.New("still full"), 3, 3)
+		record = load()
+		require.Equal(t, "failed", record.Status, task.Type())
+		require.Equal(t, 3, record.RetryCount)
+		require.NotNil(t, record.FinishedAt)
+
+		// a permanent error fails the task without using up the retries
+		require.NoError(t, DB.Model(&db.Task{}).Where("id = ?", id).Updates(map[string]interface{}{"status": "running", "finished_at": nil}).Error)
+		worker.recordTaskError(ctx, task, fmt.Errorf("bad payload: %w", asynq.SkipRetry), 0, 3)
+		require.Equal(t, "failed", load().Status, task.Type())
+	}
+}
+
+// startRemote runs a second server instance, with its own database, that
+// replication can target as a remote endpoint.
+func startRemote(t *testing.T) (*gorm.DB, string) {
+	remoteDB := setupTestDB(t)
+	app := fiber.New()
+	app.Use(middleware.AuthMiddleware(remoteDB, nil))
+	app.Head("/api/buckets/:bucketName/files/:fileName", handlers.HeadFile(remoteDB))
+	app.Post("/api/buckets/:bucketName/files/:fileName", handlers.UploadFile(remoteDB, nil))
+	app.Delete("/api/buckets/:bucketName/files/:fileName", handlers.DeleteFile(remoteDB, nil))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+	return remoteDB, "http://" + ln.Addr().String()
+}
+
+func TestHandleReplicateObjectTask(t *testing.T) {
+	DB := setupTestDB(t)
+	// the remote runs on loopback
+	notify.AllowPrivateAddresses = true
+	t.Cleanup(func() { notify.AllowPrivateAddresses = false })
+	remoteDB, endpoint := startRemote(t)
+	defer os.RemoveAll("./storage")
+
+	user := db.User{ID: "user-1", Email: "user@example.com", AccessKey: "local-ak"}
+	require.NoError(t, DB.Create(&user).Error)
+	src := db.Bucket{ID: "src-1", BucketName: "replsrc", UserID: user.ID}
+	dest := db.Bucket{ID: "dest-1", BucketName: "repldest", UserID: user.ID}
+	require.NoError(t, DB.Create(&src).Error)
+	require.NoError(t, DB.Create(&dest).Error)
+
+	remoteUser := db.User{ID: "remote-user", Email: "remote@example.com", AccessKey: "remote-ak", SecretKey: "remote-sk"}
+	require.NoError(t, remoteDB.Create(&remoteUser).Error)
+	acl := "private"
+	remoteBucket := db.Bucket{ID: "remote-bucket", BucketName: "replremote", UserID: remoteUser.ID, ACL: &acl}
+	require.NoError(t, remoteDB.Create(&remoteBucket).Error)
+
+	rules := []db.ReplicationRule{
+		{ID: "rule-local", BucketID: src.ID, DestBucket: dest.BucketName, ReplicateDeletes: true},
+		{ID: "rule-remote", BucketID: src.ID, DestBucket: remoteBucket.BucketName, Endpoint: endpoint,
+			AccessKey: remoteUser.AccessKey, SecretKey: remoteUser.SecretKey, ReplicateDeletes: true},
+	}
+	require.NoError(t, DB.Create(&rules).Error)
+
+	blob := filepath.Join(".", "storage", src.BucketName, "a.txt")
+	require.NoError(t, os.MkdirAll(filepath.Dir(blob), 0755))
+	require.NoError(t, os.WriteFile(blob, []byte("hello"), 0644))
+	file := db.File{
+		ID:                "file-1",
+		BucketID:          src.ID,
+		FileName:          "a.txt",
+		Size:              5,
+		ContentType:       "text/plain",
+		Checksum:          "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		IsLatest:          true,
+		ReplicationStatus: db.ReplicationPending,
+	}
+	require.NoError(t, DB.Create(&file).Error)
+
+	worker := &Worker{DB: DB}
+	put, err := tasks.NewReplicateObjectTask(tasks.ReplicationPayload{
+		Op: tasks.ReplicationOpPut, BucketID: src.ID, FileID: file.ID, Key: file.FileName,
+		RuleIDs: []string{"rule-local", "rule-remote"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, worker.HandleReplicateObjectTask(context.Background(), put))
+
+	var replica db.File
+	require.NoError(t, DB.Where("bucket_id = ? AND file_name = ?", dest.ID, "a.txt").First(&replica).Error)
+	require.Equal(t, db.ReplicationReplica, replica.ReplicationStatus)
+	content, err := os.ReadFile(filepath.Join(".", "storage", dest.BucketName, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(content))
+
+	var remoteFile db.File
+	require.NoError(t, remoteDB.Where("bucket_id = ? AND file_name = ?", remoteBucket.ID, "a.txt").First(&remoteFile).Error)
+	require.Equal(t, file.Checksum, remoteFile.Checksum)
+	require.Equal(t, "text/plain", remoteFile.ContentType)
+
+	var updated db.File
+	require.NoError(t, DB.First(&updated, "id = ?", file.ID).Error)
+	require.Equal(t, db.ReplicationCompleted, updated.ReplicationStatus)
+
+	// A retry after partial success must not fail on objects already there.
+	require.NoError(t, worker.HandleReplicateObjectTask(context.Background(), put))
+	var count int64
+	remoteDB.Model(&db.File{}).Where("bucket_id = ?", remoteBucket.ID).Count(&count)
+	require.Equal(t, int64(1), count)
+
+	del, err := tasks.NewReplicateObjectTask(tasks.ReplicationPayload{
+		Op: tasks.ReplicationOpDelete, BucketID: src.ID, FileID: file.ID, Key: file.FileName,
+		RuleIDs: []string{"rule-local", "rule-remote"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, worker.HandleReplicateObjectTask(context.Background(), del))
+
+	DB.Model(&db.File{}).Where("bucket_id = ?", dest.ID).Count(&count)
+	require.Equal(t, int64(0), count)
+	remoteDB.Model(&db.File{}).Where("bucket_id = ?", remoteBucket.ID).Count(&count)
+	require.Equal(t, int64(0), count)
+}
+
+func TestHandleReplicateObjectTaskReplacedRules(t *testing.T) {
+	DB := setupTestDB(t)
+	defer os.RemoveAll("./storage")
+
+	user := db.User{ID: "user-1", Email: "user@example.com"}
+	require.NoError(t, DB.Create(&user).Error)
+	src := db.Bucket{ID: "src-1", BucketName: "replsrc", UserID: user.ID}
+	dest := db.Bucket{ID: "dest-1", BucketName: "repldest", UserID: user.ID}
+	require.NoError(t, DB.Create(&src).Error)
+	require.NoError(t, DB.Create(&dest).Error)
+
+	blob := filepath.Join(".", "storage", src.BucketName, "a.txt")
+	require.NoError(t, os.MkdirAll(filepath.Dir(blob), 0755))
+	require.NoError(t, os.WriteFile(blob, []byte("hello"), 0644))
+	file := db.File{ID: "file-1", BucketID: src.ID, FileName: "a.txt", Size: 5, IsLatest: true, ReplicationStatus: db.ReplicationPending}
+	require.NoError(t, DB.Create(&file).Error)
+
+	worker := &Worker{DB: DB}
+	put, err := tasks.NewReplicateObjectTask(tasks.ReplicationPayload{
+		Op: tasks.ReplicationOpPut, BucketID: src.ID, FileID: file.ID, Key: file.FileName,
+		RuleIDs: []string{"rule-gone"},
+	})
+	require.NoError(t, err)
+
+	// with replication turned off the object was never copied
+	require.NoError(t, worker.HandleReplicateObjectTask(context.Background(), put))
+	var updated db.File
+	require.NoError(t, DB.First(&updated, "id = ?", file.ID).Error)
+	require.Equal(t, db.ReplicationFailed, updated.ReplicationStatus)
+
+	// rules replaced since the write are resolved again
+	require.NoError(t, DB.Create(&db.ReplicationRule{ID: "rule-new", BucketID: src.ID, DestBucket: dest.BucketName}).Error)
+	require.NoError(t, worker.HandleReplicateObjectTask(context.Background(), put))
+	require.NoError(t, DB.First(&updated, "id = ?", file.ID).Error)
+	require.Equal(t, db.ReplicationCompleted, updated.ReplicationStatus)
+	var count int64
+	DB.Model(&db.File{}).Where("bucket_id = ?", dest.ID).Count(&count)
+	require.Equal(t, int64(1), count)
+}
+
+func TestHandleReplicateObjectTaskQuota(t *testing.T) {
+	DB := setupTestDB(t)
+	defer os.RemoveAll("./storage")
+
+	maxObjects := int64(1)
+	user := db.User{ID: "user-1", Email: "user@example.com", MaxObjects: &maxObjects}
+	require.NoError(t, DB.Create(&user).Error)
+	src := db.Bucket{ID: "src-1", BucketName: "replsrc", UserID: user.ID}
+	dest := db.Bucket{ID: "dest-1", BucketName: "repldest", UserID: user.ID}
+	require.NoError(t, DB.Create(&src).Error)
+	require.NoError(t, DB.Create(&dest).Error)
+	require.NoError(t, DB.Create(&db.ReplicationRule{ID: "rule-local", BucketID: src.ID, DestBucket: dest.BucketName}).Error)
+
+	blob := filepath.Join(".", "storage", src.BucketName, "a.txt")
+	require.NoError(t, os.MkdirAll(filepath.Dir(blob), 0755))
+	require.NoError(t, os.WriteFile(blob, []byte("hello"), 0644))
+	file := db.File{ID: "file-1", BucketID: src.ID, FileName: "a.txt", Size: 5, IsLatest: true, ReplicationStatus: db.ReplicationPending}
+	require.NoError(t, DB.Create(&file).Error)
+
+	worker := &Worker{DB: DB}
+	put, err := tasks.NewReplicateObjectTask(tasks.ReplicationPayload{
+		Op: tasks.ReplicationOpPut, BucketID: src.ID, FileID: file.ID, Key: file.FileName,
+		RuleIDs: []string{"rule-local"},
+	})
+	require.NoError(t, err)
+
+	// the source object already fills the account
+	err = worker.HandleReplicateObjectTask(context.Background(), put)
+	require.ErrorContains(t, err, "quota exceeded")
+	require.ErrorIs(t, err, asynq.SkipRetry)
+	var count int64
+	DB.Model(&db.File{}).Where("bucket_id = ?", dest.ID).Count(&count)
+	require.Zero(t, count)
+}
+
+func TestHandleEmptyBucketTaskObjectLock(t *testing.T) {
+	DB := setupTestDB(t)
+
+	user := db.User{ID: "user-1", Email: "user@example.com"}
+	require.NoError(t, DB.Create(&user).Error)
+	bucket := db.Bucket{ID: "bucket-1", BucketName: "lockedbucket", UserID: user.ID, Versioning: true, ObjectLockEnabled: true}
+	require.NoError(t, DB.Create(&bucket).Error)
+
+	until := time.Now().Add(time.Hour)
+	files := []db.File{
+		{ID: "file-1", FileName: "free.txt", BucketID: bucket.ID, VersionID: "v1"},
+		{ID: "file-2", FileName: "governed.txt", BucketID: bucket.ID, VersionID: "v2", RetentionMode: "GOVERNANCE", RetainUntil: &until},
+		{ID: "file-3", FileName: "complied.txt", BucketID: bucket.ID, VersionID: "v3", RetentionMode: "COMPLIANCE", RetainUntil: &until},
+	}
+	dir := filepath.Join(".", "storage", bucket.BucketName)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll("./storage")
+	for _, f := range files {
+		require.NoError(t, DB.Create(&f).Error)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, f.VersionID+"_"+f.FileName), []byte("data"), 0644))
+	}
+
+	run := func(taskID string, bypass bool) tasks.EmptySummary {
+		task := db.Task{ID: taskID, UserID: user.ID, Type: "empty", BucketSrc: &bucket.BucketName, Status: "queued"}
+		require.NoError(t, DB.Create(&task).Error)
+		asynqTask, err := tasks.NewEmptyBucketTask(context.Background(), taskID, user.ID, bucket.BucketName, bypass)
+		require.NoError(t, err)
+		require.NoError(t, (&Worker{DB: DB}).HandleEmptyBucketTask(context.Background(), asynqTask))
+
+		require.NoError(t, DB.First(&task, "id = ?", taskID).Error)
+		require.Equal(t, "completed", task.Status)
+		var summary tasks.EmptySummary
+		require.NoError(t, json.Unmarshal([]byte(*task.Result), &summary))
+		return summary
+	}
+
+	summary := run("task-1", false)
+	require.Equal(t, 1, summary.Deleted)
+	require.Equal(t, 2, summary.Retained)
+	_, err := os.Stat(filepath.Join(dir, "v1_free.txt"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "v2_governed.txt"))
+	require.NoError(t, err)
+
+	// the governance bypass releases governed versions but not compliance ones
+	summary = run("task-2", true)
+	require.Equal(t, 1, summary.Deleted)
+	require.Equal(t, []string{"complied.txt"}, summary.RetainedKeys)
+}
+
+func TestHandleDeliverAccessLogsTask(t *testing.T) {
+	DB := setupTestDB(t)
+	require.NoError(t, DB.Create(&db.User{ID: "user-1", Email: "user@example.com"}).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-1", BucketName: "photos", UserID: "user-1"}).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-2", BucketName: "logs", UserID: "user-1"}).Error)
+	require.NoError(t, DB.Create(&db.Bucket{ID: "bucket-3", BucketName: "others", UserID: "user-2"}).Error)
+	defer os.RemoveAll("./storage")
+
+	w := &Worker{DB: DB}
+	deliver := func(target, key string) error {
+		task, err := tasks.NewDeliverAccessLogsTask(tasks.AccessLogPayload{
+			BucketID:     "bucket-1",
+			TargetBucket: target,
+			Key:          key,
+			Lines:        []string{"line one", "line two"},
+		})
+		require.NoError(t, err)
+		return w.HandleDeliverAccessLogsTask(context.Background(), task)
+	}
+
+	require.NoError(t, deliver("logs", "photos/2026-10-18-12-00-00-ABCDEF"))
+	data, err := os.ReadFile(filepath.Join(".", "storage", "logs", "photos", "2026-10-18-12-00-00-ABCDEF"))
+	require.NoError(t, err)
+	require.Equal(t, "line one\nline two\n", string(data))
+
+	// a retry of the same delivery writes nothing new
+	require.NoError(t, deliver("logs", "photos/2026-10-18-12-00-00-ABCDEF"))
+	var files []db.File
+	require.NoError(t, DB.Where("bucket_id = ?", "bucket-2").Find(&files).Error)
+	require.Len(t, files, 1)
+	require.Equal(t, int64(len(data)), files[0].Size)
+
+	// targets that are gone or owned by someone else are dropped
+	require.ErrorIs(t, deliver("missing", "k"), asynq.SkipRetry)
+	require.ErrorIs(t, deliver("others", "k"), asynq.SkipRetry)
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(context.Context, mail.Message) error {
+	return errors.New("connection refused")
+}
+
+func TestHandleSendEmailTask(t *testing.T) {
+	outbox := &mail.Memory{}
+	w := &Worker{Mailer: outbox}
+	task, err := tasks.NewSendEmailTask(context.Background(), tasks.SendEmailPayload{
+		To:      "user@example.com",
+		Subject: "Verify your email",
+		HTML:    "<p>hi</p>",
+		Text:    "hi",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, w.HandleSendEmailTask(context.Background(), task))
+	require.Equal(t, []mail.Message{{To: "user@example.com", Subject: "Verify your email", HTML: "<p>hi</p>", Text: "hi"}}, outbox.Sent())
+
+	// transient failures are retried, bad payloads are not
+	w.Mailer = failingMailer{}
+	err = w.HandleSendEmailTask(context.Background(), task)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, asynq.SkipRetry)
+	err = w.HandleSendEmailTask(context.Background(), asynq.NewTask(tasks.TaskTypeSendEmail, []byte("{")))
+	require.ErrorIs(t, err, asynq.SkipRetry)
+}
+
+func TestHandleDeleteAccountTask(t *testing.T) {
+	DB := setupTestDB(t)
+
+	requested := time.Now()
+	user := db.User{ID: "user-1", Email: "gone@example.com", Disabled: true, DeletionRequestedAt: &requested}
+	require.NoError(t, DB.Create(&user).Error)
+	require.NoError(t, DB.Create(&db.PasswordResetToken{ID: "reset-1", UserID: user.ID, TokenHash: "hash", ExpiresAt: requested}).Error)
+	buckets := []db.Bucket{
+		{ID: "bucket-1", BucketName: "plainbucket", UserID: user.ID},
+		{ID: "bucket-2", BucketName: "heldbucket", UserID: user.ID, Versioning: true, ObjectLockEnabled: true},
+	}
+	files := []db.File{
+		{ID: "file-1", FileName: "a.txt", BucketID: "bucket-1"},
+		{ID: "file-2", FileName: "free.txt", BucketID: "bucket-2", VersionID: "v1"},
+		{ID: "file-3", FileName: "held.txt", BucketID: "bucket-2", VersionID: "v2", LegalHold: true},
+	}
+	defer os.RemoveAll("./storage")
+	for _, b := range buckets {
+		require.NoError(t, DB.Create(&b).Error)
+		require.NoError(t, os.MkdirAll(filepath.Join(".", "storage", b.BucketName), 0755))
+	}
+	require.NoError(t, DB.Create(&db.ReplicationRule{ID: "rule-1", BucketID: "bucket-1", DestBucket: "copy", Endpoint: "http://remote"}).Error)
+	for _, f := range files {
+		require.NoError(t, DB.Create(&f).Error)
+		path := filepath.Join(".", "storage", "plainbucket", f.FileName)
+		if f.VersionID != "" {
+			path = filepath.Join(".", "storage", "heldbucket", f.VersionID+"_"+f.FileName)
+		}
+		require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+	}
+
+	task, err := tasks.NewDeleteAccountTask(context.Background(), user.ID)
+	require.NoError(t, err)
+	worker := &Worker{DB: DB}
+
+	// the held object keeps its bucket and the account until released
+	err = worker.HandleDeleteAccountTask(context.Background(), task)
+	require.ErrorIs(t, err, errObjectsRetained)
+	var remaining []db.Bucket
+	require.NoError(t, DB.Find(&remaining).Error)
+	require.Len(t, remaining, 1)
+	require.Equal(t, "heldbucket", remaining[0].BucketName)
+	_, err = os.Stat(filepath.Join(".", "storage", "plainbucket"))
+	require.True(t, os.IsNotExist(err))
+	var rules int64
+	DB.Model(&db.ReplicationRule{}).Count(&rules)
+	require.Zero(t, rules)
+	require.NoError(t, DB.First(&db.User{}, "id = ?", user.ID).Error)
+
+	require.NoError(t, DB.Model(&db.File{}).Where("id = ?", "file-3").Update("legal_hold", false).Error)
+	require.NoError(t, worker.HandleDeleteAccountTask(context.Background(), task))
+	require.ErrorIs(t, DB.First(&db.User{}, "id = ?", user.ID).Error, gorm.ErrRecordNotFound)
+	var left int64
+	DB.Model(&db.PasswordResetToken{}).Count(&left)
+	require.Zero(t, left)
+	DB.Model(&db.File{}).Count(&left)
+	require.Zero(t, left)
+
+	// a run after the account is gone is a no-op
+	require.NoError(t, worker.HandleDeleteAccountTask(context.Background(), task))
+}
+
+func TestHandleCleanupTokensTask(t *testing.T) {
+	DB := setupTestDB(t)
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	require.NoError(t, DB.Create(&[]db.EmailVerification{
+		{ID: "v1", UserID: "user-1", Token: "expired", ExpiresAt: past},
+		{ID: "v2", UserID: "user-1", Token: "valid", ExpiresAt: future},
+	}).Error)
+	require.NoError(t, DB.Create(&[]db.PasswordResetToken{
+		{ID: "r1", UserID: "user-1", TokenHash: "expired", ExpiresAt: past},
+		{ID: "r2", UserID: "user-1", TokenHash: "valid", ExpiresAt: future},
+	}).Error)
+
+	require.NoError(t, (&Worker{DB: DB}).HandleCleanupTokensTask(context.Background(), tasks.NewCleanupTokensTask()))
+
+	var verifications []db.EmailVerification
+	require.NoError(t, DB.Find(&verifications).Error)
+	require.Len(t, verifications, 1)
+	require.Equal(t, "v2", verifications[0].ID)
+	var resets []db.PasswordResetToken
+	require.NoError(t, DB.Find(&resets).Error)
+	require.Len(t, resets, 1)
+	require.Equal(t, "r2", resets[0].ID)
+}